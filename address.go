@@ -0,0 +1,97 @@
+package microchipboot
+
+import "fmt"
+
+// Address is a byte address, as used in hex files.
+//
+// Address, Length and RowCount are used by the Programmer interface and the profile
+// helpers, which work in hex file units. The Bootloader interface and the Command
+// constructors keep plain uint32 and uint16 values, since they pass addresses and lengths
+// to the device unchanged, in whatever units its protocol uses.
+type Address uint32
+
+// WordAddress is a 16-bit word address, as used by bootloaders on word addressed devices.
+type WordAddress uint32
+
+// Length is a number of bytes.
+type Length uint32
+
+// RowCount is a number of erase rows.
+type RowCount uint16
+
+// Word converts a byte address into a word address.
+func (a Address) Word() WordAddress {
+	return WordAddress(a / 2)
+}
+
+// Byte converts a word address into a byte address.
+func (w WordAddress) Byte() Address {
+	return Address(w * 2)
+}
+
+// RowAligned returns true if the address lies on a row boundary.
+func (a Address) RowAligned(rowSize int) bool {
+	return uint32(a)%uint32(rowSize) == 0
+}
+
+// RowStart returns the address of the start of the row containing the address.
+// The row size must be a power of two.
+func (a Address) RowStart(rowSize int) Address {
+	return a &^ Address(rowSize-1)
+}
+
+// RowsSpanned returns the number of rows touched by length bytes starting at address.
+// The row size must be a power of two.
+func RowsSpanned(address Address, length Length, rowSize int) RowCount {
+	if length == 0 {
+		return 0
+	}
+	start := address.RowStart(rowSize)
+	end := address + Address(length)
+	return RowCount((uint32(end-start) + uint32(rowSize) - 1) / uint32(rowSize))
+}
+
+// AddressRange represents the range of addresses from Start up to, but not including, End.
+type AddressRange struct {
+	Start Address
+	End   Address
+}
+
+// Contains returns true if the address lies within the range.
+func (r AddressRange) Contains(address Address) bool {
+	return address >= r.Start && address < r.End
+}
+
+// Length returns the number of bytes in the range.
+func (r AddressRange) Length() Length {
+	return Length(r.End - r.Start)
+}
+
+// Regions returns the memory regions described by the profile, after applying any family defaults.
+// Regions with a size of zero are omitted.
+func (p PIC8Profile) Regions() map[string]AddressRange {
+	p.applyFamilyDefaults()
+	regions := make(map[string]AddressRange)
+	add := func(name string, offset, size uint32) {
+		if size > 0 {
+			regions[name] = AddressRange{Start: Address(offset), End: Address(offset + size)}
+		}
+	}
+	add("flash", p.BootloaderOffset, p.FlashSize-p.BootloaderOffset)
+	add("eeprom", p.EEPROMOffset, p.EEPROMSize)
+	add("config", p.ConfigOffset, p.ConfigSize)
+	add("id", p.IDOffset, p.IDSize)
+	return regions
+}
+
+// CheckRange returns an error if length bytes starting at address don't lie entirely
+// within one of the profile's memory regions.
+func (p PIC8Profile) CheckRange(address Address, length Length) error {
+	end := uint64(address) + uint64(length)
+	for _, r := range p.Regions() {
+		if address >= r.Start && end <= uint64(r.End) {
+			return nil
+		}
+	}
+	return fmt.Errorf("range %X-%X does not lie within a memory region", address, end)
+}
@@ -0,0 +1,35 @@
+package microchipboot
+
+import "testing"
+
+func TestRowsSpanned(t *testing.T) {
+	tests := []struct {
+		address Address
+		length  Length
+		want    RowCount
+	}{
+		{0x800, 0, 0},
+		{0x800, 64, 1},
+		{0x800, 65, 2},
+		{0x83F, 2, 2},
+		{0x810, 16, 1},
+	}
+	for _, test := range tests {
+		if got := RowsSpanned(test.address, test.length, 64); got != test.want {
+			t.Errorf("RowsSpanned(%X, %v): got %v, want %v", test.address, test.length, got, test.want)
+		}
+	}
+}
+
+func TestCheckRange(t *testing.T) {
+	profile := PIC8Profile{Family: FamilyPIC18, BootloaderOffset: 0x800, FlashSize: 0x8000, EEPROMSize: 256}
+	if err := profile.CheckRange(0x800, 0x7800); err != nil {
+		t.Errorf("unexpected error for flash range: %v", err)
+	}
+	if err := profile.CheckRange(0xF00000, 256); err != nil {
+		t.Errorf("unexpected error for eeprom range: %v", err)
+	}
+	if err := profile.CheckRange(0x700, 0x200); err == nil {
+		t.Errorf("expected error for range overlapping the bootloader")
+	}
+}
@@ -0,0 +1,118 @@
+package microchipboot
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Application info field types.
+const (
+	// AppInfoString is ASCII text, terminated or padded with NUL or erased (0xFF) bytes.
+	AppInfoString = "string"
+	// AppInfoHex is raw bytes shown as a hex string, e.g. a build hash.
+	AppInfoHex = "hex"
+	// AppInfoUint is a little endian unsigned integer of up to 8 bytes.
+	AppInfoUint = "uint"
+	// AppInfoVersion is a version number stored as one byte per component, e.g. 1.2.3.
+	AppInfoVersion = "version"
+)
+
+// AppInfoLayout describes a block of application metadata, such as the version and
+// build ID, that the application stores at a fixed location in flash.
+type AppInfoLayout struct {
+	Address uint32
+	Fields  []AppInfoField
+}
+
+// AppInfoField is a single field of the application metadata.
+type AppInfoField struct {
+	Name string
+	// Offset of the field from the start of the block.
+	Offset uint32
+	Length uint32
+	// One of AppInfoString, AppInfoHex, AppInfoUint or AppInfoVersion. Defaults to
+	// AppInfoHex.
+	Type string
+}
+
+// ApplicationInfo is the decoded application metadata.
+type ApplicationInfo struct {
+	// The raw block read from flash.
+	Raw []byte
+	// Decoded field values by name.
+	Fields map[string]string
+	// True if the block is erased, i.e. no application has been programmed.
+	Erased bool
+}
+
+// length returns the size of the block covering all of the fields.
+func (l AppInfoLayout) length() uint32 {
+	var length uint32
+	for _, f := range l.Fields {
+		if end := f.Offset + f.Length; end > length {
+			length = end
+		}
+	}
+	return length
+}
+
+// ReadApplicationInfo reads the application metadata described by layout from the
+// device's flash and decodes it. This allows the installed application to be checked,
+// e.g. to decide whether an update is needed, before anything is erased. The programmer
+// must already be connected.
+func ReadApplicationInfo(p Programmer, layout AppInfoLayout) (*ApplicationInfo, error) {
+	length := layout.length()
+	if length == 0 {
+		return nil, fmt.Errorf("application info layout has no fields")
+	}
+	data, err := ReadRange(p, RegionFlash, Address(layout.Address), Length(length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read application info: %w", err)
+	}
+	return DecodeApplicationInfo(layout, data)
+}
+
+// DecodeApplicationInfo decodes a block of application metadata read from flash.
+func DecodeApplicationInfo(layout AppInfoLayout, data []byte) (*ApplicationInfo, error) {
+	if uint32(len(data)) < layout.length() {
+		return nil, fmt.Errorf("application info is %v bytes but the layout needs %v", len(data), layout.length())
+	}
+	info := &ApplicationInfo{
+		Raw:    data,
+		Fields: make(map[string]string),
+		Erased: len(bytes.Trim(data, "\xFF")) == 0,
+	}
+	for _, f := range layout.Fields {
+		value := data[f.Offset : f.Offset+f.Length]
+		switch f.Type {
+		case AppInfoString:
+			if i := bytes.IndexAny(value, "\x00\xFF"); i >= 0 {
+				value = value[:i]
+			}
+			info.Fields[f.Name] = string(value)
+		case "", AppInfoHex:
+			info.Fields[f.Name] = hex.EncodeToString(value)
+		case AppInfoUint:
+			if len(value) > 8 {
+				return nil, fmt.Errorf("field %v is too long for an integer", f.Name)
+			}
+			var n uint64
+			for i := len(value) - 1; i >= 0; i-- {
+				n = n<<8 | uint64(value[i])
+			}
+			info.Fields[f.Name] = strconv.FormatUint(n, 10)
+		case AppInfoVersion:
+			parts := make([]string, len(value))
+			for i, b := range value {
+				parts[i] = strconv.Itoa(int(b))
+			}
+			info.Fields[f.Name] = strings.Join(parts, ".")
+		default:
+			return nil, fmt.Errorf("invalid type %q for field %v", f.Type, f.Name)
+		}
+	}
+	return info, nil
+}
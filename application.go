@@ -0,0 +1,85 @@
+package microchipboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// ErrApplicationNotStarted is returned by CheckApplication when the application doesn't
+// respond after a reset.
+var ErrApplicationNotStarted = errors.New("device failed to start application")
+
+// ApplicationCheck configures how CheckApplication confirms that the application has
+// started after the device has been reset.
+type ApplicationCheck struct {
+	// Time to wait for the device to reboot before opening the connection.
+	Delay time.Duration
+	// Maximum time to wait for the banner or for the probe to succeed.
+	Timeout time.Duration
+	// Opens a connection to the application, e.g. the serial port at the application's baud rate.
+	// If nil, the check only waits for Delay.
+	Open func() (io.ReadWriteCloser, error)
+	// Probe is called with the open connection and returns nil if the application is alive.
+	// If nil, the connection is read until Banner is received.
+	Probe func(conn io.ReadWriter) error
+	// Banner expected from the application if no Probe is specified.
+	Banner []byte
+}
+
+// CheckApplication waits for the device to reboot after a reset and confirms that the
+// application is running. ErrApplicationNotStarted is returned if it isn't.
+func CheckApplication(check ApplicationCheck) error {
+	time.Sleep(check.Delay)
+	if check.Open == nil {
+		return nil
+	}
+
+	conn, err := check.Open()
+	if err != nil {
+		return fmt.Errorf("failed to connect to application: %w", err)
+	}
+	defer conn.Close()
+
+	if check.Probe != nil {
+		result := make(chan error, 1)
+		go func() { result <- check.Probe(conn) }()
+		select {
+		case err := <-result:
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrApplicationNotStarted, err)
+			}
+			return nil
+		case <-time.After(check.Timeout):
+			return fmt.Errorf("%w: probe timed out", ErrApplicationNotStarted)
+		}
+	}
+
+	if len(check.Banner) == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(check.Timeout)
+	var received []byte
+	buf := make([]byte, 256)
+	for time.Now().Before(deadline) {
+		n, err := conn.Read(buf)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read from application: %w", err)
+		}
+		received = append(received, buf[:n]...)
+		if bytes.Contains(received, check.Banner) {
+			return nil
+		}
+	}
+	return ErrApplicationNotStarted
+}
+
+// OpenSerialPort opens a serial port for talking to the application, e.g. in an ApplicationCheck.
+// Reads time out after readTimeout, returning no data.
+func OpenSerialPort(name string, baud int, readTimeout time.Duration) (io.ReadWriteCloser, error) {
+	return serial.OpenPort(&serial.Config{Name: name, Baud: baud, ReadTimeout: readTimeout})
+}
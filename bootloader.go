@@ -20,7 +20,9 @@ import (
 )
 
 // The Bootloader interface allows low-level interaction with the bootloader in a transport-agnostic fashion.
-// For higher level programming operations, use the Programmer interface.
+// For higher level programming operations, use the Programmer interface. Addresses and
+// lengths are sent as given, e.g. as word addresses on PIC16 devices, so they are plain
+// integers rather than Address and Length values.
 type Bootloader interface {
 	Connect() error
 	Disconnect()
@@ -36,6 +38,11 @@ type Bootloader interface {
 	Reset() error
 }
 
+// CommandSender is implemented by bootloaders that can send arbitrary commands.
+type CommandSender interface {
+	SendCommand(cmd Command) ([]byte, error)
+}
+
 // VersionInfo holds the results of the Request Version command.
 type VersionInfo struct {
 	VersionMinor, VersionMajor int
@@ -250,6 +257,35 @@ func NewCalculateChecksumCommand(address uint32, length uint16) Command {
 	return c
 }
 
+// NewCalculateChecksum32Command returns the representation of the CalculateChecksum command
+// for bootloaders that return a 32-bit checksum, such as those for PIC32 devices.
+func NewCalculateChecksum32Command(address uint32, length uint16) Command {
+	c := Command{
+		Command:        commandCalculateChecksum,
+		Address:        address,
+		Length:         length,
+		responseLength: 4,
+	}
+	return c
+}
+
+// NewCustomCommand returns the representation of a command that isn't part of the standard
+// protocol, for use with bootloader variants that add their own commands.
+func NewCustomCommand(command uint8, address uint32, data []byte, responseLength int, expectsSuccessCode bool) Command {
+	c := Command{
+		Command:            command,
+		Address:            address,
+		Length:             uint16(len(data)),
+		Data:               data,
+		responseLength:     responseLength,
+		expectsSuccessCode: expectsSuccessCode,
+	}
+	if expectsSuccessCode {
+		c.UnlockSequence = [2]byte{0x55, 0xAA}
+	}
+	return c
+}
+
 // NewResetCommand returns the representation of the Reset command.
 func NewResetCommand() Command {
 	c := Command{
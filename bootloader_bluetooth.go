@@ -0,0 +1,332 @@
+package microchipboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Default RFCOMM channel used by SPP modules.
+const defaultRFCOMMChannel = 1
+
+// BluetoothConfig configures the Bluetooth transport.
+type BluetoothConfig struct {
+	// Address of the device, e.g. 00:11:22:33:44:55.
+	Address string
+	// If true, the device is a Bluetooth Low Energy module running the Nordic UART
+	// Service (NUS). Otherwise, it is a Bluetooth Classic module using the Serial Port
+	// Profile (SPP).
+	BLE bool
+	// RFCOMM channel of the SPP service. Defaults to 1.
+	Channel int
+	// If true, the BLE address is a random address rather than a public one.
+	RandomAddress bool
+	// Maximum time to wait for data from the device. Defaults to 1 second.
+	ReadTimeout time.Duration
+}
+
+// bluetoothConn is a connection to a Bluetooth device, which is a byte stream for SPP
+// and a stream of ATT packets for BLE.
+type bluetoothConn interface {
+	read(p []byte) (int, error)
+	write(p []byte) error
+	close()
+}
+
+type bluetoothBootloader struct {
+	streamBootloader
+	config  BluetoothConfig
+	address [6]byte
+	conn    bluetoothConn
+	// Set when connected over BLE
+	uart *nusClient
+}
+
+// NewBluetoothBootloader creates a new bootloader that communicates with a device through
+// a Bluetooth module, either over a Bluetooth Classic SPP (RFCOMM) link or through the
+// Nordic UART Service of a BLE module. The device must already be paired if the module
+// requires it. This is only supported on Linux, using BlueZ sockets.
+func NewBluetoothBootloader(config BluetoothConfig) (Bootloader, error) {
+	address, err := parseBluetoothAddress(config.Address)
+	if err != nil {
+		return nil, err
+	}
+	if config.Channel == 0 {
+		config.Channel = defaultRFCOMMChannel
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = time.Second
+	}
+	b := &bluetoothBootloader{config: config, address: address}
+	b.rw = &bluetoothStream{b}
+	return b, nil
+}
+
+func (b *bluetoothBootloader) Connect() error {
+	var err error
+	if b.config.BLE {
+		transportLog.Debugf("connecting to BLE device %v", b.config.Address)
+		b.conn, err = openATT(b.address, b.config.RandomAddress, b.config.ReadTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %v: %w", b.config.Address, err)
+		}
+		if b.uart, err = newNUSClient(b.conn); err != nil {
+			b.Disconnect()
+			return fmt.Errorf("failed to set up the UART service on %v: %w", b.config.Address, err)
+		}
+		return nil
+	}
+	transportLog.Debugf("connecting to %v channel %v", b.config.Address, b.config.Channel)
+	b.conn, err = openRFCOMM(b.address, b.config.Channel, b.config.ReadTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %v: %w", b.config.Address, err)
+	}
+	return nil
+}
+
+func (b *bluetoothBootloader) Disconnect() {
+	if b.conn != nil {
+		b.conn.close()
+		b.conn = nil
+		b.uart = nil
+	}
+}
+
+// bluetoothStream reads and writes the bootloader's byte stream over the connection.
+type bluetoothStream struct {
+	b *bluetoothBootloader
+}
+
+func (s *bluetoothStream) Read(p []byte) (int, error) {
+	if s.b.conn == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	if s.b.uart != nil {
+		return s.b.uart.read(p)
+	}
+	return s.b.conn.read(p)
+}
+
+func (s *bluetoothStream) Write(p []byte) (int, error) {
+	if s.b.conn == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	if s.b.uart != nil {
+		return len(p), s.b.uart.write(p)
+	}
+	return len(p), s.b.conn.write(p)
+}
+
+// parseBluetoothAddress parses an address in the usual notation into the byte order used
+// by BlueZ, which is least significant byte first.
+func parseBluetoothAddress(s string) ([6]byte, error) {
+	var address [6]byte
+	data, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil || len(data) != len(address) {
+		return address, fmt.Errorf("invalid Bluetooth address %q", s)
+	}
+	for i := range data {
+		address[len(address)-1-i] = data[i]
+	}
+	return address, nil
+}
+
+// ATT protocol opcodes.
+const (
+	attErrorResponse       = 0x01
+	attExchangeMTURequest  = 0x02
+	attExchangeMTUResponse = 0x03
+	attFindInfoRequest     = 0x04
+	attFindInfoResponse    = 0x05
+	attReadByTypeRequest   = 0x08
+	attReadByTypeResponse  = 0x09
+	attWriteRequest        = 0x12
+	attWriteResponse       = 0x13
+	attNotification        = 0x1B
+	attWriteCommand        = 0x52
+)
+
+// ATT and GATT constants.
+const (
+	attDefaultMTU            = 23
+	attRequestedMTU          = 247
+	gattCharacteristicUUID   = 0x2803
+	gattClientConfigUUID     = 0x2902
+	gattNotificationsEnabled = 0x0001
+)
+
+// Nordic UART Service characteristics, in the little endian byte order used by ATT.
+var (
+	// Written by the host
+	nusRXUUID = attUUID("6E400002-B5A3-F393-E0A9-E50E24DCCA9E")
+	// Notified by the device
+	nusTXUUID = attUUID("6E400003-B5A3-F393-E0A9-E50E24DCCA9E")
+)
+
+// attUUID converts a 128-bit UUID into ATT byte order.
+func attUUID(s string) []byte {
+	data, _ := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+	return data
+}
+
+// nusClient implements a byte stream over the Nordic UART Service using a minimal ATT
+// client.
+type nusClient struct {
+	conn bluetoothConn
+	mtu  int
+	// Value handles of the characteristics
+	rx, tx uint16
+	// Notified data that hasn't been read yet
+	pending []byte
+}
+
+// newNUSClient finds the UART service's characteristics and enables notifications.
+func newNUSClient(conn bluetoothConn) (*nusClient, error) {
+	c := &nusClient{conn: conn, mtu: attDefaultMTU}
+
+	req := []byte{attExchangeMTURequest, 0, 0}
+	binary.LittleEndian.PutUint16(req[1:], attRequestedMTU)
+	if resp, err := c.request(req, attExchangeMTUResponse); err == nil && len(resp) >= 3 {
+		if mtu := int(binary.LittleEndian.Uint16(resp[1:])); mtu < attRequestedMTU {
+			c.mtu = mtu
+		} else {
+			c.mtu = attRequestedMTU
+		}
+	}
+
+	// Find the characteristics by reading the characteristic declarations
+	for start := uint16(1); start != 0; {
+		req := make([]byte, 7)
+		req[0] = attReadByTypeRequest
+		binary.LittleEndian.PutUint16(req[1:], start)
+		binary.LittleEndian.PutUint16(req[3:], 0xFFFF)
+		binary.LittleEndian.PutUint16(req[5:], gattCharacteristicUUID)
+		resp, err := c.request(req, attReadByTypeResponse)
+		if err != nil || len(resp) < 2 {
+			break
+		}
+		// Each entry is the declaration handle, properties, value handle and UUID
+		entryLen := int(resp[1])
+		if entryLen < 5 {
+			break
+		}
+		next := start
+		for entry := resp[2:]; len(entry) >= entryLen; entry = entry[entryLen:] {
+			handle := binary.LittleEndian.Uint16(entry)
+			valueHandle := binary.LittleEndian.Uint16(entry[3:])
+			switch uuid := entry[5:entryLen]; {
+			case bytes.Equal(uuid, nusRXUUID):
+				c.rx = valueHandle
+			case bytes.Equal(uuid, nusTXUUID):
+				c.tx = valueHandle
+			}
+			next = handle + 1
+		}
+		if next == start {
+			break
+		}
+		start = next
+	}
+	if c.rx == 0 || c.tx == 0 {
+		return nil, fmt.Errorf("device doesn't provide the Nordic UART Service")
+	}
+
+	// Enable notifications on the TX characteristic
+	cccd, err := c.findDescriptor(c.tx+1, gattClientConfigUUID)
+	if err != nil {
+		return nil, err
+	}
+	req = make([]byte, 5)
+	req[0] = attWriteRequest
+	binary.LittleEndian.PutUint16(req[1:], cccd)
+	binary.LittleEndian.PutUint16(req[3:], gattNotificationsEnabled)
+	if _, err := c.request(req, attWriteResponse); err != nil {
+		return nil, fmt.Errorf("failed to enable notifications: %w", err)
+	}
+	transportLog.Debugf("UART service found, rx %X tx %X, mtu %v", c.rx, c.tx, c.mtu)
+	return c, nil
+}
+
+// findDescriptor returns the handle of the descriptor with the given 16-bit UUID, looking
+// at the few handles from start.
+func (c *nusClient) findDescriptor(start uint16, uuid uint16) (uint16, error) {
+	req := make([]byte, 5)
+	req[0] = attFindInfoRequest
+	binary.LittleEndian.PutUint16(req[1:], start)
+	binary.LittleEndian.PutUint16(req[3:], start+2)
+	resp, err := c.request(req, attFindInfoResponse)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find descriptor %X: %w", uuid, err)
+	}
+	// Format 1 lists 16-bit UUIDs
+	if len(resp) >= 2 && resp[1] == 1 {
+		for entry := resp[2:]; len(entry) >= 4; entry = entry[4:] {
+			if binary.LittleEndian.Uint16(entry[2:]) == uuid {
+				return binary.LittleEndian.Uint16(entry), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("descriptor %X not found", uuid)
+}
+
+// request sends an ATT request and waits for the expected response, skipping any
+// notifications that arrive in the meantime.
+func (c *nusClient) request(req []byte, expected byte) ([]byte, error) {
+	if err := c.conn.write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, attRequestedMTU+1)
+	for {
+		n, err := c.conn.read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+		switch {
+		case n == 0:
+		case resp[0] == expected:
+			return resp, nil
+		case resp[0] == attErrorResponse && n >= 5 && resp[1] == req[0]:
+			return nil, fmt.Errorf("ATT request %X failed with error %X", req[0], resp[4])
+		}
+	}
+}
+
+func (c *nusClient) read(p []byte) (int, error) {
+	buf := make([]byte, attRequestedMTU+1)
+	for len(c.pending) == 0 {
+		n, err := c.conn.read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n >= 3 && buf[0] == attNotification && binary.LittleEndian.Uint16(buf[1:]) == c.tx {
+			c.pending = append(c.pending, buf[3:n]...)
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *nusClient) write(p []byte) error {
+	c.pending = nil
+	chunkSize := c.mtu - 3
+	for offset := 0; offset < len(p); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		packet := []byte{attWriteCommand, 0, 0}
+		binary.LittleEndian.PutUint16(packet[1:], c.rx)
+		if err := c.conn.write(append(packet, p[offset:end]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
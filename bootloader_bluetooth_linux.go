@@ -0,0 +1,91 @@
+package microchipboot
+
+import (
+	"io"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BlueZ constants from bluetooth/bluetooth.h and l2cap.h.
+const (
+	attCID         = 4
+	bdaddrLEPublic = 1
+	bdaddrLERandom = 2
+)
+
+// bluetoothSocket is a connected Bluetooth socket.
+type bluetoothSocket struct {
+	fd int
+}
+
+func openBluetoothSocket(sockType, proto int, readTimeout time.Duration) (int, error) {
+	fd, err := syscall.Socket(unix.AF_BLUETOOTH, sockType, proto)
+	if err != nil {
+		return 0, err
+	}
+	tv := syscall.NsecToTimeval(readTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return 0, err
+	}
+	return fd, nil
+}
+
+func openRFCOMM(address [6]byte, channel int, readTimeout time.Duration) (bluetoothConn, error) {
+	fd, err := openBluetoothSocket(syscall.SOCK_STREAM, unix.BTPROTO_RFCOMM, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Connect(fd, &unix.SockaddrRFCOMM{Addr: address, Channel: uint8(channel)}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &bluetoothSocket{fd: fd}, nil
+}
+
+func openATT(address [6]byte, random bool, readTimeout time.Duration) (bluetoothConn, error) {
+	fd, err := openBluetoothSocket(syscall.SOCK_SEQPACKET, unix.BTPROTO_L2CAP, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrL2{CID: attCID, AddrType: bdaddrLEPublic}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// Unlike SockaddrRFCOMM, SockaddrL2 takes the address in big endian order
+	remote := &unix.SockaddrL2{CID: attCID, AddrType: bdaddrLEPublic}
+	for i := range address {
+		remote.Addr[i] = address[len(address)-1-i]
+	}
+	if random {
+		remote.AddrType = bdaddrLERandom
+	}
+	if err := unix.Connect(fd, remote); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &bluetoothSocket{fd: fd}, nil
+}
+
+func (s *bluetoothSocket) read(p []byte) (int, error) {
+	n, err := syscall.Read(s.fd, p)
+	if err == syscall.EAGAIN {
+		// The read timed out
+		return 0, io.EOF
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (s *bluetoothSocket) write(p []byte) error {
+	_, err := syscall.Write(s.fd, p)
+	return err
+}
+
+func (s *bluetoothSocket) close() {
+	syscall.Close(s.fd)
+}
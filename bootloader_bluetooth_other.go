@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package microchipboot
+
+import (
+	"errors"
+	"time"
+)
+
+func openRFCOMM(address [6]byte, channel int, readTimeout time.Duration) (bluetoothConn, error) {
+	return nil, errors.New("Bluetooth is only supported on Linux")
+}
+
+func openATT(address [6]byte, random bool, readTimeout time.Duration) (bluetoothConn, error) {
+	return nil, errors.New("Bluetooth is only supported on Linux")
+}
@@ -0,0 +1,118 @@
+package microchipboot
+
+import (
+	"fmt"
+	"time"
+)
+
+// Maximum payload of a classic CAN frame.
+const canFrameSize = 8
+
+// Flag set in a CAN ID to indicate a 29-bit extended identifier.
+const canExtendedFlag = 0x80000000
+
+// CANConfig configures the CAN transport.
+type CANConfig struct {
+	// SocketCAN network interface, e.g. can0.
+	Interface string
+	// Arbitration IDs of the frames sent to and received from the device.
+	TXID, RXID uint32
+	// If true, the IDs are 29-bit extended identifiers. Otherwise, they are 11-bit standard identifiers.
+	Extended bool
+	// Maximum time to wait for each frame from the device. Defaults to 1 second.
+	ReadTimeout time.Duration
+}
+
+type canBootloader struct {
+	streamBootloader
+	config CANConfig
+	socket *canSocket
+	// Unread data from the frames received so far
+	pending []byte
+}
+
+// NewCANBootloader creates a new bootloader that communicates over a CAN bus, for devices
+// running the CAN variant of the bootloader. Commands are split into frames of up to 8
+// bytes sent with the TX ID, and the response is reassembled from the frames received with
+// the RX ID. This is only supported on Linux, using SocketCAN.
+func NewCANBootloader(config CANConfig) (Bootloader, error) {
+	limit := uint32(0x7FF)
+	if config.Extended {
+		limit = 0x1FFFFFFF
+	}
+	if config.TXID > limit || config.RXID > limit {
+		return nil, fmt.Errorf("CAN IDs must not exceed %X", limit)
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = time.Second
+	}
+	b := &canBootloader{config: config}
+	b.rw = &canStream{b}
+	return b, nil
+}
+
+func (b *canBootloader) Connect() error {
+	socket, err := openCANSocket(b.config.Interface, b.config.ReadTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %w", b.config.Interface, err)
+	}
+	b.socket = socket
+	b.pending = nil
+	return nil
+}
+
+func (b *canBootloader) Disconnect() {
+	if b.socket != nil {
+		b.socket.close()
+		b.socket = nil
+	}
+}
+
+// id returns the identifier of frames with the given arbitration ID, as used by SocketCAN.
+func (b *canBootloader) id(arbitrationID uint32) uint32 {
+	if b.config.Extended {
+		return arbitrationID | canExtendedFlag
+	}
+	return arbitrationID
+}
+
+// canStream segments the bootloader's byte stream into CAN frames and reassembles the responses.
+type canStream struct {
+	b *canBootloader
+}
+
+func (s *canStream) Read(p []byte) (int, error) {
+	if s.b.socket == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	for len(s.b.pending) == 0 {
+		id, data, err := s.b.socket.read()
+		if err != nil {
+			return 0, err
+		}
+		// Ignore traffic from other nodes
+		if id == s.b.id(s.b.config.RXID) {
+			s.b.pending = data
+		}
+	}
+	n := copy(p, s.b.pending)
+	s.b.pending = s.b.pending[n:]
+	return n, nil
+}
+
+func (s *canStream) Write(p []byte) (int, error) {
+	if s.b.socket == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	s.b.pending = nil
+	for offset := 0; offset < len(p); offset += canFrameSize {
+		end := offset + canFrameSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := s.b.socket.write(s.b.id(s.b.config.TXID), p[offset:end]); err != nil {
+			return offset, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,71 @@
+package microchipboot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Size of struct can_frame, from linux/can.h.
+const canFrameLength = 16
+
+type canSocket struct {
+	fd int
+}
+
+func openCANSocket(iface string, readTimeout time.Duration) (*canSocket, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Socket(unix.AF_CAN, syscall.SOCK_RAW, unix.CAN_RAW)
+	if err != nil {
+		return nil, err
+	}
+	tv := syscall.NsecToTimeval(readTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrCAN{Ifindex: ifi.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &canSocket{fd: fd}, nil
+}
+
+func (s *canSocket) read() (uint32, []byte, error) {
+	frame := make([]byte, canFrameLength)
+	n, err := syscall.Read(s.fd, frame)
+	if err != nil {
+		if err == syscall.EAGAIN {
+			return 0, nil, fmt.Errorf("timed out waiting for CAN frame")
+		}
+		return 0, nil, err
+	}
+	if n != canFrameLength {
+		return 0, nil, fmt.Errorf("short CAN frame")
+	}
+	length := int(frame[4])
+	if length > canFrameSize {
+		length = canFrameSize
+	}
+	return binary.LittleEndian.Uint32(frame), frame[8 : 8+length], nil
+}
+
+func (s *canSocket) write(id uint32, data []byte) error {
+	frame := make([]byte, canFrameLength)
+	binary.LittleEndian.PutUint32(frame, id)
+	frame[4] = byte(len(data))
+	copy(frame[8:], data)
+	_, err := syscall.Write(s.fd, frame)
+	return err
+}
+
+func (s *canSocket) close() {
+	syscall.Close(s.fd)
+}
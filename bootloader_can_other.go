@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package microchipboot
+
+import (
+	"errors"
+	"time"
+)
+
+type canSocket struct{}
+
+func openCANSocket(iface string, readTimeout time.Duration) (*canSocket, error) {
+	return nil, errors.New("CAN is only supported on Linux")
+}
+
+func (s *canSocket) read() (uint32, []byte, error) {
+	return 0, nil, errors.New("CAN is only supported on Linux")
+}
+
+func (s *canSocket) write(id uint32, data []byte) error {
+	return errors.New("CAN is only supported on Linux")
+}
+
+func (s *canSocket) close() {}
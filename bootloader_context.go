@@ -0,0 +1,138 @@
+package microchipboot
+
+import "context"
+
+type contextBootloader struct {
+	Bootloader
+	ctx context.Context
+}
+
+func (b *contextBootloader) unwrap() Bootloader {
+	return b.Bootloader
+}
+
+// NewContextBootloader wraps a bootloader so that its commands can be cancelled using ctx.
+// Once ctx is done, commands fail immediately with ctx.Err(). A command that is already in
+// progress is interrupted at its next read from the device, which happens at least once
+// per read timeout, and the underlying bootloader is then disconnected. Pass the wrapped
+// bootloader to a Programmer to allow a long running Program() or Verify() to be aborted.
+func NewContextBootloader(ctx context.Context, bootloader Bootloader) Bootloader {
+	return &contextBootloader{
+		Bootloader: bootloader,
+		ctx:        ctx,
+	}
+}
+
+// interrupter is implemented by bootloaders whose command in progress can be made to fail
+// with err from another goroutine.
+type interrupter interface {
+	interrupt(err error)
+}
+
+// do runs f, interrupting it if the context is done before f completes. It always waits
+// for f to return, so that the bootloader is never used by two goroutines at once.
+func (b *contextBootloader) do(f func() error) error {
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-b.ctx.Done():
+	}
+
+	i, _ := findBootloader(b.Bootloader, func(b Bootloader) bool {
+		_, ok := b.(interrupter)
+		return ok
+	}).(interrupter)
+	if i != nil {
+		i.interrupt(b.ctx.Err())
+	}
+	<-done
+	if i != nil {
+		i.interrupt(nil)
+	}
+	b.Bootloader.Disconnect()
+	return b.ctx.Err()
+}
+
+func (b *contextBootloader) Connect() error {
+	return b.do(b.Bootloader.Connect)
+}
+
+func (b *contextBootloader) GetVersion() (VersionInfo, error) {
+	var info VersionInfo
+	err := b.do(func() (err error) {
+		info, err = b.Bootloader.GetVersion()
+		return err
+	})
+	return info, err
+}
+
+func (b *contextBootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(func() (err error) {
+		data, err = b.Bootloader.ReadFlash(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *contextBootloader) WriteFlash(address uint32, data []byte) error {
+	return b.do(func() error {
+		return b.Bootloader.WriteFlash(address, data)
+	})
+}
+
+func (b *contextBootloader) EraseFlash(address uint32, numRows uint16) error {
+	return b.do(func() error {
+		return b.Bootloader.EraseFlash(address, numRows)
+	})
+}
+
+func (b *contextBootloader) ReadEE(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(func() (err error) {
+		data, err = b.Bootloader.ReadEE(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *contextBootloader) WriteEE(address uint32, data []byte) error {
+	return b.do(func() error {
+		return b.Bootloader.WriteEE(address, data)
+	})
+}
+
+func (b *contextBootloader) ReadConfig(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(func() (err error) {
+		data, err = b.Bootloader.ReadConfig(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *contextBootloader) WriteConfig(address uint32, data []byte) error {
+	return b.do(func() error {
+		return b.Bootloader.WriteConfig(address, data)
+	})
+}
+
+func (b *contextBootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	var checksum uint16
+	err := b.do(func() (err error) {
+		checksum, err = b.Bootloader.CalculateChecksum(address, length)
+		return err
+	})
+	return checksum, err
+}
+
+func (b *contextBootloader) Reset() error {
+	return b.do(b.Bootloader.Reset)
+}
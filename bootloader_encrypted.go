@@ -0,0 +1,197 @@
+package microchipboot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// Ciphers that can be negotiated with the device.
+const (
+	CipherAES128CTR = 0x01
+	CipherAES192CTR = 0x02
+	CipherAES256CTR = 0x03
+)
+
+// DefaultSetIVCommand is the default command code used to send the session IV to the device.
+const DefaultSetIVCommand = 0x0A
+
+// KeyProvider returns the pre-shared key for a device. The cipher is chosen based on the
+// length of the key (16, 24 or 32 bytes for AES-128, AES-192 or AES-256).
+type KeyProvider func(info VersionInfo) ([]byte, error)
+
+// EncryptionConfig configures payload encryption for secure bootloader variants.
+type EncryptionConfig struct {
+	Keys KeyProvider
+	// Command code used to send the session IV. Defaults to DefaultSetIVCommand.
+	SetIVCommand uint8
+}
+
+type encryptedBootloader struct {
+	Bootloader
+	sender   CommandSender
+	config   EncryptionConfig
+	cipherID byte
+	block    cipher.Block
+	iv       [aes.BlockSize]byte
+	// Counter blocks whose keystream has been used with the current IV
+	used map[[aes.BlockSize]byte]bool
+}
+
+func (b *encryptedBootloader) unwrap() Bootloader {
+	return b.Bootloader
+}
+
+// NewEncryptedBootloader wraps a bootloader so that the payloads of WriteFlash, WriteEE
+// and WriteConfig are encrypted with a pre-shared AES key, for secure bootloader variants
+// that decrypt on the device. Only the data is encrypted; the commands, addresses and
+// everything read from the device are sent in the clear.
+//
+// On Connect, a random session IV is generated and sent to the device in a SetIV command,
+// whose data is the cipher ID followed by the IV. The device rejects ciphers it doesn't
+// support with an unsupported response code. Each write payload is then encrypted in CTR
+// mode, using the session IV with the packet address XORed into its last four bytes as
+// the initial counter block. Counter blocks are never reused with the same IV: before a
+// write that would reuse one, such as rewriting an address or writing EEPROM at an address
+// already written in flash, a new IV is generated and sent.
+//
+// The wrapped bootloader must implement CommandSender.
+func NewEncryptedBootloader(bootloader Bootloader, config EncryptionConfig) (Bootloader, error) {
+	sender, ok := bootloader.(CommandSender)
+	if !ok {
+		return nil, fmt.Errorf("bootloader doesn't support sending custom commands")
+	}
+	if config.Keys == nil {
+		return nil, fmt.Errorf("a key provider must be specified")
+	}
+	if config.SetIVCommand == 0 {
+		config.SetIVCommand = DefaultSetIVCommand
+	}
+	return &encryptedBootloader{
+		Bootloader: bootloader,
+		sender:     sender,
+		config:     config,
+	}, nil
+}
+
+func (b *encryptedBootloader) Connect() error {
+	if err := b.Bootloader.Connect(); err != nil {
+		return err
+	}
+	if err := b.negotiate(); err != nil {
+		b.Bootloader.Disconnect()
+		return fmt.Errorf("failed to set up encryption: %w", err)
+	}
+	return nil
+}
+
+// negotiate gets the device key, generates a session IV and sends it to the device.
+func (b *encryptedBootloader) negotiate() error {
+	info, err := b.Bootloader.GetVersion()
+	if err != nil {
+		return err
+	}
+	key, err := b.config.Keys(info)
+	if err != nil {
+		return fmt.Errorf("failed to get key: %w", err)
+	}
+
+	switch len(key) {
+	case 16:
+		b.cipherID = CipherAES128CTR
+	case 24:
+		b.cipherID = CipherAES192CTR
+	case 32:
+		b.cipherID = CipherAES256CTR
+	default:
+		return fmt.Errorf("invalid key length %v", len(key))
+	}
+	b.block, err = aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	protocolLog.Debugf("negotiating cipher %X", b.cipherID)
+	return b.setIV()
+}
+
+// setIV generates a new session IV and sends it to the device.
+func (b *encryptedBootloader) setIV() error {
+	if _, err := rand.Read(b.iv[:]); err != nil {
+		return fmt.Errorf("failed to generate iv: %w", err)
+	}
+	b.used = make(map[[aes.BlockSize]byte]bool)
+
+	data := append([]byte{b.cipherID}, b.iv[:]...)
+	_, err := b.sender.SendCommand(NewCustomCommand(b.config.SetIVCommand, 0, data, 0, true))
+	return err
+}
+
+// encrypt encrypts the payload of a write to address, first changing the IV if any of the
+// counter blocks that it needs have already been used.
+func (b *encryptedBootloader) encrypt(address uint32, data []byte) ([]byte, error) {
+	counters := func() [][aes.BlockSize]byte {
+		counter := b.iv
+		addr := binary.BigEndian.Uint32(counter[aes.BlockSize-4:]) ^ address
+		binary.BigEndian.PutUint32(counter[aes.BlockSize-4:], addr)
+
+		blocks := make([][aes.BlockSize]byte, 0, (len(data)+aes.BlockSize-1)/aes.BlockSize)
+		for i := 0; i < len(data); i += aes.BlockSize {
+			blocks = append(blocks, counter)
+			// Increment the counter in the same way as cipher.NewCTR
+			for j := len(counter) - 1; j >= 0; j-- {
+				counter[j]++
+				if counter[j] != 0 {
+					break
+				}
+			}
+		}
+		return blocks
+	}
+
+	blocks := counters()
+	for _, c := range blocks {
+		if b.used[c] {
+			protocolLog.Debugf("changing iv before writing %X", address)
+			if err := b.setIV(); err != nil {
+				return nil, fmt.Errorf("failed to change iv: %w", err)
+			}
+			blocks = counters()
+			break
+		}
+	}
+	for _, c := range blocks {
+		b.used[c] = true
+	}
+
+	encrypted := make([]byte, len(data))
+	if len(blocks) > 0 {
+		cipher.NewCTR(b.block, blocks[0][:]).XORKeyStream(encrypted, data)
+	}
+	return encrypted, nil
+}
+
+func (b *encryptedBootloader) WriteFlash(address uint32, data []byte) error {
+	encrypted, err := b.encrypt(address, data)
+	if err != nil {
+		return err
+	}
+	return b.Bootloader.WriteFlash(address, encrypted)
+}
+
+func (b *encryptedBootloader) WriteEE(address uint32, data []byte) error {
+	encrypted, err := b.encrypt(address, data)
+	if err != nil {
+		return err
+	}
+	return b.Bootloader.WriteEE(address, encrypted)
+}
+
+func (b *encryptedBootloader) WriteConfig(address uint32, data []byte) error {
+	encrypted, err := b.encrypt(address, data)
+	if err != nil {
+		return err
+	}
+	return b.Bootloader.WriteConfig(address, encrypted)
+}
@@ -0,0 +1,67 @@
+package microchipboot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+// ivRecorder is a simulated device that records the IVs sent by SetIV commands.
+type ivRecorder struct {
+	*SimulatedBootloader
+	ivs [][]byte
+}
+
+func (d *ivRecorder) SendCommand(cmd Command) ([]byte, error) {
+	d.ivs = append(d.ivs, cmd.Data[1:])
+	return nil, nil
+}
+
+func TestEncryptedWrites(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 16)
+	device := &ivRecorder{SimulatedBootloader: newSimulatedPIC18()}
+	b, err := NewEncryptedBootloader(device, EncryptionConfig{
+		Keys: func(VersionInfo) ([]byte, error) { return key, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte{0x12}, 64)
+	for _, address := range []uint32{0, 0x40} {
+		if err := b.WriteFlash(address, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.EraseFlash(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteFlash(0, data); err != nil {
+		t.Fatal(err)
+	}
+	// Rewriting 0 would reuse the keystream of the first write
+	if len(device.ivs) != 2 {
+		t.Fatalf("got %v IVs, want 2", len(device.ivs))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted := make([]byte, len(data))
+	cipher.NewCTR(block, device.ivs[1]).XORKeyStream(decrypted, device.Memory(0, len(data)))
+	if !bytes.Equal(decrypted, data) {
+		t.Errorf("decrypted %X, want %X", decrypted, data)
+	}
+
+	if err := b.WriteEE(0, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := device.SimulatedBootloader.ReadEE(0, 2); err != nil || bytes.Equal(stored, []byte{1, 2}) {
+		t.Error("EEPROM data wasn't encrypted")
+	}
+}
@@ -0,0 +1,167 @@
+package microchipboot
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Size of the reports exchanged with HID bootloaders.
+const hidReportSize = 64
+
+// Directory that Linux lists hidraw devices in.
+const hidrawClassDir = "/sys/class/hidraw"
+
+// HIDDevice describes a USB HID device found by ListHIDDevices.
+type HIDDevice struct {
+	// Device node used to communicate with the device, e.g. /dev/hidraw0.
+	Path      string
+	VendorID  uint16
+	ProductID uint16
+	Name      string
+}
+
+// ListHIDDevices returns the HID devices attached to the system. This is only supported on
+// Linux, using the hidraw interface.
+func ListHIDDevices() ([]HIDDevice, error) {
+	entries, err := ioutil.ReadDir(hidrawClassDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list HID devices: %w", err)
+	}
+	var devices []HIDDevice
+	for _, entry := range entries {
+		device, err := readHIDUevent(filepath.Join(hidrawClassDir, entry.Name(), "device", "uevent"))
+		if err != nil {
+			transportLog.Debugf("skipping %v: %v", entry.Name(), err)
+			continue
+		}
+		device.Path = filepath.Join("/dev", entry.Name())
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// readHIDUevent parses the HID_ID and HID_NAME fields of a hidraw device's uevent file,
+// e.g. HID_ID=0003:000004D8:0000003C.
+func readHIDUevent(filename string) (HIDDevice, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return HIDDevice{}, err
+	}
+	defer f.Close()
+
+	var device HIDDevice
+	var found bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "HID_ID":
+			var bus, vendor, product uint32
+			if _, err := fmt.Sscanf(parts[1], "%x:%x:%x", &bus, &vendor, &product); err != nil {
+				return HIDDevice{}, fmt.Errorf("invalid HID_ID %q: %w", parts[1], err)
+			}
+			device.VendorID, device.ProductID = uint16(vendor), uint16(product)
+			found = true
+		case "HID_NAME":
+			device.Name = parts[1]
+		}
+	}
+	if !found {
+		return HIDDevice{}, fmt.Errorf("no HID_ID")
+	}
+	return device, scanner.Err()
+}
+
+type hidBootloader struct {
+	streamBootloader
+	vendorID, productID uint16
+	file                *os.File
+	// Unread data from the last report received
+	pending []byte
+}
+
+// NewHIDBootloader creates a new bootloader that communicates with the first USB HID device
+// with the given vendor and product IDs, for devices running the HID variant of the
+// bootloader. Commands and responses are split into 64 byte reports. This is only
+// supported on Linux, using the hidraw interface.
+func NewHIDBootloader(vendorID, productID uint16) (Bootloader, error) {
+	b := &hidBootloader{
+		vendorID:  vendorID,
+		productID: productID,
+	}
+	b.rw = &hidStream{b}
+	return b, nil
+}
+
+func (b *hidBootloader) Connect() error {
+	devices, err := ListHIDDevices()
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if device.VendorID != b.vendorID || device.ProductID != b.productID {
+			continue
+		}
+		transportLog.Debugf("opening %v (%v)", device.Path, device.Name)
+		b.file, err = os.OpenFile(device.Path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		b.pending = nil
+		return nil
+	}
+	return fmt.Errorf("no HID device found with ID %04X:%04X", b.vendorID, b.productID)
+}
+
+func (b *hidBootloader) Disconnect() {
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+// hidStream converts between the bootloader's byte stream and HID reports.
+type hidStream struct {
+	b *hidBootloader
+}
+
+func (s *hidStream) Read(p []byte) (int, error) {
+	if s.b.file == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	if len(s.b.pending) == 0 {
+		report := make([]byte, hidReportSize)
+		n, err := s.b.file.Read(report)
+		if err != nil {
+			return 0, err
+		}
+		s.b.pending = report[:n]
+	}
+	n := copy(p, s.b.pending)
+	s.b.pending = s.b.pending[n:]
+	return n, nil
+}
+
+func (s *hidStream) Write(p []byte) (int, error) {
+	if s.b.file == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	// Any padding left over from the previous response is discarded
+	s.b.pending = nil
+	for offset := 0; offset < len(p); offset += hidReportSize {
+		// Each report is preceded by a report ID of 0 and padded to the full report size
+		report := make([]byte, hidReportSize+1)
+		copy(report[1:], p[offset:])
+		if _, err := s.b.file.Write(report); err != nil {
+			return offset, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,90 @@
+package microchipboot
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Default time to wait for an I2C device that isn't acknowledging its address, e.g.
+// because it is busy erasing flash.
+const defaultI2CTimeout = time.Second
+
+type i2cBootloader struct {
+	streamBootloader
+	bus     string
+	address byte
+	// Maximum time to keep retrying a transfer that isn't acknowledged.
+	timeout time.Duration
+	file    *os.File
+}
+
+// NewI2CBootloader creates a new bootloader that communicates with a device at the given
+// 7-bit address on an I2C bus, e.g. /dev/i2c-1. Addresses outside 0x08-0x77 are reserved
+// by the I2C specification and are rejected. The framing is the same as for the serial
+// transport: each command is written to the device and the response is then read back.
+// This is only supported on Linux, using the i2c-dev interface.
+func NewI2CBootloader(bus string, address byte) (Bootloader, error) {
+	if address < 0x08 || address > 0x77 {
+		return nil, fmt.Errorf("invalid I2C address %X, must be between 08 and 77", address)
+	}
+	b := &i2cBootloader{
+		bus:     bus,
+		address: address,
+		timeout: defaultI2CTimeout,
+	}
+	b.rw = &i2cStream{b}
+	return b, nil
+}
+
+func (b *i2cBootloader) Connect() error {
+	file, err := os.OpenFile(b.bus, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := setI2CAddress(file, b.address); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to set I2C address %X: %w", b.address, err)
+	}
+	b.file = file
+	return nil
+}
+
+func (b *i2cBootloader) Disconnect() {
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+// i2cStream performs each read and write as a single I2C transfer, retrying transfers
+// that aren't acknowledged until the timeout expires.
+type i2cStream struct {
+	b *i2cBootloader
+}
+
+func (s *i2cStream) transfer(f func() (int, error)) (int, error) {
+	if s.b.file == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	deadline := time.Now().Add(s.b.timeout)
+	for {
+		n, err := f()
+		if err == nil || time.Now().After(deadline) {
+			return n, err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *i2cStream) Read(p []byte) (int, error) {
+	return s.transfer(func() (int, error) {
+		return s.b.file.Read(p)
+	})
+}
+
+func (s *i2cStream) Write(p []byte) (int, error) {
+	return s.transfer(func() (int, error) {
+		return s.b.file.Write(p)
+	})
+}
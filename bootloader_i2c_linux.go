@@ -0,0 +1,17 @@
+package microchipboot
+
+import (
+	"os"
+	"syscall"
+)
+
+// ioctl request that sets the address of the device that subsequent transfers go to.
+const i2cSlave = 0x0703
+
+func setI2CAddress(file *os.File, address byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), i2cSlave, uintptr(address))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
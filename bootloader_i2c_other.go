@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package microchipboot
+
+import (
+	"errors"
+	"os"
+)
+
+func setI2CAddress(file *os.File, address byte) error {
+	return errors.New("I2C is only supported on Linux")
+}
@@ -0,0 +1,16 @@
+package microchipboot
+
+import "testing"
+
+func TestI2CAddressRange(t *testing.T) {
+	for _, address := range []byte{0x00, 0x07, 0x78, 0x7F, 0x80} {
+		if _, err := NewI2CBootloader("/dev/i2c-1", address); err == nil {
+			t.Errorf("address %X was accepted", address)
+		}
+	}
+	for _, address := range []byte{0x08, 0x40, 0x77} {
+		if _, err := NewI2CBootloader("/dev/i2c-1", address); err != nil {
+			t.Errorf("address %X: %v", address, err)
+		}
+	}
+}
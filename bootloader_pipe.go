@@ -0,0 +1,152 @@
+package microchipboot
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PipeConfig configures the pipe transport.
+type PipeConfig struct {
+	// Path of the pipe. This is a Windows named pipe such as \\.\pipe\com1, a Unix domain
+	// socket, or a FIFO or pseudo terminal that can be opened for reading and writing.
+	Path string
+	// Maximum time to wait for data from the other end. Defaults to 1 second.
+	ReadTimeout time.Duration
+	// How to recover from echo mismatches. By default, the command fails.
+	Resync ResyncPolicy
+}
+
+type pipeBootloader struct {
+	streamBootloader
+	config PipeConfig
+	conn   io.ReadWriteCloser
+	// Data read from the pipe in the background, so that reads can time out
+	chunks chan pipeChunk
+	// Closed when the connection is closed, to stop the background reader
+	closed chan struct{}
+	// Received data that hasn't been read yet
+	pending []byte
+}
+
+type pipeChunk struct {
+	data []byte
+	err  error
+}
+
+// NewPipeBootloader creates a new bootloader that speaks the bootloader protocol over a
+// pipe, such as the virtual serial ports provided by emulators and test harnesses.
+func NewPipeBootloader(config PipeConfig) (Bootloader, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("no pipe path given")
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = time.Second
+	}
+	b := &pipeBootloader{config: config}
+	b.rw = &pipeStream{b}
+	b.resync = config.Resync
+	return b, nil
+}
+
+func (b *pipeBootloader) Connect() error {
+	b.Disconnect()
+	transportLog.Debugf("opening pipe %v", b.config.Path)
+	var err error
+	if stat, statErr := os.Stat(b.config.Path); statErr == nil && stat.Mode()&os.ModeSocket != 0 {
+		b.conn, err = net.Dial("unix", b.config.Path)
+	} else {
+		b.conn, err = os.OpenFile(b.config.Path, os.O_RDWR, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open pipe %v: %w", b.config.Path, err)
+	}
+
+	// Pipes don't support read timeouts on every platform, so read in the background
+	b.chunks = make(chan pipeChunk)
+	b.closed = make(chan struct{})
+	b.pending = nil
+	go func(conn io.Reader, chunks chan<- pipeChunk, closed <-chan struct{}) {
+		for {
+			buf := make([]byte, 1024)
+			n, err := conn.Read(buf)
+			select {
+			case chunks <- pipeChunk{buf[:n], err}:
+			case <-closed:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}(b.conn, b.chunks, b.closed)
+	return nil
+}
+
+func (b *pipeBootloader) Disconnect() {
+	if b.conn != nil {
+		close(b.closed)
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// pipeStream reads and writes the bootloader's pipe.
+type pipeStream struct {
+	b *pipeBootloader
+}
+
+func (s *pipeStream) Read(p []byte) (int, error) {
+	if s.b.conn == nil {
+		return 0, fmt.Errorf("pipe %v is not open", s.b.config.Path)
+	}
+	if len(s.b.pending) == 0 {
+		select {
+		case chunk := <-s.b.chunks:
+			if chunk.err != nil {
+				s.b.Disconnect()
+				if chunk.err == io.EOF {
+					return 0, fmt.Errorf("pipe %v was closed", s.b.config.Path)
+				}
+				return 0, chunk.err
+			}
+			s.b.pending = chunk.data
+		case <-time.After(s.b.config.ReadTimeout):
+			// The read timed out
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, s.b.pending)
+	s.b.pending = s.b.pending[n:]
+	return n, nil
+}
+
+func (s *pipeStream) Write(p []byte) (int, error) {
+	if s.b.conn == nil {
+		return 0, fmt.Errorf("pipe %v is not open", s.b.config.Path)
+	}
+	return s.b.conn.Write(p)
+}
+
+// isNamedPipe returns true if name is a Windows named pipe path, e.g. \\.\pipe\com1.
+func isNamedPipe(name string) bool {
+	name = strings.Replace(name, "/", `\`, -1)
+	parts := strings.SplitN(strings.TrimPrefix(name, `\\`), `\`, 3)
+	return strings.HasPrefix(name, `\\`) && len(parts) == 3 && strings.EqualFold(parts[1], "pipe")
+}
+
+var comPortPattern = regexp.MustCompile(`^(?i)com(\d+):?$`)
+
+// windowsPortName converts the ways that COM ports are commonly written, e.g. com10 or
+// COM10:, into the \\.\COM10 form that Windows requires to open ports above COM9. Other
+// names are returned as they are.
+func windowsPortName(name string) string {
+	if m := comPortPattern.FindStringSubmatch(name); m != nil {
+		return `\\.\COM` + m[1]
+	}
+	return name
+}
@@ -0,0 +1,76 @@
+package microchipboot
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWindowsPortName(t *testing.T) {
+	for name, want := range map[string]string{
+		"COM3":       `\\.\COM3`,
+		"com10":      `\\.\COM10`,
+		"COM12:":     `\\.\COM12`,
+		`\\.\COM10`:  `\\.\COM10`,
+		"/dev/ttyS0": "/dev/ttyS0",
+	} {
+		if got := windowsPortName(name); got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+	}
+	if !isNamedPipe(`\\.\pipe\com1`) || isNamedPipe(`\\.\COM10`) {
+		t.Errorf("named pipe not detected")
+	}
+}
+
+func TestPipeBootloader(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are needed")
+	}
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sim.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		// Echo the first write back
+		buf := make([]byte, 16)
+		n, _ := conn.Read(buf)
+		conn.Write(buf[:n])
+	}()
+
+	b, err := NewPipeBootloader(PipeConfig{Path: path, ReadTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect()
+	rw := b.(*pipeBootloader).rw
+	if _, err := rw.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(rw, buf); err != nil || string(buf) != "abc" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	if _, err := rw.Read(buf); !isTimeout(err) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
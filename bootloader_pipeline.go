@@ -0,0 +1,117 @@
+package microchipboot
+
+import "fmt"
+
+// pendingCommand is a command that has been sent but whose response hasn't been
+// received yet.
+type pendingCommand struct {
+	cmd Command
+	tx  []byte
+}
+
+// pipeliner is implemented by transports that can keep several commands in flight.
+type pipeliner interface {
+	drainPipeline() error
+}
+
+// drainPipeline waits for the responses to any commands that are still in flight on the
+// transport underlying bootloader.
+func drainPipeline(bootloader Bootloader) error {
+	if p, ok := findBootloader(bootloader, func(b Bootloader) bool {
+		_, ok := b.(pipeliner)
+		return ok
+	}).(pipeliner); ok {
+		return p.drainPipeline()
+	}
+	return nil
+}
+
+func isWriteCommand(cmd Command) bool {
+	switch cmd.Command {
+	case commandWriteFlash, commandWriteEE, commandWriteConfig:
+		return true
+	}
+	return false
+}
+
+func (b *streamBootloader) pipelining() bool {
+	return b.pipelineDepth > 1 && !b.pipelineFailed
+}
+
+// resetPipeline discards the commands in flight and re-enables pipelining, e.g. after
+// reconnecting.
+func (b *streamBootloader) resetPipeline() {
+	b.pending = nil
+	b.pipelineFailed = false
+}
+
+// sendPipelined sends a command without waiting for its response, unless the pipeline
+// is full, in which case the response to the oldest command is received first. Errors
+// are returned by the call that receives the failed response.
+func (b *streamBootloader) sendPipelined(cmd Command) error {
+	tx, err := b.transmit(cmd)
+	b.pending = append(b.pending, pendingCommand{cmd: cmd, tx: tx})
+	if err != nil {
+		return b.fallback(err)
+	}
+	if len(b.pending) < b.pipelineDepth {
+		return nil
+	}
+	return b.completeOldest()
+}
+
+// completeOldest receives the response to the oldest command in flight.
+func (b *streamBootloader) completeOldest() error {
+	p := b.pending[0]
+	_, err := b.receive(p.cmd, p.tx)
+	if b.onResult != nil {
+		b.onResult(err)
+	}
+	if err != nil {
+		return b.fallback(err)
+	}
+	b.pending = b.pending[1:]
+	return nil
+}
+
+func (b *streamBootloader) drainPipeline() error {
+	for len(b.pending) > 0 {
+		if err := b.completeOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fallback recovers from a failed pipelined command by discarding the responses that are
+// still arriving and resending the commands in flight one at a time. Pipelining stays
+// disabled until the pipeline is reset.
+func (b *streamBootloader) fallback(err error) error {
+	transportLog.Warnf("pipelined command failed, falling back to sending commands one at a time: %v", err)
+	b.pipelineFailed = true
+	pending := b.pending
+	b.pending = nil
+
+	// Wait for the device to go quiet
+	buf := make([]byte, 64)
+	for {
+		if n, err := b.rw.Read(buf); n == 0 || err != nil {
+			break
+		}
+	}
+	for i, p := range pending {
+		_, err := b.exchange(p.cmd)
+		if b.onResult != nil {
+			b.onResult(err)
+		}
+		if err != nil && i < len(pending)-1 {
+			// The failure doesn't belong to the command being sent by the caller, so a
+			// retry by the caller won't fix it
+			return fmt.Errorf("%w: pipelined command %X at %X failed: %v", ErrPipelineFailed, p.cmd.Command, p.cmd.Address, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package microchipboot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// RetryPolicy controls how failed commands are retried.
+type RetryPolicy struct {
+	// Maximum number of times a command is attempted, including the first attempt.
+	MaxAttempts int
+	// Delay before the first retry. The delay doubles after each subsequent attempt.
+	Backoff time.Duration
+	// If true, the transport's receive buffer is flushed before a command is resent,
+	// discarding any partial response that would otherwise corrupt the next attempt.
+	Resync bool
+}
+
+// flusher is implemented by transports that can discard unread data.
+type flusher interface {
+	Flush() error
+}
+
+type retryBootloader struct {
+	Bootloader
+	policy RetryPolicy
+	// Total number of retries, accessed atomically
+	retried int64
+}
+
+func (b *retryBootloader) unwrap() Bootloader {
+	return b.Bootloader
+}
+
+func (b *retryBootloader) retries() int {
+	return int(atomic.LoadInt64(&b.retried))
+}
+
+// NewRetryBootloader wraps a bootloader so that failed commands are retried according to
+// the policy. This allows a transient framing error, which is more likely at high baud
+// rates, to be recovered from without aborting an entire programming session.
+//
+// Connect, Disconnect and Reset are not retried, and neither are commands that the device
+// rejects with an address error or as unsupported.
+func NewRetryBootloader(bootloader Bootloader, policy RetryPolicy) Bootloader {
+	return &retryBootloader{
+		Bootloader: bootloader,
+		policy:     policy,
+	}
+}
+
+// do runs f until it succeeds or the maximum number of attempts has been reached. fields
+// describe the command in the log.
+func (b *retryBootloader) do(fields Fields, f func() error) error {
+	delay := b.policy.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if attempt >= b.policy.MaxAttempts {
+			break
+		}
+		if !retryable(err) {
+			return err
+		}
+		transportLog.WithFields(fields).WithFields(Fields{FieldAttempt: attempt + 1}).Warnf("command failed, retrying (attempt %v of %v): %v", attempt+1, b.policy.MaxAttempts, err)
+		atomic.AddInt64(&b.retried, 1)
+		time.Sleep(delay)
+		delay *= 2
+		if b.policy.Resync {
+			if fl, ok := b.Bootloader.(flusher); ok {
+				if err := fl.Flush(); err != nil {
+					return fmt.Errorf("failed to resync: %w", err)
+				}
+			}
+		}
+	}
+	if b.policy.MaxAttempts > 1 {
+		return fmt.Errorf("failed after %v attempts: %w", b.policy.MaxAttempts, err)
+	}
+	return err
+}
+
+// retryable returns false for errors that would recur if the command was resent, such as
+// the device rejecting the address, or cancellation, and for failures of earlier pipelined
+// commands, which resending this command wouldn't fix.
+func retryable(err error) bool {
+	return !errors.Is(err, ErrAddressError) && !errors.Is(err, ErrUnsupportedCommand) &&
+		!errors.Is(err, ErrPipelineFailed) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func (b *retryBootloader) GetVersion() (VersionInfo, error) {
+	var info VersionInfo
+	err := b.do(commandFields(commandGetVersion, 0, 0), func() (err error) {
+		info, err = b.Bootloader.GetVersion()
+		return err
+	})
+	return info, err
+}
+
+func (b *retryBootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(commandFields(commandReadFlash, address, int(length)), func() (err error) {
+		data, err = b.Bootloader.ReadFlash(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *retryBootloader) WriteFlash(address uint32, data []byte) error {
+	return b.do(commandFields(commandWriteFlash, address, len(data)), func() error {
+		return b.Bootloader.WriteFlash(address, data)
+	})
+}
+
+func (b *retryBootloader) EraseFlash(address uint32, numRows uint16) error {
+	return b.do(commandFields(commandEraseFlash, address, int(numRows)), func() error {
+		return b.Bootloader.EraseFlash(address, numRows)
+	})
+}
+
+func (b *retryBootloader) ReadEE(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(commandFields(commandReadEE, address, int(length)), func() (err error) {
+		data, err = b.Bootloader.ReadEE(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *retryBootloader) WriteEE(address uint32, data []byte) error {
+	return b.do(commandFields(commandWriteEE, address, len(data)), func() error {
+		return b.Bootloader.WriteEE(address, data)
+	})
+}
+
+func (b *retryBootloader) ReadConfig(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(commandFields(commandReadConfig, address, int(length)), func() (err error) {
+		data, err = b.Bootloader.ReadConfig(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *retryBootloader) WriteConfig(address uint32, data []byte) error {
+	return b.do(commandFields(commandWriteConfig, address, len(data)), func() error {
+		return b.Bootloader.WriteConfig(address, data)
+	})
+}
+
+func (b *retryBootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	var checksum uint16
+	err := b.do(commandFields(commandCalculateChecksum, address, int(length)), func() (err error) {
+		checksum, err = b.Bootloader.CalculateChecksum(address, length)
+		return err
+	})
+	return checksum, err
+}
+
+// SendCommand sends an arbitrary command, retrying it on failure. It fails if the
+// wrapped bootloader cannot send arbitrary commands.
+func (b *retryBootloader) SendCommand(cmd Command) ([]byte, error) {
+	sender, ok := b.Bootloader.(CommandSender)
+	if !ok {
+		return nil, fmt.Errorf("bootloader does not support sending arbitrary commands")
+	}
+	var resp []byte
+	err := b.do(commandFields(cmd.Command, cmd.Address, int(cmd.Length)), func() (err error) {
+		resp, err = sender.SendCommand(cmd)
+		return err
+	})
+	return resp, err
+}
@@ -1,181 +1,492 @@
 package microchipboot
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
+	"runtime"
+	"strings"
 	"time"
 
 	"github.com/tarm/serial"
 )
 
-type serialBootloader struct {
-	portConfig serial.Config
-	port       *serial.Port
+// Parity settings.
+const (
+	ParityNone  = 'N'
+	ParityOdd   = 'O'
+	ParityEven  = 'E'
+	ParityMark  = 'M'
+	ParitySpace = 'S'
+)
+
+// ModemLine identifies a serial port control line.
+type ModemLine int
+
+// Serial port control lines.
+const (
+	LineDTR ModemLine = iota
+	LineRTS
+)
+
+func (l ModemLine) String() string {
+	if l == LineRTS {
+		return "RTS"
+	}
+	return "DTR"
 }
 
-// NewSerialBootloader creates a new bootloader using the serial transport.
-func NewSerialBootloader(port string, baud int) (Bootloader, error) {
-	b := new(serialBootloader)
+// SerialConfig holds the settings of a serial port. Zero values are replaced with defaults.
+type SerialConfig struct {
+	Name string
+	// Defaults to 115200.
+	Baud int
+	// Number of data bits. Defaults to 8.
+	DataBits byte
+	// One of the Parity constants. Defaults to ParityNone.
+	Parity byte
+	// Number of stop bits, 1 or 2. Defaults to 1.
+	StopBits byte
+	// Maximum time to wait for data when reading. Defaults to 1 second.
+	ReadTimeout time.Duration
+	// If non-zero, a response that has started arriving fails once no data has been
+	// received for this long, instead of waiting for the rest of the command's timeout.
+	// Reads then time out after this long and are retried until the command's timeout.
+	InterByteTimeout time.Duration
+	// Number of write commands sent before waiting for their responses, which speeds up
+	// programming over high latency links such as USB adapters or RFC2217 bridges. The
+	// bootloader must be able to buffer the commands while it is busy writing. If a
+	// pipelined command fails, the commands in flight are resent one at a time and
+	// pipelining is disabled until the next Connect. Values below 2 disable pipelining.
+	Pipeline int
+	// Time allowed for a command to complete. If this is longer than ReadTimeout, reads
+	// that time out are retried until it has elapsed. Defaults to ReadTimeout.
+	DefaultTimeout time.Duration
+	// Time allowed for write commands to complete. Defaults to DefaultTimeout.
+	WriteTimeout time.Duration
+	// Additional time allowed per row for erase commands, as erasing many rows at once can
+	// take longer than any other command.
+	EraseTimeout time.Duration
+	// If true, RTS/CTS hardware flow control is enabled. Linux only.
+	FlowControl bool
+	// Minimum time between the last data exchanged with the device and the next command,
+	// for bootloaders that need time to recover after writing a row.
+	CommandDelay time.Duration
+	// If non-zero, commands are sent a byte at a time with this delay between bytes, for
+	// bootloaders that can't keep up with back-to-back bytes at high baud rates.
+	ByteDelay time.Duration
+	// Initial states of the DTR and RTS lines, set when the port is opened. If nil, the
+	// line is left in the state chosen by the operating system. Linux only.
+	DTR, RTS *bool
+	// If set, the modem lines are pulsed after opening the port to force the target into
+	// its bootloader. Linux only.
+	Entry *EntrySequence
+	// Lower baud rates to fall back to, in descending order. If set, Connect sends
+	// GetVersion at Baud and then at each fallback rate until the device responds. This
+	// relies on the bootloader detecting the baud rate from the sync byte.
+	FallbackBauds []int
+	// If non-zero, the port is reopened at the next fallback baud rate after this many
+	// consecutive echo mismatches. The failed command still returns an error, so this
+	// is best combined with NewRetryBootloader.
+	DowngradeAfter int
+	// How to recover from echo mismatches. By default, the command fails.
+	Resync ResyncPolicy
+	// How commands and responses are framed on the port, either FramingRaw or
+	// FramingAN1310. Defaults to FramingRaw. Not used with tcp://, rfc2217:// and
+	// pipe:// ports.
+	Framing string
+}
 
-	b.portConfig.Baud = baud
-	b.portConfig.Name = port
-	b.portConfig.ReadTimeout = time.Second
+// EntrySequence describes how DTR and/or RTS are pulsed to reset the target into its
+// bootloader, for boards where these lines are wired to MCLR or a boot mode pin.
+type EntrySequence struct {
+	// Lines that are pulsed. Both lines are asserted and released together.
+	DTR, RTS bool
+	// If true, a line is asserted by clearing it rather than setting it.
+	Inverted bool
+	// Time that the lines are held asserted. Defaults to 100ms.
+	Pulse time.Duration
+	// Time to wait after releasing the lines for the bootloader to start. Defaults to 100ms.
+	Settle time.Duration
+}
 
-	return b, nil
+// How long ProbePorts waits for each port to respond.
+const probeTimeout = 200 * time.Millisecond
+
+// ProbedPort is a serial port found by ProbePorts with a bootloader attached.
+type ProbedPort struct {
+	Name string
+	Info VersionInfo
 }
 
-func (b *serialBootloader) Connect() error {
-	var err error
-	b.port, err = serial.OpenPort(&b.portConfig)
+// ListSerialPorts returns the names of the serial ports attached to the system.
+func ListSerialPorts() ([]string, error) {
+	ports, err := listSerialPorts()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to list serial ports: %w", err)
 	}
-	// On Linux with USB serial ports, in order for flush to work properly
-	// we need to delay a little before flushing to make sure that any
-	// received data has made its way up the driver stack.
-	// See https://stackoverflow.com/questions/13013387/clearing-the-serial-ports-buffer
-	time.Sleep(time.Millisecond * 100)
-	b.port.Flush()
-	return nil
-}
-
-func (b *serialBootloader) Disconnect() {
-	b.port.Close()
+	return ports, nil
 }
 
-func (b *serialBootloader) recv(count int) ([]byte, error) {
-	resp := make([]byte, 0, count)
-	for count > 0 {
-		buf := make([]byte, count)
-		n, err := b.port.Read(buf)
+// ProbePorts sends GetVersion on each of the system's serial ports at the given baud rate,
+// and returns the ports that respond with valid version info. Ports that can't be opened,
+// e.g. because they're in use, are skipped.
+func ProbePorts(baud int) ([]ProbedPort, error) {
+	ports, err := ListSerialPorts()
+	if err != nil {
+		return nil, err
+	}
+	var found []ProbedPort
+	for _, port := range ports {
+		info, err := probePort(port, baud)
 		if err != nil {
-			return nil, err
+			transportLog.Debugf("no bootloader on %v: %v", port, err)
+			continue
 		}
-		resp = append(resp, buf[:n]...)
-		count -= n
+		transportLog.Debugf("found bootloader on %v: %+v", port, info)
+		found = append(found, ProbedPort{Name: port, Info: info})
 	}
-	return resp, nil
+	return found, nil
 }
 
-func (b *serialBootloader) send(cmd Command) ([]byte, error) {
-	tx := append([]byte{0x55}, cmd.GetBytes()...)
-	b.port.Write(tx)
-	// Wait for the echoed command
-	echoLen := len(tx) - len(cmd.Data)
-	echo, err := b.recv(echoLen)
+func probePort(port string, baud int) (VersionInfo, error) {
+	b, err := NewSerialBootloaderWithConfig(SerialConfig{Name: port, Baud: baud, ReadTimeout: probeTimeout})
 	if err != nil {
-		return nil, err
+		return VersionInfo{}, err
 	}
-
-	// Check that the echoed data matches the sent data
-	for i := 0; i < echoLen; i++ {
-		if i != 4 && i != 5 && tx[i] != echo[i] {
-			return nil, fmt.Errorf("echo mismatch at position %v", i)
-		}
+	if err := b.Connect(); err != nil {
+		return VersionInfo{}, err
 	}
+	defer b.Disconnect()
+	info, err := b.GetVersion()
+	if err != nil {
+		return VersionInfo{}, err
+	}
+	if info.EraseRowSize == 0 || info.WriteRowSize == 0 {
+		return VersionInfo{}, fmt.Errorf("invalid version info %+v", info)
+	}
+	return info, nil
+}
+
+type serialBootloader struct {
+	streamBootloader
+	config     SerialConfig
+	portConfig serial.Config
+	port       *serial.Port
+	// Index into bauds of the rate in use
+	baudIndex int
+	bauds     []int
+	// Number of consecutive echo mismatches
+	mismatches int
+}
+
+// defaultSerialBaud is used if no baud rate is given.
+const defaultSerialBaud = 115200
+
+// NewSerialBootloader creates a new bootloader using the serial transport. The port may
+// also be a serial://, tcp://, rfc2217:// or pipe:// URL, as accepted by
+// NewBootloaderFromURL, whose baud parameter overrides the given baud rate, or a
+// Windows named pipe such as \\.\pipe\com1. On Windows, COM ports can be given as e.g.
+// COM10, com10 or \\.\COM10.
+func NewSerialBootloader(port string, baud int) (Bootloader, error) {
+	return NewSerialBootloaderWithConfig(SerialConfig{Name: port, Baud: baud})
+}
 
-	// Now receive the actual response
-	if cmd.ExpectsSuccessCode() {
-		code, err := b.recv(1)
+// NewSerialBootloaderWithConfig creates a new bootloader using the serial transport with
+// the given port settings.
+func NewSerialBootloaderWithConfig(config SerialConfig) (Bootloader, error) {
+	if config.Baud == 0 {
+		config.Baud = defaultSerialBaud
+	}
+	if isNamedPipe(config.Name) {
+		return NewPipeBootloader(PipeConfig{Path: config.Name, ReadTimeout: config.ReadTimeout, Resync: config.Resync})
+	}
+	if runtime.GOOS == "windows" {
+		config.Name = windowsPortName(config.Name)
+	}
+	if strings.Contains(config.Name, "://") {
+		u, err := url.Parse(config.Name)
 		if err != nil {
 			return nil, err
 		}
-		if code[0] != ResultSuccess {
-			return nil, fmt.Errorf("command returned code %v: %v", code[0], GetResponseCodeString(int(code[0])))
+		if config.Baud, err = urlBaud(u, config.Baud); err != nil {
+			return nil, err
+		}
+		if u.Scheme != "serial" {
+			return newRemoteSerialBootloader(u, config)
 		}
+		config.Name = u.Path
 	}
-	resp := []byte{}
-	if cmd.GetResponseLength() > 0 {
-		resp, err = b.recv(cmd.GetResponseLength())
-		if err != nil {
-			return nil, err
+	if config.DataBits == 0 {
+		config.DataBits = 8
+	}
+	if config.Parity == 0 {
+		config.Parity = ParityNone
+	}
+	if config.StopBits == 0 {
+		config.StopBits = 1
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = time.Second
+	}
+	if config.DefaultTimeout == 0 {
+		config.DefaultTimeout = config.ReadTimeout
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = config.DefaultTimeout
+	}
+	if config.Entry != nil {
+		entry := *config.Entry
+		if !entry.DTR && !entry.RTS {
+			return nil, fmt.Errorf("entry sequence must pulse DTR or RTS")
 		}
+		if entry.Pulse == 0 {
+			entry.Pulse = 100 * time.Millisecond
+		}
+		if entry.Settle == 0 {
+			entry.Settle = 100 * time.Millisecond
+		}
+		config.Entry = &entry
 	}
 
-	return resp, nil
-}
+	if err := validateFraming(config.Framing); err != nil {
+		return nil, err
+	}
+	switch config.Parity {
+	case ParityNone, ParityOdd, ParityEven, ParityMark, ParitySpace:
+	default:
+		return nil, fmt.Errorf("invalid parity %q", config.Parity)
+	}
+	if config.StopBits != 1 && config.StopBits != 2 {
+		return nil, fmt.Errorf("invalid number of stop bits %v", config.StopBits)
+	}
+	if config.DataBits < 5 || config.DataBits > 8 {
+		return nil, fmt.Errorf("invalid number of data bits %v", config.DataBits)
+	}
 
-func (b *serialBootloader) GetVersion() (VersionInfo, error) {
-	resp, err := b.send(NewGetVersionCommand())
-	if err != nil {
-		return VersionInfo{}, err
+	for i, baud := range config.FallbackBauds {
+		if baud <= 0 || (i > 0 && baud >= config.FallbackBauds[i-1]) || (i == 0 && baud >= config.Baud) {
+			return nil, fmt.Errorf("fallback baud rates must be in descending order and lower than %v", config.Baud)
+		}
 	}
 
-	info, err := ParseGetVersionResponse(resp)
-	if err != nil {
-		return VersionInfo{}, fmt.Errorf("failed to parse GetVersion response: %v", err)
+	b := new(serialBootloader)
+	b.config = config
+	b.bauds = append([]int{config.Baud}, config.FallbackBauds...)
+	b.onResult = b.checkEcho
+	b.pipelineDepth = config.Pipeline
+	b.resync = config.Resync
+	b.interByteTimeout = config.InterByteTimeout
+	portTimeout := config.ReadTimeout
+	if config.InterByteTimeout > 0 && config.InterByteTimeout < portTimeout {
+		// Poll often enough to notice a stalled response
+		portTimeout = config.InterByteTimeout
 	}
-	return info, nil
+	if portTimeout != config.ReadTimeout || config.DefaultTimeout != config.ReadTimeout || config.WriteTimeout != config.ReadTimeout || config.EraseTimeout != 0 {
+		b.commandTimeout = b.timeout
+	}
+	b.portConfig = serial.Config{
+		Name:        config.Name,
+		Baud:        config.Baud,
+		Size:        config.DataBits,
+		Parity:      serial.Parity(config.Parity),
+		StopBits:    serial.StopBits(config.StopBits),
+		ReadTimeout: portTimeout,
+	}
+	return b, nil
 }
 
-func (b *serialBootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
-	resp, err := b.send(NewReadFlashCommand(address, length))
-	if err != nil {
-		return nil, fmt.Errorf("read flash failed: %v", err)
+func (b *serialBootloader) Connect() error {
+	b.mismatches = 0
+	b.resetPipeline()
+	if len(b.bauds) == 1 {
+		return b.open(0, true)
 	}
-	return resp, nil
-}
 
-func (b *serialBootloader) WriteFlash(address uint32, data []byte) error {
-	_, err := b.send(NewWriteFlashCommand(address, data))
-	if err != nil {
-		return fmt.Errorf("write flash failed: %v", err)
+	// Negotiate the baud rate
+	var err error
+	for i := range b.bauds {
+		if err = b.open(i, i == 0); err != nil {
+			return err
+		}
+		if _, err = b.exchange(NewGetVersionCommand()); err == nil {
+			transportLog.Debugf("device responded at %v baud", b.bauds[i])
+			return nil
+		}
+		transportLog.Debugf("no response at %v baud: %v", b.bauds[i], err)
+		b.port.Close()
 	}
-	return nil
+	return fmt.Errorf("device did not respond at any baud rate: %w", err)
 }
 
-func (b *serialBootloader) EraseFlash(address uint32, numRows uint16) error {
-	_, err := b.send(NewEraseFlashCommand(address, numRows))
+// open opens the port at the baud rate with the given index, pulsing the modem lines to
+// enter the bootloader if enter is true.
+func (b *serialBootloader) open(baudIndex int, enter bool) error {
+	b.baudIndex = baudIndex
+	b.portConfig.Baud = b.bauds[baudIndex]
+	var err error
+	b.port, err = serial.OpenPort(&b.portConfig)
 	if err != nil {
-		return fmt.Errorf("erase flash failed: %v", err)
+		return err
+	}
+	if err := b.configureLines(); err != nil {
+		b.port.Close()
+		return err
+	}
+	if enter {
+		if err := b.enterBootloader(); err != nil {
+			b.port.Close()
+			return err
+		}
+	}
+	// On Linux with USB serial ports, in order for flush to work properly
+	// we need to delay a little before flushing to make sure that any
+	// received data has made its way up the driver stack.
+	// See https://stackoverflow.com/questions/13013387/clearing-the-serial-ports-buffer
+	time.Sleep(time.Millisecond * 100)
+	b.port.Flush()
+	b.rw = b.port
+	if b.config.CommandDelay > 0 || b.config.ByteDelay > 0 {
+		b.rw = &pacedPort{ReadWriter: b.port, commandDelay: b.config.CommandDelay, byteDelay: b.config.ByteDelay}
+	}
+	if b.config.Framing == FramingAN1310 {
+		b.rw = &an1310Framer{rw: b.rw}
 	}
 	return nil
 }
 
-func (b *serialBootloader) ReadEE(address uint32, length uint16) ([]byte, error) {
-	resp, err := b.send(NewReadEECommand(address, length))
-	if err != nil {
-		return nil, fmt.Errorf("read eeprom failed: %v", err)
+// pacedPort slows down the data sent to the device, for bootloaders that can't keep up.
+type pacedPort struct {
+	io.ReadWriter
+	commandDelay time.Duration
+	byteDelay    time.Duration
+	// Time that data was last sent or received
+	last time.Time
+}
+
+func (p *pacedPort) Read(buf []byte) (int, error) {
+	n, err := p.ReadWriter.Read(buf)
+	if n > 0 {
+		p.last = time.Now()
 	}
-	return resp, nil
+	return n, err
 }
 
-func (b *serialBootloader) WriteEE(address uint32, data []byte) error {
-	_, err := b.send(NewWriteEECommand(address, data))
-	if err != nil {
-		return fmt.Errorf("write eeprom failed: %v", err)
+// Write sends a command once the command delay has passed, pausing between bytes if a
+// byte delay is set.
+func (p *pacedPort) Write(data []byte) (int, error) {
+	if wait := time.Until(p.last.Add(p.commandDelay)); wait > 0 {
+		time.Sleep(wait)
 	}
-	return nil
+	defer func() {
+		p.last = time.Now()
+	}()
+	if p.byteDelay == 0 {
+		return p.ReadWriter.Write(data)
+	}
+	for i := range data {
+		if i > 0 {
+			time.Sleep(p.byteDelay)
+		}
+		if _, err := p.ReadWriter.Write(data[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(data), nil
 }
 
-func (b *serialBootloader) ReadConfig(address uint32, length uint16) ([]byte, error) {
-	resp, err := b.send(NewReadConfigCommand(address, length))
-	if err != nil {
-		return nil, fmt.Errorf("read config failed: %v", err)
+// configureLines applies the flow control and modem line settings that aren't supported
+// by the serial package.
+func (b *serialBootloader) configureLines() error {
+	if b.config.FlowControl {
+		if err := setHardwareFlowControl(b.config.Name, true); err != nil {
+			return fmt.Errorf("failed to enable flow control: %w", err)
+		}
+	}
+	lines := []struct {
+		line  ModemLine
+		state *bool
+	}{
+		{LineDTR, b.config.DTR},
+		{LineRTS, b.config.RTS},
 	}
-	return resp, nil
+	for _, l := range lines {
+		if l.state == nil {
+			continue
+		}
+		if err := setModemLine(b.config.Name, l.line, *l.state); err != nil {
+			return fmt.Errorf("failed to set %v: %w", l.line, err)
+		}
+	}
+	return nil
 }
 
-func (b *serialBootloader) WriteConfig(address uint32, data []byte) error {
-	_, err := b.send(NewWriteConfigCommand(address, data))
-	if err != nil {
-		return fmt.Errorf("write config failed: %v", err)
+// enterBootloader pulses the modem lines given by the entry sequence, if any.
+func (b *serialBootloader) enterBootloader() error {
+	entry := b.config.Entry
+	if entry == nil {
+		return nil
 	}
+	setLines := func(asserted bool) error {
+		for _, line := range []ModemLine{LineDTR, LineRTS} {
+			if (line == LineDTR && !entry.DTR) || (line == LineRTS && !entry.RTS) {
+				continue
+			}
+			if err := setModemLine(b.config.Name, line, asserted != entry.Inverted); err != nil {
+				return fmt.Errorf("failed to pulse %v: %w", line, err)
+			}
+		}
+		return nil
+	}
+	transportLog.Debugf("pulsing modem lines for %v to enter the bootloader", entry.Pulse)
+	if err := setLines(true); err != nil {
+		return err
+	}
+	time.Sleep(entry.Pulse)
+	if err := setLines(false); err != nil {
+		return err
+	}
+	time.Sleep(entry.Settle)
 	return nil
 }
 
-func (b *serialBootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
-	resp, err := b.send(NewCalculateChecksumCommand(address, length))
-	if err != nil {
-		return 0, fmt.Errorf("calculate checksum failed: %v", err)
+// timeout returns the time allowed for the command to complete.
+func (b *serialBootloader) timeout(cmd Command) time.Duration {
+	switch cmd.Command {
+	case commandEraseFlash:
+		return b.config.DefaultTimeout + time.Duration(cmd.Length)*b.config.EraseTimeout
+	case commandWriteFlash, commandWriteEE, commandWriteConfig:
+		return b.config.WriteTimeout
+	default:
+		return b.config.DefaultTimeout
 	}
-	checksum := uint16(resp[0]) + 256*uint16(resp[1])
-	return checksum, nil
 }
 
-func (b *serialBootloader) Reset() error {
-	_, err := b.send(NewResetCommand())
-	if err != nil {
-		return fmt.Errorf("reset failed: %v", err)
+// checkEcho counts consecutive echo mismatches and drops to the next fallback baud rate
+// once there have been too many.
+func (b *serialBootloader) checkEcho(err error) {
+	if !errors.Is(err, ErrEchoMismatch) {
+		b.mismatches = 0
+		return
 	}
-	return nil
+	b.mismatches++
+	if b.config.DowngradeAfter == 0 || b.mismatches < b.config.DowngradeAfter || b.baudIndex+1 >= len(b.bauds) {
+		return
+	}
+	transportLog.Warnf("%v echo mismatches, dropping to %v baud", b.mismatches, b.bauds[b.baudIndex+1])
+	b.mismatches = 0
+	b.port.Close()
+	if err := b.open(b.baudIndex+1, false); err != nil {
+		transportLog.Errorf("failed to reopen port: %v", err)
+	}
+}
+
+func (b *serialBootloader) Disconnect() {
+	b.port.Close()
+}
+
+// Flush discards any data that has been received but not yet read.
+func (b *serialBootloader) Flush() error {
+	return b.port.Flush()
 }
@@ -0,0 +1,285 @@
+package microchipboot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// SharedBootloader wraps a bootloader so that it can be used from several goroutines,
+// e.g. a UI polling the version while a programmer writes. Each command runs on its own,
+// so commands from different goroutines can't interleave and corrupt the stream.
+//
+// Operations made up of several commands, such as programming, should hold a Session.
+// While a session is held, commands sent through the SharedBootloader itself or through
+// another session fail with ErrBootloaderBusy rather than interfering with it.
+type SharedBootloader struct {
+	bootloader Bootloader
+	// Held while a command runs and while owner is checked or changed
+	mu    sync.Mutex
+	owner *Session
+	// Holds a token while a session is active, so that sessions can wait for each other
+	sessions chan struct{}
+}
+
+// Session is exclusive use of a SharedBootloader. It implements Bootloader, so it can be
+// passed to a Programmer. Call Release when done.
+type Session struct {
+	shared   *SharedBootloader
+	released bool
+}
+
+// NewSharedBootloader wraps a bootloader so that it is safe for concurrent use.
+func NewSharedBootloader(bootloader Bootloader) *SharedBootloader {
+	return &SharedBootloader{
+		bootloader: bootloader,
+		sessions:   make(chan struct{}, 1),
+	}
+}
+
+func (b *SharedBootloader) unwrap() Bootloader {
+	return b.bootloader
+}
+
+// Acquire waits until no other session is active and starts a new session, or returns
+// ctx.Err() if ctx is done first.
+func (b *SharedBootloader) Acquire(ctx context.Context) (*Session, error) {
+	select {
+	case b.sessions <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return b.start(), nil
+}
+
+// TryAcquire starts a new session, or returns ErrBootloaderBusy if another session is
+// active.
+func (b *SharedBootloader) TryAcquire() (*Session, error) {
+	select {
+	case b.sessions <- struct{}{}:
+	default:
+		return nil, ErrBootloaderBusy
+	}
+	return b.start(), nil
+}
+
+func (b *SharedBootloader) start() *Session {
+	s := &Session{shared: b}
+	b.mu.Lock()
+	b.owner = s
+	b.mu.Unlock()
+	return s
+}
+
+// Release ends the session, allowing other goroutines to use the bootloader. Commands
+// sent through the session afterwards fail with ErrSessionReleased.
+func (s *Session) Release() {
+	b := s.shared
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	b.owner = nil
+	<-b.sessions
+}
+
+func (s *Session) unwrap() Bootloader {
+	return s.shared.bootloader
+}
+
+// do runs f on behalf of session s, or on behalf of no session if s is nil.
+func (b *SharedBootloader) do(s *Session, f func() error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s != nil && s.released {
+		return ErrSessionReleased
+	}
+	if b.owner != s {
+		return ErrBootloaderBusy
+	}
+	return f()
+}
+
+func (b *SharedBootloader) Connect() error {
+	return b.do(nil, b.bootloader.Connect)
+}
+
+func (b *SharedBootloader) Disconnect() {
+	b.do(nil, func() error {
+		b.bootloader.Disconnect()
+		return nil
+	})
+}
+
+func (b *SharedBootloader) GetVersion() (VersionInfo, error) {
+	var info VersionInfo
+	err := b.do(nil, func() (err error) {
+		info, err = b.bootloader.GetVersion()
+		return err
+	})
+	return info, err
+}
+
+func (b *SharedBootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(nil, func() (err error) {
+		data, err = b.bootloader.ReadFlash(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *SharedBootloader) WriteFlash(address uint32, data []byte) error {
+	return b.do(nil, func() error { return b.bootloader.WriteFlash(address, data) })
+}
+
+func (b *SharedBootloader) EraseFlash(address uint32, numRows uint16) error {
+	return b.do(nil, func() error { return b.bootloader.EraseFlash(address, numRows) })
+}
+
+func (b *SharedBootloader) ReadEE(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(nil, func() (err error) {
+		data, err = b.bootloader.ReadEE(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *SharedBootloader) WriteEE(address uint32, data []byte) error {
+	return b.do(nil, func() error { return b.bootloader.WriteEE(address, data) })
+}
+
+func (b *SharedBootloader) ReadConfig(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := b.do(nil, func() (err error) {
+		data, err = b.bootloader.ReadConfig(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (b *SharedBootloader) WriteConfig(address uint32, data []byte) error {
+	return b.do(nil, func() error { return b.bootloader.WriteConfig(address, data) })
+}
+
+func (b *SharedBootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	var checksum uint16
+	err := b.do(nil, func() (err error) {
+		checksum, err = b.bootloader.CalculateChecksum(address, length)
+		return err
+	})
+	return checksum, err
+}
+
+func (b *SharedBootloader) Reset() error {
+	return b.do(nil, b.bootloader.Reset)
+}
+
+// SendCommand sends an arbitrary command if the wrapped bootloader supports it.
+func (b *SharedBootloader) SendCommand(cmd Command) ([]byte, error) {
+	var resp []byte
+	err := b.do(nil, func() (err error) {
+		resp, err = sendCommand(b.bootloader, cmd)
+		return err
+	})
+	return resp, err
+}
+
+func (s *Session) Connect() error {
+	return s.shared.do(s, s.shared.bootloader.Connect)
+}
+
+func (s *Session) Disconnect() {
+	s.shared.do(s, func() error {
+		s.shared.bootloader.Disconnect()
+		return nil
+	})
+}
+
+func (s *Session) GetVersion() (VersionInfo, error) {
+	var info VersionInfo
+	err := s.shared.do(s, func() (err error) {
+		info, err = s.shared.bootloader.GetVersion()
+		return err
+	})
+	return info, err
+}
+
+func (s *Session) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := s.shared.do(s, func() (err error) {
+		data, err = s.shared.bootloader.ReadFlash(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (s *Session) WriteFlash(address uint32, data []byte) error {
+	return s.shared.do(s, func() error { return s.shared.bootloader.WriteFlash(address, data) })
+}
+
+func (s *Session) EraseFlash(address uint32, numRows uint16) error {
+	return s.shared.do(s, func() error { return s.shared.bootloader.EraseFlash(address, numRows) })
+}
+
+func (s *Session) ReadEE(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := s.shared.do(s, func() (err error) {
+		data, err = s.shared.bootloader.ReadEE(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (s *Session) WriteEE(address uint32, data []byte) error {
+	return s.shared.do(s, func() error { return s.shared.bootloader.WriteEE(address, data) })
+}
+
+func (s *Session) ReadConfig(address uint32, length uint16) ([]byte, error) {
+	var data []byte
+	err := s.shared.do(s, func() (err error) {
+		data, err = s.shared.bootloader.ReadConfig(address, length)
+		return err
+	})
+	return data, err
+}
+
+func (s *Session) WriteConfig(address uint32, data []byte) error {
+	return s.shared.do(s, func() error { return s.shared.bootloader.WriteConfig(address, data) })
+}
+
+func (s *Session) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	var checksum uint16
+	err := s.shared.do(s, func() (err error) {
+		checksum, err = s.shared.bootloader.CalculateChecksum(address, length)
+		return err
+	})
+	return checksum, err
+}
+
+func (s *Session) Reset() error {
+	return s.shared.do(s, s.shared.bootloader.Reset)
+}
+
+// SendCommand sends an arbitrary command if the wrapped bootloader supports it.
+func (s *Session) SendCommand(cmd Command) ([]byte, error) {
+	var resp []byte
+	err := s.shared.do(s, func() (err error) {
+		resp, err = sendCommand(s.shared.bootloader, cmd)
+		return err
+	})
+	return resp, err
+}
+
+// sendCommand sends an arbitrary command, failing if bootloader can't send arbitrary
+// commands.
+func sendCommand(bootloader Bootloader, cmd Command) ([]byte, error) {
+	sender, ok := bootloader.(CommandSender)
+	if !ok {
+		return nil, fmt.Errorf("bootloader does not support sending arbitrary commands")
+	}
+	return sender.SendCommand(cmd)
+}
@@ -0,0 +1,284 @@
+package microchipboot
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// SimulatedDevice describes the device emulated by a SimulatedBootloader.
+type SimulatedDevice struct {
+	// Version info returned by GetVersion. The erase and write row sizes and the maximum
+	// packet size are enforced.
+	Info VersionInfo
+	// Flash address ranges that may be erased, written and read. This normally covers
+	// program flash and, if present, the ID locations.
+	Flash []AddressRange
+	// Ranges of addresses accepted by the EEPROM and config commands.
+	EEPROM AddressRange
+	Config AddressRange
+}
+
+// SimulatedFaults configures the faults injected by a SimulatedBootloader. Each
+// probability is between 0 (never) and 1 (every command).
+type SimulatedFaults struct {
+	// Probability that a command fails with an invalid response code, as happens when the
+	// device receives a corrupted frame.
+	NAK float64
+	// Probability that a command's response is cut short.
+	Truncate float64
+	// Source of randomness. If nil, a source seeded with 1 is used so that runs are repeatable.
+	Rand *rand.Rand
+}
+
+// SimulatedBootloader is a Bootloader that emulates a device's memory in RAM, for testing
+// programming logic without hardware.
+//
+// Erased memory reads as 0xFF. Like real flash, erases must start on an erase row boundary,
+// and writes must start on a write row boundary and can only clear bits, so writing to
+// memory that hasn't been erased results in corrupted data. Addresses outside the device's
+// memory are rejected with ResultAddressError.
+type SimulatedBootloader struct {
+	Device SimulatedDevice
+	Faults SimulatedFaults
+
+	mutex     sync.Mutex
+	connected bool
+	flash     map[uint32]byte
+	eeprom    map[uint32]byte
+	config    map[uint32]byte
+	// Number of times Reset has been called
+	resets int
+}
+
+// NewSimulatedBootloader creates a simulated bootloader for the given device, with all
+// memory erased.
+func NewSimulatedBootloader(device SimulatedDevice) *SimulatedBootloader {
+	return &SimulatedBootloader{
+		Device: device,
+		flash:  make(map[uint32]byte),
+		eeprom: make(map[uint32]byte),
+		config: make(map[uint32]byte),
+	}
+}
+
+// Resets returns the number of times that the device has been reset.
+func (b *SimulatedBootloader) Resets() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.resets
+}
+
+// Memory returns a copy of length bytes of flash starting at address, without going
+// through the bootloader protocol or injecting any faults.
+func (b *SimulatedBootloader) Memory(address uint32, length int) []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.read(b.flash, address, length)
+}
+
+func (b *SimulatedBootloader) Connect() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.connected = true
+	return nil
+}
+
+func (b *SimulatedBootloader) Disconnect() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.connected = false
+}
+
+// begin checks that the command can be run and injects any faults.
+func (b *SimulatedBootloader) begin() error {
+	if !b.connected {
+		return fmt.Errorf("not connected")
+	}
+	if b.Faults.Rand == nil {
+		b.Faults.Rand = rand.New(rand.NewSource(1))
+	}
+	if b.Faults.NAK > 0 && b.Faults.Rand.Float64() < b.Faults.NAK {
+		return &ResponseError{Code: 0}
+	}
+	if b.Faults.Truncate > 0 && b.Faults.Rand.Float64() < b.Faults.Truncate {
+		return &TimeoutError{Expected: 1}
+	}
+	return nil
+}
+
+func (b *SimulatedBootloader) inFlash(address uint32, length int) bool {
+	for _, r := range b.Device.Flash {
+		if inRange(r, address, length) {
+			return true
+		}
+	}
+	return false
+}
+
+// inRange returns true if length bytes starting at address lie within the range.
+func inRange(r AddressRange, address uint32, length int) bool {
+	return r.Contains(Address(address)) && (length == 0 || r.Contains(Address(address+uint32(length)-1)))
+}
+
+func addressError() error {
+	return &ResponseError{Code: ResultAddressError}
+}
+
+func (b *SimulatedBootloader) read(memory map[uint32]byte, address uint32, length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		v, ok := memory[address+uint32(i)]
+		if !ok {
+			v = erasedValue
+		}
+		data[i] = v
+	}
+	return data
+}
+
+// program clears the bits of memory that are clear in data, as programming flash does.
+func (b *SimulatedBootloader) program(memory map[uint32]byte, address uint32, data []byte) {
+	for i, v := range data {
+		old, ok := memory[address+uint32(i)]
+		if !ok {
+			old = erasedValue
+		}
+		memory[address+uint32(i)] = old & v
+	}
+}
+
+func (b *SimulatedBootloader) GetVersion() (VersionInfo, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return VersionInfo{}, err
+	}
+	return b.Device.Info, nil
+}
+
+func (b *SimulatedBootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return nil, err
+	}
+	if !b.inFlash(address, int(length)) {
+		return nil, fmt.Errorf("read flash failed: %w", addressError())
+	}
+	return b.read(b.flash, address, int(length)), nil
+}
+
+func (b *SimulatedBootloader) WriteFlash(address uint32, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return err
+	}
+	if !b.inFlash(address, len(data)) || !Address(address).RowAligned(b.Device.Info.WriteRowSize) {
+		return fmt.Errorf("write flash failed: %w", addressError())
+	}
+	if max := b.Device.Info.MaxPacketSize; max > 0 && commandHeaderSize+len(data) > max {
+		return fmt.Errorf("write flash failed: %v bytes exceeds the maximum packet size", len(data))
+	}
+	b.program(b.flash, address, data)
+	return nil
+}
+
+func (b *SimulatedBootloader) EraseFlash(address uint32, numRows uint16) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return err
+	}
+	length := int(numRows) * b.Device.Info.EraseRowSize
+	if !b.inFlash(address, length) || !Address(address).RowAligned(b.Device.Info.EraseRowSize) {
+		return fmt.Errorf("erase flash failed: %w", addressError())
+	}
+	for i := 0; i < length; i++ {
+		delete(b.flash, address+uint32(i))
+	}
+	return nil
+}
+
+func (b *SimulatedBootloader) ReadEE(address uint32, length uint16) ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return nil, err
+	}
+	if !inRange(b.Device.EEPROM, address, int(length)) {
+		return nil, fmt.Errorf("read eeprom failed: %w", addressError())
+	}
+	return b.read(b.eeprom, address, int(length)), nil
+}
+
+func (b *SimulatedBootloader) WriteEE(address uint32, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return err
+	}
+	if !inRange(b.Device.EEPROM, address, len(data)) {
+		return fmt.Errorf("write eeprom failed: %w", addressError())
+	}
+	// EEPROM bytes are erased automatically before being written
+	for i, v := range data {
+		b.eeprom[address+uint32(i)] = v
+	}
+	return nil
+}
+
+func (b *SimulatedBootloader) ReadConfig(address uint32, length uint16) ([]byte, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return nil, err
+	}
+	if !inRange(b.Device.Config, address, int(length)) {
+		return nil, fmt.Errorf("read config failed: %w", addressError())
+	}
+	return b.read(b.config, address, int(length)), nil
+}
+
+func (b *SimulatedBootloader) WriteConfig(address uint32, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return err
+	}
+	if !inRange(b.Device.Config, address, len(data)) {
+		return fmt.Errorf("write config failed: %w", addressError())
+	}
+	for i, v := range data {
+		b.config[address+uint32(i)] = v
+	}
+	return nil
+}
+
+func (b *SimulatedBootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return 0, err
+	}
+	if !b.inFlash(address, int(length)) {
+		return 0, fmt.Errorf("calculate checksum failed: %w", addressError())
+	}
+	data := b.read(b.flash, address, int(length))
+	var sum uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint16(data[i]) + (uint16(data[i+1]) << 8)
+	}
+	return sum, nil
+}
+
+func (b *SimulatedBootloader) Reset() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.begin(); err != nil {
+		return err
+	}
+	b.resets++
+	return nil
+}
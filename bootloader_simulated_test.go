@@ -0,0 +1,962 @@
+package microchipboot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/marcinbor85/gohex"
+)
+
+func newSimulatedPIC18() *SimulatedBootloader {
+	return NewSimulatedBootloader(SimulatedDevice{
+		Info:   VersionInfo{MaxPacketSize: 128, EraseRowSize: 64, WriteRowSize: 64},
+		Flash:  []AddressRange{{Start: 0, End: 0x8000}},
+		EEPROM: AddressRange{Start: 0, End: 0x100},
+		Config: AddressRange{Start: 0x300000, End: 0x30000E},
+	})
+}
+
+// simulatedImage returns a hex image containing flash, config and EEPROM data.
+func simulatedImage(t *testing.T) string {
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x800, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16})
+	mem.AddBinary(0x886, []byte{0x11, 0x22, 0x33, 0x44})
+	mem.AddBinary(0x300000, []byte{0x12})
+	mem.AddBinary(0xF00000, []byte{0xAA, 0x55})
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestProgramSimulatedDevice(t *testing.T) {
+	for _, verifyByReading := range []bool{true, false} {
+		sim := newSimulatedPIC18()
+		prog := NewPIC8Programmer(sim, PIC8Profile{
+			Family:           FamilyPIC18,
+			BootloaderOffset: 0x800,
+			FlashSize:        0x8000,
+			EEPROMSize:       0x100,
+			ConfigSize:       14,
+		}, PIC8Options{ProgramEEPROM: true, ProgramConfig: true, VerifyByReading: verifyByReading})
+
+		if err := prog.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.Program(); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.Verify(); err != nil {
+			t.Errorf("verify by reading %v: %v", verifyByReading, err)
+		}
+		if got := sim.Memory(0x880, 6); !bytes.Equal(got, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) {
+			t.Errorf("gap not erased: %X", got)
+		}
+
+		// Corrupt the device and make sure that verification notices
+		sim.program(sim.flash, 0x804, []byte{0})
+		var mismatch *VerifyMismatchError
+		if err := prog.Verify(); !errors.As(err, &mismatch) {
+			t.Errorf("verify by reading %v: got %v, want VerifyMismatchError", verifyByReading, err)
+		}
+	}
+}
+
+func TestProgramStream(t *testing.T) {
+	profile := PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}
+	for _, verifyByReading := range []bool{true, false} {
+		sim := newSimulatedPIC18()
+		sim.Faults = SimulatedFaults{NAK: 0.1}
+		options := PIC8Options{ProgramEEPROM: true, ProgramConfig: true, VerifyByReading: verifyByReading}
+		prog := NewPIC8Programmer(NewRetryBootloader(sim, RetryPolicy{MaxAttempts: 10}), profile, options)
+		if err := prog.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ProgramStream(prog, strings.NewReader(simulatedImage(t))); err != nil {
+			t.Fatalf("verify by reading %v: %v", verifyByReading, err)
+		}
+
+		// The device should contain the whole image
+		check := NewPIC8Programmer(sim, profile, options)
+		sim.Faults = SimulatedFaults{}
+		if err := check.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyAgainstHex(check, strings.NewReader(simulatedImage(t))); err != nil {
+			t.Errorf("verify by reading %v: %v", verifyByReading, err)
+		}
+		if stats := GetStats(prog); stats.RowsErased != 2 {
+			t.Errorf("erased %v rows, want 2", stats.RowsErased)
+		}
+	}
+
+	// Rows can't be returned to once they have been written
+	image := ":020900000102F2\n:020800000304EF\n:00000001FF\n"
+	prog := NewPIC8Programmer(newSimulatedPIC18(), profile, PIC8Options{})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ProgramStream(prog, strings.NewReader(image)); err == nil || !strings.Contains(err.Error(), "ascending") {
+		t.Errorf("got %v, want an error about the record order", err)
+	}
+}
+
+func TestSimulatedFaults(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Faults = SimulatedFaults{NAK: 0.5, Rand: rand.New(rand.NewSource(1))}
+	sim.Connect()
+
+	var failures int
+	for i := 0; i < 100; i++ {
+		if _, err := sim.ReadFlash(0, 16); err != nil {
+			failures++
+		}
+	}
+	if failures == 0 || failures == 100 {
+		t.Errorf("got %v failures out of 100", failures)
+	}
+
+	retry := NewRetryBootloader(sim, RetryPolicy{MaxAttempts: 20})
+	for i := 0; i < 10; i++ {
+		if _, err := retry.ReadFlash(0, 16); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDumpToHex(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Connect()
+	sim.WriteFlash(0x840, []byte{0xDE, 0xAD})
+	sim.WriteEE(0x10, []byte{0x42})
+
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+	}, PIC8Options{})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := DumpToHex(prog, buf, RegionFlash|RegionEEPROM); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := gohex.NewMemory()
+	if err := mem.ParseIntelHex(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := mem.ToBinary(0x840, 2, 0); !bytes.Equal(got, []byte{0xDE, 0xAD}) {
+		t.Errorf("got flash %X", got)
+	}
+	if got := mem.ToBinary(0xF00010, 1, 0); !bytes.Equal(got, []byte{0x42}) {
+		t.Errorf("got eeprom %X", got)
+	}
+}
+
+func TestSimulatedAddressError(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Connect()
+	_, err := NewRetryBootloader(sim, RetryPolicy{MaxAttempts: 3}).ReadFlash(0x9000, 16)
+	if !errors.Is(err, ErrAddressError) {
+		t.Errorf("got %v, want address error", err)
+	}
+}
+
+func TestNeedsUpdateComparesEveryRegion(t *testing.T) {
+	sim := newSimulatedPIC18()
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}, PIC8Options{ProgramEEPROM: true, ProgramConfig: true})
+
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	if needsUpdate, err := NeedsUpdate(prog); err != nil || !needsUpdate {
+		t.Fatalf("blank device: got %v, %v, want an update", needsUpdate, err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	if needsUpdate, err := NeedsUpdate(prog); err != nil || needsUpdate {
+		t.Fatalf("programmed device: got %v, %v, want no update", needsUpdate, err)
+	}
+
+	// The flash still matches, but the EEPROM doesn't
+	sim.program(sim.eeprom, 0x01, []byte{0})
+	if needsUpdate, err := NeedsUpdate(prog); err != nil || !needsUpdate {
+		t.Errorf("changed eeprom: got %v, %v, want an update", needsUpdate, err)
+	}
+}
+
+func TestExcludedRowsArePreserved(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Connect()
+	sim.WriteFlash(0x880, []byte{0xCA, 0xFE})
+
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}, PIC8Options{
+		EraseAll:      true,
+		ExcludeRanges: []AddressRange{{Start: 0x880, End: 0x882}},
+	})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Verify(); err != nil {
+		t.Error(err)
+	}
+	if got := sim.Memory(0x880, 8); !bytes.Equal(got, []byte{0xCA, 0xFE, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}) {
+		t.Errorf("excluded row was modified: %X", got)
+	}
+}
+
+type recordingSink struct {
+	stages                  []string
+	erases, writes, verifys []RowEvent
+}
+
+func (s *recordingSink) OnStage(stage string)    { s.stages = append(s.stages, stage) }
+func (s *recordingSink) OnErase(event RowEvent)  { s.erases = append(s.erases, event) }
+func (s *recordingSink) OnWrite(event RowEvent)  { s.writes = append(s.writes, event) }
+func (s *recordingSink) OnVerify(event RowEvent) { s.verifys = append(s.verifys, event) }
+
+func TestEventSink(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Faults = SimulatedFaults{NAK: 0.2}
+	prog := NewPIC8Programmer(NewRetryBootloader(sim, RetryPolicy{MaxAttempts: 10}), PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}, PIC8Options{VerifyByReading: true})
+	sink := new(recordingSink)
+	SetEventSink(prog, sink)
+
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{StageErase, StageWrite, StageVerify}; !reflect.DeepEqual(sink.stages, want) {
+		t.Errorf("got stages %v, want %v", sink.stages, want)
+	}
+	if len(sink.erases) == 0 || len(sink.writes) == 0 || len(sink.verifys) == 0 {
+		t.Fatalf("missing events: %+v", sink)
+	}
+	if w := sink.writes[0]; w.Address != 0x800 || w.Length != 64 || w.Err != nil {
+		t.Errorf("unexpected write event %+v", w)
+	}
+	var retries int
+	for _, events := range [][]RowEvent{sink.erases, sink.writes, sink.verifys} {
+		for _, e := range events {
+			retries += e.Retries
+		}
+	}
+	if retries == 0 {
+		t.Error("expected retries to be counted")
+	}
+}
+
+func TestProgramStats(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Faults = SimulatedFaults{NAK: 0.2}
+	prog := NewPIC8Programmer(NewRetryBootloader(sim, RetryPolicy{MaxAttempts: 10}), PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}, PIC8Options{VerifyByReading: true})
+
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := GetPlan(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	var written, erased int
+	for _, step := range plan.Steps {
+		if step.IsErase() {
+			erased += int(step.Rows)
+		} else {
+			written += len(step.Data)
+		}
+	}
+	stats := GetStats(prog)
+	if stats.BytesWritten != written || stats.RowsErased != erased {
+		t.Errorf("got %v bytes written and %v rows erased, want %v and %v", stats.BytesWritten, stats.RowsErased, written, erased)
+	}
+	if stats.BytesVerified == 0 || stats.Retries == 0 {
+		t.Errorf("expected verified bytes and retries to be counted: %+v", stats)
+	}
+	if stats.EraseDuration <= 0 || stats.WriteDuration <= 0 || stats.VerifyDuration <= 0 || stats.Throughput() <= 0 {
+		t.Errorf("expected the time spent in each stage to be measured: %+v", stats)
+	}
+}
+
+func TestFleetProgrammer(t *testing.T) {
+	profile := PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}
+	good, bad := newSimulatedPIC18(), newSimulatedPIC18()
+	bad.Device.Flash = nil
+	fleet := NewFleetProgrammer(func(b Bootloader) Programmer {
+		return NewPIC8Programmer(b, profile, PIC8Options{})
+	}, FleetOptions{Workers: 1, Reset: true})
+
+	results := fleet.Program(context.Background(), []FleetDevice{
+		{Name: "good", Bootloader: good},
+		{Name: "bad", Bootloader: bad},
+	}, []byte(simulatedImage(t)))
+
+	if results[0].Err != nil {
+		t.Errorf("good device failed: %v", results[0].Err)
+	}
+	if good.Resets() != 1 {
+		t.Errorf("good device was not reset")
+	}
+	if failed := results.Failed(); len(failed) != 1 || failed[0].Name != "bad" {
+		t.Errorf("got failed devices %+v, want bad", failed)
+	}
+}
+
+func TestResume(t *testing.T) {
+	sim := newSimulatedPIC18()
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}, PIC8Options{})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend that programming failed while the second row was being written
+	sim.program(sim.flash, 0x886, []byte{0, 0})
+	sink := new(recordingSink)
+	SetEventSink(prog, sink)
+	if err := Resume(prog); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Verify(); err != nil {
+		t.Error(err)
+	}
+	if len(sink.erases) != 1 || sink.erases[0].Address != 0x880 {
+		t.Errorf("got erases %+v, want only the row at 880", sink.erases)
+	}
+	if len(sink.writes) != 1 || sink.writes[0].Address != 0x880 {
+		t.Errorf("got writes %+v, want only the row at 880", sink.writes)
+	}
+}
+
+// corruptingBootloader corrupts the first write to corruptAddress, as a noisy link might.
+type corruptingBootloader struct {
+	Bootloader
+	corruptAddress uint32
+	corrupted      bool
+}
+
+func (b *corruptingBootloader) WriteFlash(address uint32, data []byte) error {
+	if address == b.corruptAddress && !b.corrupted {
+		b.corrupted = true
+		corrupt := make([]byte, len(data))
+		for i := range data {
+			corrupt[i] = data[i] ^ 0x01
+		}
+		data = corrupt
+	}
+	return b.Bootloader.WriteFlash(address, data)
+}
+
+func TestVerifyEachRow(t *testing.T) {
+	for _, verifyByReading := range []bool{true, false} {
+		sim := newSimulatedPIC18()
+		bootloader := &corruptingBootloader{Bootloader: sim, corruptAddress: 0x880}
+		prog := NewPIC8Programmer(bootloader, PIC8Profile{
+			Family:           FamilyPIC18,
+			BootloaderOffset: 0x800,
+			FlashSize:        0x8000,
+		}, PIC8Options{VerifyEachRow: true, VerifyByReading: verifyByReading, IgnoreOutOfRangeSegments: true})
+		if err := prog.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.Program(); err != nil {
+			t.Fatal(err)
+		}
+		if !bootloader.corrupted {
+			t.Fatal("write was not corrupted")
+		}
+		if err := prog.Verify(); err != nil {
+			t.Errorf("verify by reading %v: %v", verifyByReading, err)
+		}
+	}
+}
+
+func TestPreserveEEPROM(t *testing.T) {
+	sim := newSimulatedPIC18()
+	if err := sim.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	settings := []byte{1, 2, 3, 4}
+	if err := sim.WriteEE(0, settings); err != nil {
+		t.Fatal(err)
+	}
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}, PIC8Options{ProgramEEPROM: true, PreserveEEPROM: true})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hex file sets the first two bytes, the rest are preserved
+	got, err := sim.ReadEE(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0xAA, 0x55, 3, 4}; !bytes.Equal(got, want) {
+		t.Errorf("got %X, want %X", got, want)
+	}
+}
+
+func TestConfigMask(t *testing.T) {
+	sim := newSimulatedPIC18()
+	if err := sim.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.WriteConfig(0x300000, []byte{0x5A}); err != nil {
+		t.Fatal(err)
+	}
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}, PIC8Options{
+		ProgramConfig:   true,
+		VerifyByReading: true,
+		ConfigMask:      []ConfigWordMask{{Address: 0x300000, Mask: 0x000F}},
+	})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the low nibble of the hex file's 0x12 is programmed
+	got, err := sim.ReadConfig(0x300000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x52}; !bytes.Equal(got, want) {
+		t.Errorf("got %X, want %X", got, want)
+	}
+}
+
+func TestExpectedDeviceID(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Device.Info.DeviceID = 0x5C00
+	for id, want := range map[int]error{0: nil, 0x5C00: nil, 0x3020: ErrWrongDevice} {
+		prog := NewPIC8Programmer(sim, PIC8Profile{
+			Family:           FamilyPIC18,
+			BootloaderOffset: 0x800,
+			FlashSize:        0x8000,
+			ExpectedDeviceID: id,
+		}, PIC8Options{})
+		if err := prog.Connect(); !errors.Is(err, want) {
+			t.Errorf("expected %04X: got %v, want %v", id, err, want)
+		}
+	}
+}
+
+func TestProgramWithRollback(t *testing.T) {
+	sim := newSimulatedPIC18()
+	profile := PIC8Profile{Family: FamilyPIC18, BootloaderOffset: 0x800, FlashSize: 0x8000}
+	prog := NewPIC8Programmer(sim, profile, PIC8Options{IgnoreOutOfRangeSegments: true})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	old := sim.Memory(0x800, 0x100)
+
+	// The update is corrupted, so the old application is restored
+	prog = NewPIC8Programmer(&corruptingBootloader{Bootloader: sim, corruptAddress: 0x800}, profile, PIC8Options{})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x800, bytes.Repeat([]byte{0x42}, 0x40))
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(buf); err != nil {
+		t.Fatal(err)
+	}
+	var mismatch *VerifyMismatchError
+	if err := ProgramWithRollback(prog, ""); !errors.Is(err, ErrRolledBack) || !errors.As(err, &mismatch) {
+		t.Fatalf("got %v, want ErrRolledBack", err)
+	}
+	if got := sim.Memory(0x800, 0x100); !bytes.Equal(got, old) {
+		t.Errorf("got %X, want %X", got, old)
+	}
+}
+
+func TestImageDigestFooter(t *testing.T) {
+	sim := newSimulatedPIC18()
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+		ConfigSize:       14,
+	}, PIC8Options{Digest: ImageDigest{Algorithm: DigestCRC32, FooterAddress: 0x7FFC}})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := GetImageDigest(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := calculateDigest(DigestCRC32, sim.Memory(0x800, 0x7FFC-0x800))
+	if !bytes.Equal(digest, want) {
+		t.Errorf("got digest %X, want %X", digest, want)
+	}
+	if got := sim.Memory(0x7FFC, 4); !bytes.Equal(got, want) {
+		t.Errorf("got footer %X, want %X", got, want)
+	}
+}
+
+func TestSharedBootloader(t *testing.T) {
+	shared := NewSharedBootloader(newSimulatedPIC18())
+	if err := shared.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	session, err := shared.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shared.GetVersion(); !errors.Is(err, ErrBootloaderBusy) {
+		t.Errorf("got %v, want ErrBootloaderBusy", err)
+	}
+	if _, err := shared.TryAcquire(); !errors.Is(err, ErrBootloaderBusy) {
+		t.Errorf("got %v, want ErrBootloaderBusy", err)
+	}
+	if _, err := session.GetVersion(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent users of the shared bootloader wait for each other
+	done := make(chan error)
+	go func() {
+		next, err := shared.Acquire(context.Background())
+		if err == nil {
+			_, err = next.ReadFlash(0, 16)
+			next.Release()
+		}
+		done <- err
+	}()
+	session.Release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.GetVersion(); !errors.Is(err, ErrSessionReleased) {
+		t.Errorf("got %v, want ErrSessionReleased", err)
+	}
+	if _, err := shared.GetVersion(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEraseRange(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Connect()
+	data := make([]byte, 64)
+	for address := uint32(0x740); address < 0x8C0; address += 64 {
+		if err := sim.WriteFlash(address, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	erased, err := EraseRange(sim, 0x7A0, 0x850)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (AddressRange{Start: 0x780, End: 0x880}); erased != want {
+		t.Errorf("erased %X-%X, want %X-%X", erased.Start, erased.End, want.Start, want.End)
+	}
+	if !bytes.Equal(sim.Memory(0x780, 0x100), bytes.Repeat([]byte{0xFF}, 0x100)) {
+		t.Errorf("range not erased")
+	}
+	if !bytes.Equal(sim.Memory(0x740, 64), data) || !bytes.Equal(sim.Memory(0x880, 64), data) {
+		t.Errorf("rows outside the range were erased")
+	}
+
+	if _, err := EraseRange(sim, 0x800, 0x800); err == nil {
+		t.Errorf("empty range accepted")
+	}
+}
+
+func TestBlankCheck(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Connect()
+	profile := PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+	}
+
+	for _, byReading := range []bool{false, true} {
+		prog := NewPIC8Programmer(sim, profile, PIC8Options{VerifyByReading: byReading})
+		if err := prog.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		results, err := BlankCheck(prog, RegionFlash|RegionEEPROM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || !results[0].Blank() || !results[1].Blank() {
+			t.Errorf("by reading %v: erased device not blank: %+v", byReading, results)
+		}
+	}
+
+	sim.WriteFlash(0x2340, []byte{0xFF, 0xFF, 0x00, 0xFF})
+	sim.WriteEE(0x10, []byte{0x42})
+	for _, byReading := range []bool{false, true} {
+		prog := NewPIC8Programmer(sim, profile, PIC8Options{VerifyByReading: byReading})
+		if err := prog.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		results, err := BlankCheck(prog, RegionFlash|RegionEEPROM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 {
+			t.Fatalf("got %v results", len(results))
+		}
+		if got := results[0].NonBlank; len(got) != 1 || got[0] != 0x2342 {
+			t.Errorf("by reading %v: got non-blank flash %X", byReading, got)
+		}
+		if got := results[1].NonBlank; len(got) != 1 || got[0] != 0xF00010 {
+			t.Errorf("by reading %v: got non-blank eeprom %X", byReading, got)
+		}
+	}
+}
+
+func TestBlankCheckListsFirstAddresses(t *testing.T) {
+	sim := newSimulatedPIC18()
+	sim.Connect()
+	sim.WriteFlash(0x1000, make([]byte, 64))
+	profile := PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+	}
+
+	for _, byReading := range []bool{false, true} {
+		prog := NewPIC8Programmer(sim, profile, PIC8Options{VerifyByReading: byReading})
+		if err := prog.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		results, err := BlankCheck(prog, RegionAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The pic18 family's config region is blank
+		if len(results) != 2 || results[0].Region != RegionFlash || !results[1].Blank() {
+			t.Fatalf("by reading %v: got results %+v", byReading, results)
+		}
+		got := results[0].NonBlank
+		if len(got) != maxNonBlankAddresses || got[0] != 0x1000 || got[len(got)-1] != 0x100F {
+			t.Errorf("by reading %v: got non-blank flash %X", byReading, got)
+		}
+	}
+}
+
+func TestBlankCheckUnsupported(t *testing.T) {
+	var prog struct{ Programmer }
+	if _, err := BlankCheck(prog, RegionFlash); err == nil {
+		t.Errorf("unsupported programmer accepted")
+	}
+}
+
+func TestOptionalFeaturesUnsupported(t *testing.T) {
+	var prog struct{ Programmer }
+	if err := Resume(prog); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("got %v resuming an unsupported programmer", err)
+	}
+	if _, err := ReadRange(prog, RegionFlash, 0, 1); err == nil {
+		t.Errorf("unsupported programmer read memory")
+	}
+	if report := GetVerifyReport(prog); report != nil {
+		t.Errorf("got report %+v from an unsupported programmer", report)
+	}
+	SetProgressHandler(prog, func(string, int, int) {})
+}
+
+func TestLoadEEPROMHex(t *testing.T) {
+	sim := newSimulatedPIC18()
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+	}, PIC8Options{ProgramEEPROM: true, IgnoreOutOfRangeSegments: true})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The EEPROM file uses offsets from the start of EEPROM
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x10, []byte{0x12, 0x34})
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadEEPROMHex(prog, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := sim.ReadEE(0, 0x12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != 0xFF || got[0x10] != 0x12 || got[0x11] != 0x34 {
+		t.Errorf("got eeprom %X", got)
+	}
+
+	mem = gohex.NewMemory()
+	mem.AddBinary(0x200, []byte{0x12})
+	buf.Reset()
+	mem.DumpIntelHex(buf, 16)
+	if err := LoadEEPROMHex(prog, buf); err == nil {
+		t.Errorf("out of range eeprom segment accepted")
+	}
+}
+
+func TestSetUserID(t *testing.T) {
+	sim := NewSimulatedBootloader(SimulatedDevice{
+		Info:  VersionInfo{MaxPacketSize: 128, EraseRowSize: 64, WriteRowSize: 64},
+		Flash: []AddressRange{{Start: 0, End: 0x8000}, {Start: 0x200000, End: 0x200040}},
+	})
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		IDOffset:         0x200000,
+		IDSize:           8,
+	}, PIC8Options{ProgramID: true, VerifyByReading: true})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserID(prog, []byte("SN0042")); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sim.Memory(0x200000, 8), []byte("SN0042\xFF\xFF"); !bytes.Equal(got, want) {
+		t.Errorf("got id %X, want %X", got, want)
+	}
+	if err := SetUserID(prog, []byte("too long!")); err == nil {
+		t.Errorf("user id longer than the id region accepted")
+	}
+}
+
+func TestSerializer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	counterFile := filepath.Join(dir, "counter")
+	recordFile := filepath.Join(dir, "record.csv")
+
+	serializer, err := NewSerializer(SerialTemplate{
+		Address: 0x7FF0,
+		Length:  8,
+		Format:  SerialString,
+		Prefix:  "SN",
+		Start:   41,
+	}, counterFile, recordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim := newSimulatedPIC18()
+	prog := NewPIC8Programmer(sim, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+	}, PIC8Options{VerifyByReading: true, IgnoreOutOfRangeSegments: true})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"SN000041", "SN000042"} {
+		if err := prog.LoadHex(strings.NewReader(simulatedImage(t))); err != nil {
+			t.Fatal(err)
+		}
+		serial, err := serializer.Apply(prog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.Value != want {
+			t.Errorf("got serial number %v, want %v", serial.Value, want)
+		}
+		if err := prog.Program(); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if got := sim.Memory(0x7FF0, 8); string(got) != want {
+			t.Errorf("got flash %q, want %q", got, want)
+		}
+		if got := sim.Memory(0x800, 2); !bytes.Equal(got, []byte{1, 2}) {
+			t.Errorf("image not programmed, got %X", got)
+		}
+		if err := serializer.Record(serial); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if counter, _ := ioutil.ReadFile(counterFile); string(counter) != "43\n" {
+		t.Errorf("got counter file %q", counter)
+	}
+	record, err := ioutil.ReadFile(recordFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(record)), "\n"); len(lines) != 2 || !strings.Contains(lines[1], ",SN000042,") {
+		t.Errorf("got record %q", record)
+	}
+
+	if _, err := NewSerializer(SerialTemplate{Length: 4, Source: SerialSourceUUID}, "", ""); err == nil {
+		t.Errorf("uuid with the uint format accepted")
+	}
+	uuids, err := NewSerializer(SerialTemplate{Length: 16, Format: SerialHex, Source: SerialSourceUUID}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := uuids.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serial.Data) != 16 || len(serial.Value) != 36 || serial.Data[6]>>4 != 4 {
+		t.Errorf("got uuid %v %X", serial.Value, serial.Data)
+	}
+}
@@ -0,0 +1,169 @@
+package microchipboot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// SPI transport defaults.
+const (
+	defaultSPISpeed        = 1000000
+	defaultSPIPollInterval = time.Millisecond
+	defaultSPITimeout      = time.Second
+)
+
+// SPIConfig configures the SPI transport. Zero values are replaced with defaults.
+type SPIConfig struct {
+	// Path of the spidev device, e.g. /dev/spidev0.0.
+	Device string
+	// Clock frequency in Hz. Defaults to 1MHz.
+	Speed uint32
+	// SPI mode, from 0 to 3, selecting the clock polarity and phase.
+	Mode uint8
+	// The host must wait for the device before reading its echo of each command and its
+	// result code. By default, single bytes are clocked in until the device sends
+	// something other than BusyByte, which is then taken as the first byte of the
+	// response. BusyByte defaults to 0x00. It can't be the sync byte or a result code,
+	// as the device couldn't then start its echo or report that result.
+	BusyByte byte
+	// If set, the host instead waits for a ready line driven high by the device when it
+	// has a response to send. This is the value file of a sysfs GPIO, e.g.
+	// /sys/class/gpio/gpio17/value.
+	ReadyPin string
+	// Time between polls of the device or ready line. Defaults to 1ms.
+	PollInterval time.Duration
+	// Maximum time to wait for the device to become ready. Defaults to 1 second.
+	Timeout time.Duration
+}
+
+type spiBootloader struct {
+	streamBootloader
+	config SPIConfig
+	file   *os.File
+	// Byte received while polling for the device to be ready, which is the first byte of
+	// its response
+	pending []byte
+}
+
+// NewSPIBootloader creates a new bootloader that communicates with a device wired as an
+// SPI slave, using the Linux spidev interface. The framing is the same as for the serial
+// transport: each command is written to the device and the response is then clocked in
+// once the device is ready. This is only supported on Linux.
+func NewSPIBootloader(config SPIConfig) (Bootloader, error) {
+	if config.Device == "" {
+		return nil, fmt.Errorf("no SPI device given")
+	}
+	if config.Mode > 3 {
+		return nil, fmt.Errorf("invalid SPI mode %v, must be from 0 to 3", config.Mode)
+	}
+	if config.Speed == 0 {
+		config.Speed = defaultSPISpeed
+	}
+	switch config.BusyByte {
+	case syncByte, ResultSuccess, ResultUnsupported, ResultAddressError:
+		return nil, fmt.Errorf("invalid busy byte %02X, it can't be the sync byte or a result code", config.BusyByte)
+	}
+	if config.PollInterval == 0 {
+		config.PollInterval = defaultSPIPollInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultSPITimeout
+	}
+	b := &spiBootloader{config: config}
+	b.rw = &spiStream{b}
+	b.waitReady = b.waitForDevice
+	return b, nil
+}
+
+func (b *spiBootloader) Connect() error {
+	b.Disconnect()
+	transportLog.Debugf("opening %v at %v Hz, mode %v", b.config.Device, b.config.Speed, b.config.Mode)
+	file, err := os.OpenFile(b.config.Device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := configureSPI(file, b.config.Mode, b.config.Speed); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to configure %v: %w", b.config.Device, err)
+	}
+	b.file = file
+	b.pending = nil
+	return nil
+}
+
+func (b *spiBootloader) Disconnect() {
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+}
+
+// waitForDevice polls until the device is ready to send its response.
+func (b *spiBootloader) waitForDevice() error {
+	deadline := time.Now().Add(b.config.Timeout)
+	for {
+		ready, err := b.ready()
+		if err != nil || ready {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return &TimeoutError{Expected: 1}
+		}
+		time.Sleep(b.config.PollInterval)
+	}
+}
+
+// ready returns true if the device is ready to send.
+func (b *spiBootloader) ready() (bool, error) {
+	if b.file == nil {
+		return false, fmt.Errorf("not connected")
+	}
+	if b.config.ReadyPin != "" {
+		value, err := ioutil.ReadFile(b.config.ReadyPin)
+		if err != nil {
+			return false, fmt.Errorf("failed to read ready pin: %w", err)
+		}
+		return strings.TrimSpace(string(value)) == "1", nil
+	}
+	if len(b.pending) > 0 {
+		return true, nil
+	}
+	buf := make([]byte, 1)
+	if _, err := b.file.Read(buf); err != nil {
+		return false, err
+	}
+	if buf[0] == b.config.BusyByte {
+		return false, nil
+	}
+	b.pending = buf
+	return true, nil
+}
+
+// spiStream performs each read and write as a single SPI transfer, ignoring the data
+// clocked in while writing.
+type spiStream struct {
+	b *spiBootloader
+}
+
+func (s *spiStream) Read(p []byte) (int, error) {
+	if s.b.file == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	n := copy(p, s.b.pending)
+	s.b.pending = s.b.pending[n:]
+	if n == len(p) {
+		return n, nil
+	}
+	m, err := s.b.file.Read(p[n:])
+	return n + m, err
+}
+
+func (s *spiStream) Write(p []byte) (int, error) {
+	if s.b.file == nil {
+		return 0, fmt.Errorf("not connected")
+	}
+	return s.b.file.Write(p)
+}
@@ -0,0 +1,32 @@
+package microchipboot
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// spidev ioctl requests.
+const (
+	spiIOCWrMode        = 0x40016B01
+	spiIOCWrMaxSpeedHz  = 0x40046B04
+	spiIOCWrBitsPerWord = 0x40016B03
+)
+
+func configureSPI(file *os.File, mode uint8, speed uint32) error {
+	bits := uint8(8)
+	for _, setting := range []struct {
+		request uintptr
+		value   unsafe.Pointer
+	}{
+		{spiIOCWrMode, unsafe.Pointer(&mode)},
+		{spiIOCWrBitsPerWord, unsafe.Pointer(&bits)},
+		{spiIOCWrMaxSpeedHz, unsafe.Pointer(&speed)},
+	} {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), setting.request, uintptr(setting.value))
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package microchipboot
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// fakeSPIDevice returns a spidev stand-in, as the host's end of a socket pair, and the
+// device's end.
+func fakeSPIDevice(t *testing.T) (*os.File, *os.File) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.NewFile(uintptr(fds[0]), "spidev"), os.NewFile(uintptr(fds[1]), "device")
+}
+
+func TestSPIUnsupportedResult(t *testing.T) {
+	host, device := fakeSPIDevice(t)
+	defer host.Close()
+	defer device.Close()
+
+	b, err := NewSPIBootloader(SPIConfig{Device: "spidev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.(*spiBootloader).file = host
+
+	go func() {
+		// The device is busy before its echo and before answering unsupported, which
+		// must not be mistaken for being busy
+		cmd := make([]byte, 64)
+		n, _ := device.Read(cmd)
+		echo := cmd[:n-4]
+		resp := append(append([]byte{0, 0, 0}, echo...), 0, 0, ResultUnsupported)
+		device.Write(resp)
+	}()
+
+	if err := b.WriteFlash(0, []byte{1, 2, 3, 4}); !errors.Is(err, ErrUnsupportedCommand) {
+		t.Errorf("got %v, want %v", err, ErrUnsupportedCommand)
+	}
+}
+
+func TestSPIBusyByteConflicts(t *testing.T) {
+	for _, busy := range []byte{syncByte, ResultSuccess, ResultUnsupported, ResultAddressError} {
+		if _, err := NewSPIBootloader(SPIConfig{Device: "spidev", BusyByte: busy}); err == nil {
+			t.Errorf("busy byte %02X was accepted", busy)
+		}
+	}
+}
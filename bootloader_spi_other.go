@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package microchipboot
+
+import (
+	"errors"
+	"os"
+)
+
+func configureSPI(file *os.File, mode uint8, speed uint32) error {
+	return errors.New("SPI is only supported on Linux")
+}
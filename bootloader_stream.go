@@ -0,0 +1,445 @@
+package microchipboot
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Default time that the receive buffer must be quiet for before a resync sends its ping.
+const defaultResyncQuietPeriod = 50 * time.Millisecond
+
+// Maximum time spent draining the receive buffer during a resync.
+const maxResyncDrain = 2 * time.Second
+
+// ResyncPolicy controls how byte stream transports recover from an echo mismatch, which
+// usually means that noise or dropped bytes have put the host and the device out of step.
+// When resynchronizing, the receive buffer is drained until it has been quiet for a
+// while, a GetVersion command is sent to check that the device is responding again and
+// the failed command is sent again.
+type ResyncPolicy struct {
+	// Number of times a command is resynchronized and sent again after an echo
+	// mismatch. Resynchronization is disabled if this is zero.
+	Attempts int
+	// Time that the receive buffer must be quiet for before it is considered drained.
+	// Defaults to 50ms.
+	QuietPeriod time.Duration
+}
+
+// streamBootloader implements the bootloader protocol over a byte stream. Transports
+// embed it and set rw once the connection has been opened.
+type streamBootloader struct {
+	rw io.ReadWriter
+	// Time of the last traced frame
+	lastFrame time.Time
+	// If set, called with the result of every command
+	onResult func(error)
+	// If set, returns the time allowed for a command to complete. Reads that time out
+	// are then retried until this has elapsed.
+	commandTimeout func(Command) time.Duration
+	// Time by which the current command must complete, if any
+	deadline time.Time
+	// If non-zero, a response that stops arriving for longer than this part way through
+	// fails straight away rather than waiting for the rest of the command's time
+	interByteTimeout time.Duration
+	// If set, every frame is recorded here
+	traceWriter *traceWriter
+	// Maximum number of write commands in flight. Pipelining is disabled if this is
+	// less than 2.
+	pipelineDepth int
+	// Commands that have been sent but whose responses haven't been received yet
+	pending []pendingCommand
+	// Set once a pipelined command has failed, after which commands are sent synchronously
+	pipelineFailed bool
+	// Differences in the protocol of the bootloader firmware, as set by the user
+	protocol ProtocolOptions
+	// Protocol variant detected from the firmware version
+	detectedVariant string
+	// Protocol options in use, combining the above
+	activeProtocol ProtocolOptions
+	// How to recover from echo mismatches
+	resync ResyncPolicy
+	// If set, called before receiving the echo and the result code of each command, for
+	// transports where the host must wait until the device is ready to send
+	waitReady func() error
+	// If set, the command in progress fails with this error at its next read
+	interruptMu  sync.Mutex
+	interruptErr error
+}
+
+// interrupt makes the command in progress, and any that follow, fail with err the next
+// time that they read from the device, which is at least once per read timeout. Unlike
+// the other methods, it can be called from any goroutine. Pass nil to clear it.
+func (b *streamBootloader) interrupt(err error) {
+	b.interruptMu.Lock()
+	defer b.interruptMu.Unlock()
+	b.interruptErr = err
+}
+
+func (b *streamBootloader) interrupted() error {
+	b.interruptMu.Lock()
+	defer b.interruptMu.Unlock()
+	return b.interruptErr
+}
+
+func (b *streamBootloader) protocolOptions() ProtocolOptions {
+	return b.protocol
+}
+
+func (b *streamBootloader) setProtocolOptions(options ProtocolOptions) error {
+	if err := validateProtocolVariant(options.Variant); err != nil {
+		return err
+	}
+	b.protocol = options
+	b.activeProtocol = options.resolve(b.detectedVariant)
+	return nil
+}
+
+// detectProtocol selects the protocol variant for the firmware version, unless the
+// variant has been set explicitly.
+func (b *streamBootloader) detectProtocol(info VersionInfo) {
+	b.detectedVariant = detectProtocolVariant(info)
+	active := b.protocol.resolve(b.detectedVariant)
+	if active.Variant != b.activeProtocol.Variant {
+		protocolLog.Debugf("using protocol %v for firmware version %v.%v", active.Variant, info.VersionMajor, info.VersionMinor)
+	}
+	b.activeProtocol = active
+}
+
+func (b *streamBootloader) setTraceWriter(w io.Writer, format TraceFormat) error {
+	if w == nil {
+		b.traceWriter = nil
+		return nil
+	}
+	t, err := newTraceWriter(w, format)
+	if err != nil {
+		return err
+	}
+	b.traceWriter = t
+	return nil
+}
+
+// trace records a frame if a trace writer has been set, and logs it along with the time
+// elapsed since the previous frame.
+func (b *streamBootloader) trace(direction string, data []byte) {
+	if b.traceWriter != nil {
+		b.traceWriter.write(direction, data)
+	}
+	if !traceEnabled {
+		return
+	}
+	now := time.Now()
+	var elapsed time.Duration
+	if !b.lastFrame.IsZero() {
+		elapsed = now.Sub(b.lastFrame)
+	}
+	b.lastFrame = now
+	transportLog.Tracef("%v %v bytes (+%v):\n%v", direction, len(data), elapsed, hex.Dump(data))
+}
+
+func (b *streamBootloader) recv(count int) ([]byte, error) {
+	resp := make([]byte, 0, count)
+	expected := count
+	var lastData time.Time
+	for count > 0 {
+		if err := b.interrupted(); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, count)
+		n, err := b.rw.Read(buf)
+		if n > 0 {
+			lastData = time.Now()
+		}
+		if err != nil {
+			stalled := b.interByteTimeout > 0 && !lastData.IsZero() && time.Since(lastData) >= b.interByteTimeout
+			if isTimeout(err) && time.Now().Before(b.deadline) && !stalled {
+				// The command is allowed longer than the port's read timeout
+				resp = append(resp, buf[:n]...)
+				count -= n
+				continue
+			}
+			if isTimeout(err) {
+				if len(resp)+n > 0 {
+					b.trace(TraceRX, append(resp, buf[:n]...))
+				}
+				return nil, &TimeoutError{Expected: expected, Received: len(resp) + n}
+			}
+			return nil, err
+		}
+		resp = append(resp, buf[:n]...)
+		count -= n
+	}
+	b.trace(TraceRX, resp)
+	return resp, nil
+}
+
+func (b *streamBootloader) send(cmd Command) ([]byte, error) {
+	cmd = b.activeProtocol.apply(cmd)
+	if b.pipelining() && isWriteCommand(cmd) {
+		return nil, b.sendPipelined(cmd)
+	}
+	if err := b.drainPipeline(); err != nil {
+		return nil, err
+	}
+	resp, err := b.exchange(cmd)
+	for attempt := 1; errors.Is(err, ErrEchoMismatch) && attempt <= b.resync.Attempts; attempt++ {
+		protocolLog.WithFields(commandFields(cmd.Command, cmd.Address, int(cmd.Length))).WithFields(Fields{FieldAttempt: attempt}).
+			Warnf("%v, resynchronizing (attempt %v of %v)", err, attempt, b.resync.Attempts)
+		if resyncErr := b.resynchronize(); resyncErr != nil {
+			err = fmt.Errorf("%v, and failed to resynchronize: %w", err, resyncErr)
+			break
+		}
+		resp, err = b.exchange(cmd)
+	}
+	if b.onResult != nil {
+		b.onResult(err)
+	}
+	return resp, err
+}
+
+// exchange sends a command and receives its response.
+func (b *streamBootloader) exchange(cmd Command) ([]byte, error) {
+	tx, err := b.transmit(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return b.receive(cmd, tx)
+}
+
+// resynchronize discards any data still arriving from the device and checks that it
+// answers a GetVersion command.
+func (b *streamBootloader) resynchronize() error {
+	quiet := b.resync.QuietPeriod
+	if quiet == 0 {
+		quiet = defaultResyncQuietPeriod
+	}
+	start := time.Now()
+	last := start
+	discarded := 0
+	buf := make([]byte, 64)
+	for time.Since(last) < quiet {
+		if time.Since(start) > maxResyncDrain {
+			return fmt.Errorf("device is still sending data after %v", maxResyncDrain)
+		}
+		if err := b.interrupted(); err != nil {
+			return err
+		}
+		n, err := b.rw.Read(buf)
+		if n > 0 {
+			b.trace(TraceRX, buf[:n])
+			discarded += n
+			last = time.Now()
+		}
+		if err != nil && !isTimeout(err) {
+			return err
+		}
+	}
+	if discarded > 0 {
+		protocolLog.Debugf("discarded %v bytes", discarded)
+	}
+	if _, err := b.exchange(b.activeProtocol.apply(NewGetVersionCommand())); err != nil {
+		return fmt.Errorf("device didn't respond to ping: %w", err)
+	}
+	return nil
+}
+
+// transmit sends a command and returns the frame that was sent.
+func (b *streamBootloader) transmit(cmd Command) ([]byte, error) {
+	protocolLog.WithFields(commandFields(cmd.Command, cmd.Address, int(cmd.Length))).
+		Tracef("sending command")
+	tx := append([]byte{syncByte}, cmd.GetBytes()...)
+	if b.activeProtocol.CRC {
+		crc := crc16(tx[1:])
+		tx = append(tx, byte(crc), byte(crc>>8))
+	}
+	b.trace(TraceTX, tx)
+	if _, err := b.rw.Write(tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// receive receives the response to a command that was sent as the frame tx.
+func (b *streamBootloader) receive(cmd Command, tx []byte) ([]byte, error) {
+	b.deadline = time.Time{}
+	if b.commandTimeout != nil {
+		b.deadline = time.Now().Add(b.commandTimeout(cmd))
+	}
+	// Wait for the echoed command
+	echoLen := len(tx) - len(cmd.Data)
+	if b.activeProtocol.CRC {
+		echoLen -= crcLength
+	}
+	if err := b.ready(); err != nil {
+		return nil, err
+	}
+	echo, err := b.recv(echoLen)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check that the echoed data matches the sent data
+	for i := 0; i < echoLen; i++ {
+		if i != 4 && i != 5 && tx[i] != echo[i] {
+			return nil, fmt.Errorf("%w at position %v", ErrEchoMismatch, i)
+		}
+	}
+
+	// Now receive the actual response. Everything after the sync byte is covered by the
+	// response's CRC.
+	received := echo[1:]
+	if cmd.ExpectsSuccessCode() {
+		if err := b.ready(); err != nil {
+			return nil, err
+		}
+		code, err := b.recv(1 + b.activeProtocol.ExtraStatusBytes)
+		if err != nil {
+			return nil, err
+		}
+		protocolLog.WithFields(commandFields(cmd.Command, cmd.Address, int(cmd.Length))).
+			Tracef("command returned code %X", code)
+		received = append(received, code...)
+		if code[0] != ResultSuccess {
+			if err := b.checkCRC(received); err != nil {
+				return nil, err
+			}
+			return nil, &ResponseError{Code: int(code[0])}
+		}
+	}
+	resp := []byte{}
+	if cmd.GetResponseLength() > 0 {
+		resp, err = b.recv(cmd.GetResponseLength())
+		if err != nil {
+			return nil, err
+		}
+		received = append(received, resp...)
+	}
+	if err := b.checkCRC(received); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// ready waits for the device to be ready to send, if the transport needs to.
+func (b *streamBootloader) ready() error {
+	if b.waitReady == nil {
+		return nil
+	}
+	return b.waitReady()
+}
+
+// Length of the CRC appended to commands and responses.
+const crcLength = 2
+
+// checkCRC receives the CRC that ends a response and checks it against the rest of the
+// response, if the protocol uses CRCs.
+func (b *streamBootloader) checkCRC(received []byte) error {
+	if !b.activeProtocol.CRC {
+		return nil
+	}
+	crc, err := b.recv(crcLength)
+	if err != nil {
+		return err
+	}
+	expected := crc16(received)
+	if actual := uint16(crc[0]) | uint16(crc[1])<<8; actual != expected {
+		return fmt.Errorf("%w: response CRC is %04X, expected %04X", ErrCRCMismatch, actual, expected)
+	}
+	return nil
+}
+
+func (b *streamBootloader) GetVersion() (VersionInfo, error) {
+	resp, err := b.send(NewGetVersionCommand())
+	if err != nil {
+		return VersionInfo{}, err
+	}
+
+	info, err := ParseGetVersionResponse(resp)
+	if err != nil {
+		return VersionInfo{}, fmt.Errorf("failed to parse GetVersion response: %w", err)
+	}
+	b.detectProtocol(info)
+	return info, nil
+}
+
+func (b *streamBootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	resp, err := b.send(NewReadFlashCommand(address, length))
+	if err != nil {
+		return nil, fmt.Errorf("read flash failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (b *streamBootloader) WriteFlash(address uint32, data []byte) error {
+	_, err := b.send(NewWriteFlashCommand(address, data))
+	if err != nil {
+		return fmt.Errorf("write flash failed: %w", err)
+	}
+	return nil
+}
+
+func (b *streamBootloader) EraseFlash(address uint32, numRows uint16) error {
+	_, err := b.send(NewEraseFlashCommand(address, numRows))
+	if err != nil {
+		return fmt.Errorf("erase flash failed: %w", err)
+	}
+	return nil
+}
+
+func (b *streamBootloader) ReadEE(address uint32, length uint16) ([]byte, error) {
+	resp, err := b.send(NewReadEECommand(address, length))
+	if err != nil {
+		return nil, fmt.Errorf("read eeprom failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (b *streamBootloader) WriteEE(address uint32, data []byte) error {
+	_, err := b.send(NewWriteEECommand(address, data))
+	if err != nil {
+		return fmt.Errorf("write eeprom failed: %w", err)
+	}
+	return nil
+}
+
+func (b *streamBootloader) ReadConfig(address uint32, length uint16) ([]byte, error) {
+	resp, err := b.send(NewReadConfigCommand(address, length))
+	if err != nil {
+		return nil, fmt.Errorf("read config failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (b *streamBootloader) WriteConfig(address uint32, data []byte) error {
+	_, err := b.send(NewWriteConfigCommand(address, data))
+	if err != nil {
+		return fmt.Errorf("write config failed: %w", err)
+	}
+	return nil
+}
+
+func (b *streamBootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	resp, err := b.send(NewCalculateChecksumCommand(address, length))
+	if err != nil {
+		return 0, fmt.Errorf("calculate checksum failed: %w", err)
+	}
+	checksum := uint16(resp[0]) + 256*uint16(resp[1])
+	return checksum, nil
+}
+
+func (b *streamBootloader) Reset() error {
+	_, err := b.send(NewResetCommand())
+	if err != nil {
+		return fmt.Errorf("reset failed: %w", err)
+	}
+	return nil
+}
+
+// SendCommand sends an arbitrary command and returns its response.
+func (b *streamBootloader) SendCommand(cmd Command) ([]byte, error) {
+	return b.send(cmd)
+}
@@ -0,0 +1,246 @@
+package microchipboot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeWriteDevice answers write commands written to it, failing the commands listed in
+// fail the first time that they are sent.
+type fakeWriteDevice struct {
+	rx     bytes.Buffer
+	writes []uint32
+	fail   map[uint32]bool
+}
+
+func (d *fakeWriteDevice) Read(p []byte) (int, error) {
+	return d.rx.Read(p)
+}
+
+func (d *fakeWriteDevice) Write(p []byte) (int, error) {
+	const headerLen = 10
+	address := uint32(p[6]) | uint32(p[7])<<8 | uint32(p[8])<<16 | uint32(p[9])<<24
+	d.rx.Write(p[:headerLen])
+	if d.fail[address] {
+		delete(d.fail, address)
+		d.rx.WriteByte(ResultAddressError)
+		return len(p), nil
+	}
+	d.writes = append(d.writes, address)
+	d.rx.WriteByte(ResultSuccess)
+	return len(p), nil
+}
+
+func TestPipelinedWrites(t *testing.T) {
+	device := &fakeWriteDevice{fail: map[uint32]bool{0x40: true}}
+	b := &streamBootloader{rw: device, pipelineDepth: 3}
+
+	for _, address := range []uint32{0, 0x40, 0x80, 0xC0} {
+		if err := b.WriteFlash(address, make([]byte, 64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.drainPipeline(); err != nil {
+		t.Fatal(err)
+	}
+	// The commands in flight when the write at 40 failed are all sent again
+	if want := []uint32{0, 0x80, 0xC0, 0x40, 0x80, 0xC0}; !reflect.DeepEqual(device.writes, want) {
+		t.Errorf("got writes %X, want %X", device.writes, want)
+	}
+	if !b.pipelineFailed {
+		t.Error("pipelining wasn't disabled after the failure")
+	}
+}
+
+func TestReadSuccessCodes(t *testing.T) {
+	device := &fakeWriteDevice{fail: map[uint32]bool{0x40: true}}
+	b := &streamBootloader{rw: device}
+	b.setProtocolOptions(ProtocolOptions{ReadSuccessCodes: true})
+
+	if _, err := b.ReadFlash(0x40, 4); !errors.Is(err, ErrAddressError) {
+		t.Errorf("got %v, want an address error", err)
+	}
+}
+
+func TestProtocolVariant(t *testing.T) {
+	v2 := VersionInfo{VersionMajor: 2}
+	if got := (ProtocolOptions{}).resolve(detectProtocolVariant(v2)); got.Variant != ProtocolV1 || got.ReadSuccessCodes {
+		t.Errorf("default resolved to %+v", got)
+	}
+	if got := (ProtocolOptions{Variant: ProtocolAuto}).resolve(detectProtocolVariant(v2)); got.Variant != ProtocolV2 || !got.ReadSuccessCodes {
+		t.Errorf("version 2 firmware resolved to %+v", got)
+	}
+	if got := (ProtocolOptions{Variant: ProtocolV1}).resolve(detectProtocolVariant(v2)); got.Variant != ProtocolV1 || got.ReadSuccessCodes {
+		t.Errorf("override resolved to %+v", got)
+	}
+	if got := (ProtocolOptions{ReadSuccessCodes: true}).resolve(""); got.Variant != ProtocolV1 || !got.ReadSuccessCodes {
+		t.Errorf("explicit options resolved to %+v", got)
+	}
+}
+
+// writeRecorder records the writes made to it.
+type writeRecorder struct {
+	bytes.Buffer
+	writes [][]byte
+	times  []time.Time
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	w.times = append(w.times, time.Now())
+	return len(p), nil
+}
+
+func TestPacedPort(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	rec := &writeRecorder{}
+	port := &pacedPort{ReadWriter: rec, commandDelay: delay, byteDelay: time.Millisecond}
+	if n, err := port.Write([]byte{1, 2, 3}); n != 3 || err != nil {
+		t.Fatalf("write returned %v, %v", n, err)
+	}
+	if _, err := port.Write([]byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rec.writes, [][]byte{{1}, {2}, {3}, {4}}) {
+		t.Errorf("writes are %v", rec.writes)
+	}
+	if gap := rec.times[3].Sub(rec.times[2]); gap < delay {
+		t.Errorf("commands were %v apart, expected at least %v", gap, delay)
+	}
+}
+
+// noisyDevice answers GetVersion and write commands, corrupting the first echo it sends
+// and following it with stray bytes.
+type noisyDevice struct {
+	rx       bytes.Buffer
+	commands []uint8
+	noisy    bool
+}
+
+func (d *noisyDevice) Read(p []byte) (int, error) {
+	return d.rx.Read(p)
+}
+
+func (d *noisyDevice) Write(p []byte) (int, error) {
+	const headerLen = 10
+	d.commands = append(d.commands, p[1])
+	echo := append([]byte(nil), p[:headerLen]...)
+	if d.noisy {
+		d.noisy = false
+		echo[1] ^= 0xFF
+		echo = append(echo, 0xAA, 0xBB)
+	}
+	d.rx.Write(echo)
+	if p[1] == commandGetVersion {
+		d.rx.Write(make([]byte, respLengthGetVersion))
+	} else {
+		d.rx.WriteByte(ResultSuccess)
+	}
+	return len(p), nil
+}
+
+func TestEchoResync(t *testing.T) {
+	device := &noisyDevice{noisy: true}
+	b := &streamBootloader{rw: device}
+	if err := b.WriteFlash(0x40, make([]byte, 64)); !errors.Is(err, ErrEchoMismatch) {
+		t.Errorf("got %v, want an echo mismatch without resync", err)
+	}
+
+	device = &noisyDevice{noisy: true}
+	b = &streamBootloader{rw: device, resync: ResyncPolicy{Attempts: 1, QuietPeriod: time.Millisecond}}
+	if err := b.WriteFlash(0x40, make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	// The write is sent again after the GetVersion ping
+	if want := []uint8{commandWriteFlash, commandGetVersion, commandWriteFlash}; !reflect.DeepEqual(device.commands, want) {
+		t.Errorf("got commands %X, want %X", device.commands, want)
+	}
+}
+
+// silentDevice never answers, with each read timing out after 10ms.
+type silentDevice struct{}
+
+func (silentDevice) Read(p []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	return 0, io.EOF
+}
+
+func (silentDevice) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+type silentBootloader struct {
+	streamBootloader
+	disconnected bool
+}
+
+func (b *silentBootloader) Connect() error { return nil }
+func (b *silentBootloader) Disconnect()    { b.disconnected = true }
+
+func TestContextInterruptsCommand(t *testing.T) {
+	b := &silentBootloader{streamBootloader: streamBootloader{
+		rw:             silentDevice{},
+		commandTimeout: func(Command) time.Duration { return time.Hour },
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := NewContextBootloader(ctx, b).ReadFlash(0, 16)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("command took %v to be interrupted", elapsed)
+	}
+	if !b.disconnected {
+		t.Error("bootloader wasn't disconnected")
+	}
+	// The bootloader can be used again once it has been reconnected
+	if err := b.interrupted(); err != nil {
+		t.Errorf("interrupt wasn't cleared: %v", err)
+	}
+}
+
+// stallingDevice sends part of a response and then stops, with each read timing out
+// after 10ms.
+type stallingDevice struct {
+	partial []byte
+}
+
+func (d *stallingDevice) Read(p []byte) (int, error) {
+	if len(d.partial) > 0 {
+		n := copy(p, d.partial)
+		d.partial = d.partial[n:]
+		return n, nil
+	}
+	time.Sleep(10 * time.Millisecond)
+	return 0, io.EOF
+}
+
+func (d *stallingDevice) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestInterByteTimeout(t *testing.T) {
+	b := &streamBootloader{
+		rw:               &stallingDevice{partial: []byte{1, 2, 3}},
+		interByteTimeout: 50 * time.Millisecond,
+	}
+	b.deadline = time.Now().Add(time.Hour)
+
+	start := time.Now()
+	_, err := b.recv(8)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Received != 3 {
+		t.Fatalf("got %v, want a timeout after 3 bytes", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stalled response took %v to time out", elapsed)
+	}
+}
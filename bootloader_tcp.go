@@ -0,0 +1,132 @@
+package microchipboot
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TCP transport defaults.
+const (
+	defaultTCPConnectTimeout = 5 * time.Second
+	defaultTCPReadTimeout    = time.Second
+)
+
+// TCPConfig configures the TCP transport. Zero values are replaced with defaults.
+type TCPConfig struct {
+	// Maximum time to wait for the connection to be established.
+	ConnectTimeout time.Duration
+	// Maximum time to wait for each read from the socket.
+	ReadTimeout time.Duration
+	// If true, the connection uses the Telnet COM port control protocol (RFC 2217), as
+	// provided by e.g. ser2net, and the remote serial port is set to Baud, 8N1.
+	RFC2217 bool
+	Baud    int
+	// How to recover from echo mismatches. By default, the command fails.
+	Resync ResyncPolicy
+}
+
+type tcpBootloader struct {
+	streamBootloader
+	address string
+	config  TCPConfig
+	conn    net.Conn
+	telnet  telnetDecoder
+}
+
+// NewTCPBootloader creates a new bootloader that speaks the bootloader protocol over a TCP
+// connection, for devices behind a serial to Ethernet bridge.
+//
+// If the connection fails, the command in progress returns an error and the connection is
+// re-established when the next command is sent.
+func NewTCPBootloader(host string, port int, config TCPConfig) (Bootloader, error) {
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = defaultTCPConnectTimeout
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = defaultTCPReadTimeout
+	}
+	if config.Baud == 0 {
+		config.Baud = defaultSerialBaud
+	}
+	b := &tcpBootloader{
+		address: net.JoinHostPort(host, strconv.Itoa(port)),
+		config:  config,
+	}
+	b.rw = &tcpStream{b}
+	b.resync = config.Resync
+	return b, nil
+}
+
+func (b *tcpBootloader) Connect() error {
+	b.Disconnect()
+	transportLog.Debugf("connecting to %v", b.address)
+	conn, err := net.DialTimeout("tcp", b.address, b.config.ConnectTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %v: %w", b.address, err)
+	}
+	b.conn = conn
+	if b.config.RFC2217 {
+		b.telnet = telnetDecoder{}
+		transportLog.Debugf("setting remote port to %v baud", b.config.Baud)
+		if _, err := conn.Write(rfc2217Negotiation(b.config.Baud)); err != nil {
+			b.Disconnect()
+			return fmt.Errorf("failed to configure remote port: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *tcpBootloader) Disconnect() {
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// tcpStream reads and writes the bootloader's connection, reconnecting if a
+// previous operation failed.
+type tcpStream struct {
+	b *tcpBootloader
+}
+
+func (s *tcpStream) Read(p []byte) (int, error) {
+	if s.b.conn == nil {
+		return 0, fmt.Errorf("not connected to %v", s.b.address)
+	}
+	s.b.conn.SetReadDeadline(time.Now().Add(s.b.config.ReadTimeout))
+	for {
+		n, err := s.b.conn.Read(p)
+		if err != nil {
+			// Drop the connection so that the next command starts afresh
+			s.b.Disconnect()
+		}
+		if s.b.config.RFC2217 {
+			n = len(s.b.telnet.decode(p[:n]))
+			if n == 0 && err == nil {
+				// Only Telnet commands were received
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+func (s *tcpStream) Write(p []byte) (int, error) {
+	if s.b.conn == nil {
+		transportLog.Warnf("reconnecting to %v", s.b.address)
+		if err := s.b.Connect(); err != nil {
+			return 0, err
+		}
+	}
+	data := p
+	if s.b.config.RFC2217 {
+		data = telnetEscape(p)
+	}
+	if _, err := s.b.conn.Write(data); err != nil {
+		s.b.Disconnect()
+		return 0, err
+	}
+	return len(p), nil
+}
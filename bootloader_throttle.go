@@ -0,0 +1,105 @@
+package microchipboot
+
+import "time"
+
+// Size of a command header, including the sync byte.
+const commandHeaderSize = 11
+
+// Throttle limits the rate at which commands are sent to the bootloader.
+// A zero value disables the corresponding limit.
+type Throttle struct {
+	BytesPerSecond    int
+	CommandsPerSecond int
+}
+
+type throttledBootloader struct {
+	Bootloader
+	throttle Throttle
+	// Earliest time that the next command may be sent
+	next time.Time
+}
+
+func (b *throttledBootloader) unwrap() Bootloader {
+	return b.Bootloader
+}
+
+// NewThrottledBootloader wraps a bootloader so that commands are sent no faster than the
+// given throttle allows. This helps on marginal links, such as long RS-485 runs or radio
+// bridges, where bursts of full speed traffic cause random failures.
+func NewThrottledBootloader(bootloader Bootloader, throttle Throttle) Bootloader {
+	return &throttledBootloader{
+		Bootloader: bootloader,
+		throttle:   throttle,
+	}
+}
+
+// wait blocks until the next command may be sent. n is the number of bytes that
+// the command transfers.
+func (b *throttledBootloader) wait(n int) {
+	now := time.Now()
+	if b.next.After(now) {
+		time.Sleep(b.next.Sub(now))
+		now = b.next
+	}
+
+	var delay time.Duration
+	if b.throttle.CommandsPerSecond > 0 {
+		delay = time.Second / time.Duration(b.throttle.CommandsPerSecond)
+	}
+	if b.throttle.BytesPerSecond > 0 {
+		if d := time.Duration(n) * time.Second / time.Duration(b.throttle.BytesPerSecond); d > delay {
+			delay = d
+		}
+	}
+	b.next = now.Add(delay)
+}
+
+func (b *throttledBootloader) GetVersion() (VersionInfo, error) {
+	b.wait(commandHeaderSize + respLengthGetVersion)
+	return b.Bootloader.GetVersion()
+}
+
+func (b *throttledBootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	b.wait(commandHeaderSize + int(length))
+	return b.Bootloader.ReadFlash(address, length)
+}
+
+func (b *throttledBootloader) WriteFlash(address uint32, data []byte) error {
+	b.wait(commandHeaderSize + len(data))
+	return b.Bootloader.WriteFlash(address, data)
+}
+
+func (b *throttledBootloader) EraseFlash(address uint32, numRows uint16) error {
+	b.wait(commandHeaderSize)
+	return b.Bootloader.EraseFlash(address, numRows)
+}
+
+func (b *throttledBootloader) ReadEE(address uint32, length uint16) ([]byte, error) {
+	b.wait(commandHeaderSize + int(length))
+	return b.Bootloader.ReadEE(address, length)
+}
+
+func (b *throttledBootloader) WriteEE(address uint32, data []byte) error {
+	b.wait(commandHeaderSize + len(data))
+	return b.Bootloader.WriteEE(address, data)
+}
+
+func (b *throttledBootloader) ReadConfig(address uint32, length uint16) ([]byte, error) {
+	b.wait(commandHeaderSize + int(length))
+	return b.Bootloader.ReadConfig(address, length)
+}
+
+func (b *throttledBootloader) WriteConfig(address uint32, data []byte) error {
+	b.wait(commandHeaderSize + len(data))
+	return b.Bootloader.WriteConfig(address, data)
+}
+
+func (b *throttledBootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	b.wait(commandHeaderSize + 2)
+	return b.Bootloader.CalculateChecksum(address, length)
+}
+
+func (b *throttledBootloader) Reset() error {
+	b.wait(commandHeaderSize)
+	return b.Bootloader.Reset()
+}
@@ -0,0 +1,51 @@
+package microchipboot
+
+// wordAddressBootloader translates the byte addresses used by the programmer into the
+// word addresses expected by bootloaders on word addressed devices, such as PIC16.
+// EEPROM addresses are passed through unchanged. The row sizes reported by the device
+// are in words and are converted into bytes.
+type wordAddressBootloader struct {
+	Bootloader
+}
+
+func (b *wordAddressBootloader) unwrap() Bootloader {
+	return b.Bootloader
+}
+
+func (b *wordAddressBootloader) word(address uint32) uint32 {
+	return uint32(Address(address).Word())
+}
+
+func (b *wordAddressBootloader) GetVersion() (VersionInfo, error) {
+	info, err := b.Bootloader.GetVersion()
+	if err != nil {
+		return info, err
+	}
+	info.EraseRowSize = int(WordAddress(info.EraseRowSize).Byte())
+	info.WriteRowSize = int(WordAddress(info.WriteRowSize).Byte())
+	return info, nil
+}
+
+func (b *wordAddressBootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	return b.Bootloader.ReadFlash(b.word(address), length)
+}
+
+func (b *wordAddressBootloader) WriteFlash(address uint32, data []byte) error {
+	return b.Bootloader.WriteFlash(b.word(address), data)
+}
+
+func (b *wordAddressBootloader) EraseFlash(address uint32, numRows uint16) error {
+	return b.Bootloader.EraseFlash(b.word(address), numRows)
+}
+
+func (b *wordAddressBootloader) ReadConfig(address uint32, length uint16) ([]byte, error) {
+	return b.Bootloader.ReadConfig(b.word(address), length)
+}
+
+func (b *wordAddressBootloader) WriteConfig(address uint32, data []byte) error {
+	return b.Bootloader.WriteConfig(b.word(address), data)
+}
+
+func (b *wordAddressBootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	return b.Bootloader.CalculateChecksum(b.word(address), length)
+}
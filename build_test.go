@@ -0,0 +1,32 @@
+package microchipboot
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestCrossCompile vets the module for platforms other than the host, as transports
+// that make raw system calls are easily broken on other architectures, e.g. linux/386
+// where the socket calls go through socketcall.
+func TestCrossCompile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cross compilation in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	for _, target := range []struct{ goos, goarch string }{
+		{"linux", "386"},
+		{"linux", "arm"},
+		{"linux", "arm64"},
+		{"windows", "amd64"},
+	} {
+		cmd := exec.Command(goTool, "vet", "./...")
+		cmd.Env = append(os.Environ(), "GOOS="+target.goos, "GOARCH="+target.goarch, "CGO_ENABLED=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("%v/%v: %v\n%s", target.goos, target.goarch, err, out)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/amrbekhit/microchipboot"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum time to wait before reconnecting to the broker after the connection is lost.
+	agentReconnectDelay = 10 * time.Second
+	// Time to wait for the broker to acknowledge a message.
+	agentPublishTimeout = 10 * time.Second
+)
+
+// agent programs the locally attached device with firmware updates received over MQTT,
+// reporting progress and results on topics below its prefix:
+//
+//	prefix/update    subscribed: an update request, an agentUpdate in JSON
+//	prefix/progress  published: the progress of the current update
+//	prefix/result    published: the result of each update
+//	prefix/status    published, retained: "online", "busy" or "offline"
+type agent struct {
+	client mqtt.Client
+	// Update requests received, which are processed one at a time
+	updates    chan []byte
+	prefix     string
+	bootloader microchipboot.Bootloader
+	pic        *pic8ProfileOptions
+	// If set, images must be firmware packages signed with these keys. Otherwise, every
+	// update must give the SHA-256 of its image.
+	keys *microchipboot.PackageKeys
+}
+
+// agentUpdate is an update request. The image is either given in full, as hex or as a
+// firmware package, or is downloaded from url.
+type agentUpdate struct {
+	// Identifies the update in the progress and result messages.
+	ID      string `json:"id"`
+	Hex     string `json:"hex"`
+	Package []byte `json:"package"`
+	URL     string `json:"url"`
+	// Expected SHA-256 of the image, in hex. Required unless the agent only accepts
+	// signed packages.
+	SHA256 string `json:"sha256"`
+}
+
+// agentResult reports the outcome of an update.
+type agentResult struct {
+	ID       string  `json:"id"`
+	State    string  `json:"state"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+// runAgentCommand connects to an MQTT broker and processes update requests until the
+// program is stopped. The client reconnects and subscribes again if the connection is
+// lost.
+func runAgentCommand(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	broker := flags.String("mqtt", "", "Address of the MQTT broker, e.g. broker.local:1883.")
+	prefix := flags.String("topic", "", "Prefix of the agent's topics. Defaults to microchipboot/<hostname>.")
+	clientID := flags.String("client-id", "", "MQTT client ID. Defaults to microchipboot-<hostname>.")
+	username := flags.String("username", "", "MQTT user name.")
+	password := flags.String("password", "", "MQTT password.")
+	port := flags.String("port", "", "Serial port of the device.")
+	baud := flags.Int("baud", 115200, "Baud rate.")
+	profileFile := flags.String("profile", "", "Device profile file.")
+	useTLS := flags.Bool("tls", false, "Connect to the broker with TLS.")
+	caFile := flags.String("ca-file", "", "File containing the PEM encoded CA certificates that the broker's certificate is checked against. Defaults to the system's. Implies -tls.")
+	publicKey := flags.String("pub-key", "", "File containing the hex encoded Ed25519 public key that updates must be signed with. If set, only signed firmware packages are accepted.")
+	decryptKey := flags.String("package-decrypt-key", "", "File containing the hex encoded AES key that encrypted firmware packages are decrypted with.")
+	flags.Parse(args)
+
+	if *broker == "" || *port == "" || *profileFile == "" {
+		log.Fatalf("expected: agent -mqtt broker -port port -profile profile")
+	}
+	var tlsConfig *tls.Config
+	if *useTLS || *caFile != "" {
+		var err error
+		if tlsConfig, err = loadTLSConfig(*caFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	scheme, defaultPort := "tcp", "1883"
+	if tlsConfig != nil {
+		scheme, defaultPort = "ssl", "8883"
+	}
+	if _, _, err := net.SplitHostPort(*broker); err != nil {
+		*broker = net.JoinHostPort(*broker, defaultPort)
+	}
+	hostname, _ := os.Hostname()
+	if *prefix == "" {
+		*prefix = "microchipboot/" + hostname
+	}
+	if *clientID == "" {
+		*clientID = "microchipboot-" + hostname
+	}
+
+	pic, err := loadProfile(*profileFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bootloader, err := microchipboot.NewSerialBootloader(*port, *baud)
+	if err != nil {
+		log.Fatalf("failed to initialise bootloader: %v", err)
+	}
+
+	a := &agent{updates: make(chan []byte, 16), prefix: *prefix, bootloader: bootloader, pic: pic}
+	if *publicKey != "" {
+		keys, err := loadPackageKeys(*publicKey, *decryptKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.keys = &keys
+	} else {
+		log.Warnf("no -pub-key given, so updates are only checked against their SHA-256")
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(scheme+"://"+*broker).
+		SetClientID(*clientID).
+		SetUsername(*username).
+		SetPassword(*password).
+		SetKeepAlive(30*time.Second).
+		SetBinaryWill(a.topic("status"), []byte("offline"), 1, true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(agentReconnectDelay).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(agentReconnectDelay).
+		// Updates are queued by the handler rather than processed in it, but the handler
+		// may still block while the queue is full
+		SetOrderMatters(false).
+		SetOnConnectHandler(a.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Errorf("mqtt: connection lost: %v", err)
+		})
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	a.client = mqtt.NewClient(opts)
+	log.Infof("connecting to %v...", *broker)
+	if token := a.client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatalf("mqtt: %v", token.Error())
+	}
+	for payload := range a.updates {
+		a.update(payload)
+	}
+}
+
+func (a *agent) topic(name string) string {
+	return a.prefix + "/" + name
+}
+
+// onConnect subscribes to update requests each time that the client connects, as the
+// session isn't kept by the broker.
+func (a *agent) onConnect(client mqtt.Client) {
+	token := client.Subscribe(a.topic("update"), 1, func(_ mqtt.Client, msg mqtt.Message) {
+		a.updates <- msg.Payload()
+	})
+	if token.WaitTimeout(agentPublishTimeout) && token.Error() != nil {
+		log.Errorf("mqtt: failed to subscribe to %v: %v", a.topic("update"), token.Error())
+		return
+	}
+	a.setStatus("online")
+	log.Infof("waiting for updates on %v", a.topic("update"))
+}
+
+func (a *agent) setStatus(status string) {
+	token := a.client.Publish(a.topic("status"), 1, true, []byte(status))
+	if token.WaitTimeout(agentPublishTimeout) && token.Error() != nil {
+		log.Errorf("failed to publish status: %v", token.Error())
+	}
+}
+
+// publish publishes v in JSON. Progress is published at QoS 0, as it is soon out of date,
+// and everything else at QoS 1.
+func (a *agent) publish(name string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("failed to publish %v: %v", name, err)
+		return
+	}
+	var qos byte = 1
+	if name == "progress" {
+		qos = 0
+	}
+	token := a.client.Publish(a.topic(name), qos, false, data)
+	if token.WaitTimeout(agentPublishTimeout) && token.Error() != nil {
+		log.Errorf("failed to publish %v: %v", name, token.Error())
+	}
+}
+
+// update processes a single update request and publishes the result.
+func (a *agent) update(payload []byte) {
+	var req agentUpdate
+	if err := json.Unmarshal(payload, &req); err != nil {
+		a.publish("result", agentResult{State: jobFailed, Error: fmt.Sprintf("invalid update request: %v", err)})
+		return
+	}
+
+	log.Infof("update %v started", req.ID)
+	a.setStatus("busy")
+	defer a.setStatus("online")
+	start := time.Now()
+	err := a.program(req)
+	result := agentResult{ID: req.ID, State: jobPassed, Duration: time.Since(start).Seconds()}
+	if err != nil {
+		log.Errorf("update %v failed: %v", req.ID, err)
+		result.State, result.Error = jobFailed, err.Error()
+	} else {
+		log.Infof("update %v passed", req.ID)
+	}
+	a.publish("result", result)
+}
+
+// image returns the hex image of an update, after checking its signature or SHA-256.
+func (a *agent) image(req agentUpdate) ([]byte, error) {
+	image := []byte(req.Hex)
+	if len(req.Package) > 0 {
+		image = req.Package
+	}
+	if req.URL != "" {
+		var err error
+		if image, err = downloadImage(req.URL); err != nil {
+			return nil, err
+		}
+	}
+	if len(image) == 0 {
+		return nil, fmt.Errorf("update must contain a hex file, package or url")
+	}
+
+	if a.keys == nil {
+		if req.SHA256 == "" {
+			return nil, fmt.Errorf("update must give the sha256 of the image")
+		}
+		if err := checkSHA256(image, req.SHA256); err != nil {
+			return nil, fmt.Errorf("image %w", err)
+		}
+		return image, nil
+	}
+	if err := checkSHA256(image, req.SHA256); err != nil {
+		return nil, fmt.Errorf("image %w", err)
+	}
+	pkg, err := microchipboot.OpenPackage(bytes.NewReader(image), *a.keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package: %w", err)
+	}
+	log.Infof("update %v is package version %q created %v", req.ID, pkg.Metadata.Version, pkg.Metadata.Created)
+	return pkg.Hex, nil
+}
+
+func (a *agent) program(req agentUpdate) error {
+	image, err := a.image(req)
+	if err != nil {
+		return err
+	}
+
+	// Only report whole percentages, to avoid flooding the broker
+	lastStage, lastPercent := "", -1
+	return programDevice(a.bootloader, programOptions{
+		pic:     a.pic,
+		hexData: image,
+		progressHandler: func(stage string, done, total int) {
+			percent := 100
+			if total > 0 {
+				percent = done * 100 / total
+			}
+			if stage == lastStage && percent == lastPercent {
+				return
+			}
+			lastStage, lastPercent = stage, percent
+			a.publish("progress", map[string]interface{}{
+				"id":    req.ID,
+				"stage": stage,
+				"done":  done,
+				"total": total,
+			})
+		},
+	})
+}
+
+// loadTLSConfig returns the TLS configuration for connecting to the broker, trusting the
+// certificates in caFile if it is set, or the system's otherwise.
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %v", caFile)
+	}
+	return config, nil
+}
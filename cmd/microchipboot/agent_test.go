@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/amrbekhit/microchipboot"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/marcinbor85/gohex"
+)
+
+// doneToken is an MQTT token that has already completed.
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{}          { c := make(chan struct{}); close(c); return c }
+func (doneToken) Error() error                   { return nil }
+
+// fakeMessage is a message received on a subscribed topic.
+type fakeMessage struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (m fakeMessage) Payload() []byte { return m.payload }
+
+// fakeMQTTClient records the messages published and the topics subscribed to. The other
+// methods of mqtt.Client aren't used by the agent.
+type fakeMQTTClient struct {
+	mqtt.Client
+	published []fakePublished
+	handlers  map[string]mqtt.MessageHandler
+}
+
+type fakePublished struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published = append(c.published, fakePublished{topic, qos, retained, payload.([]byte)})
+	return doneToken{}
+}
+
+func (c *fakeMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	if c.handlers == nil {
+		c.handlers = make(map[string]mqtt.MessageHandler)
+	}
+	c.handlers[topic] = callback
+	return doneToken{}
+}
+
+func TestAgentImageChecks(t *testing.T) {
+	const image = ":00000001FF\n"
+	sum := sha256.Sum256([]byte(image))
+
+	a := &agent{}
+	if _, err := a.image(agentUpdate{Hex: image}); err == nil {
+		t.Error("accepted an update without a sha256")
+	}
+	if _, err := a.image(agentUpdate{Hex: image, SHA256: hex.EncodeToString(sum[:])}); err != nil {
+		t.Error(err)
+	}
+
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.keys = &microchipboot.PackageKeys{PublicKey: public}
+	if _, err := a.image(agentUpdate{Hex: image, SHA256: hex.EncodeToString(sum[:])}); err == nil {
+		t.Error("accepted an unsigned image")
+	}
+}
+
+func TestAgentUpdate(t *testing.T) {
+	profile, cleanup := writeTempFile(t, "profile.yaml", `
+profile:
+  family: pic18
+  bootloaderoffset: 0x800
+  flashsize: 0x8000
+`)
+	defer cleanup()
+	pic, err := loadProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x800, []byte{1, 2, 3, 4})
+	image := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(image, 16); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(image.Bytes())
+
+	client := &fakeMQTTClient{}
+	device := newTestDevice()
+	a := &agent{client: client, updates: make(chan []byte, 1), prefix: "line1", bootloader: device, pic: pic}
+
+	// Update requests are queued by the subscription, to be processed one at a time
+	a.onConnect(client)
+	request, _ := json.Marshal(agentUpdate{ID: "v1", Hex: image.String(), SHA256: hex.EncodeToString(sum[:])})
+	client.handlers["line1/update"](client, fakeMessage{payload: request})
+	a.update(<-a.updates)
+
+	device.Connect()
+	if flash, _ := device.ReadFlash(0x800, 4); !bytes.Equal(flash, []byte{1, 2, 3, 4}) {
+		t.Errorf("flash is %X", flash)
+	}
+
+	var statuses []string
+	var result agentResult
+	for _, msg := range client.published {
+		switch msg.topic {
+		case "line1/status":
+			if !msg.retained {
+				t.Error("status isn't retained")
+			}
+			statuses = append(statuses, string(msg.payload))
+		case "line1/result":
+			if err := json.Unmarshal(msg.payload, &result); err != nil {
+				t.Fatal(err)
+			}
+		case "line1/progress":
+			if msg.qos != 0 {
+				t.Errorf("progress published at QoS %v", msg.qos)
+			}
+		default:
+			t.Errorf("published to %v", msg.topic)
+		}
+	}
+	if want := []string{"online", "busy", "online"}; len(statuses) != len(want) || statuses[0] != want[0] || statuses[1] != want[1] || statuses[2] != want[2] {
+		t.Errorf("got statuses %v, want %v", statuses, want)
+	}
+	if result.ID != "v1" || result.State != jobPassed {
+		t.Errorf("got result %+v", result)
+	}
+
+	// An invalid request fails without touching the device
+	client.published = nil
+	a.update([]byte("{"))
+	if len(client.published) != 1 || !bytes.Contains(client.published[0].payload, []byte(jobFailed)) {
+		t.Errorf("got %+v, want a failed result", client.published)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// runAppInfo reads and prints the application metadata described by the profile's
+// appinfo layout.
+func runAppInfo(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions) error {
+	if len(pic.AppInfo.Fields) == 0 {
+		return fmt.Errorf("profile doesn't describe the application info")
+	}
+	prog := microchipboot.NewPIC8Programmer(bootloader, pic.Profile, pic.Options)
+	log.Infof("connecting to device...")
+	if err := prog.Connect(); err != nil {
+		return err
+	}
+	defer prog.Disconnect()
+
+	info, err := microchipboot.ReadApplicationInfo(prog, pic.AppInfo)
+	if err != nil {
+		return err
+	}
+
+	text := new(strings.Builder)
+	if info.Erased {
+		fmt.Fprintln(text, "no application installed")
+	} else {
+		for _, f := range pic.AppInfo.Fields {
+			fmt.Fprintf(text, "%v: %v\n", f.Name, info.Fields[f.Name])
+		}
+	}
+	printResult("appinfo", map[string]interface{}{
+		"erased": info.Erased,
+		"fields": info.Fields,
+	}, text.String())
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Batch script operations.
+const (
+	opErase       = "erase"
+	opWriteHex    = "writehex"
+	opWriteEEPROM = "writeeeprom"
+	opWriteConfig = "writeconfig"
+	opVerify      = "verify"
+	opReset       = "reset"
+)
+
+// batchScript describes a sequence of operations that is run in one session, e.g. a
+// manufacturing procedure.
+type batchScript struct {
+	// Device profile file, needed for writehex and verify. Defaults to -profile.
+	Profile string
+	Steps   []batchStep
+}
+
+// batchStep is a single operation of a batch script. The fields used depend on the
+// operation:
+//
+//	erase         address, rows    erase flash rows
+//	writehex      file             program a hex, ELF, S-record or package file
+//	writeeeprom   address, file    write a binary file to EEPROM
+//	writeconfig   address, data    write hex encoded config bytes, e.g. "08FF"
+//	verify        file             verify a firmware file, by default the last one written
+//	reset                          reset the device
+type batchStep struct {
+	Op      string
+	Address uint32
+	Rows    uint16
+	File    string
+	Data    string
+}
+
+// loadBatchScript reads a batch script in YAML or JSON format. Relative paths in the
+// script are made relative to the script's directory.
+func loadBatchScript(filename string) (*batchScript, error) {
+	f, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open script: %w", err)
+	}
+
+	s := new(batchScript)
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(f))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(s)
+	} else {
+		err = yaml.UnmarshalStrict(f, s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse script: %w", err)
+	}
+
+	dir := filepath.Dir(filename)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	s.Profile = resolve(s.Profile)
+	for i, step := range s.Steps {
+		s.Steps[i].File = resolve(step.File)
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("step %v: %w", i+1, err)
+		}
+	}
+	return s, nil
+}
+
+// validate checks that the step has the fields needed by its operation, so that
+// mistakes are found before the device is touched.
+func (s batchStep) validate() error {
+	switch s.Op {
+	case opErase:
+		if s.Rows == 0 {
+			return fmt.Errorf("erase must specify the number of rows")
+		}
+	case opWriteHex, opWriteEEPROM:
+		if s.File == "" {
+			return fmt.Errorf("%v must specify a file", s.Op)
+		}
+	case opWriteConfig:
+		if _, err := hex.DecodeString(s.Data); err != nil || s.Data == "" {
+			return fmt.Errorf("writeconfig must specify hex encoded data")
+		}
+	case opVerify, opReset:
+	default:
+		return fmt.Errorf("invalid operation %q", s.Op)
+	}
+	return nil
+}
+
+// runBatchScript runs the steps of the script in order in one session, stopping at the
+// first failure. pic is used if the script doesn't name a profile.
+func runBatchScript(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions, filename string) error {
+	s, err := loadBatchScript(filename)
+	if err != nil {
+		return err
+	}
+	if s.Profile != "" {
+		if pic, err = loadProfile(s.Profile); err != nil {
+			return err
+		}
+	}
+	actions, err := s.actions(pic != nil)
+	if err != nil {
+		return err
+	}
+	runner := newScriptRunner(bootloader, pic)
+	defer runner.disconnect()
+	if err := runner.connect(); err != nil {
+		return err
+	}
+	for _, action := range actions {
+		if err := action.run(runner); err != nil {
+			return fmt.Errorf("%v: %w", action.pos, err)
+		}
+	}
+	log.Infof("complete")
+	return nil
+}
+
+// batchAction is a step of a batch script, ready to be run, along with its position in
+// the script for error messages.
+type batchAction struct {
+	pos string
+	run func(s *scriptRunner) error
+}
+
+// actions translates the steps into the operations that Starlark scripts use, so that
+// both kinds of script are executed in the same way. Files are read and the steps are
+// checked before anything is sent to the device.
+func (s *batchScript) actions(haveProfile bool) ([]batchAction, error) {
+	var actions []batchAction
+	// The last firmware file written, which is verified by default
+	lastFile := ""
+	for i, step := range s.Steps {
+		step := step
+		pos := fmt.Sprintf("step %v (%v)", i+1, step.Op)
+		add := func(run func(s *scriptRunner) error) {
+			actions = append(actions, batchAction{pos: pos, run: run})
+		}
+		if (step.Op == opWriteHex || step.Op == opVerify) && !haveProfile {
+			return nil, fmt.Errorf("%v: a profile must be specified to program or verify", pos)
+		}
+
+		switch step.Op {
+		case opErase:
+			add(func(s *scriptRunner) error {
+				return s.erase(step.Address, step.Rows)
+			})
+		case opWriteHex:
+			add(func(s *scriptRunner) error {
+				if err := s.load(step.File); err != nil {
+					return err
+				}
+				return s.program()
+			})
+			lastFile = step.File
+		case opWriteEEPROM:
+			data, err := ioutil.ReadFile(step.File)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", pos, err)
+			}
+			if len(data) == 0 {
+				return nil, fmt.Errorf("%v: %v is empty", pos, step.File)
+			}
+			add(func(s *scriptRunner) error {
+				return s.write("eeprom", step.Address, data)
+			})
+		case opWriteConfig:
+			data, _ := hex.DecodeString(step.Data)
+			add(func(s *scriptRunner) error {
+				return s.write("config", step.Address, data)
+			})
+		case opVerify:
+			file := step.File
+			if file == "" {
+				file = lastFile
+			}
+			if file == "" {
+				return nil, fmt.Errorf("%v: no file to verify", pos)
+			}
+			add(func(s *scriptRunner) error {
+				if err := s.load(file); err != nil {
+					return err
+				}
+				return s.verify()
+			})
+		case opReset:
+			add(func(s *scriptRunner) error {
+				return s.reset()
+			})
+		}
+	}
+	return actions, nil
+}
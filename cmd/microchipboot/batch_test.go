@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amrbekhit/microchipboot"
+	"github.com/marcinbor85/gohex"
+)
+
+// eepromRecorder records the length of each EEPROM write.
+type eepromRecorder struct {
+	*microchipboot.SimulatedBootloader
+	writes []int
+}
+
+func (r *eepromRecorder) WriteEE(address uint32, data []byte) error {
+	r.writes = append(r.writes, len(data))
+	return r.SimulatedBootloader.WriteEE(address, data)
+}
+
+func TestBatchScript(t *testing.T) {
+	profile, cleanup := writeTempFile(t, "profile.yaml", `
+profile:
+  family: pic18
+  bootloaderoffset: 0x800
+  flashsize: 0x8000
+  eepromsize: 256
+  eepromwritesize: 16
+  configsize: 14
+`)
+	defer cleanup()
+	dir := filepath.Dir(profile)
+
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x800, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	image := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(image, 16); err != nil {
+		t.Fatal(err)
+	}
+	calibration := bytes.Repeat([]byte{0x5A}, 40)
+	for name, data := range map[string][]byte{"app.hex": image.Bytes(), "calibration.bin": calibration} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "station.yaml"), []byte(`
+profile: profile.yaml
+steps:
+  - op: erase
+    address: 0x800
+    rows: 4
+  - op: writehex
+    file: app.hex
+  - op: writeeeprom
+    address: 0xF00000
+    file: calibration.bin
+  - op: writeconfig
+    address: 0x300000
+    data: "08FF"
+  - op: verify
+  - op: reset
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	device := &eepromRecorder{SimulatedBootloader: newTestDevice()}
+	if err := runBatchScript(device, nil, filepath.Join(dir, "station.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	device.Connect()
+	if flash, _ := device.ReadFlash(0x800, 8); !bytes.Equal(flash, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("flash is %X", flash)
+	}
+	if eeprom, _ := device.ReadEE(0xF00000, 40); !bytes.Equal(eeprom, calibration) {
+		t.Errorf("eeprom is %X", eeprom)
+	}
+	if config, _ := device.ReadConfig(0x300000, 2); !bytes.Equal(config, []byte{0x08, 0xFF}) {
+		t.Errorf("config is %X", config)
+	}
+	// EEPROM is written in pieces of the profile's eepromwritesize
+	if got := device.writes; len(got) != 3 || got[0] != 16 || got[1] != 16 || got[2] != 8 {
+		t.Errorf("got eeprom writes of %v bytes", got)
+	}
+}
+
+func TestBatchScriptErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		err    string
+	}{
+		{"steps:\n  - op: writehex\n    file: app.hex\n", "a profile must be specified"},
+		{"steps:\n  - op: writeeeprom\n    file: missing.bin\n", "step 1 (writeeeprom)"},
+		{"steps:\n  - op: reset\n  - op: format\n", "invalid operation"},
+	}
+	for _, test := range tests {
+		script, cleanup := writeTempFile(t, "station.yaml", test.script)
+		device := newTestDevice()
+		err := runBatchScript(device, nil, script)
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got %v, want %q", test.script, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// runBlankCheck checks that the device's memory is erased and lists the first non-blank
+// addresses of each region that isn't. args are an optional list of regions, which
+// defaults to the application area of flash, followed by an optional method of read or
+// checksum.
+func runBlankCheck(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions, args []string) error {
+	regions := microchipboot.RegionFlash
+	options := pic.Options
+	for _, arg := range args {
+		switch arg {
+		case "read":
+			options.VerifyByReading = true
+		case "checksum":
+			options.VerifyByReading = false
+		default:
+			var err error
+			if regions, err = microchipboot.ParseRegions(arg); err != nil {
+				return err
+			}
+		}
+	}
+
+	prog := microchipboot.NewPIC8Programmer(bootloader, pic.Profile, options)
+	log.Infof("connecting to device...")
+	if err := prog.Connect(); err != nil {
+		return err
+	}
+	defer prog.Disconnect()
+
+	log.Infof("blank checking...")
+	results, err := microchipboot.BlankCheck(prog, regions)
+	if err != nil {
+		return err
+	}
+
+	text := new(strings.Builder)
+	blank := true
+	var fields []map[string]interface{}
+	for _, result := range results {
+		fields = append(fields, map[string]interface{}{
+			"region":   result.Region.String(),
+			"start":    uint32(result.Range.Start),
+			"end":      uint32(result.Range.End),
+			"blank":    result.Blank(),
+			"nonBlank": result.NonBlank,
+		})
+		fmt.Fprintf(text, "%v %X-%X: ", result.Region, result.Range.Start, result.Range.End)
+		if result.Blank() {
+			fmt.Fprintln(text, "blank")
+			continue
+		}
+		blank = false
+		addresses := make([]string, len(result.NonBlank))
+		for i, address := range result.NonBlank {
+			addresses[i] = fmt.Sprintf("%X", address)
+		}
+		fmt.Fprintf(text, "not blank at %v\n", strings.Join(addresses, ", "))
+	}
+	printResult("blankcheck", map[string]interface{}{
+		"blank":   blank,
+		"regions": fields,
+	}, text.String())
+	if !blank {
+		return fmt.Errorf("device is not blank")
+	}
+	return nil
+}
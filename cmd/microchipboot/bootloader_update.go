@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// Bootloader update stages, as recorded in the state file.
+const (
+	updateStageStart             = ""
+	updateStageUpdaterProgrammed = "updater-programmed"
+)
+
+const (
+	updaterStartDelay   = 2 * time.Second
+	updaterConnectTries = 10
+)
+
+// runBootloaderUpdate replaces the bootloader in two stages. First, a second stage
+// updater is programmed into the application area by the existing bootloader. The device
+// is then reset into the updater, which is used to program the new bootloader image.
+// Progress is recorded in a state file for the port and device ID, so that the update
+// can be resumed if it is interrupted after the updater has been programmed.
+func runBootloaderUpdate(bootloader microchipboot.Bootloader, port string, pic *pic8ProfileOptions, updaterFile, bootloaderFile string) {
+	stageProfile := &pic8ProfileOptions{
+		Profile: pic.Profile.BootloaderRegionProfile(),
+		Options: microchipboot.PIC8Options{VerifyByReading: pic.Options.VerifyByReading},
+	}
+	updaterProfile := &pic8ProfileOptions{
+		Profile: pic.Profile,
+		Options: microchipboot.PIC8Options{VerifyByReading: pic.Options.VerifyByReading},
+	}
+
+	// Check that both images fit in their regions before touching the device
+	if err := checkImage(updaterProfile, updaterFile); err != nil {
+		log.Fatalf("updater image doesn't fit in the application area: %v", err)
+	}
+	if err := checkImage(stageProfile, bootloaderFile); err != nil {
+		log.Fatalf("bootloader image doesn't fit in the bootloader region: %v", err)
+	}
+
+	info, err := waitForBootloader(bootloader)
+	if err != nil {
+		log.Fatalf("failed to get device info: %v", err)
+	}
+	stateFile, err := updateStateFile(port, info.DeviceID)
+	if err != nil {
+		log.Fatalf("failed to locate the update state: %v", err)
+	}
+	stage := readUpdateStage(stateFile)
+
+	if stage == updateStageStart {
+		log.Infof("stage 1: programming updater into the application area...")
+		if err := programDevice(bootloader, programOptions{pic: updaterProfile, hexFile: updaterFile}); err != nil {
+			log.Fatalf("failed to program updater: %v", err)
+		}
+		writeUpdateStage(stateFile, updateStageUpdaterProgrammed)
+	} else {
+		log.Infof("resuming update, updater has already been programmed")
+	}
+
+	log.Infof("waiting for the updater to start...")
+	time.Sleep(updaterStartDelay)
+	if _, err := waitForBootloader(bootloader); err != nil {
+		log.Fatalf("updater didn't respond: %v", err)
+	}
+
+	log.Warnf("stage 2: programming new bootloader, do not disconnect the device...")
+	if err := programDevice(bootloader, programOptions{pic: stageProfile, hexFile: bootloaderFile}); err != nil {
+		log.Fatalf("failed to program bootloader: %v. Run the same command again to resume the update", err)
+	}
+
+	os.Remove(stateFile)
+	log.Infof("bootloader updated")
+}
+
+// checkImage loads a hex file into a programmer to check that it fits the profile.
+func checkImage(pic *pic8ProfileOptions, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return microchipboot.NewPIC8Programmer(nil, pic.Profile, pic.Options).LoadHex(f)
+}
+
+// waitForBootloader repeatedly tries to connect to the bootloader until it responds, and
+// returns its device info.
+func waitForBootloader(bootloader microchipboot.Bootloader) (microchipboot.VersionInfo, error) {
+	var info microchipboot.VersionInfo
+	var err error
+	for i := 0; i < updaterConnectTries; i++ {
+		if err = bootloader.Connect(); err == nil {
+			info, err = bootloader.GetVersion()
+			bootloader.Disconnect()
+			if err == nil {
+				return info, nil
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return info, err
+}
+
+// updateStateFile returns the file in the user's cache directory that records the
+// progress of a bootloader update of the device with the given ID on the given port, so
+// that an update is only resumed on the device it was started on.
+func updateStateFile(port string, deviceID int) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "microchipboot")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	// Port names such as /dev/ttyUSB0 or COM3 are turned into a valid file name
+	key := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.TrimPrefix(port, "/dev/"))
+	return filepath.Join(dir, fmt.Sprintf("update-state-%v-%04X", key, deviceID)), nil
+}
+
+func readUpdateStage(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return updateStageStart
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func writeUpdateStage(filename, stage string) {
+	if err := ioutil.WriteFile(filename, []byte(stage+"\n"), 0644); err != nil {
+		log.Fatalf("failed to write update state: %v", err)
+	}
+}
+
+// confirmBootloaderUpdate returns an error unless the user has explicitly acknowledged
+// the risk of updating the bootloader.
+func confirmBootloaderUpdate(confirmed bool) error {
+	if !confirmed {
+		return fmt.Errorf("updating the bootloader can brick the device if interrupted, " +
+			"pass -confirm-bootloader-update to proceed")
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUpdateStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "microchipboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", dir)
+
+	files := map[string]bool{}
+	for _, key := range []struct {
+		port     string
+		deviceID int
+	}{{"/dev/ttyUSB0", 0x1234}, {"/dev/ttyUSB1", 0x1234}, {"/dev/ttyUSB0", 0x5678}} {
+		file, err := updateStateFile(key.port, key.deviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file] = true
+	}
+	if len(files) != 3 {
+		t.Errorf("got %v, want a state file per port and device", files)
+	}
+}
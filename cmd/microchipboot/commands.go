@@ -3,123 +3,257 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
-	"io/ioutil"
 	"strconv"
+	"strings"
 
 	"github.com/amrbekhit/microchipboot"
 	log "github.com/sirupsen/logrus"
 )
 
-func processGetVersion(bootloader microchipboot.Bootloader, args []string) {
+func processGetVersion(bootloader microchipboot.Bootloader, args []string) error {
 	ver, err := bootloader.GetVersion()
 	if err != nil {
-		log.Fatalf("failed to read version: %v", err)
+		return fmt.Errorf("failed to read version: %w", err)
 	}
 
-	log.Infof("version info: %+v", ver)
+	if !jsonOutput {
+		log.Infof("version info: %+v", ver)
+	}
+	fields := map[string]interface{}{"info": ver}
+
+	// Decode the config words if the device family has been specified
+	if len(args) > 0 {
+		settings, err := microchipboot.DecodeConfigWords(args[0], ver.ConfigWords)
+		if err != nil {
+			return fmt.Errorf("failed to decode config words: %w", err)
+		}
+		if !jsonOutput {
+			for _, setting := range settings {
+				log.Infof("config: %v", setting)
+			}
+		}
+		fields["config"] = settings
+	}
+	printResult("version", fields, "")
+	return nil
 }
 
-func getAddrAndLen(args []string) (uint32, uint16) {
+// printData prints data read from the device as a hex dump, or as a hex string in JSON mode.
+func printData(region string, addr uint32, data []byte) {
+	printResult("data", map[string]interface{}{
+		"region":  region,
+		"address": addr,
+		"length":  len(data),
+		"data":    hex.EncodeToString(data),
+	}, hex.Dump(data))
+}
+
+func getAddrAndLen(args []string) (uint32, uint16, error) {
 	if len(args) != 2 {
-		log.Fatalf("expected: addr len")
+		return 0, 0, fmt.Errorf("expected: addr len")
 	}
 	addr, err := strconv.ParseUint(args[0], 0, 32)
 	if err != nil {
-		log.Fatalf("invalid address: %v", err)
+		return 0, 0, fmt.Errorf("invalid address: %w", err)
 	}
 	len, err := strconv.ParseUint(args[1], 0, 16)
 	if err != nil {
-		log.Fatalf("invalid length: %v", err)
+		return 0, 0, fmt.Errorf("invalid length: %w", err)
 	}
-	return uint32(addr), uint16(len)
+	return uint32(addr), uint16(len), nil
 }
 
-func processReadFlash(bootloader microchipboot.Bootloader, args []string) {
-	addr, len := getAddrAndLen(args)
+func processReadFlash(bootloader microchipboot.Bootloader, args []string) error {
+	addr, len, err := getAddrAndLen(args)
+	if err != nil {
+		return err
+	}
 	data, err := bootloader.ReadFlash(uint32(addr), uint16(len))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	fmt.Print(hex.Dump(data))
+	printData("flash", addr, data)
+	return nil
 }
 
-func getAddrAndData(args []string) (uint32, []byte) {
+func getAddrAndData(args []string) (uint32, []byte, error) {
 	if len(args) != 2 {
-		log.Fatalf("expected: addr datafile")
+		return 0, nil, fmt.Errorf("expected: addr datafile")
 	}
 	addr, err := strconv.ParseUint(args[0], 0, 32)
 	if err != nil {
-		log.Fatalf("invalid address: %v", err)
+		return 0, nil, fmt.Errorf("invalid address: %w", err)
 	}
-	data, err := ioutil.ReadFile(args[1])
+	data, err := readFirmwareFile(args[1])
 	if err != nil {
-		log.Fatalf("failed to read data file: %v", err)
+		return 0, nil, fmt.Errorf("failed to read data file: %w", err)
 	}
-	return uint32(addr), data
+	return uint32(addr), data, nil
 }
 
-func processWriteFlash(bootloader microchipboot.Bootloader, args []string) {
-	addr, data := getAddrAndData(args)
-	err := bootloader.WriteFlash(addr, data)
+func processWriteFlash(bootloader microchipboot.Bootloader, args []string) error {
+	addr, data, err := getAddrAndData(args)
+	if err != nil {
+		return err
+	}
+	err = bootloader.WriteFlash(addr, data)
 	if err != nil {
-		log.Fatalf("failed to write flash: %v", err)
+		return fmt.Errorf("failed to write flash: %w", err)
 	}
+	return nil
 }
 
-func processEraseFlash(bootloader microchipboot.Bootloader, args []string) {
-	addr, blocks := getAddrAndLen(args)
-	err := bootloader.EraseFlash(addr, blocks)
+func processEraseFlash(bootloader microchipboot.Bootloader, args []string) error {
+	addr, blocks, err := getAddrAndLen(args)
+	if err != nil {
+		return err
+	}
+	err = bootloader.EraseFlash(addr, blocks)
 	if err != nil {
-		log.Fatalf("failed to erase flash: %v", err)
+		return fmt.Errorf("failed to erase flash: %w", err)
 	}
+	return nil
 }
 
-func processReadEE(bootloader microchipboot.Bootloader, args []string) {
-	addr, len := getAddrAndLen(args)
+func processReadEE(bootloader microchipboot.Bootloader, args []string) error {
+	addr, len, err := getAddrAndLen(args)
+	if err != nil {
+		return err
+	}
 	data, err := bootloader.ReadEE(addr, len)
 	if err != nil {
-		log.Fatalf("failed to read eeprom: %v", err)
+		return fmt.Errorf("failed to read eeprom: %w", err)
 	}
-	fmt.Print(hex.Dump(data))
+	printData("eeprom", addr, data)
+	return nil
 }
 
-func processWriteEE(bootloader microchipboot.Bootloader, args []string) {
-	addr, data := getAddrAndData(args)
-	err := bootloader.WriteEE(addr, data)
+func processWriteEE(bootloader microchipboot.Bootloader, args []string) error {
+	addr, data, err := getAddrAndData(args)
 	if err != nil {
-		log.Fatalf("failed to write eeprom: %v", err)
+		return err
 	}
+	err = bootloader.WriteEE(addr, data)
+	if err != nil {
+		return fmt.Errorf("failed to write eeprom: %w", err)
+	}
+	return nil
 }
 
-func processReadConfig(bootloader microchipboot.Bootloader, args []string) {
-	addr, len := getAddrAndLen(args)
+// Profile file given with -profile, for commands that decode what they read.
+var commandProfile string
+
+func processReadConfig(bootloader microchipboot.Bootloader, args []string) error {
+	// --decode may be given after the address and length
+	decode := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "--decode" {
+			decode = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	addr, len, err := getAddrAndLen(rest)
+	if err != nil {
+		return err
+	}
 	data, err := bootloader.ReadConfig(addr, len)
 	if err != nil {
-		log.Fatalf("failed to read config: %v", err)
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if !decode {
+		printData("config", addr, data)
+		return nil
+	}
+	if commandProfile == "" {
+		return fmt.Errorf("--decode needs a profile file")
+	}
+	pic, err := loadProfile(commandProfile)
+	if err != nil {
+		return err
+	}
+	// The field offsets are relative to the start of the config region
+	if start := pic.Profile.ConfigStart(); addr != start {
+		return fmt.Errorf("--decode needs the config to be read from the start of the config region (%X)", start)
+	}
+	table := pic.Profile.ConfigTable()
+	if table == nil {
+		return fmt.Errorf("the profile doesn't list any configfields and has no family with a built-in table")
+	}
+	settings, err := microchipboot.DecodeConfig(table, data)
+	if err != nil {
+		return fmt.Errorf("failed to decode config: %w", err)
 	}
-	fmt.Print(hex.Dump(data))
+	var text strings.Builder
+	text.WriteString(hex.Dump(data))
+	for _, setting := range settings {
+		fmt.Fprintln(&text, setting)
+	}
+	printResult("config", map[string]interface{}{
+		"address":  addr,
+		"data":     hex.EncodeToString(data),
+		"settings": settings,
+	}, text.String())
+	return nil
 }
 
-func processWriteConfig(bootloader microchipboot.Bootloader, args []string) {
-	addr, data := getAddrAndData(args)
-	err := bootloader.WriteConfig(addr, data)
+func processWriteConfig(bootloader microchipboot.Bootloader, args []string) error {
+	addr, data, err := getAddrAndData(args)
+	if err != nil {
+		return err
+	}
+	err = bootloader.WriteConfig(addr, data)
 	if err != nil {
-		log.Fatalf("failed to write config: %v", err)
+		return fmt.Errorf("failed to write config: %w", err)
 	}
+	return nil
 }
 
-func processCalculateChecksum(bootloader microchipboot.Bootloader, args []string) {
-	addr, len := getAddrAndLen(args)
+func processCalculateChecksum(bootloader microchipboot.Bootloader, args []string) error {
+	addr, len, err := getAddrAndLen(args)
+	if err != nil {
+		return err
+	}
 	checksum, err := bootloader.CalculateChecksum(addr, len)
 	if err != nil {
-		log.Fatal("failed to calculate checksum: %v", err)
+		return fmt.Errorf("failed to calculate checksum: %w", err)
+	}
+	printResult("checksum", map[string]interface{}{
+		"address":  addr,
+		"length":   len,
+		"checksum": checksum,
+	}, fmt.Sprintf("checksum: %X\n", checksum))
+	return nil
+}
+
+func processEraseRange(bootloader microchipboot.Bootloader, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected: start end")
+	}
+	start, err := strconv.ParseUint(args[0], 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid start address: %w", err)
+	}
+	end, err := strconv.ParseUint(args[1], 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid end address: %w", err)
+	}
+	erased, err := microchipboot.EraseRange(bootloader, microchipboot.Address(start), microchipboot.Address(end))
+	if err != nil {
+		return fmt.Errorf("failed to erase range: %w", err)
 	}
-	fmt.Printf("checksum: %X\n", checksum)
+	printResult("eraserange", map[string]interface{}{
+		"start": uint32(erased.Start),
+		"end":   uint32(erased.End),
+	}, fmt.Sprintf("erased %X-%X\n", uint32(erased.Start), uint32(erased.End)))
+	return nil
 }
 
-func processReset(bootloader microchipboot.Bootloader, args []string) {
+func processReset(bootloader microchipboot.Bootloader, args []string) error {
 	err := bootloader.Reset()
 	if err != nil {
-		log.Fatalf("failed to reset: %v", err)
+		return fmt.Errorf("failed to reset: %w", err)
 	}
+	return nil
 }
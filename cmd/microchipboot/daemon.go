@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Job states.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobPassed  = "passed"
+	jobFailed  = "failed"
+)
+
+const jobPollInterval = time.Second
+
+// Number of jobs that can be queued for each port. Further jobs are rejected until the
+// queue has room.
+const jobQueueSize = 100
+
+// Number of jobs kept in the history. Once it is full, the oldest finished jobs are
+// dropped.
+const jobHistorySize = 1000
+
+// Job actions.
+const (
+	actionProgram = "program"
+	actionVersion = "version"
+)
+
+// job describes a single programming job.
+type job struct {
+	// Action is actionProgram (the default) or actionVersion, which reads the device's
+	// version info without programming it.
+	Action  string `yaml:",omitempty"`
+	Port    string
+	Baud    int
+	Profile string
+	Hex     string
+	Before  string
+	After   string
+}
+
+// jobStatus tracks the progress of a job.
+type jobStatus struct {
+	ID       string
+	Job      job
+	State    string
+	Error    string `yaml:",omitempty"`
+	Queued   time.Time
+	Started  time.Time `yaml:",omitempty"`
+	Finished time.Time `yaml:",omitempty"`
+	// Progress of the current stage while the job is running
+	Stage string `yaml:",omitempty"`
+	Done  int    `yaml:",omitempty"`
+	Total int    `yaml:",omitempty"`
+	// Version info read by a version job
+	Version *microchipboot.VersionInfo `yaml:",omitempty"`
+	// File that the final status is written to, if any.
+	resultFile string
+}
+
+// daemon executes queued jobs sequentially for each port, keeping a bootloader
+// instance and worker for every port that it has seen.
+type daemon struct {
+	mu      sync.Mutex
+	nextID  int
+	queues  map[string]chan *jobStatus
+	history []*jobStatus
+}
+
+func newDaemon() *daemon {
+	return &daemon{
+		queues: make(map[string]chan *jobStatus),
+	}
+}
+
+// submit queues a job for execution and returns its status.
+func (d *daemon) submit(j job) (*jobStatus, error) {
+	return d.enqueue(j, "")
+}
+
+// enqueue queues a job for execution. If resultFile is not empty, the final status
+// of the job is written to it.
+func (d *daemon) enqueue(j job, resultFile string) (*jobStatus, error) {
+	if j.Port == "" {
+		return nil, fmt.Errorf("job must specify a port")
+	}
+	switch j.Action {
+	case "":
+		j.Action = actionProgram
+		fallthrough
+	case actionProgram:
+		if j.Profile == "" || j.Hex == "" {
+			return nil, fmt.Errorf("job must specify a profile and hex file")
+		}
+	case actionVersion:
+	default:
+		return nil, fmt.Errorf("invalid job action %q", j.Action)
+	}
+	if j.Baud == 0 {
+		j.Baud = 115200
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queue, ok := d.queues[j.Port]
+	if !ok {
+		queue = make(chan *jobStatus, jobQueueSize)
+		d.queues[j.Port] = queue
+		go d.worker(j.Port, queue)
+	}
+	status := &jobStatus{
+		ID:         fmt.Sprint(d.nextID + 1),
+		Job:        j,
+		State:      jobQueued,
+		Queued:     time.Now(),
+		resultFile: resultFile,
+	}
+	// The worker needs d.mu to update the status, so never wait for it here
+	select {
+	case queue <- status:
+	default:
+		return nil, fmt.Errorf("the queue for %v is full", j.Port)
+	}
+	d.nextID++
+	d.history = append(d.history, status)
+	d.pruneHistory()
+	log.Infof("job %v queued on %v", status.ID, j.Port)
+	return status, nil
+}
+
+// pruneHistory drops the oldest finished jobs once the history is full. d.mu must be held.
+func (d *daemon) pruneHistory() {
+	excess := len(d.history) - jobHistorySize
+	if excess <= 0 {
+		return
+	}
+	kept := d.history[:0]
+	for _, status := range d.history {
+		if excess > 0 && (status.State == jobPassed || status.State == jobFailed) {
+			excess--
+			continue
+		}
+		kept = append(kept, status)
+	}
+	d.history = kept
+}
+
+// jobs returns a snapshot of the status of all jobs.
+func (d *daemon) jobs() []jobStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := make([]jobStatus, len(d.history))
+	for i, s := range d.history {
+		jobs[i] = *s
+	}
+	return jobs
+}
+
+// job returns a snapshot of the status of the job with the given ID.
+func (d *daemon) job(id string) (jobStatus, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.history {
+		if s.ID == id {
+			return *s, true
+		}
+	}
+	return jobStatus{}, false
+}
+
+func (d *daemon) setState(status *jobStatus, state string, err error) {
+	d.mu.Lock()
+	status.State = state
+	switch state {
+	case jobRunning:
+		status.Started = time.Now()
+	case jobPassed, jobFailed:
+		status.Finished = time.Now()
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	d.mu.Unlock()
+}
+
+// worker executes the jobs for a single port in order.
+func (d *daemon) worker(port string, queue chan *jobStatus) {
+	bootloaders := make(map[int]microchipboot.Bootloader)
+	for status := range queue {
+		bootloader, ok := bootloaders[status.Job.Baud]
+		if !ok {
+			var err error
+			bootloader, err = microchipboot.NewSerialBootloader(port, status.Job.Baud)
+			if err != nil {
+				d.finish(status, fmt.Errorf("failed to initialise bootloader: %w", err))
+				continue
+			}
+			bootloaders[status.Job.Baud] = bootloader
+		}
+
+		d.setState(status, jobRunning, nil)
+		log.Infof("job %v started on %v", status.ID, port)
+		d.finish(status, d.runJob(bootloader, status))
+	}
+}
+
+func (d *daemon) finish(status *jobStatus, err error) {
+	if err != nil {
+		log.Errorf("job %v failed: %v", status.ID, err)
+		d.setState(status, jobFailed, err)
+	} else {
+		log.Infof("job %v passed", status.ID)
+		d.setState(status, jobPassed, nil)
+	}
+	if status.resultFile != "" {
+		d.mu.Lock()
+		result := *status
+		d.mu.Unlock()
+		writeJobResult(status.resultFile, &result)
+	}
+}
+
+// runJob runs a job, turning any panic into an error so that the daemon survives.
+func (d *daemon) runJob(bootloader microchipboot.Bootloader, status *jobStatus) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	j := status.Job
+	if j.Action == actionVersion {
+		if err := bootloader.Connect(); err != nil {
+			return err
+		}
+		defer bootloader.Disconnect()
+		info, err := bootloader.GetVersion()
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		status.Version = &info
+		d.mu.Unlock()
+		return nil
+	}
+
+	pic, err := loadProfile(j.Profile)
+	if err != nil {
+		return err
+	}
+	return programDevice(bootloader, programOptions{
+		pic:     pic,
+		hexFile: j.Hex,
+		before:  j.Before,
+		after:   j.After,
+		progressHandler: func(stage string, done, total int) {
+			d.mu.Lock()
+			status.Stage, status.Done, status.Total = stage, done, total
+			d.mu.Unlock()
+		},
+	})
+}
+
+// watchDir polls a directory for job files (*.job.yaml). Each job file is renamed to
+// *.queued once it has been submitted, and the final status of the job is written to
+// *.result once it has finished. Relative paths in a job are relative to the directory.
+// Errors are logged rather than stopping the daemon, and a job file that can't be renamed
+// is skipped from then on, so that it isn't submitted again.
+func (d *daemon) watchDir(dir string) {
+	skipped := make(map[string]bool)
+	for {
+		d.pollDir(dir, skipped)
+		time.Sleep(jobPollInterval)
+	}
+}
+
+// pollDir submits the job files in the directory, apart from those in skipped.
+func (d *daemon) pollDir(dir string, skipped map[string]bool) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.job.yaml"))
+	if err != nil {
+		log.Errorf("failed to read jobs directory: %v", err)
+		return
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if skipped[file] {
+			continue
+		}
+		base := strings.TrimSuffix(file, ".job.yaml")
+		if err := d.submitFile(dir, file, base); err != nil {
+			log.Errorf("failed to submit job %v: %v", file, err)
+			writeJobResult(base+".result", &jobStatus{State: jobFailed, Error: err.Error(), Queued: time.Now()})
+		}
+		if err := os.Rename(file, base+".queued"); err != nil {
+			log.Errorf("failed to rename job file %v, skipping it: %v", file, err)
+			skipped[file] = true
+		}
+	}
+}
+
+func (d *daemon) submitFile(dir, file, base string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var j job
+	if err := yaml.UnmarshalStrict(data, &j); err != nil {
+		return err
+	}
+	for _, path := range []*string{&j.Profile, &j.Hex} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+
+	_, err = d.enqueue(j, base+".result")
+	return err
+}
+
+func writeJobResult(filename string, status *jobStatus) {
+	data, err := yaml.Marshal(status)
+	if err != nil {
+		log.Errorf("failed to encode job result: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		log.Errorf("failed to write job result: %v", err)
+	}
+}
+
+// runDaemon runs the job daemon until the program is stopped.
+func runDaemon(jobsDir string) {
+	if jobsDir == "" {
+		log.Fatalf("must specify a jobs directory")
+	}
+	log.Infof("watching %v for jobs...", jobsDir)
+	newDaemon().watchDir(jobsDir)
+}
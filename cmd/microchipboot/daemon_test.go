@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnqueueFullQueue(t *testing.T) {
+	d := newDaemon()
+	// Without a worker, nothing is taken off the queue
+	const port = "/dev/null-port"
+	d.queues[port] = make(chan *jobStatus, jobQueueSize)
+
+	done := make(chan int)
+	go func() {
+		rejected := 0
+		for i := 0; i < jobQueueSize+10; i++ {
+			if _, err := d.enqueue(job{Action: actionVersion, Port: port}, ""); err != nil {
+				rejected++
+			}
+		}
+		done <- rejected
+	}()
+	select {
+	case rejected := <-done:
+		if rejected != 10 {
+			t.Errorf("%v jobs rejected, want 10", rejected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue blocked on a full queue")
+	}
+	if n := len(d.jobs()); n != jobQueueSize {
+		t.Errorf("got %v jobs in the history, want %v", n, jobQueueSize)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// runDiscoverCommand lists the network serial bridges that respond to a discovery query.
+func runDiscoverCommand(args []string) {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	service := flags.String("service", microchipboot.DefaultDiscoveryService, "Service name to query.")
+	port := flags.Int("udp-port", microchipboot.DefaultDiscoveryPort, "UDP port to broadcast the query to.")
+	timeout := flags.Duration("timeout", 0, "How long to wait for responses.")
+	flags.Parse(args)
+
+	bridges, err := microchipboot.DiscoverBridges(microchipboot.DiscoveryConfig{
+		Service: *service,
+		Port:    *port,
+		Timeout: *timeout,
+	})
+	if err != nil {
+		log.Fatalf("discovery failed: %v", err)
+	}
+	for _, b := range bridges {
+		printResult("bridge", map[string]interface{}{
+			"name":    b.Name,
+			"address": b.Address(),
+		}, fmt.Sprintf("%v\t%v\n", b.Name, b.Address()))
+	}
+	if len(bridges) == 0 {
+		log.Infof("no bridges found")
+	}
+}
+
+// listHIDDevices lists the USB HID devices attached to the system.
+func listHIDDevices() {
+	devices, err := microchipboot.ListHIDDevices()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, d := range devices {
+		printResult("hid", map[string]interface{}{
+			"vendor":  fmt.Sprintf("%04x", d.VendorID),
+			"product": fmt.Sprintf("%04x", d.ProductID),
+			"path":    d.Path,
+			"name":    d.Name,
+		}, fmt.Sprintf("%04x:%04x\t%v\t%v\n", d.VendorID, d.ProductID, d.Path, d.Name))
+	}
+}
+
+// listSerialPorts lists the serial ports attached to the system. If probe is true, only
+// the ports with a bootloader attached are listed, along with their version info.
+func listSerialPorts(probe bool, baud int) {
+	if !probe {
+		ports, err := microchipboot.ListSerialPorts()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range ports {
+			printResult("port", map[string]interface{}{"name": p}, p+"\n")
+		}
+		return
+	}
+	ports, err := microchipboot.ProbePorts(baud)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range ports {
+		printResult("port", map[string]interface{}{"name": p.Name, "info": p.Info},
+			fmt.Sprintf("%v\tdevice ID %04X\n", p.Name, p.Info.DeviceID))
+	}
+}
+
+// findPort returns the only serial port with a bootloader attached.
+func findPort(baud int) string {
+	ports, err := microchipboot.ProbePorts(baud)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch len(ports) {
+	case 0:
+		log.Fatalf("no bootloader found on any serial port")
+	case 1:
+		log.Infof("found bootloader on %v", ports[0].Name)
+		return ports[0].Name
+	}
+	var names []string
+	for _, p := range ports {
+		names = append(names, p.Name)
+	}
+	log.Fatalf("found bootloaders on multiple ports, choose one of: %v", strings.Join(names, ", "))
+	return ""
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Expected SHA-256 of the firmware or data file, set by the -sha256 flag.
+var firmwareSHA256 string
+
+// Time allowed to download a firmware image.
+const downloadTimeout = time.Minute
+
+// isURL reports whether a file argument is an HTTP(S) URL rather than a path.
+func isURL(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://")
+}
+
+// fileExt returns the extension of a file argument, ignoring the query string of a URL.
+func fileExt(name string) string {
+	if isURL(name) {
+		if u, err := url.Parse(name); err == nil {
+			return path.Ext(u.Path)
+		}
+	}
+	return filepath.Ext(name)
+}
+
+// readFirmwareFile reads a file argument, downloading it if it is a URL. If -sha256 was
+// given, the contents must match it.
+func readFirmwareFile(name string) ([]byte, error) {
+	var data []byte
+	var err error
+	if isURL(name) {
+		data, err = downloadImage(name)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSHA256(data, firmwareSHA256); err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return data, nil
+}
+
+// checkSHA256 checks data against an expected hex encoded SHA-256, if there is one.
+func checkSHA256(data []byte, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("SHA-256 is %v, expected %v", actual, expected)
+	}
+	return nil
+}
+
+// downloadImage fetches a firmware image over HTTP(S).
+func downloadImage(url string) ([]byte, error) {
+	client := http.Client{Timeout: downloadTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download image: %v", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	if len(data) > maxImageSize {
+		return nil, fmt.Errorf("image is larger than %v bytes", maxImageSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// runDump reads the device's memory and saves it as a hex file.
+// args are the output file name followed by an optional list of regions.
+func runDump(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("expected: dump file.hex [regions]")
+	}
+	regions := microchipboot.RegionAll
+	if len(args) == 2 {
+		var err error
+		if regions, err = microchipboot.ParseRegions(args[1]); err != nil {
+			return err
+		}
+	}
+
+	prog := microchipboot.NewPIC8Programmer(bootloader, pic.Profile, pic.Options)
+	log.Infof("connecting to device...")
+	if err := prog.Connect(); err != nil {
+		return err
+	}
+	defer prog.Disconnect()
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	log.Infof("reading device...")
+	if err := microchipboot.DumpToHex(prog, f, regions); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Infof("saved to %v", args[0])
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// interruptContext returns a context that is cancelled when the user presses Ctrl-C.
+// Pressing Ctrl-C a second time terminates the program immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		signal.Stop(c)
+		log.Warnf("aborting...")
+		cancel()
+	}()
+	return ctx
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+
+	"github.com/amrbekhit/microchipboot"
+)
+
+// fileKeyProvider returns a key provider that reads a hex encoded key from a file.
+func fileKeyProvider(filename string) microchipboot.KeyProvider {
+	return func(info microchipboot.VersionInfo) ([]byte, error) {
+		return readHexKey(filename)
+	}
+}
+
+// readHexKey reads a hex encoded key from a file.
+func readHexKey(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(data)))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// kioskOptions holds the settings for kiosk mode.
+type kioskOptions struct {
+	trigger string
+	logFile string
+	beep    bool
+	// Command run to provision each device once it has been programmed and verified.
+	provision string
+	passGPIO  int
+	failGPIO  int
+}
+
+const portPollInterval = 500 * time.Millisecond
+
+const passBanner = `
+ ######     ###     #####    #####
+ ##   ##   ## ##   ##   ##  ##   ##
+ ##   ##  ##   ##  ##       ##
+ ######   #######   #####    #####
+ ##       ##   ##       ##       ##
+ ##       ##   ##  ##   ##  ##   ##
+ ##       ##   ##   #####    #####
+`
+
+const failBanner = `
+ #######    ###    ####  ##
+ ##        ## ##    ##   ##
+ ##       ##   ##   ##   ##
+ #####    #######   ##   ##
+ ##       ##   ##   ##   ##
+ ##       ##   ##   ##   ##
+ ##       ##   ##  ####  #######
+`
+
+// runKiosk repeatedly waits for a device, programs it and displays the result, so that
+// production line operators don't have to interact with the program.
+func runKiosk(bootloader microchipboot.Bootloader, port string, opts programOptions, k kioskOptions) {
+	if k.trigger != "port" && k.trigger != "enter" {
+		log.Fatalf("invalid kiosk trigger %v", k.trigger)
+	}
+	stdin := bufio.NewReader(os.Stdin)
+
+	for unit := 1; ; unit++ {
+		switch k.trigger {
+		case "port":
+			fmt.Printf("\nwaiting for device on %v...\n", port)
+			waitForPort(port, true)
+		case "enter":
+			fmt.Printf("\nconnect the device and press enter...\n")
+			stdin.ReadString('\n')
+		}
+		setGPIO(k.passGPIO, false)
+		setGPIO(k.failGPIO, false)
+
+		start := time.Now()
+		err := programDevice(bootloader, opts)
+		if err == nil && k.provision != "" {
+			err = provisionDevice(k.provision, port, unit)
+		}
+		if err != nil {
+			log.Error(err)
+			fmt.Print(failBanner)
+		} else {
+			fmt.Print(passBanner)
+		}
+		setGPIO(k.passGPIO, err == nil)
+		setGPIO(k.failGPIO, err != nil)
+		if k.beep {
+			fmt.Print("\a")
+		}
+		logKioskResult(k.logFile, unit, port, start, err)
+
+		if k.trigger == "port" {
+			fmt.Printf("remove the device...\n")
+			waitForPort(port, false)
+		}
+	}
+}
+
+// provisionDevice runs the provision command for a unit that has been programmed. The
+// port and unit number are passed to it in the MICROCHIPBOOT_PORT and MICROCHIPBOOT_UNIT
+// environment variables.
+func provisionDevice(command, port string, unit int) error {
+	log.Infof("provisioning...")
+	cmd := exec.Command(command)
+	cmd.Env = append(os.Environ(), "MICROCHIPBOOT_PORT="+port, "MICROCHIPBOOT_UNIT="+strconv.Itoa(unit))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to provision device: %w", err)
+	}
+	return nil
+}
+
+// waitForPort blocks until the port either exists or doesn't exist.
+func waitForPort(port string, present bool) {
+	for {
+		_, err := os.Stat(port)
+		if (err == nil) == present {
+			return
+		}
+		time.Sleep(portPollInterval)
+	}
+}
+
+// setGPIO drives a Linux sysfs GPIO output. A negative gpio number is ignored.
+func setGPIO(gpio int, high bool) {
+	if gpio < 0 {
+		return
+	}
+	dir := filepath.Join("/sys/class/gpio", "gpio"+strconv.Itoa(gpio))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := ioutil.WriteFile("/sys/class/gpio/export", []byte(strconv.Itoa(gpio)), 0644); err != nil {
+			log.Warnf("failed to export gpio %v: %v", gpio, err)
+			return
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "direction"), []byte("out"), 0644); err != nil {
+		log.Warnf("failed to set gpio %v direction: %v", gpio, err)
+		return
+	}
+	value := "0"
+	if high {
+		value = "1"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "value"), []byte(value), 0644); err != nil {
+		log.Warnf("failed to set gpio %v: %v", gpio, err)
+	}
+}
+
+// logKioskResult appends the result of programming a unit to the kiosk log file.
+func logKioskResult(filename string, unit int, port string, start time.Time, result error) {
+	if filename == "" {
+		return
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Warnf("failed to open kiosk log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	status := "PASS"
+	detail := ""
+	if result != nil {
+		status = "FAIL"
+		detail = result.Error()
+	}
+	fmt.Fprintf(f, "%v\t%v\t%v\t%v\t%v\t%v\n", start.Format(time.RFC3339), unit, port, status,
+		time.Since(start).Round(time.Millisecond), detail)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestProvisionDevice(t *testing.T) {
+	script, cleanup := writeTempFile(t, "provision.sh",
+		"#!/bin/sh\ntest \"$MICROCHIPBOOT_PORT\" = /dev/ttyUSB0 && test \"$MICROCHIPBOOT_UNIT\" = 3\n")
+	defer cleanup()
+	if err := os.Chmod(script, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provisionDevice(script, "/dev/ttyUSB0", 3); err != nil {
+		t.Errorf("provisioning failed: %v", err)
+	}
+	if err := provisionDevice(script, "/dev/ttyUSB0", 4); err == nil {
+		t.Error("failed provisioning passed")
+	}
+}
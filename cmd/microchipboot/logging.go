@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+var subsystems = []string{
+	microchipboot.SubsystemTransport,
+	microchipboot.SubsystemProtocol,
+	microchipboot.SubsystemPlanner,
+}
+
+// setupLogging configures the log level of each subsystem. The default level is set by
+// the verbose and trace flags, and can be overridden per subsystem by a comma separated
+// list of subsystem=level pairs.
+func setupLogging(verbose, trace bool, levels string) error {
+	level := microchipboot.LevelInfo
+	switch {
+	case trace:
+		level = microchipboot.LevelTrace
+	case verbose:
+		level = microchipboot.LevelDebug
+	}
+	for _, s := range subsystems {
+		microchipboot.SetLogLevel(s, level)
+	}
+
+	maxLevel := level
+	if levels != "" {
+		for _, entry := range strings.Split(levels, ",") {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid log level setting %q, expected subsystem=level", entry)
+			}
+			l, err := microchipboot.ParseLogLevel(parts[1])
+			if err != nil {
+				return err
+			}
+			if err := microchipboot.SetLogLevel(parts[0], l); err != nil {
+				return err
+			}
+			if l > maxLevel {
+				maxLevel = l
+			}
+		}
+	}
+
+	switch maxLevel {
+	case microchipboot.LevelTrace:
+		log.SetLevel(log.TraceLevel)
+		microchipboot.SetTrace(true)
+	case microchipboot.LevelDebug:
+		log.SetLevel(log.DebugLevel)
+	}
+	microchipboot.SetLogger(logrusLogger{log.NewEntry(log.StandardLogger())})
+	return nil
+}
+
+// logrusLogger passes the fields attached to the package's log messages on to logrus, so
+// that they appear as fields in JSON output.
+type logrusLogger struct {
+	*log.Entry
+}
+
+func (l logrusLogger) WithFields(fields microchipboot.Fields) microchipboot.Logger {
+	return logrusLogger{l.Entry.WithFields(log.Fields(fields))}
+}
+
+// enableTrace records the frames exchanged with the device to a file in the given format.
+// The file is left open until the program exits.
+func enableTrace(bootloader microchipboot.Bootloader, filename, format string) error {
+	var traceFormat microchipboot.TraceFormat
+	switch format {
+	case "hex":
+		traceFormat = microchipboot.TraceHexDump
+	case "binary":
+		traceFormat = microchipboot.TraceBinary
+	default:
+		return fmt.Errorf("invalid trace format %q", format)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	return microchipboot.EnableTrace(bootloader, f, traceFormat)
+}
@@ -4,16 +4,17 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/amrbekhit/microchipboot"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
-var commands = map[string]func(microchipboot.Bootloader, []string){
+var commands = map[string]func(microchipboot.Bootloader, []string) error{
 	"ver":         processGetVersion,
 	"readflash":   processReadFlash,
 	"writeflash":  processWriteFlash,
@@ -23,29 +24,133 @@ var commands = map[string]func(microchipboot.Bootloader, []string){
 	"readconfig":  processReadConfig,
 	"writeconfig": processWriteConfig,
 	"checksum":    processCalculateChecksum,
+	"eraserange":  processEraseRange,
 	"reset":       processReset,
 }
 
 type pic8ProfileOptions struct {
 	Profile microchipboot.PIC8Profile
 	Options microchipboot.PIC8Options
+	// Location of the application's version information, for the appinfo subcommand
+	AppInfo microchipboot.AppInfoLayout `yaml:",omitempty"`
+	// If set, a serial number is patched into the image for each device programmed
+	Serial *microchipboot.SerialTemplate `yaml:",omitempty"`
 }
 
 const appVersion = "0.2.2"
 
 func main() {
 	version := flag.Bool("version", false, "Prints the program version.")
-	port := flag.String("port", "", "Serial port name.")
+	port := flag.String("port", "", "Serial port name, or auto to use the only port with a bootloader attached.")
 	baud := flag.Int("baud", 115200, "Baud rate.")
+	baudFallback := flag.String("baud-fallback", "", "Comma separated list of lower baud rates to try, in descending order, if the device doesn't respond at -baud.")
+	baudDowngrade := flag.Int("baud-downgrade", 0, "Drop to the next -baud-fallback rate after this many consecutive echo mismatches.")
+	resync := flag.Int("resync", 0, "Number of times to resynchronize with the device and resend a command after an echo mismatch")
+	resyncQuiet := flag.Duration("resync-quiet", 0, "Time the port must be quiet for when resynchronizing. Defaults to 50ms.")
+	dataBits := flag.Uint("data-bits", 8, "Number of serial data bits.")
+	parity := flag.String("parity", "N", "Serial parity: N (none), O (odd), E (even), M (mark) or S (space).")
+	stopBits := flag.Uint("stop-bits", 1, "Number of serial stop bits, 1 or 2.")
+	readTimeout := flag.Duration("read-timeout", time.Second, "Maximum time to wait for a response on the serial port.")
+	interByteTimeout := flag.Duration("inter-byte-timeout", 0, "If non-zero, fail a response on the serial port that stops arriving for this long part way through.")
+	defaultTimeout := flag.Duration("default-timeout", 0, "Time allowed for a command to complete on the serial port. Defaults to -read-timeout.")
+	writeTimeout := flag.Duration("write-timeout", 0, "Time allowed for a write command to complete on the serial port. Defaults to -default-timeout.")
+	eraseTimeout := flag.Duration("erase-timeout", 0, "Additional time allowed per row for an erase command to complete on the serial port.")
+	pipeline := flag.Int("pipeline", 0, "Number of write commands to send before waiting for their responses, to speed up high latency links.")
+	rtscts := flag.Bool("rtscts", false, "Enable RTS/CTS hardware flow control. Linux only.")
+	framing := flag.String("framing", "raw", "Framing of the bootloader protocol on the serial port: raw or an1310")
+	commandDelay := flag.Duration("command-delay", 0, "Minimum time to wait after each response before sending the next command")
+	byteDelay := flag.Duration("byte-delay", 0, "If non-zero, send commands a byte at a time with this delay between bytes")
+	dtr := flag.String("dtr", "", "Initial state of the DTR line when the serial port is opened, on or off. Linux only.")
+	rts := flag.String("rts", "", "Initial state of the RTS line when the serial port is opened, on or off. Linux only.")
+	entryLines := flag.String("entry", "", "Pulse these modem lines (dtr, rts or dtr,rts) after opening the serial port to reset the target into its bootloader. Linux only.")
+	entryInvert := flag.Bool("entry-invert", false, "Assert the -entry lines by clearing them instead of setting them.")
+	entryPulse := flag.Duration("entry-pulse", 100*time.Millisecond, "Time that the -entry lines are held asserted.")
+	entrySettle := flag.Duration("entry-settle", 100*time.Millisecond, "Time to wait after the -entry pulse for the bootloader to start.")
+	tcpAddress := flag.String("tcp", "", "Connect to a network serial bridge at host:port instead of a serial port.")
+	tcpTimeout := flag.Duration("tcp-timeout", 0, "Read timeout for network serial bridges.")
+	bridgeName := flag.String("bridge", "", "Connect to the network serial bridge with this name, found using discovery.")
+	i2cBus := flag.String("i2c", "", "Connect over this I2C bus (e.g. /dev/i2c-1) instead of a serial port. Linux only.")
+	i2cAddress := flag.Uint("i2c-address", 0, "7-bit I2C address of the device.")
+	spiDevice := flag.String("spi", "", "Connect over this spidev device (e.g. /dev/spidev0.0) instead of a serial port. Linux only.")
+	spiSpeed := flag.Uint("spi-speed", 1000000, "SPI clock frequency in Hz.")
+	spiMode := flag.Uint("spi-mode", 0, "SPI mode, from 0 to 3.")
+	spiReadyPin := flag.String("spi-ready-pin", "", "Value file of a sysfs GPIO that the device drives high when it is ready to respond. By default, the device is polled until it stops sending 0xFF.")
+	hidID := flag.String("hid", "", "Connect to the USB HID device with this vendor:product ID (e.g. 04d8:003c) instead of a serial port. Linux only.")
+	canInterface := flag.String("can", "", "Connect over this SocketCAN interface (e.g. can0) instead of a serial port. Linux only.")
+	canTX := flag.Uint("can-tx", 0, "Arbitration ID of the frames sent to the device.")
+	canRX := flag.Uint("can-rx", 0, "Arbitration ID of the frames received from the device.")
+	canExtended := flag.Bool("can-extended", false, "Use 29-bit extended CAN identifiers.")
+	btAddress := flag.String("bt", "", "Connect to the Bluetooth module with this address (e.g. 00:11:22:33:44:55) over SPP instead of a serial port. Linux only.")
+	btChannel := flag.Int("bt-channel", 1, "RFCOMM channel of the SPP service.")
+	ble := flag.Bool("ble", false, "Connect to the -bt module over BLE, using the Nordic UART Service, instead of SPP.")
+	bleRandom := flag.Bool("ble-random", false, "The -bt address is a random BLE address.")
+	protocolVariant := flag.String("protocol", "v1", "Bootloader protocol variant: v1, v2 or auto (detected from the firmware version).")
+	protocolCRC := flag.Bool("crc", false, "Append a CRC-16 to each command and check the CRC-16 at the end of each response, for bootloader builds that support it.")
+	readSuccessCodes := flag.Bool("read-success-codes", false, "The bootloader answers read commands with a result code before the data, as some firmware versions do.")
+	retries := flag.Int("retries", 1, "Number of times each command is attempted before giving up.")
+	retryBackoff := flag.Duration("retry-backoff", 100*time.Millisecond, "Delay before retrying a failed command, doubling after each attempt.")
+	throttleBytes := flag.Int("throttle-bps", 0, "Limit the data rate to this many bytes per second.")
+	throttleCommands := flag.Int("throttle-cps", 0, "Limit the command rate to this many commands per second.")
+	flag.StringVar(&packageKeyFile, "package-key", "", "File containing the hex encoded Ed25519 public key that .pkg firmware packages must be signed with.")
+	flag.StringVar(&packageDecryptKeyFile, "package-decrypt-key", "", "File containing the hex encoded AES key that encrypted .pkg firmware packages are decrypted with.")
+	flag.StringVar(&firmwareSHA256, "sha256", "", "Expected SHA-256 of the hex file or writeflash/writeee data file, in hex. Programming stops if it doesn't match.")
+	keyFile := flag.String("key-file", "", "File containing the hex encoded AES key for bootloaders that decrypt the flash data.")
+	jsonFlag := flag.Bool("json", false, "Write results, progress and log messages to stdout as JSON lines.")
 	verbose := flag.Bool("v", false, "Enable verbose logging.")
+	logLevels := flag.String("log", "", "Per-subsystem log levels (error, warn, info, debug or trace), e.g. protocol=trace,planner=info.\n"+
+		"Subsystems: transport, protocol, planner.")
+	trace := flag.Bool("vvv", false, "Enable trace logging, which hex dumps every frame sent to and received from the device.")
+	traceFile := flag.String("trace-file", "", "Record every frame sent to and received from the device, with timestamps, to this file.")
+	traceFormat := flag.String("trace-format", "hex", "Format of the -trace-file: hex (hex dump) or binary.")
 	before := flag.String("before", "", "Command to run before programming.")
 	after := flag.String("after", "", "Command to run after programming has been completed successfully.")
+	appBanner := flag.String("app-banner", "", "After resetting, wait for the application to send this banner on the serial port.")
+	appProbe := flag.String("app-probe", "", "After resetting, run this command to check that the application has started. "+
+		"It must exit successfully if the application is alive.")
+	appBaud := flag.Int("app-baud", 0, "Baud rate of the application, if different from the bootloader.")
+	appDelay := flag.Duration("app-delay", time.Second, "Time to wait for the device to reboot before checking the application.")
+	appTimeout := flag.Duration("app-timeout", 5*time.Second, "Maximum time to wait for the application to respond.")
+	eraseAll := flag.Bool("erase-all", false, "Erase the whole application area before programming, not just the rows used by the hex file.")
+	preserveEEPROM := flag.Bool("preserve-eeprom", false, "Restore the EEPROM bytes that the hex file doesn't set after programming.")
+	eepromFile := flag.String("eeprom", "", "Separate HEX file (e.g. a .eep file) with the initial EEPROM contents, programmed along with the image. Its addresses may be offsets from the start of EEPROM.")
+	serialCounter := flag.String("serial-counter", "", "File that the next serial number is kept in, when the profile has a serial section.")
+	serialRecord := flag.String("serial-record", "", "File that the serial number of each device programmed is appended to.")
+	verifyEachRow := flag.Bool("verify-each-row", false, "Check each flash row straight after writing it, and write it again if it doesn't match.")
+	resume := flag.Bool("resume", false, "Continue an interrupted programming session, skipping the flash rows that already match the hex file.")
+	rollback := flag.Bool("rollback", false, "Back up the application before programming and program it back if programming or verification fails.")
+	backupFile := flag.String("backup", "", "With -rollback, save the backup to this hex file instead of a temporary file.")
+	stream := flag.Bool("stream", false, "Program the hex file as it is read instead of loading it first, to keep memory use down for large images. "+
+		"Each row is checked as soon as it is written.")
+	skipIfSame := flag.Bool("skip-if-same", false, "Skip programming if the device already contains the hex file. The device is still verified.")
+	verifyOnly := flag.Bool("verify-only", false, "Verify the device against the hex file without erasing or programming it.")
+	showProgress := flag.Bool("progress", false, "Show a progress bar while programming and verifying.")
+	verifyDiff := flag.String("verify-diff", "", "File to write every mismatching byte to if verification fails, with a summary of the likely cause.")
+	verifyReport := flag.String("verify-report", "", "File to write the verification report to, in JSON or HTML format depending on the extension.")
+	updateBootloader := flag.String("update-bootloader", "", "New bootloader hex file. The hex file argument is then the second stage updater "+
+		"that is used to program it.")
+	confirmUpdate := flag.Bool("confirm-bootloader-update", false, "Confirm that the bootloader should be updated.")
+	batchFile := flag.String("script", "", "Batch script (YAML or JSON) listing the operations to run in one session, e.g. erase, writehex, writeeeprom, writeconfig, verify and reset.")
+	interactive := flag.Bool("interactive", false, "Start an interactive prompt that keeps the connection to the device open between commands.")
+	manifestFile := flag.String("manifest", "", "Manifest file describing multiple artifacts to program in one session, instead of a single hex file.")
+	daemonMode := flag.Bool("daemon", false, "Run as a daemon that executes programming jobs queued in the jobs directory.")
+	jobsDir := flag.String("jobs-dir", "", "Directory watched for job files (*.job.yaml) in daemon mode.")
+	kiosk := flag.Bool("kiosk", false, "Run in kiosk mode, programming each device that is connected until the program is stopped.")
+	kioskTrigger := flag.String("kiosk-trigger", "port", "How kiosk mode waits for the next device: "+
+		"port (wait for the port to disappear and reappear) or enter (wait for the enter key).")
+	kioskLog := flag.String("kiosk-log", "", "File that kiosk mode appends the result of each device to.")
+	kioskBeep := flag.Bool("kiosk-beep", false, "Beep after each device has been programmed in kiosk mode.")
+	kioskProvision := flag.String("kiosk-provision", "", "Command run to provision each device after it has been programmed and verified in kiosk mode, "+
+		"e.g. to load keys or calibrate it. The device fails if the command fails.")
+	kioskPassGPIO := flag.Int("kiosk-pass-gpio", -1, "Linux sysfs GPIO number driven high when a device passes in kiosk mode.")
+	kioskFailGPIO := flag.Int("kiosk-fail-gpio", -1, "Linux sysfs GPIO number driven high when a device fails in kiosk mode.")
 
 	// Format an empty pic8ProfileOptions struct in YAML format as an example.
 	buf := new(bytes.Buffer)
 	enc := yaml.NewEncoder(buf)
 	enc.Encode(pic8ProfileOptions{})
-	profile := flag.String("profile", "", "Device profile yaml file. Example:\n\n"+buf.String())
+	profile := flag.String("profile", "", "Device profile file in YAML, JSON or TOML format, or a profile library file or directory. Example:\n\n"+buf.String())
+	family := flag.String("family", "", "Device family of the profile, as listed by the families subcommand, for devices other than 8-bit PICs. The profile then has profile and options sections in the family's format.")
+	flag.StringVar(&profileDevice, "device", "", "Name of the device to use from the -profile library, e.g. pic18f46k22.")
 
 	cmdList := []string{}
 	for key := range commands {
@@ -63,102 +168,427 @@ func main() {
 		return
 	}
 
-	if *verbose {
-		log.SetLevel(log.DebugLevel)
+	if *jsonFlag {
+		enableJSONOutput()
+	}
+	if err := setupLogging(*verbose, *trace, *logLevels); err != nil {
+		log.Fatal(err)
 	}
 
-	microchipboot.SetLogger(log.StandardLogger())
+	switch flag.Arg(0) {
+	case "profile":
+		runProfileCommand(flag.Args()[1:])
+		return
+	case "discover":
+		runDiscoverCommand(flag.Args()[1:])
+		return
+	case "hid":
+		listHIDDevices()
+		return
+	case "ports":
+		listSerialPorts(flag.Arg(1) == "probe", *baud)
+		return
+	case "serve":
+		runServeCommand(flag.Args()[1:])
+		return
+	case "package":
+		runPackageCommand(flag.Args()[1:])
+		return
+	case "agent":
+		runAgentCommand(flag.Args()[1:])
+		return
+	case "families":
+		for _, name := range microchipboot.ProgrammerFamilies() {
+			fmt.Println(name)
+		}
+		return
+	}
 
-	if *port == "" {
-		log.Fatal("must specify port")
+	if *daemonMode {
+		runDaemon(*jobsDir)
+		return
 	}
 
-	bootloader, err := microchipboot.NewSerialBootloader(*port, *baud)
+	var bootloader microchipboot.Bootloader
+	var err error
+	tcpConfig := microchipboot.TCPConfig{ReadTimeout: *tcpTimeout}
+	switch {
+	case *bridgeName != "":
+		bridge, findErr := microchipboot.FindBridge(*bridgeName, microchipboot.DiscoveryConfig{})
+		if findErr != nil {
+			log.Fatal(findErr)
+		}
+		log.Infof("found bridge %v at %v", bridge.Name, bridge.Address())
+		bootloader, err = microchipboot.NewTCPBootloader(bridge.Host, bridge.Port, tcpConfig)
+	case *tcpAddress != "":
+		host, tcpPort, splitErr := net.SplitHostPort(*tcpAddress)
+		if splitErr != nil {
+			log.Fatalf("invalid tcp address: %v", splitErr)
+		}
+		portNum, atoiErr := strconv.Atoi(tcpPort)
+		if atoiErr != nil {
+			log.Fatalf("invalid tcp port: %v", atoiErr)
+		}
+		bootloader, err = microchipboot.NewTCPBootloader(host, portNum, tcpConfig)
+	case *i2cBus != "":
+		if *i2cAddress > 0xFF {
+			log.Fatalf("invalid i2c address %X, must be between 08 and 77", *i2cAddress)
+		}
+		bootloader, err = microchipboot.NewI2CBootloader(*i2cBus, byte(*i2cAddress))
+	case *spiDevice != "":
+		bootloader, err = microchipboot.NewSPIBootloader(microchipboot.SPIConfig{
+			Device:   *spiDevice,
+			Speed:    uint32(*spiSpeed),
+			Mode:     uint8(*spiMode),
+			ReadyPin: *spiReadyPin,
+		})
+	case *hidID != "":
+		var vendorID, productID uint16
+		if _, scanErr := fmt.Sscanf(*hidID, "%x:%x", &vendorID, &productID); scanErr != nil {
+			log.Fatalf("invalid HID ID %q, expected vendor:product", *hidID)
+		}
+		bootloader, err = microchipboot.NewHIDBootloader(vendorID, productID)
+	case *canInterface != "":
+		bootloader, err = microchipboot.NewCANBootloader(microchipboot.CANConfig{
+			Interface: *canInterface,
+			TXID:      uint32(*canTX),
+			RXID:      uint32(*canRX),
+			Extended:  *canExtended,
+		})
+	case *btAddress != "":
+		bootloader, err = microchipboot.NewBluetoothBootloader(microchipboot.BluetoothConfig{
+			Address:       *btAddress,
+			BLE:           *ble,
+			Channel:       *btChannel,
+			RandomAddress: *bleRandom,
+		})
+	case *port != "":
+		if *port == "auto" {
+			*port = findPort(*baud)
+		}
+		config := microchipboot.SerialConfig{
+			Name:             *port,
+			Baud:             *baud,
+			DataBits:         byte(*dataBits),
+			StopBits:         byte(*stopBits),
+			ReadTimeout:      *readTimeout,
+			InterByteTimeout: *interByteTimeout,
+			DefaultTimeout:   *defaultTimeout,
+			WriteTimeout:     *writeTimeout,
+			EraseTimeout:     *eraseTimeout,
+			FlowControl:      *rtscts,
+			Pipeline:         *pipeline,
+
+			CommandDelay: *commandDelay,
+			ByteDelay:    *byteDelay,
+
+			Resync:  microchipboot.ResyncPolicy{Attempts: *resync, QuietPeriod: *resyncQuiet},
+			Framing: *framing,
+		}
+		if *baudFallback != "" {
+			for _, rate := range strings.Split(*baudFallback, ",") {
+				n, atoiErr := strconv.Atoi(strings.TrimSpace(rate))
+				if atoiErr != nil {
+					log.Fatalf("invalid fallback baud rate %q", rate)
+				}
+				config.FallbackBauds = append(config.FallbackBauds, n)
+			}
+		}
+		config.DowngradeAfter = *baudDowngrade
+		if len(*parity) != 1 {
+			log.Fatalf("invalid parity %q", *parity)
+		}
+		config.Parity = strings.ToUpper(*parity)[0]
+		if config.DTR, err = parseLineState(*dtr); err != nil {
+			log.Fatalf("invalid dtr: %v", err)
+		}
+		if config.RTS, err = parseLineState(*rts); err != nil {
+			log.Fatalf("invalid rts: %v", err)
+		}
+		if *entryLines != "" {
+			entry := &microchipboot.EntrySequence{
+				Inverted: *entryInvert,
+				Pulse:    *entryPulse,
+				Settle:   *entrySettle,
+			}
+			for _, line := range strings.Split(*entryLines, ",") {
+				switch strings.ToLower(strings.TrimSpace(line)) {
+				case "dtr":
+					entry.DTR = true
+				case "rts":
+					entry.RTS = true
+				default:
+					log.Fatalf("invalid entry line %q", line)
+				}
+			}
+			config.Entry = entry
+		}
+		bootloader, err = microchipboot.NewSerialBootloaderWithConfig(config)
+	default:
+		log.Fatal("must specify port")
+	}
 	if err != nil {
 		log.Fatalf("failed to initialise bootloader: %v", err)
 	}
+	if *readSuccessCodes || *protocolCRC || *protocolVariant != microchipboot.ProtocolV1 {
+		err := microchipboot.SetProtocolOptions(bootloader, microchipboot.ProtocolOptions{
+			Variant:          *protocolVariant,
+			ReadSuccessCodes: *readSuccessCodes,
+			CRC:              *protocolCRC,
+		})
+		if err != nil {
+			log.Fatalf("failed to set protocol options: %v", err)
+		}
+	}
+	if *traceFile != "" {
+		if err := enableTrace(bootloader, *traceFile, *traceFormat); err != nil {
+			log.Fatalf("failed to enable trace: %v", err)
+		}
+	}
+	if *retries > 1 {
+		bootloader = microchipboot.NewRetryBootloader(bootloader, microchipboot.RetryPolicy{
+			MaxAttempts: *retries,
+			Backoff:     *retryBackoff,
+			Resync:      true,
+		})
+	}
+	if *keyFile != "" {
+		bootloader, err = microchipboot.NewEncryptedBootloader(bootloader, microchipboot.EncryptionConfig{
+			Keys: fileKeyProvider(*keyFile),
+		})
+		if err != nil {
+			log.Fatalf("failed to initialise encryption: %v", err)
+		}
+	}
+	if *throttleBytes > 0 || *throttleCommands > 0 {
+		bootloader = microchipboot.NewThrottledBootloader(bootloader, microchipboot.Throttle{
+			BytesPerSecond:    *throttleBytes,
+			CommandsPerSecond: *throttleCommands,
+		})
+	}
+
+	if !*kiosk && !*interactive {
+		// Allow the current operation to be aborted with Ctrl-C. Kiosk mode runs until
+		// the program is stopped, so it keeps the default behaviour. The interactive
+		// prompt handles Ctrl-C itself.
+		bootloader = microchipboot.NewContextBootloader(interruptContext(), bootloader)
+	}
 
 	switch {
-	case *command != "":
-		// Run a single command
-		f, ok := commands[*command]
-		if !ok {
-			log.Fatalf("invalid command %v", *command)
+	case flag.Arg(0) == "run":
+		// Run a programming script
+		if flag.NArg() < 2 {
+			log.Fatalf("must specify script file")
 		}
-		if err = bootloader.Connect(); err != nil {
-			log.Fatalf("failed to open bootloader: %v", err)
+		var pic *pic8ProfileOptions
+		if *profile != "" {
+			if pic, err = loadProfile(*profile); err != nil {
+				log.Fatal(err)
+			}
 		}
-		defer bootloader.Disconnect()
-		f(bootloader, flag.Args())
-
-	default:
-		// Try and program a hex file
-		if len(flag.Args()) != 1 {
-			log.Fatalf("must specify hex file to program")
+		if err := runScript(bootloader, pic, flag.Arg(1), flag.Args()[2:]); err != nil {
+			log.Fatal(err)
 		}
 
+	case flag.Arg(0) == "dump":
+		// Save the device's memory to a hex file
 		if *profile == "" {
 			log.Fatalf("must specify a profile file")
 		}
-
-		f, err := ioutil.ReadFile(*profile)
+		pic, err := loadProfile(*profile)
 		if err != nil {
-			log.Fatalf("failed to open profile file: %v", err)
+			log.Fatal(err)
 		}
-		pic := new(pic8ProfileOptions)
-		if err := yaml.Unmarshal(f, pic); err != nil {
-			log.Fatalf("failed to parse profile file: %v", err)
+		if err := runDump(bootloader, pic, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
 		}
 
-		// Run the before command
-		if *before != "" {
-			log.Infof("running before command...")
-			if err := exec.Command(*before).Run(); err != nil {
-				log.Fatalf("failed to run before command: %v", err)
-			}
+	case flag.Arg(0) == "blankcheck":
+		// Check that the device's memory is erased
+		if *profile == "" {
+			log.Fatalf("must specify a profile file")
 		}
-
-		prog := microchipboot.NewPIC8Programmer(bootloader, pic.Profile, pic.Options)
-		log.Infof("connecting to device...")
-		if err := prog.Connect(); err != nil {
+		pic, err := loadProfile(*profile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runBlankCheck(bootloader, pic, flag.Args()[1:]); err != nil {
 			log.Fatal(err)
 		}
-		defer prog.Disconnect()
-		log.Infof("connected")
 
-		file, err := os.Open(flag.Args()[0])
+	case flag.Arg(0) == "writeid":
+		// Program the user ID locations, e.g. with a serial number
+		if *profile == "" {
+			log.Fatalf("must specify a profile file")
+		}
+		pic, err := loadProfile(*profile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer file.Close()
+		if err := runWriteID(bootloader, pic, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
 
-		if err := prog.LoadHex(file); err != nil {
+	case flag.Arg(0) == "appinfo":
+		// Show the version information of the installed application
+		if *profile == "" {
+			log.Fatalf("must specify a profile file")
+		}
+		pic, err := loadProfile(*profile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runAppInfo(bootloader, pic); err != nil {
 			log.Fatal(err)
 		}
-		log.Infof("hex file loaded")
 
-		log.Infof("programming...")
-		if err := prog.Program(); err != nil {
+	case *batchFile != "":
+		// Run a batch script
+		var pic *pic8ProfileOptions
+		if *profile != "" {
+			if pic, err = loadProfile(*profile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := runBatchScript(bootloader, pic, *batchFile); err != nil {
 			log.Fatal(err)
 		}
 
-		log.Infof("verifying...")
-		if err := prog.Verify(); err != nil {
+	case *interactive:
+		// Start the interactive prompt
+		var pic *pic8ProfileOptions
+		if *profile != "" {
+			if pic, err = loadProfile(*profile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := runREPL(bootloader, pic); err != nil {
 			log.Fatal(err)
 		}
 
-		log.Infof("resetting...")
-		if err := prog.Reset(); err != nil {
+	case *command != "":
+		// Run a single command
+		f, ok := commands[*command]
+		if !ok {
+			log.Fatalf("invalid command %v", *command)
+		}
+		commandProfile = *profile
+		if err = bootloader.Connect(); err != nil {
+			log.Fatalf("failed to open bootloader: %v", err)
+		}
+		err = f(bootloader, flag.Args())
+		bootloader.Disconnect()
+		if err != nil {
 			log.Fatal(err)
 		}
-		log.Infof("complete")
 
-		// Run the after command
-		if *after != "" {
-			log.Infof("running after command...")
-			if err := exec.Command(*after).Run(); err != nil {
-				log.Fatalf("failed to run after command: %v", err)
+	default:
+		// Try and program a hex file
+		var opts programOptions
+		if *manifestFile != "" {
+			opts = loadManifestOptions(*manifestFile)
+		} else {
+			if len(flag.Args()) != 1 {
+				log.Fatalf("must specify hex file to program")
+			}
+
+			if *profile == "" {
+				log.Fatalf("must specify a profile file")
+			}
+
+			opts = programOptions{hexFile: flag.Args()[0]}
+			if *family != "" {
+				opts.family = *family
+				if opts.decodeProfile, err = loadFamilyProfile(*profile); err != nil {
+					log.Fatal(err)
+				}
+			} else if opts.pic, err = loadProfile(*profile); err != nil {
+				log.Fatal(err)
+			}
+			if isURL(opts.hexFile) {
+				// Download once, rather than for every device in kiosk mode
+				if opts.hexData, err = readFirmwareFile(opts.hexFile); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		opts.before = *before
+		opts.after = *after
+		opts.verifyReport = *verifyReport
+		opts.verifyDiff = *verifyDiff
+		opts.progress = *showProgress
+		opts.verifyOnly = *verifyOnly
+		opts.resume = *resume
+		opts.skipIfSame = *skipIfSame
+		opts.rollback = *rollback
+		opts.backupFile = *backupFile
+		opts.stream = *stream
+		opts.eepromFile = *eepromFile
+		if opts.pic != nil && opts.pic.Serial != nil {
+			if opts.serializer, err = microchipboot.NewSerializer(*opts.pic.Serial, *serialCounter, *serialRecord); err != nil {
+				log.Fatalf("invalid serial section: %v", err)
+			}
+		}
+		if opts.stream && (opts.resume || opts.rollback || opts.skipIfSame || opts.verifyOnly || *manifestFile != "" || opts.eepromFile != "" || opts.serializer != nil) {
+			log.Fatalf("-stream can't be used with -resume, -rollback, -skip-if-same, -verify-only, -manifest, -eeprom or serial numbers")
+		}
+		if opts.family != "" && (*eraseAll || *verifyEachRow || *preserveEEPROM || opts.eepromFile != "") {
+			log.Fatalf("-erase-all, -verify-each-row, -preserve-eeprom and -eeprom can't be used with -family")
+		}
+		if *eraseAll && opts.pic != nil {
+			opts.pic.Options.EraseAll = true
+		}
+		if *verifyEachRow && opts.pic != nil {
+			opts.pic.Options.VerifyEachRow = true
+		}
+		if *preserveEEPROM && opts.pic != nil {
+			opts.pic.Options.PreserveEEPROM = true
+		}
+		if opts.eepromFile != "" && opts.pic != nil {
+			opts.pic.Options.ProgramEEPROM = true
+		}
+		if *appBanner != "" || *appProbe != "" {
+			opts.appCheck = &appCheckOptions{
+				port:    *port,
+				baud:    *appBaud,
+				delay:   *appDelay,
+				timeout: *appTimeout,
+				banner:  *appBanner,
+				probe:   *appProbe,
+			}
+			if opts.appCheck.baud == 0 {
+				opts.appCheck.baud = *baud
+			}
+		}
+
+		if *updateBootloader != "" {
+			if err := confirmBootloaderUpdate(*confirmUpdate); err != nil {
+				log.Fatal(err)
 			}
+			if opts.hexFile == "" {
+				log.Fatalf("must specify the updater hex file")
+			}
+			if opts.pic == nil {
+				log.Fatalf("-update-bootloader needs an 8-bit PIC profile")
+			}
+			runBootloaderUpdate(bootloader, *port, opts.pic, opts.hexFile, *updateBootloader)
+			return
+		}
+
+		if *kiosk {
+			runKiosk(bootloader, *port, opts, kioskOptions{
+				trigger:   *kioskTrigger,
+				logFile:   *kioskLog,
+				beep:      *kioskBeep,
+				provision: *kioskProvision,
+				passGPIO:  *kioskPassGPIO,
+				failGPIO:  *kioskFailGPIO,
+			})
+			return
+		}
+
+		if err := programDevice(bootloader, opts); err != nil {
+			log.Fatal(err)
 		}
 	}
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/marcinbor85/gohex"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Artifact types.
+const (
+	artifactHex    = "hex"
+	artifactBinary = "binary"
+)
+
+// manifest describes a programming job made up of several artifacts that are
+// combined into a single image, programmed and then verified in one session.
+type manifest struct {
+	// Device profile file.
+	Profile   string
+	Artifacts []artifact
+	// Patches are applied after all the artifacts have been loaded, overriding
+	// any existing data, e.g. to set config words or ID values.
+	Patches []patch
+}
+
+type artifact struct {
+	// Either hex or binary.
+	Type string
+	File string
+	// Load address of binary artifacts.
+	Address uint32
+}
+
+type patch struct {
+	Address uint32
+	// Hex encoded data, e.g. "08FF".
+	Data string
+}
+
+// loadManifest reads a manifest in YAML or JSON format. Relative paths in the manifest
+// are made relative to the manifest's directory.
+func loadManifest(filename string) (*manifest, error) {
+	f, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+
+	m := new(manifest)
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(f))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(m)
+	} else {
+		err = yaml.UnmarshalStrict(f, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	dir := filepath.Dir(filename)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	m.Profile = resolve(m.Profile)
+	for i := range m.Artifacts {
+		m.Artifacts[i].File = resolve(m.Artifacts[i].File)
+	}
+	return m, nil
+}
+
+// buildImage combines the manifest's artifacts and patches into a single hex image.
+// Artifacts are not allowed to overlap each other.
+func (m *manifest) buildImage() ([]byte, error) {
+	mem := gohex.NewMemory()
+	for _, a := range m.Artifacts {
+		switch a.Type {
+		case artifactHex:
+			f, err := os.Open(a.File)
+			if err != nil {
+				return nil, err
+			}
+			artifactMem := gohex.NewMemory()
+			err = artifactMem.ParseIntelHex(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %v: %w", a.File, err)
+			}
+			for _, segment := range artifactMem.GetDataSegments() {
+				if err := mem.AddBinary(segment.Address, segment.Data); err != nil {
+					return nil, fmt.Errorf("failed to add %v: %w", a.File, err)
+				}
+			}
+
+		case artifactBinary:
+			data, err := ioutil.ReadFile(a.File)
+			if err != nil {
+				return nil, err
+			}
+			if err := mem.AddBinary(a.Address, data); err != nil {
+				return nil, fmt.Errorf("failed to add %v: %w", a.File, err)
+			}
+
+		default:
+			return nil, fmt.Errorf("invalid artifact type %q for %v", a.Type, a.File)
+		}
+	}
+
+	for _, p := range m.Patches {
+		data, err := hex.DecodeString(p.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid patch data at %X: %w", p.Address, err)
+		}
+		mem.SetBinary(p.Address, data)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// loadManifestOptions loads a manifest and its profile and builds the combined image.
+func loadManifestOptions(filename string) programOptions {
+	m, err := loadManifest(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if m.Profile == "" {
+		log.Fatalf("manifest must specify a profile file")
+	}
+	pic, err := loadProfile(m.Profile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	image, err := m.buildImage()
+	if err != nil {
+		log.Fatalf("failed to build image: %v", err)
+	}
+	return programOptions{
+		pic:     pic,
+		hexData: image,
+	}
+}
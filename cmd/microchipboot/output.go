@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// jsonOutput is set by the -json flag. Command results are then written to stdout as JSON
+// lines, and log messages, including errors, are written to stdout in JSON format too.
+var jsonOutput bool
+
+func enableJSONOutput() {
+	jsonOutput = true
+	log.SetFormatter(&log.JSONFormatter{})
+	log.SetOutput(os.Stdout)
+}
+
+// printResult writes a command result. In JSON mode, the fields are written as a single
+// JSON object with a "type" field set to kind. Otherwise text is printed as is.
+func printResult(kind string, fields map[string]interface{}, text string) {
+	if !jsonOutput {
+		fmt.Print(text)
+		return
+	}
+	result := map[string]interface{}{"type": kind}
+	for k, v := range fields {
+		result[k] = v
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+		log.Errorf("failed to write result: %v", err)
+	}
+}
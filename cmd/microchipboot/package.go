@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// Keys used to open firmware packages, set by the -package-key and -package-decrypt-key flags.
+var packageKeyFile, packageDecryptKeyFile string
+
+// runPackageCommand creates and checks signed firmware packages.
+//
+//	package keygen name                  write a signing key to name.key and its public key to name.pub
+//	package create -key k in.hex out.pkg create a package from a hex file
+//	package verify -pub-key p file.pkg   check a package's signature and print its metadata
+func runPackageCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: package keygen|create|verify")
+	}
+	flags := flag.NewFlagSet("package "+args[0], flag.ExitOnError)
+	signingKey := flags.String("key", "", "File containing the hex encoded Ed25519 signing key.")
+	publicKey := flags.String("pub-key", "", "File containing the hex encoded Ed25519 public key.")
+	encryptKey := flags.String("encrypt-key", "", "File containing the hex encoded AES key (16, 24 or 32 bytes) that the image is encrypted with.")
+	version := flags.String("version", "", "Firmware version stored in the package.")
+	description := flags.String("description", "", "Description stored in the package.")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "keygen":
+		if flags.NArg() != 1 {
+			log.Fatalf("usage: package keygen name")
+		}
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name := flags.Arg(0)
+		if err := ioutil.WriteFile(name+".key", []byte(hex.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0644); err != nil {
+			log.Fatal(err)
+		}
+
+	case "create":
+		if flags.NArg() != 2 || *signingKey == "" {
+			log.Fatalf("usage: package create -key signing.key [-encrypt-key aes.key] in.hex out.pkg")
+		}
+		seed, err := readHexKey(*signingKey)
+		if err != nil {
+			log.Fatalf("failed to read signing key: %v", err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			log.Fatalf("invalid signing key length %v", len(seed))
+		}
+		var aesKey []byte
+		if *encryptKey != "" {
+			if aesKey, err = readHexKey(*encryptKey); err != nil {
+				log.Fatalf("failed to read encryption key: %v", err)
+			}
+		}
+		in, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer in.Close()
+		out, err := os.Create(flags.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+		metadata := microchipboot.PackageMetadata{
+			Version:     *version,
+			Description: *description,
+			Created:     time.Now().UTC(),
+		}
+		if err := microchipboot.CreatePackage(out, in, metadata, ed25519.NewKeyFromSeed(seed), aesKey); err != nil {
+			log.Fatalf("failed to create package: %v", err)
+		}
+
+	case "verify":
+		if flags.NArg() != 1 || *publicKey == "" {
+			log.Fatalf("usage: package verify -pub-key signing.pub [-encrypt-key aes.key] file.pkg")
+		}
+		keys, err := loadPackageKeys(*publicKey, *encryptKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		pkg, err := microchipboot.OpenPackage(f, keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m := pkg.Metadata
+		printResult("package", map[string]interface{}{
+			"version":     m.Version,
+			"description": m.Description,
+			"created":     m.Created,
+			"encrypted":   m.Encrypted,
+		}, fmt.Sprintf("signature ok\nversion: %v\ndescription: %v\ncreated: %v\nencrypted: %v\n",
+			m.Version, m.Description, m.Created, m.Encrypted))
+
+	default:
+		log.Fatalf("invalid package command %q", args[0])
+	}
+}
+
+// loadPackageKeys reads the keys needed to open a package. The encryption key is optional.
+func loadPackageKeys(publicKeyFile, encryptionKeyFile string) (microchipboot.PackageKeys, error) {
+	var keys microchipboot.PackageKeys
+	if publicKeyFile == "" {
+		return keys, fmt.Errorf("must specify the public key that packages are signed with")
+	}
+	pub, err := readHexKey(publicKeyFile)
+	if err != nil {
+		return keys, fmt.Errorf("failed to read public key: %w", err)
+	}
+	keys.PublicKey = ed25519.PublicKey(pub)
+	if encryptionKeyFile != "" {
+		if keys.EncryptionKey, err = readHexKey(encryptionKeyFile); err != nil {
+			return keys, fmt.Errorf("failed to read encryption key: %w", err)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Name of the device selected from a profile library with -device.
+var profileDevice string
+
+// loadProfile reads a profile file in YAML, JSON or TOML format, depending on the file
+// extension. Unknown fields are rejected so that typos don't go unnoticed.
+//
+// The file may instead be a profile library containing several named devices, or a
+// directory of profile files, in which case the device is selected with -device.
+func loadProfile(filename string) (*pic8ProfileOptions, error) {
+	pic, err := loadProfileFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := pic.Profile.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid profile: %w", err)
+	}
+	return pic, nil
+}
+
+func loadProfileFile(filename string) (*pic8ProfileOptions, error) {
+	if stat, err := os.Stat(filename); err == nil && stat.IsDir() {
+		devices, err := loadProfileDirectory(filename)
+		if err != nil {
+			return nil, err
+		}
+		return devices.resolve(profileDevice)
+	}
+
+	f, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open profile file: %w", err)
+	}
+	root, err := parseProfileDocument(filename, f)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := parseProfileLibrary(root)
+	if err != nil {
+		return nil, err
+	}
+	if devices != nil {
+		return devices.resolve(profileDevice)
+	}
+	if profileDevice != "" {
+		return nil, fmt.Errorf("profile file %v doesn't list any devices", filename)
+	}
+
+	pic := new(pic8ProfileOptions)
+	if err := decodeProfile(filename, f, pic); err != nil {
+		return nil, fmt.Errorf("failed to parse profile file: %w", err)
+	}
+	return pic, nil
+}
+
+// decodeProfile decodes a profile file's data into v, in the format given by the file
+// extension, rejecting unknown fields.
+func decodeProfile(filename string, data []byte, v interface{}) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(v)
+
+	case ".toml":
+		md, err := toml.Decode(string(data), v)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown fields %v", undecoded)
+		}
+		return err
+
+	default:
+		return yaml.UnmarshalStrict(data, v)
+	}
+}
+
+// loadFamilyProfile reads the profile file of a device family selected with -family,
+// returning a function that decodes it into the family's profile type.
+func loadFamilyProfile(filename string) (func(v interface{}) error, error) {
+	f, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open profile file: %w", err)
+	}
+	return func(v interface{}) error {
+		if err := decodeProfile(filename, f, v); err != nil {
+			return fmt.Errorf("failed to parse profile file: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// profileLibrary holds the named device entries of a profile library. Each entry has
+// the same fields as a profile file, plus an optional "inherits" field naming the entry
+// it is based on. Its fields override the inherited ones, with nested sections merged
+// field by field.
+type profileLibrary map[string]map[string]interface{}
+
+// Field of a device entry naming the entry that it inherits from.
+const profileInheritsField = "inherits"
+
+// parseProfileDocument decodes a profile file into a generic map, for files that may be
+// profile libraries.
+func parseProfileDocument(filename string, data []byte) (map[string]interface{}, error) {
+	var doc interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		err = json.Unmarshal(data, &doc)
+	case ".toml":
+		var m map[string]interface{}
+		_, err = toml.Decode(string(data), &m)
+		doc = m
+	default:
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse profile file: %w", err)
+	}
+	root, ok := normaliseProfileValue(doc).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("failed to parse profile file: expected a map")
+	}
+	return root, nil
+}
+
+// parseProfileLibrary returns the device entries of a profile file, or nil if it is a
+// plain profile file rather than a library.
+func parseProfileLibrary(root map[string]interface{}) (profileLibrary, error) {
+	devices, ok := root["devices"]
+	if !ok {
+		return nil, nil
+	}
+	entries, ok := devices.(map[string]interface{})
+	if !ok || len(root) != 1 {
+		return nil, fmt.Errorf("failed to parse profile file: a profile library must only contain a devices map")
+	}
+	library := make(profileLibrary)
+	for name, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("failed to parse profile file: device %v is not a map", name)
+		}
+		library[name] = fields
+	}
+	return library, nil
+}
+
+// loadProfileDirectory reads every profile file in a directory. Profile libraries
+// contribute all of their devices, and plain profile files are named after the file.
+func loadProfileDirectory(dir string) (profileLibrary, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open profile directory: %w", err)
+	}
+	library := make(profileLibrary)
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if file.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json" && ext != ".toml") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open profile file: %w", err)
+		}
+		root, err := parseProfileDocument(file.Name(), data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", file.Name(), err)
+		}
+		devices, err := parseProfileLibrary(root)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", file.Name(), err)
+		}
+		if devices == nil {
+			name := strings.ToLower(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())))
+			devices = profileLibrary{name: root}
+		}
+		for name, fields := range devices {
+			if _, ok := library[name]; ok {
+				return nil, fmt.Errorf("device %v is defined more than once in %v", name, dir)
+			}
+			library[name] = fields
+		}
+	}
+	return library, nil
+}
+
+// resolve builds the profile of the named device, applying its inherited entries.
+func (l profileLibrary) resolve(name string) (*pic8ProfileOptions, error) {
+	if name == "" {
+		return nil, fmt.Errorf("must select a device from the profile library with -device, one of: %v", l.names())
+	}
+	fields, err := l.merged(name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode the merged fields strictly, as for a single profile file
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	pic := new(pic8ProfileOptions)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(pic); err != nil {
+		return nil, fmt.Errorf("failed to parse profile of device %v: %w", name, err)
+	}
+	return pic, nil
+}
+
+// merged returns the fields of the named device merged over those it inherits from.
+// seen lists the devices already visited, to detect inheritance loops.
+func (l profileLibrary) merged(name string, seen []string) (map[string]interface{}, error) {
+	// Keys, including device names, are normalised to lower case
+	name = strings.ToLower(name)
+	for _, s := range seen {
+		if s == name {
+			return nil, fmt.Errorf("device %v inherits from itself", name)
+		}
+	}
+	fields, ok := l[name]
+	if !ok {
+		return nil, fmt.Errorf("device %v not found in the profile library, expected one of: %v", name, l.names())
+	}
+
+	result := make(map[string]interface{})
+	if parent, ok := fields[profileInheritsField]; ok {
+		parentName, ok := parent.(string)
+		if !ok {
+			return nil, fmt.Errorf("device %v: %v must be a device name", name, profileInheritsField)
+		}
+		var err error
+		if result, err = l.merged(parentName, append(seen, name)); err != nil {
+			return nil, err
+		}
+	}
+	mergeProfileFields(result, fields)
+	return result, nil
+}
+
+// names returns the sorted device names.
+func (l profileLibrary) names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mergeProfileFields merges src into dst. Nested maps are merged recursively, while
+// other values, including lists, replace the existing value.
+func mergeProfileFields(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if key == profileInheritsField {
+			continue
+		}
+		if srcMap, ok := value.(map[string]interface{}); ok {
+			if dstMap, ok := dst[key].(map[string]interface{}); ok {
+				merged := make(map[string]interface{})
+				mergeProfileFields(merged, dstMap)
+				mergeProfileFields(merged, srcMap)
+				dst[key] = merged
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// normaliseProfileValue converts the maps produced by the YAML, JSON and TOML decoders
+// into maps with lower case string keys, so that entries from files in different formats
+// can be merged. Field names are matched case insensitively when decoding anyway.
+func normaliseProfileValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[strings.ToLower(fmt.Sprint(key))] = normaliseProfileValue(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[strings.ToLower(key)] = normaliseProfileValue(value)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = normaliseProfileValue(v[i])
+		}
+		return v
+	case []map[string]interface{}:
+		// TOML arrays of tables
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = normaliseProfileValue(v[i])
+		}
+		return list
+	}
+	return v
+}
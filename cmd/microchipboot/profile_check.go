@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// runProfileCommand handles the "profile" subcommands.
+func runProfileCommand(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		log.Fatalf("expected: profile check [-device port] [-baud rate] profile [image.hex]")
+	}
+
+	flags := flag.NewFlagSet("profile check", flag.ExitOnError)
+	device := flags.String("device", "", "Serial port of a device to check the row sizes against.")
+	baud := flags.Int("baud", 115200, "Baud rate.")
+	flags.Parse(args[1:])
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		log.Fatalf("must specify a profile file and optionally a hex file")
+	}
+
+	pic, err := loadProfile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var info microchipboot.VersionInfo
+	if *device != "" {
+		bootloader, err := microchipboot.NewSerialBootloader(*device, *baud)
+		if err != nil {
+			log.Fatalf("failed to initialise bootloader: %v", err)
+		}
+		// Connect through a programmer, so that the row sizes are converted to bytes in
+		// the same way as when programming, e.g. from words on PIC16 devices
+		prog := microchipboot.NewPIC8Programmer(bootloader, pic.Profile, pic.Options)
+		if err := prog.Connect(); err != nil {
+			log.Fatal(err)
+		}
+		info = prog.GetVersionInfo()
+		prog.Disconnect()
+	}
+
+	warnings := microchipboot.LintPIC8Profile(pic.Profile, pic.Options, info)
+	for _, w := range warnings {
+		fmt.Printf("warning: %v\n", w)
+	}
+
+	// Check that the image fits the profile and device
+	var findings []string
+	if flags.NArg() == 2 {
+		f, err := os.Open(flags.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		findings, err = microchipboot.PreflightCheckPIC8(pic.Profile, pic.Options, info, f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("failed to check hex file: %v", err)
+		}
+		for _, f := range findings {
+			fmt.Printf("error: %v\n", f)
+		}
+	}
+
+	if len(warnings) > 0 || len(findings) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("profile ok")
+}
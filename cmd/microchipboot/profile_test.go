@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testProfileLibrary = `
+devices:
+  pic18-base:
+    profile:
+      family: pic18
+      bootloaderoffset: 0x800
+      flashsize: 0x8000
+    options:
+      programeeprom: true
+  PIC18F46K22:
+    inherits: pic18-base
+    profile:
+      flashsize: 0x10000
+      eepromsize: 0x400
+  pic18f46k22-noeeprom:
+    inherits: pic18f46k22
+    options:
+      programeeprom: false
+`
+
+// loadTestProfile loads the named device from a profile file.
+func loadTestProfile(t *testing.T, filename, device string) (*pic8ProfileOptions, error) {
+	t.Helper()
+	defer func(previous string) { profileDevice = previous }(profileDevice)
+	profileDevice = device
+	return loadProfile(filename)
+}
+
+func TestProfileInheritance(t *testing.T) {
+	filename, cleanup := writeTempFile(t, "devices.yaml", testProfileLibrary)
+	defer cleanup()
+
+	pic, err := loadTestProfile(t, filename, "pic18f46k22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nested sections are merged field by field
+	profile := pic.Profile
+	if profile.Family != "pic18" || profile.BootloaderOffset != 0x800 || profile.FlashSize != 0x10000 || profile.EEPROMSize != 0x400 {
+		t.Errorf("got profile %+v", profile)
+	}
+	if !pic.Options.ProgramEEPROM {
+		t.Error("inherited options were lost")
+	}
+
+	// Inheritance is transitive, and later entries override earlier ones
+	pic, err = loadTestProfile(t, filename, "PIC18F46K22-NoEEPROM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pic.Profile.FlashSize != 0x10000 || pic.Options.ProgramEEPROM {
+		t.Errorf("got profile %+v and options %+v", pic.Profile, pic.Options)
+	}
+}
+
+func TestMergeProfileFields(t *testing.T) {
+	dst := map[string]interface{}{
+		"profile": map[string]interface{}{"family": "pic18", "flashsize": 0x8000},
+		"list":    []interface{}{1, 2},
+	}
+	mergeProfileFields(dst, map[string]interface{}{
+		"inherits": "base",
+		"profile":  map[string]interface{}{"flashsize": 0x10000},
+		"list":     []interface{}{3},
+	})
+	want := map[string]interface{}{
+		"profile": map[string]interface{}{"family": "pic18", "flashsize": 0x10000},
+		"list":    []interface{}{3},
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("got %v, want %v", dst, want)
+	}
+}
+
+func TestProfileLibraryErrors(t *testing.T) {
+	tests := []struct {
+		library string
+		device  string
+		err     string
+	}{
+		{"devices:\n  a:\n    inherits: b\n  b:\n    inherits: a\n", "a", "device a inherits from itself"},
+		{"devices:\n  a:\n    inherits: a\n", "a", "device a inherits from itself"},
+		{"devices:\n  a:\n    inherits: missing\n", "a", "device missing not found"},
+		{"devices:\n  a:\n    profile:\n      family: pic18\n", "", "must select a device"},
+		{"devices:\n  a:\n    profile:\n      flashsise: 0x8000\n", "a", "failed to parse profile of device a"},
+		{"devices:\n  a: {}\nprofile: {}\n", "a", "must only contain a devices map"},
+	}
+	for _, test := range tests {
+		filename, cleanup := writeTempFile(t, "devices.yaml", test.library)
+		_, err := loadTestProfile(t, filename, test.device)
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got %v, want %q", test.library, err, test.err)
+		}
+	}
+}
+
+func TestProfileDirectory(t *testing.T) {
+	library, cleanup := writeTempFile(t, "library.yaml", testProfileLibrary)
+	defer cleanup()
+	dir := filepath.Dir(library)
+	if err := ioutil.WriteFile(filepath.Join(dir, "PIC16F1829.json"),
+		[]byte(`{"profile": {"family": "pic16", "bootloaderoffset": 512, "flashsize": 16384}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pic, err := loadTestProfile(t, dir, "pic16f1829")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pic.Profile.Family != "pic16" || pic.Profile.FlashSize != 16384 {
+		t.Errorf("got profile %+v", pic.Profile)
+	}
+	if _, err := loadTestProfile(t, dir, "pic18f46k22"); err != nil {
+		t.Errorf("device from the library: %v", err)
+	}
+
+	// A device can't be defined twice
+	if err := ioutil.WriteFile(filepath.Join(dir, "pic18-base.toml"), []byte("[profile]\nfamily = \"pic18\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTestProfile(t, dir, "pic16f1829"); err == nil || !strings.Contains(err.Error(), "defined more than once") {
+		t.Errorf("got %v, want a duplicate device error", err)
+	}
+}
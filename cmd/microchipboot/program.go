@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// programOptions holds the settings used to program a hex file into a device.
+type programOptions struct {
+	pic     *pic8ProfileOptions
+	hexFile string
+	// If set, the hex image is taken from here rather than hexFile.
+	hexData []byte
+	before  string
+	after   string
+	// File that the verification report is written to, if any.
+	verifyReport string
+	// File that the mismatching bytes are written to if verification fails, if any.
+	verifyDiff string
+	// If set, used to confirm that the application starts after the device is reset.
+	appCheck *appCheckOptions
+	// Print a progress bar while programming and verifying.
+	progress bool
+	// If set, called instead of printing the progress.
+	progressHandler microchipboot.ProgressFunc
+	// Only verify the device against the hex file, without programming it.
+	verifyOnly bool
+	// Resume an interrupted programming session instead of starting from scratch.
+	resume bool
+	// Skip programming if the device already contains the image.
+	skipIfSame bool
+	// Back up the application first and program it back if the update fails.
+	rollback bool
+	// File that the backup is saved to. If empty, a temporary file is used.
+	backupFile string
+	// Program the hex file as it is read, rather than loading it first.
+	stream bool
+	// If set, the programmer is created for this device family, with its profile decoded
+	// by decodeProfile rather than taken from pic.
+	family        string
+	decodeProfile func(v interface{}) error
+	// If set, the EEPROM contents are loaded from this hex file rather than the image.
+	eepromFile string
+	// If set, a serial number is patched into the image before programming each device.
+	serializer *microchipboot.Serializer
+}
+
+// newProgrammer creates the programmer for the device family selected by opts.
+func newProgrammer(bootloader microchipboot.Bootloader, opts programOptions) (microchipboot.Programmer, error) {
+	if opts.family == "" {
+		return microchipboot.NewPIC8Programmer(bootloader, opts.pic.Profile, opts.pic.Options), nil
+	}
+	return microchipboot.NewProgrammer(opts.family, bootloader, opts.decodeProfile)
+}
+
+// appCheckOptions configures how the application is checked after a reset.
+type appCheckOptions struct {
+	port    string
+	baud    int
+	delay   time.Duration
+	timeout time.Duration
+	// Banner expected from the application.
+	banner string
+	// Command run to probe the application, which must exit successfully if the application is alive.
+	probe string
+}
+
+// programDevice runs the before command, programs, verifies and resets the device
+// and then runs the after command.
+func programDevice(bootloader microchipboot.Bootloader, opts programOptions) error {
+	// Run the before command
+	if opts.before != "" {
+		log.Infof("running before command...")
+		if err := exec.Command(opts.before).Run(); err != nil {
+			return fmt.Errorf("failed to run before command: %w", err)
+		}
+	}
+
+	if err := programAndReset(bootloader, opts); err != nil {
+		return err
+	}
+
+	if opts.appCheck != nil {
+		log.Infof("waiting for application to start...")
+		if err := checkApplication(opts.appCheck); err != nil {
+			return err
+		}
+		log.Infof("application started")
+	}
+	log.Infof("complete")
+
+	// Run the after command
+	if opts.after != "" {
+		log.Infof("running after command...")
+		if err := exec.Command(opts.after).Run(); err != nil {
+			return fmt.Errorf("failed to run after command: %w", err)
+		}
+	}
+	return nil
+}
+
+// programAndReset connects to the device, then programs, verifies and resets it. The
+// connection is closed when it returns, so that the application can be checked on the
+// same port.
+func programAndReset(bootloader microchipboot.Bootloader, opts programOptions) error {
+	prog, err := newProgrammer(bootloader, opts)
+	if err != nil {
+		return err
+	}
+	log.Infof("connecting to device...")
+	if err := prog.Connect(); err != nil {
+		return err
+	}
+	defer prog.Disconnect()
+	log.Infof("connected")
+
+	// Check the whole image before anything is erased, so that every problem is listed
+	// rather than just the first one found when it is loaded
+	if opts.family == "" && !opts.stream && !opts.verifyOnly && isHexFile(opts.hexFile) {
+		if opts.hexData == nil {
+			if opts.hexData, err = readFirmwareFile(opts.hexFile); err != nil {
+				return err
+			}
+		}
+		if err := preflightCheck(prog.GetVersionInfo(), opts); err != nil {
+			return err
+		}
+	}
+
+	// A streamed image is only read while it is programmed
+	var serial *microchipboot.Serial
+	if !opts.stream {
+		if err := loadFirmware(prog, opts.hexFile, opts.hexData); err != nil {
+			return err
+		}
+		log.Infof("hex file loaded")
+		if opts.eepromFile != "" {
+			if err := loadEEPROMFile(prog, opts.eepromFile); err != nil {
+				return err
+			}
+			log.Infof("eeprom hex file loaded")
+		}
+		if opts.serializer != nil && !opts.verifyOnly {
+			s, err := opts.serializer.Apply(prog)
+			if err != nil {
+				return err
+			}
+			serial = &s
+			printResult("serial", map[string]interface{}{
+				"serial": s.Value,
+			}, fmt.Sprintf("serial number: %v\n", s.Value))
+		}
+		if opts.pic != nil && opts.pic.Options.Digest.Algorithm != "" {
+			digest, err := microchipboot.GetImageDigest(prog)
+			if err != nil {
+				return err
+			}
+			log.Infof("image %v digest: %X", opts.pic.Options.Digest.Algorithm, digest)
+		}
+	}
+
+	switch {
+	case opts.progressHandler != nil:
+		microchipboot.SetProgressHandler(prog, opts.progressHandler)
+	case opts.progress || jsonOutput:
+		microchipboot.SetProgressHandler(prog, printProgress)
+	}
+
+	upToDate := false
+	if opts.skipIfSame && !opts.verifyOnly {
+		needsUpdate, err := microchipboot.NeedsUpdate(prog)
+		if err != nil {
+			return err
+		}
+		upToDate = !needsUpdate
+	}
+
+	verified := false
+	switch {
+	case opts.verifyOnly:
+	case upToDate:
+		log.Infof("device already contains the image, skipping programming")
+	case opts.stream:
+		log.Infof("programming while reading the hex file...")
+		if err := streamFirmware(prog, opts.hexFile, opts.hexData); err != nil {
+			return err
+		}
+		verified = true
+	case opts.rollback:
+		log.Infof("programming with rollback...")
+		if err := microchipboot.ProgramWithRollback(prog, opts.backupFile); err != nil {
+			return err
+		}
+		verified = true
+	case opts.resume:
+		log.Infof("resuming programming...")
+		if err := microchipboot.Resume(prog); err != nil {
+			return err
+		}
+	default:
+		log.Infof("programming...")
+		if err := prog.Program(); err != nil {
+			return err
+		}
+	}
+
+	if !verified {
+		log.Infof("verifying...")
+		err := prog.Verify()
+		report := microchipboot.GetVerifyReport(prog)
+		if opts.verifyReport != "" && report != nil {
+			if err := writeVerifyReport(opts.verifyReport, report); err != nil {
+				log.Errorf("failed to write verification report: %v", err)
+			}
+		}
+		if report != nil && !report.Passed() {
+			log.Warnf("verification failed: %v", report.Summary())
+			if opts.verifyDiff != "" {
+				if err := writeVerifyDiff(opts.verifyDiff, report); err != nil {
+					log.Errorf("failed to write verification diff: %v", err)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !upToDate && !opts.verifyOnly {
+		printStats(microchipboot.GetStats(prog))
+	}
+	if serial != nil {
+		if err := opts.serializer.Record(*serial); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("resetting...")
+	return prog.Reset()
+}
+
+// streamFirmware programs a hex file as it is read, either from data if it has already
+// been read or from the file. Only Intel HEX files can be streamed.
+func streamFirmware(prog microchipboot.Programmer, filename string, data []byte) error {
+	if !isHexFile(filename) {
+		return fmt.Errorf("only hex files can be streamed")
+	}
+	if data != nil {
+		return microchipboot.ProgramStream(prog, bytes.NewReader(data))
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return microchipboot.ProgramStream(prog, file)
+}
+
+// printStats prints a summary of the programming session.
+func printStats(stats microchipboot.ProgramStats) {
+	round := func(d time.Duration) time.Duration {
+		return d.Round(time.Millisecond)
+	}
+	text := fmt.Sprintf("erased %v rows in %v, wrote %v bytes in %v (%.0f bytes/s), verified %v bytes in %v, %v retries\n",
+		stats.RowsErased, round(stats.EraseDuration), stats.BytesWritten, round(stats.WriteDuration), stats.Throughput(),
+		stats.BytesVerified, round(stats.VerifyDuration), stats.Retries)
+	printResult("stats", map[string]interface{}{
+		"rowsErased":     stats.RowsErased,
+		"bytesWritten":   stats.BytesWritten,
+		"bytesVerified":  stats.BytesVerified,
+		"retries":        stats.Retries,
+		"eraseSeconds":   stats.EraseDuration.Seconds(),
+		"writeSeconds":   stats.WriteDuration.Seconds(),
+		"verifySeconds":  stats.VerifyDuration.Seconds(),
+		"bytesPerSecond": stats.Throughput(),
+	}, text)
+}
+
+// preflightCheck logs every problem that stops the hex image in opts.hexData from being
+// programmed into the device and returns an error if there are any.
+func preflightCheck(info microchipboot.VersionInfo, opts programOptions) error {
+	findings, err := microchipboot.PreflightCheckPIC8(opts.pic.Profile, opts.pic.Options, info, bytes.NewReader(opts.hexData))
+	if err != nil {
+		return fmt.Errorf("failed to check hex file: %w", err)
+	}
+	for _, f := range findings {
+		log.Errorf("%v", f)
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("hex file can't be programmed: %v problems found", len(findings))
+	}
+	return nil
+}
+
+// isHexFile returns true if the firmware file is loaded as Intel HEX.
+func isHexFile(filename string) bool {
+	switch strings.ToLower(fileExt(filename)) {
+	case ".elf", ".srec", ".s19", ".s28", ".s37", ".pkg":
+		return false
+	}
+	return true
+}
+
+// loadFirmware loads the firmware image into the programmer, either from data if it has
+// already been read or from the file. The format is chosen by the file extension: .elf
+// for ELF files, .srec, .s19, .s28 or .s37 for S-records, .pkg for signed firmware
+// packages and anything else for Intel HEX.
+func loadFirmware(prog microchipboot.Programmer, filename string, data []byte) error {
+	var r interface {
+		io.Reader
+		io.ReaderAt
+	}
+	if data == nil && (isURL(filename) || firmwareSHA256 != "") {
+		var err error
+		if data, err = readFirmwareFile(filename); err != nil {
+			return err
+		}
+	}
+	if data != nil {
+		r = bytes.NewReader(data)
+	} else {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	switch strings.ToLower(fileExt(filename)) {
+	case ".elf":
+		return microchipboot.LoadELF(prog, r)
+	case ".srec", ".s19", ".s28", ".s37":
+		return microchipboot.LoadSREC(prog, r)
+	case ".pkg":
+		keys, err := loadPackageKeys(packageKeyFile, packageDecryptKeyFile)
+		if err != nil {
+			return err
+		}
+		metadata, err := microchipboot.LoadPackage(prog, r, keys)
+		if err != nil {
+			return err
+		}
+		log.Infof("loaded package version %q created %v", metadata.Version, metadata.Created)
+		return nil
+	default:
+		return prog.LoadHex(r)
+	}
+}
+
+// loadEEPROMFile loads the initial EEPROM contents from a separate hex file.
+func loadEEPROMFile(prog microchipboot.Programmer, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := microchipboot.LoadEEPROMHex(prog, file); err != nil {
+		return fmt.Errorf("failed to load eeprom hex file: %w", err)
+	}
+	return nil
+}
+
+// printProgress draws a progress bar for the current stage on stderr, or reports the
+// progress as a result in JSON mode.
+func printProgress(stage string, done, total int) {
+	if jsonOutput {
+		printResult("progress", map[string]interface{}{
+			"stage": stage,
+			"done":  done,
+			"total": total,
+		}, "")
+		return
+	}
+	const width = 40
+	filled := width
+	if total > 0 {
+		filled = width * done / total
+	}
+	fmt.Fprintf(os.Stderr, "\r%-6v [%v%v] %v/%v", stage, strings.Repeat("#", filled), strings.Repeat(" ", width-filled), done, total)
+	if done >= total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// writeVerifyReport writes a verification report in HTML format if the filename has
+// a .html extension, and in JSON format otherwise.
+func writeVerifyReport(filename string, report *microchipboot.VerifyReport) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(fileExt(filename)) {
+	case ".html", ".htm":
+		return report.WriteHTML(f)
+	default:
+		return report.WriteJSON(f)
+	}
+}
+
+// writeVerifyDiff writes the mismatching bytes of a failed verification to a file.
+func writeVerifyDiff(filename string, report *microchipboot.VerifyReport) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return report.WriteDiff(f)
+}
+
+// checkApplication confirms that the application has started, either by waiting for its
+// banner or by running the probe command.
+func checkApplication(opts *appCheckOptions) error {
+	check := microchipboot.ApplicationCheck{
+		Delay:   opts.delay,
+		Timeout: opts.timeout,
+	}
+	if opts.banner != "" {
+		check.Banner = []byte(opts.banner)
+		check.Open = func() (io.ReadWriteCloser, error) {
+			return microchipboot.OpenSerialPort(opts.port, opts.baud, 100*time.Millisecond)
+		}
+	}
+	if err := microchipboot.CheckApplication(check); err != nil {
+		return err
+	}
+
+	if opts.probe != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+		defer cancel()
+		if err := exec.CommandContext(ctx, opts.probe).Run(); err != nil {
+			return fmt.Errorf("%w: probe failed: %v", microchipboot.ErrApplicationNotStarted, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/amrbekhit/microchipboot"
+	"github.com/marcinbor85/gohex"
+)
+
+func TestSkipIfSameStillVerifies(t *testing.T) {
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x800, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	mem.AddBinary(0x1000, []byte{0xCA, 0xFE})
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	opts := programOptions{
+		pic: &pic8ProfileOptions{
+			Profile: microchipboot.PIC8Profile{
+				Family:           microchipboot.FamilyPIC18,
+				BootloaderOffset: 0x800,
+				FlashSize:        0x8000,
+				VersionAddress:   0x800,
+				VersionLength:    8,
+			},
+			Options: microchipboot.PIC8Options{VerifyByReading: true},
+		},
+		hexData:    buf.Bytes(),
+		skipIfSame: true,
+	}
+
+	device := newTestDevice()
+	if err := programDevice(device, opts); err != nil {
+		t.Fatal(err)
+	}
+	// The version still matches, so programming is skipped, but verification fails
+	device.Connect()
+	device.WriteFlash(0x1000, []byte{0})
+	if err := programDevice(device, opts); err == nil {
+		t.Error("device with corrupted flash passed")
+	}
+}
+
+func TestProgramChecksImageFirst(t *testing.T) {
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x7F0, make([]byte, 0x20))
+	mem.AddBinary(0x900000, make([]byte, 0x10))
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	opts := programOptions{
+		pic: &pic8ProfileOptions{
+			Profile: microchipboot.PIC8Profile{
+				Family:           microchipboot.FamilyPIC18,
+				BootloaderOffset: 0x800,
+				FlashSize:        0x8000,
+			},
+		},
+		hexData: buf.Bytes(),
+	}
+
+	err := programDevice(newTestDevice(), opts)
+	if err == nil || !strings.Contains(err.Error(), "2 problems found") {
+		t.Errorf("got %v, want both problems found", err)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// persistentBootloader keeps the connection open for the whole session, so that the
+// programmer used by the prompt doesn't reconnect.
+type persistentBootloader struct {
+	microchipboot.Bootloader
+}
+
+func (persistentBootloader) Connect() error { return nil }
+func (persistentBootloader) Disconnect()    {}
+
+// repl runs the interactive prompt. Each line is Starlark code that can use the same
+// functions as scripts run with the run subcommand, so that a sequence tried out at the
+// prompt can be pasted into a script.
+type repl struct {
+	bootloader microchipboot.Bootloader
+	// The bootloader used by the runner, which is pointed at a new context for each line
+	// so that Ctrl-C can abort it.
+	session *persistentBootloader
+	runner  *scriptRunner
+	// The functions available to each line, along with the globals defined by earlier lines.
+	globals starlark.StringDict
+}
+
+// runREPL connects to the device and reads lines from the terminal until the user quits.
+func runREPL(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions) error {
+	if err := bootloader.Connect(); err != nil {
+		return fmt.Errorf("failed to open bootloader: %w", err)
+	}
+	defer bootloader.Disconnect()
+
+	r := newREPL(bootloader, pic)
+	if err := r.runner.connect(); err != nil {
+		return err
+	}
+	lines := newLineReader(os.Stdin, os.Stdout, r.complete)
+	fmt.Println(`connected, type "help()" for a list of functions`)
+	for {
+		line, err := lines.readLine("> ")
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		if err := r.execute(line); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+}
+
+func newREPL(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions) *repl {
+	session := &persistentBootloader{bootloader}
+	r := &repl{
+		bootloader: bootloader,
+		session:    session,
+		runner:     newScriptRunner(session, pic),
+	}
+	if r.runner.programmer != nil {
+		microchipboot.SetProgressHandler(r.runner.programmer, printProgress)
+	}
+	r.globals = r.runner.builtins()
+	r.globals["help"] = starlark.NewBuiltin("help", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+			return nil, err
+		}
+		for _, usage := range scriptHelp {
+			fmt.Println(usage)
+		}
+		fmt.Println("quit                               exit")
+		return starlark.None, nil
+	})
+	return r
+}
+
+// execute runs a line. Ctrl-C aborts it and reopens the connection, rather than exiting.
+func (r *repl) execute(line string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	thread := newScriptThread("<stdin>")
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		select {
+		case <-c:
+			log.Warnf("aborting...")
+			cancel()
+			thread.Cancel("aborted")
+		case <-ctx.Done():
+		}
+	}()
+	defer func() {
+		signal.Stop(c)
+		cancel()
+	}()
+
+	r.session.Bootloader = microchipboot.NewContextBootloader(ctx, r.bootloader)
+	err := r.eval(thread, line)
+	if ctx.Err() != nil {
+		// The connection was closed to abort the line
+		if err := r.bootloader.Connect(); err != nil {
+			return fmt.Errorf("failed to reopen bootloader: %w", err)
+		}
+	}
+	return err
+}
+
+// eval prints the value of an expression, as the Python prompt does, and otherwise runs
+// the line as statements, keeping any globals that it defines for later lines.
+func (r *repl) eval(thread *starlark.Thread, line string) error {
+	if expr, err := syntax.ParseExpr("<stdin>", line, 0); err == nil {
+		value, err := starlark.EvalExpr(thread, expr, r.globals)
+		if err != nil {
+			return scriptError(err)
+		}
+		switch value := value.(type) {
+		case starlark.NoneType:
+		case starlark.Bytes:
+			fmt.Print(hex.Dump([]byte(value)))
+		default:
+			fmt.Println(value)
+		}
+		return nil
+	}
+	globals, err := starlark.ExecFile(thread, "<stdin>", line, r.globals)
+	for name, value := range globals {
+		r.globals[name] = value
+	}
+	return scriptError(err)
+}
+
+// complete returns the candidates for the last word of line, completing the name or
+// module member, or the file name inside a string, at the end of the word.
+func (r *repl) complete(line string) []string {
+	word := line[strings.LastIndex(line, " ")+1:]
+	if quote := strings.LastIndexAny(word, `"'`); quote >= 0 && strings.Count(word, word[quote:quote+1])%2 == 1 {
+		var candidates []string
+		matches, _ := filepath.Glob(word[quote+1:] + "*")
+		for _, match := range matches {
+			if stat, err := os.Stat(match); err == nil && stat.IsDir() {
+				match += string(filepath.Separator)
+			}
+			candidates = append(candidates, word[:quote+1]+match)
+		}
+		return candidates
+	}
+
+	start := strings.LastIndexFunc(word, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '.'
+	}) + 1
+	names := r.globals
+	name := word[start:]
+	prefix := word[:start]
+	if dot := strings.Index(name, "."); dot >= 0 {
+		module, ok := r.globals[name[:dot]].(*starlarkstruct.Module)
+		if !ok {
+			return nil
+		}
+		names = module.Members
+		prefix += name[:dot+1]
+		name = name[dot+1:]
+	}
+
+	var candidates []string
+	for key, value := range names {
+		if !strings.HasPrefix(key, name) {
+			continue
+		}
+		switch value.(type) {
+		case *starlarkstruct.Module:
+			key += "."
+		case starlark.Callable:
+			key += "("
+		}
+		candidates = append(candidates, prefix+key)
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// lineReader reads lines from the terminal with history and tab completion. If the input
+// isn't a terminal, lines are read as they are.
+type lineReader struct {
+	in       *os.File
+	out      io.Writer
+	reader   *bufio.Reader
+	complete func(line string) []string
+	history  []string
+}
+
+func newLineReader(in *os.File, out io.Writer, complete func(string) []string) *lineReader {
+	return &lineReader{
+		in:       in,
+		out:      out,
+		reader:   bufio.NewReader(in),
+		complete: complete,
+	}
+}
+
+// Control characters handled by the line editor.
+const (
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyBackspace = 8
+	keyTab       = 9
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// readLine prints the prompt and reads a line. It returns io.EOF at the end of the input
+// or if Ctrl-D is pressed on an empty line.
+func (l *lineReader) readLine(prompt string) (string, error) {
+	fmt.Fprint(l.out, prompt)
+	restore, err := makeRaw(int(l.in.Fd()))
+	if err != nil {
+		line, err := l.reader.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restore()
+
+	line := ""
+	historyIndex := len(l.history)
+	redraw := func() {
+		fmt.Fprintf(l.out, "\r\x1b[K%v%v", prompt, line)
+	}
+	for {
+		b, err := l.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case b == '\r' || b == '\n':
+			fmt.Fprint(l.out, "\r\n")
+			if strings.TrimSpace(line) != "" {
+				l.history = append(l.history, line)
+			}
+			return line, nil
+		case b == keyCtrlC:
+			fmt.Fprint(l.out, "^C\r\n")
+			line = ""
+			historyIndex = len(l.history)
+			redraw()
+		case b == keyCtrlD:
+			if line == "" {
+				return "", io.EOF
+			}
+		case b == keyBackspace || b == keyDelete:
+			if line != "" {
+				line = line[:len(line)-1]
+				fmt.Fprint(l.out, "\b \b")
+			}
+		case b == keyTab:
+			line = l.completeLine(prompt, line)
+		case b == keyEscape:
+			// Only the up and down arrows are supported, for the history
+			seq := make([]byte, 2)
+			if _, err := io.ReadFull(l.reader, seq); err != nil {
+				return "", err
+			}
+			switch {
+			case seq[0] != '[':
+			case seq[1] == 'A' && historyIndex > 0:
+				historyIndex--
+				line = l.history[historyIndex]
+				redraw()
+			case seq[1] == 'B' && historyIndex < len(l.history):
+				historyIndex++
+				line = ""
+				if historyIndex < len(l.history) {
+					line = l.history[historyIndex]
+				}
+				redraw()
+			}
+		case b >= ' ' && b < keyDelete:
+			line += string(b)
+			fmt.Fprintf(l.out, "%c", b)
+		}
+	}
+}
+
+// completeLine completes the last word of line as far as the candidates agree, listing
+// them if there is more than one.
+func (l *lineReader) completeLine(prompt, line string) string {
+	candidates := l.complete(line)
+	if len(candidates) == 0 {
+		return line
+	}
+	word := line[strings.LastIndex(line, " ")+1:]
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	completed := line[:len(line)-len(word)] + prefix
+	if len(candidates) > 1 && prefix == word {
+		fmt.Fprintf(l.out, "\r\n%v\r\n", strings.Join(candidates, "  "))
+	}
+	fmt.Fprintf(l.out, "\r\x1b[K%v%v", prompt, completed)
+	return completed
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/amrbekhit/microchipboot"
+	"github.com/marcinbor85/gohex"
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// scriptRunner holds the state of a programming session driven by a script: the
+// connection, the programmer and the image being built up. Starlark code, whether run
+// with the run subcommand or typed at the interactive prompt, calls its methods through
+// the modules returned by builtins, while batch scripts call them directly.
+type scriptRunner struct {
+	bootloader microchipboot.Bootloader
+	// Only set if a profile was given, which is needed for loading, programming and verifying.
+	pic        *pic8ProfileOptions
+	programmer microchipboot.Programmer
+	// Device info used to split writes, read when it is first needed.
+	info      *microchipboot.VersionInfo
+	image     *gohex.Memory
+	connected bool
+}
+
+func newScriptRunner(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions) *scriptRunner {
+	s := &scriptRunner{
+		bootloader: bootloader,
+		pic:        pic,
+	}
+	if pic != nil {
+		s.programmer = microchipboot.NewPIC8Programmer(bootloader, pic.Profile, pic.Options)
+	}
+	return s
+}
+
+// scriptHelp lists the functions that scripts can use besides the Starlark built-ins.
+var scriptHelp = []string{
+	"device.connect()                   connect to the device",
+	"device.disconnect()                disconnect from the device",
+	"device.version()                   return the version info as a struct",
+	"device.read(region, addr, len)     read flash, eeprom or config memory as bytes",
+	"device.write(region, addr, data)   write bytes to flash, eeprom or config memory",
+	"device.erase(addr, rows)           erase flash rows",
+	"device.reset()                     reset the device",
+	"device.command(name, args...)      run one of the commands available via -cmd",
+	"image.load_file(file)              load a hex, ELF, S-record or package file",
+	"image.patch(addr, data)            overwrite bytes of the image",
+	"image.program()                    erase and write the image (needs -profile)",
+	"image.verify()                     verify the image (needs -profile)",
+	"sleep(duration)                    wait, e.g. sleep(\"500ms\")",
+	"getenv(name)                       return an environment variable",
+	"hex(data), unhex(text)             convert between bytes and hex strings",
+}
+
+// runScript executes a Starlark script with the given arguments, which are available to
+// the script as the args list, along with the functions listed in scriptHelp. if, for
+// and while statements are allowed at the top level. The script stops at the first error.
+func runScript(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions, filename string, args []string) error {
+	s := newScriptRunner(bootloader, pic)
+	defer s.disconnect()
+
+	predeclared := s.builtins()
+	argList := make([]starlark.Value, len(args))
+	for i, arg := range args {
+		argList[i] = starlark.String(arg)
+	}
+	predeclared["args"] = starlark.NewList(argList)
+
+	_, err := starlark.ExecFile(newScriptThread(filename), filename, nil, predeclared)
+	return scriptError(err)
+}
+
+// newScriptThread returns a thread to run Starlark code on, printing to stdout.
+func newScriptThread(name string) *starlark.Thread {
+	resolve.AllowGlobalReassign = true
+	resolve.AllowRecursion = true
+	return &starlark.Thread{
+		Name:  name,
+		Print: func(_ *starlark.Thread, msg string) { fmt.Println(msg) },
+	}
+}
+
+// scriptError reports the position in the script where err occurred, rather than the
+// whole backtrace.
+func scriptError(err error) error {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		for i := 0; i < len(evalErr.CallStack); i++ {
+			if pos := evalErr.CallStack.At(i).Pos; pos.Line > 0 {
+				return fmt.Errorf("%v: %v", pos, evalErr.Msg)
+			}
+		}
+	}
+	return err
+}
+
+// builtins returns the functions and modules available to scripts.
+func (s *scriptRunner) builtins() starlark.StringDict {
+	// function wraps a script function that doesn't return a value.
+	function := func(name string, f func(args starlark.Tuple, kwargs []starlark.Tuple) error) *starlark.Builtin {
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return starlark.None, f(args, kwargs)
+		})
+	}
+	// data returns the contents of a bytes or string argument.
+	data := func(fnname string, v starlark.Value) ([]byte, error) {
+		switch v := v.(type) {
+		case starlark.Bytes:
+			return []byte(v), nil
+		case starlark.String:
+			return []byte(v), nil
+		}
+		return nil, fmt.Errorf("%v: expected bytes, got %v", fnname, v.Type())
+	}
+
+	device := &starlarkstruct.Module{Name: "device", Members: starlark.StringDict{
+		"connect": function("device.connect", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			if err := starlark.UnpackArgs("device.connect", args, kwargs); err != nil {
+				return err
+			}
+			return s.connect()
+		}),
+		"disconnect": function("device.disconnect", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			if err := starlark.UnpackArgs("device.disconnect", args, kwargs); err != nil {
+				return err
+			}
+			s.disconnect()
+			return nil
+		}),
+		"version": starlark.NewBuiltin("device.version", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+				return nil, err
+			}
+			info, err := s.bootloader.GetVersion()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read version: %w", err)
+			}
+			return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"major":           starlark.MakeInt(info.VersionMajor),
+				"minor":           starlark.MakeInt(info.VersionMinor),
+				"device_id":       starlark.MakeInt(info.DeviceID),
+				"max_packet_size": starlark.MakeInt(info.MaxPacketSize),
+				"erase_row_size":  starlark.MakeInt(info.EraseRowSize),
+				"write_row_size":  starlark.MakeInt(info.WriteRowSize),
+			}), nil
+		}),
+		"read": starlark.NewBuiltin("device.read", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var region string
+			var addr, length int
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "region", &region, "addr", &addr, "len", &length); err != nil {
+				return nil, err
+			}
+			data, err := s.read(region, uint32(addr), length)
+			if err != nil {
+				return nil, err
+			}
+			return starlark.Bytes(data), nil
+		}),
+		"write": function("device.write", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			var region string
+			var addr int
+			var value starlark.Value
+			if err := starlark.UnpackArgs("device.write", args, kwargs, "region", &region, "addr", &addr, "data", &value); err != nil {
+				return err
+			}
+			d, err := data("device.write", value)
+			if err != nil {
+				return err
+			}
+			return s.write(region, uint32(addr), d)
+		}),
+		"erase": function("device.erase", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			var addr, rows int
+			if err := starlark.UnpackArgs("device.erase", args, kwargs, "addr", &addr, "rows", &rows); err != nil {
+				return err
+			}
+			return s.erase(uint32(addr), uint16(rows))
+		}),
+		"reset": function("device.reset", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			if err := starlark.UnpackArgs("device.reset", args, kwargs); err != nil {
+				return err
+			}
+			return s.reset()
+		}),
+		"command": function("device.command", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			if len(args) == 0 || len(kwargs) > 0 {
+				return fmt.Errorf("device.command: expected a command name and its arguments")
+			}
+			fields := make([]string, len(args))
+			for i, arg := range args {
+				if s, ok := starlark.AsString(arg); ok {
+					fields[i] = s
+				} else {
+					fields[i] = arg.String()
+				}
+			}
+			command, ok := commands[fields[0]]
+			if !ok {
+				return fmt.Errorf("device.command: invalid command %v", fields[0])
+			}
+			return command(s.bootloader, fields[1:])
+		}),
+	}}
+
+	image := &starlarkstruct.Module{Name: "image", Members: starlark.StringDict{
+		"load_file": function("image.load_file", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			var filename string
+			if err := starlark.UnpackArgs("image.load_file", args, kwargs, "file", &filename); err != nil {
+				return err
+			}
+			return s.load(filename)
+		}),
+		"patch": function("image.patch", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			var addr int
+			var value starlark.Value
+			if err := starlark.UnpackArgs("image.patch", args, kwargs, "addr", &addr, "data", &value); err != nil {
+				return err
+			}
+			d, err := data("image.patch", value)
+			if err != nil {
+				return err
+			}
+			return s.patch(uint32(addr), d)
+		}),
+		"program": function("image.program", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			if err := starlark.UnpackArgs("image.program", args, kwargs); err != nil {
+				return err
+			}
+			return s.program()
+		}),
+		"verify": function("image.verify", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			if err := starlark.UnpackArgs("image.verify", args, kwargs); err != nil {
+				return err
+			}
+			return s.verify()
+		}),
+	}}
+
+	return starlark.StringDict{
+		"device": device,
+		"image":  image,
+		"sleep": function("sleep", func(args starlark.Tuple, kwargs []starlark.Tuple) error {
+			var duration string
+			if err := starlark.UnpackArgs("sleep", args, kwargs, "duration", &duration); err != nil {
+				return err
+			}
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				return fmt.Errorf("invalid duration: %w", err)
+			}
+			time.Sleep(d)
+			return nil
+		}),
+		"getenv": starlark.NewBuiltin("getenv", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name); err != nil {
+				return nil, err
+			}
+			return starlark.String(os.Getenv(name)), nil
+		}),
+		"hex": starlark.NewBuiltin("hex", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var value starlark.Value
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "data", &value); err != nil {
+				return nil, err
+			}
+			d, err := data(b.Name(), value)
+			if err != nil {
+				return nil, err
+			}
+			return starlark.String(fmt.Sprintf("%X", d)), nil
+		}),
+		"unhex": starlark.NewBuiltin("unhex", func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var text string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "text", &text); err != nil {
+				return nil, err
+			}
+			d, err := hex.DecodeString(text)
+			if err != nil {
+				return nil, fmt.Errorf("unhex: invalid hex %q", text)
+			}
+			return starlark.Bytes(d), nil
+		}),
+	}
+}
+
+func (s *scriptRunner) connect() error {
+	var err error
+	if s.programmer != nil {
+		err = s.programmer.Connect()
+	} else {
+		err = s.bootloader.Connect()
+	}
+	s.connected = err == nil
+	return err
+}
+
+func (s *scriptRunner) disconnect() {
+	if s.connected {
+		s.bootloader.Disconnect()
+		s.connected = false
+	}
+}
+
+func (s *scriptRunner) erase(addr uint32, rows uint16) error {
+	if err := s.bootloader.EraseFlash(addr, rows); err != nil {
+		return fmt.Errorf("failed to erase flash: %w", err)
+	}
+	return nil
+}
+
+func (s *scriptRunner) reset() error {
+	if err := s.bootloader.Reset(); err != nil {
+		return fmt.Errorf("failed to reset: %w", err)
+	}
+	return nil
+}
+
+// load reads a firmware file into the image, replacing the current image.
+func (s *scriptRunner) load(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var data io.Reader = file
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".pkg":
+		keys, err := loadPackageKeys(packageKeyFile, packageDecryptKeyFile)
+		if err != nil {
+			return err
+		}
+		pkg, err := microchipboot.OpenPackage(file, keys)
+		if err != nil {
+			return err
+		}
+		log.Infof("loaded package version %q created %v", pkg.Metadata.Version, pkg.Metadata.Created)
+		data = bytes.NewReader(pkg.Hex)
+	case ".elf":
+		buf := new(bytes.Buffer)
+		if err := microchipboot.ConvertELFToHex(file, buf); err != nil {
+			return err
+		}
+		data = buf
+	case ".srec", ".s19", ".s28", ".s37":
+		buf := new(bytes.Buffer)
+		if err := microchipboot.ConvertSRECToHex(file, buf); err != nil {
+			return err
+		}
+		data = buf
+	}
+	image := gohex.NewMemory()
+	if err := image.ParseIntelHex(data); err != nil {
+		return fmt.Errorf("failed to parse hex file: %w", err)
+	}
+	s.image = image
+	return nil
+}
+
+// patch overwrites bytes of the image.
+func (s *scriptRunner) patch(addr uint32, data []byte) error {
+	if s.image == nil {
+		return fmt.Errorf("no image loaded")
+	}
+	s.image.SetBinary(addr, data)
+	return nil
+}
+
+func (s *scriptRunner) program() error {
+	if err := s.loadImage(); err != nil {
+		return err
+	}
+	log.Infof("programming...")
+	return s.programmer.Program()
+}
+
+func (s *scriptRunner) verify() error {
+	if err := s.loadImage(); err != nil {
+		return err
+	}
+	log.Infof("verifying...")
+	return s.programmer.Verify()
+}
+
+// loadImage passes the current image, including any patches, to the programmer.
+func (s *scriptRunner) loadImage() error {
+	if s.programmer == nil {
+		return fmt.Errorf("a profile must be specified to program or verify")
+	}
+	if s.image == nil {
+		return fmt.Errorf("no image loaded")
+	}
+	buf := new(bytes.Buffer)
+	if err := s.image.DumpIntelHex(buf, 16); err != nil {
+		return err
+	}
+	return s.programmer.LoadHex(buf)
+}
+
+// read reads the named memory region of the device.
+func (s *scriptRunner) read(region string, addr uint32, length int) ([]byte, error) {
+	var readFunc func(uint32, uint16) ([]byte, error)
+	switch region {
+	case "flash":
+		readFunc = s.bootloader.ReadFlash
+	case "eeprom":
+		readFunc = s.bootloader.ReadEE
+	case "config":
+		readFunc = s.bootloader.ReadConfig
+	default:
+		return nil, fmt.Errorf("invalid region %v", region)
+	}
+	if length <= 0 || length > 0xFFFF {
+		return nil, fmt.Errorf("invalid length %v", length)
+	}
+	data, err := readFunc(addr, uint16(length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", region, err)
+	}
+	return data, nil
+}
+
+// write writes data to the named memory region of the device in pieces no larger than
+// the region's write size, as given by the profile or the device's write row size.
+func (s *scriptRunner) write(regionName string, addr uint32, data []byte) error {
+	var writeFunc func(uint32, []byte) error
+	var region microchipboot.Region
+	switch regionName {
+	case "flash":
+		writeFunc, region = s.bootloader.WriteFlash, microchipboot.RegionFlash
+	case "eeprom":
+		writeFunc, region = s.bootloader.WriteEE, microchipboot.RegionEEPROM
+	case "config":
+		writeFunc, region = s.bootloader.WriteConfig, microchipboot.RegionConfig
+	default:
+		return fmt.Errorf("invalid region %v", regionName)
+	}
+
+	chunkSize, err := s.writeSize(region)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := writeFunc(addr+uint32(offset), data[offset:end]); err != nil {
+			return fmt.Errorf("failed to write %v at %X: %w", regionName, addr+uint32(offset), err)
+		}
+	}
+	return nil
+}
+
+// writeSize returns the number of bytes of the region to write per command.
+func (s *scriptRunner) writeSize(region microchipboot.Region) (int, error) {
+	if s.info == nil {
+		var info microchipboot.VersionInfo
+		if s.programmer != nil {
+			info = s.programmer.GetVersionInfo()
+		}
+		if info.WriteRowSize == 0 {
+			var err error
+			if info, err = s.bootloader.GetVersion(); err != nil {
+				return 0, fmt.Errorf("failed to get device info: %w", err)
+			}
+		}
+		s.info = &info
+	}
+	var profile microchipboot.PIC8Profile
+	if s.pic != nil {
+		profile = s.pic.Profile
+	}
+	size := profile.WriteSize(region, *s.info)
+	if size <= 0 {
+		return 0, fmt.Errorf("the device doesn't report a write row size")
+	}
+	return size, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/amrbekhit/microchipboot"
+	"github.com/marcinbor85/gohex"
+	"go.starlark.net/starlark"
+)
+
+// writeTempFile writes a file to a temporary directory, which is removed by the cleanup
+// function that is returned.
+func writeTempFile(t *testing.T, name, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "microchipboot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func newTestDevice() *microchipboot.SimulatedBootloader {
+	return microchipboot.NewSimulatedBootloader(microchipboot.SimulatedDevice{
+		Info:   microchipboot.VersionInfo{MaxPacketSize: 128, EraseRowSize: 64, WriteRowSize: 64},
+		Flash:  []microchipboot.AddressRange{{Start: 0, End: 0x8000}},
+		EEPROM: microchipboot.AddressRange{Start: 0xF00000, End: 0xF00100},
+		Config: microchipboot.AddressRange{Start: 0x300000, End: 0x30000E},
+	})
+}
+
+func TestScriptCommandErrors(t *testing.T) {
+	script, cleanup := writeTempFile(t, "test.star", "device.connect()\ndevice.read(\"flash\", 0x9000, 16)\nprint(\"not reached\")\n")
+	defer cleanup()
+
+	err := runScript(newTestDevice(), nil, script, nil)
+	if err == nil || !strings.Contains(err.Error(), "test.star:2") {
+		t.Errorf("got %v, want an error on line 2", err)
+	}
+}
+
+func TestScriptPatchesSerial(t *testing.T) {
+	profile, cleanup := writeTempFile(t, "profile.yaml", `
+profile:
+  family: pic18
+  bootloaderoffset: 0x800
+  flashsize: 0x8000
+`)
+	defer cleanup()
+	dir := filepath.Dir(profile)
+	pic, err := loadProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x800, []byte{1, 2, 3, 4})
+	image := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(image, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.hex"), image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "program.star")
+	if err := ioutil.WriteFile(script, []byte(`
+device.connect()
+serial = device.read("eeprom", 0xF00000, 4)
+if serial == b"\xff\xff\xff\xff":
+    fail("no serial number")
+image.load_file(args[0])
+image.patch(0x900, serial)
+image.program()
+image.verify()
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	device := newTestDevice()
+	device.Connect()
+	device.WriteEE(0xF00000, []byte{0x12, 0x34, 0x56, 0x78})
+	if err := runScript(device, pic, script, []string{filepath.Join(dir, "app.hex")}); err != nil {
+		t.Fatal(err)
+	}
+
+	device.Connect()
+	if flash, _ := device.ReadFlash(0x800, 4); !bytes.Equal(flash, []byte{1, 2, 3, 4}) {
+		t.Errorf("flash is %X", flash)
+	}
+	if serial, _ := device.ReadFlash(0x900, 4); !bytes.Equal(serial, []byte{0x12, 0x34, 0x56, 0x78}) {
+		t.Errorf("serial number in flash is %X", serial)
+	}
+}
+
+func TestREPL(t *testing.T) {
+	device := newTestDevice()
+	device.Connect()
+	r := newREPL(device, nil)
+	if err := r.runner.connect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`data = unhex("CAFE")`, `device.write("flash", 0x800, data)`, `read = device.read("flash", 0x800, 2)`} {
+		if err := r.execute(line); err != nil {
+			t.Fatalf("%v: %v", line, err)
+		}
+	}
+	if got := r.globals["read"]; got != starlark.Bytes("\xCA\xFE") {
+		t.Errorf("read %v", got)
+	}
+	if err := r.execute(`device.read("flash", 0x9000, 2)`); err == nil || !strings.Contains(err.Error(), "<stdin>:1") {
+		t.Errorf("got %v, want an error on line 1", err)
+	}
+
+	tests := map[string][]string{
+		"dev":            {"device."},
+		"x = device.re":  {"device.read(", "device.reset("},
+		"print(rea":      {"print(read"},
+		"print(missing.": nil,
+	}
+	for line, want := range tests {
+		if got := r.complete(line); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q completes to %q, want %q", line, got, want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "fmt"
+
+// parseLineState parses the state of a serial port control line given on the command
+// line. An empty string leaves the line unchanged and returns nil.
+func parseLineState(s string) (*bool, error) {
+	var state bool
+	switch s {
+	case "":
+		return nil, nil
+	case "on", "1", "high":
+		state = true
+	case "off", "0", "low":
+		state = false
+	default:
+		return nil, fmt.Errorf("expected on or off, got %q", s)
+	}
+	return &state, nil
+}
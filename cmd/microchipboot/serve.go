@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/marcinbor85/gohex"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum size of an uploaded hex file.
+const maxImageSize = 16 << 20
+
+// Environment variable that the server's token is taken from by default.
+const serverTokenEnv = "MICROCHIPBOOT_TOKEN"
+
+// How often job status is checked when waiting for a job or streaming its events.
+const serverPollInterval = 200 * time.Millisecond
+
+// server exposes the job daemon over HTTP so that a programming station can be driven
+// from a web UI or another language. Jobs are queued per port in the same way as in
+// daemon mode. Every request must carry the server's token as a bearer token, and jobs
+// can only use the ports that the server allows.
+//
+//	POST /api/images              upload a hex file (request body), returns its id
+//	GET  /api/profiles            list the available profiles
+//	POST /api/jobs                start programming: {"port", "baud", "profile", "image"}
+//	GET  /api/jobs                list all jobs
+//	GET  /api/jobs/{id}           get the status of a job
+//	GET  /api/jobs/{id}/events    stream the status of a job as server-sent events
+//	GET  /api/version?port=&baud= read the version info of the device on a port
+type server struct {
+	daemon      *daemon
+	profilesDir string
+	imagesDir   string
+	token       string
+	// Ports that jobs may use.
+	ports map[string]bool
+}
+
+// jobRequest is the body of a request to start a programming job.
+type jobRequest struct {
+	Port    string `json:"port"`
+	Baud    int    `json:"baud"`
+	Profile string `json:"profile"`
+	Image   string `json:"image"`
+}
+
+// runServeCommand runs the HTTP server until the program is stopped.
+func runServeCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8080", "Address to listen on.")
+	profilesDir := flags.String("profiles", ".", "Directory containing the profiles that can be selected.")
+	imagesDir := flags.String("images", "", "Directory that uploaded hex files are stored in. Defaults to a temporary directory.")
+	token := flags.String("token", os.Getenv(serverTokenEnv), "Token that clients must send as a bearer token. Defaults to $"+serverTokenEnv+".")
+	ports := flags.String("ports", "", "Comma separated list of the serial ports that jobs may use.")
+	flags.Parse(args)
+
+	if *token == "" {
+		log.Fatalf("must specify a token with -token or $%v", serverTokenEnv)
+	}
+	if *ports == "" {
+		log.Fatalf("must specify the allowed ports with -ports")
+	}
+
+	if *imagesDir == "" {
+		dir, err := ioutil.TempDir("", "microchipboot")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		*imagesDir = dir
+	}
+
+	s := &server{
+		daemon:      newDaemon(),
+		profilesDir: *profilesDir,
+		imagesDir:   *imagesDir,
+		token:       *token,
+		ports:       make(map[string]bool),
+	}
+	for _, port := range strings.Split(*ports, ",") {
+		s.ports[strings.TrimSpace(port)] = true
+	}
+	log.Infof("listening on %v", *listen)
+	log.Fatal(http.ListenAndServe(*listen, s.handler()))
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/images", s.handleImages)
+	mux.HandleFunc("/api/profiles", s.handleProfiles)
+	mux.HandleFunc("/api/jobs", s.handleJobs)
+	mux.HandleFunc("/api/jobs/", s.handleJob)
+	mux.HandleFunc("/api/version", s.handleVersion)
+	return s.authenticate(mux)
+}
+
+// authenticate rejects requests that don't carry the server's token.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkPort returns an error if jobs may not use the port.
+func (s *server) checkPort(port string) error {
+	if !s.ports[port] {
+		return fmt.Errorf("port %q is not allowed", port)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// handleImages stores an uploaded hex file. Images are named after their hash, so
+// uploading the same file twice returns the same id.
+func (s *server) handleImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxImageSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := gohex.NewMemory().ParseIntelHex(bytes.NewReader(data)); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid hex file: %w", err))
+		return
+	}
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:8])
+	if err := ioutil.WriteFile(s.imagePath(id), data, 0644); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": id})
+}
+
+func (s *server) imagePath(id string) string {
+	return filepath.Join(s.imagesDir, id+".hex")
+}
+
+// profilePath returns the path of the named profile, making sure that it lies in the
+// profiles directory.
+func (s *server) profilePath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid profile name %q", name)
+	}
+	path := filepath.Join(s.profilesDir, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("unknown profile %q", name)
+	}
+	return path, nil
+}
+
+func (s *server) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	var profiles []string
+	for _, ext := range []string{"*.yaml", "*.yml", "*.json", "*.toml"} {
+		files, err := filepath.Glob(filepath.Join(s.profilesDir, ext))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, f := range files {
+			profiles = append(profiles, filepath.Base(f))
+		}
+	}
+	writeJSON(w, http.StatusOK, profiles)
+}
+
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.daemon.jobs())
+
+	case http.MethodPost:
+		var req jobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.checkPort(req.Port); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		profile, err := s.profilePath(req.Profile)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		image := s.imagePath(filepath.Base(req.Image))
+		if _, err := os.Stat(image); req.Image == "" || err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown image %q", req.Image))
+			return
+		}
+		status, err := s.daemon.submit(job{Port: req.Port, Baud: req.Baud, Profile: profile, Hex: image})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		st, _ := s.daemon.job(status.ID)
+		writeJSON(w, http.StatusAccepted, st)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+}
+
+// handleJob returns the status of a job, or streams it if the path ends in /events.
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/")
+	status, ok := s.daemon.job(parts[0])
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown job %q", parts[0]))
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		writeJSON(w, http.StatusOK, status)
+	case len(parts) == 2 && parts[1] == "events":
+		s.streamJob(w, r, status.ID)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+	}
+}
+
+// streamJob sends the status of a job as a server-sent event each time that it changes,
+// until the job has finished or the client goes away.
+func (s *server) streamJob(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var last jobStatus
+	for first := true; ; first = false {
+		status, _ := s.daemon.job(id)
+		if first || !reflect.DeepEqual(status, last) {
+			data, err := json.Marshal(status)
+			if err != nil {
+				log.Errorf("failed to encode job status: %v", err)
+				return
+			}
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+			flusher.Flush()
+			last = status
+		}
+		if status.State == jobPassed || status.State == jobFailed {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(serverPollInterval):
+		}
+	}
+}
+
+// waitJob waits for a job to finish and returns its final status.
+func (s *server) waitJob(r *http.Request, id string) (jobStatus, error) {
+	for {
+		status, _ := s.daemon.job(id)
+		if status.State == jobPassed || status.State == jobFailed {
+			return status, nil
+		}
+		select {
+		case <-r.Context().Done():
+			return status, r.Context().Err()
+		case <-time.After(serverPollInterval):
+		}
+	}
+}
+
+// handleVersion reads the version info of the device on a port. The request is queued
+// behind any other jobs on the port.
+func (s *server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	j := job{Action: actionVersion, Port: r.URL.Query().Get("port")}
+	if err := s.checkPort(j.Port); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	if baud := r.URL.Query().Get("baud"); baud != "" {
+		if _, err := fmt.Sscan(baud, &j.Baud); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid baud rate %q", baud))
+			return
+		}
+	}
+	submitted, err := s.daemon.submit(j)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	status, err := s.waitJob(r, submitted.ID)
+	if err != nil {
+		return
+	}
+	if status.State == jobFailed {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("%v", status.Error))
+		return
+	}
+	writeJSON(w, http.StatusOK, status.Version)
+}
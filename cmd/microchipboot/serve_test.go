@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerAuthentication(t *testing.T) {
+	s := &server{
+		daemon: newDaemon(),
+		token:  "secret",
+		ports:  map[string]bool{"/dev/ttyUSB0": true},
+	}
+	handler := s.handler()
+
+	tests := []struct {
+		token string
+		body  string
+		want  int
+	}{
+		{"", `{"port":"/dev/ttyUSB0"}`, http.StatusUnauthorized},
+		{"wrong", `{"port":"/dev/ttyUSB0"}`, http.StatusUnauthorized},
+		{"secret", `{"port":"/dev/ttyS0"}`, http.StatusForbidden},
+		{"secret", `{"port":"/dev/ttyUSB0","profile":"../profile.yaml"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/jobs", strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("token %q body %v: got status %v, want %v", test.token, test.body, rec.Code, test.want)
+		}
+	}
+}
+
+func TestJobHistoryIsCapped(t *testing.T) {
+	d := newDaemon()
+	for i := 0; i < jobHistorySize+10; i++ {
+		d.history = append(d.history, &jobStatus{State: jobPassed})
+	}
+	d.history = append(d.history, &jobStatus{State: jobQueued})
+	d.pruneHistory()
+	if len(d.history) != jobHistorySize {
+		t.Errorf("got %v jobs, want %v", len(d.history), jobHistorySize)
+	}
+	if d.history[len(d.history)-1].State != jobQueued {
+		t.Errorf("queued job dropped from the history")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func termiosIoctl(fd int, request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRaw puts the terminal into raw mode, so that key presses are read one at a time
+// without being echoed, and returns a function that restores the previous mode. It fails
+// if fd isn't a terminal.
+func makeRaw(fd int) (func(), error) {
+	var old syscall.Termios
+	if err := termiosIoctl(fd, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.ISIG | syscall.IEXTEN
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := termiosIoctl(fd, syscall.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() {
+		termiosIoctl(fd, syscall.TCSETS, &old)
+	}, nil
+}
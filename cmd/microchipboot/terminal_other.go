@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("line editing is only supported on Linux")
+}
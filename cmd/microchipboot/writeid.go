@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/amrbekhit/microchipboot"
+	log "github.com/sirupsen/logrus"
+)
+
+// runWriteID programs the user ID locations without touching the rest of the device.
+// args are either "serial" followed by a number, which fills every ID location, or
+// "text" followed by a string.
+func runWriteID(bootloader microchipboot.Bootloader, pic *pic8ProfileOptions, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected: writeid serial|text value")
+	}
+	var id []byte
+	switch args[0] {
+	case "serial":
+		serial, err := strconv.ParseUint(args[1], 0, 64)
+		if err != nil {
+			return fmt.Errorf("invalid serial number: %w", err)
+		}
+		if id, err = microchipboot.UserIDFromSerial(serial, pic.Profile.UserIDLength()); err != nil {
+			return err
+		}
+	case "text":
+		id = []byte(args[1])
+	default:
+		return fmt.Errorf("invalid user id format %v", args[0])
+	}
+
+	// Only the ID locations are written, and they are always verified by reading, as the
+	// checksum only covers flash
+	options := pic.Options
+	options.ProgramID = true
+	options.ProgramEEPROM = false
+	options.ProgramConfig = false
+	options.PreserveEEPROM = false
+	options.EraseAll = false
+	options.SkipIfUpToDate = false
+	options.VerifyByReading = true
+	prog := microchipboot.NewPIC8Programmer(bootloader, pic.Profile, options)
+	log.Infof("connecting to device...")
+	if err := prog.Connect(); err != nil {
+		return err
+	}
+	defer prog.Disconnect()
+
+	if err := microchipboot.SetUserID(prog, id); err != nil {
+		return err
+	}
+	log.Infof("writing user id...")
+	if err := prog.Program(); err != nil {
+		return err
+	}
+	log.Infof("verifying...")
+	if err := prog.Verify(); err != nil {
+		return err
+	}
+	printResult("writeid", map[string]interface{}{
+		"id": hex.EncodeToString(id),
+	}, fmt.Sprintf("wrote user id %X\n", id))
+	return nil
+}
@@ -0,0 +1,159 @@
+package microchipboot
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// ConfigField describes a field of the config words, so that raw config bytes can be
+// decoded into named settings.
+type ConfigField struct {
+	// Name of the field as used in the datasheet, e.g. WDTE.
+	Name        string
+	Description string
+	// Offset of the field's config word from the start of the config region.
+	Offset uint32
+	// Mask of the field's bits within the little endian 16-bit word at Offset. The
+	// field's value is the masked bits shifted down to bit 0.
+	Mask uint16
+	// Optional names of the field's values, e.g. 0: disabled.
+	Values map[uint16]string
+}
+
+// size returns the number of bytes that the field's config word occupies.
+func (f ConfigField) size() uint32 {
+	if f.Mask > 0xFF {
+		return 2
+	}
+	return 1
+}
+
+// ConfigSetting is the value of a config field, as decoded by DecodeConfig.
+type ConfigSetting struct {
+	Name        string
+	Description string `json:",omitempty"`
+	Value       uint16
+	// Name of the value from the field's Values, or empty if it isn't listed.
+	Meaning string `json:",omitempty"`
+}
+
+func (s ConfigSetting) String() string {
+	text := fmt.Sprintf("%v = %v", s.Name, s.Value)
+	if s.Meaning != "" {
+		text += " (" + s.Meaning + ")"
+	}
+	if s.Description != "" {
+		text += ": " + s.Description
+	}
+	return text
+}
+
+// Tables used to decode the config words of each family when the profile doesn't list its
+// own ConfigFields. They only cover fields that are common to most devices in the family,
+// so a profile should list the fields of its device for a complete decode.
+var configTables = map[string][]ConfigField{
+	// CONFIG1 and CONFIG2 of enhanced mid-range devices
+	FamilyPIC16: {
+		{Name: "FOSC", Description: "Oscillator selection", Offset: 0, Mask: 0x0007},
+		{Name: "WDTE", Description: "Watchdog timer enable", Offset: 0, Mask: 0x0018,
+			Values: map[uint16]string{0: "disabled", 1: "controlled by SWDTEN", 2: "enabled while running", 3: "enabled"}},
+		{Name: "PWRTE", Description: "Power-up timer enable", Offset: 0, Mask: 0x0020,
+			Values: map[uint16]string{0: "enabled", 1: "disabled"}},
+		{Name: "MCLRE", Description: "MCLR pin function", Offset: 0, Mask: 0x0040,
+			Values: map[uint16]string{0: "digital input", 1: "MCLR"}},
+		{Name: "CP", Description: "Flash program memory code protection", Offset: 0, Mask: 0x0080,
+			Values: map[uint16]string{0: "enabled", 1: "disabled"}},
+		{Name: "BOREN", Description: "Brown-out reset enable", Offset: 0, Mask: 0x0600,
+			Values: map[uint16]string{0: "disabled", 1: "controlled by SBOREN", 2: "enabled while running", 3: "enabled"}},
+		{Name: "STVREN", Description: "Stack overflow/underflow reset enable", Offset: 2, Mask: 0x0200,
+			Values: map[uint16]string{0: "disabled", 1: "enabled"}},
+		{Name: "LVP", Description: "Low voltage programming enable", Offset: 2, Mask: 0x2000,
+			Values: map[uint16]string{0: "disabled", 1: "enabled"}},
+	},
+	// CONFIG1L to CONFIG5L
+	FamilyPIC18: {
+		{Name: "FOSC", Description: "Oscillator selection", Offset: 1, Mask: 0x0F},
+		{Name: "PWRTEN", Description: "Power-up timer enable", Offset: 2, Mask: 0x01,
+			Values: map[uint16]string{0: "enabled", 1: "disabled"}},
+		{Name: "BOREN", Description: "Brown-out reset enable", Offset: 2, Mask: 0x06},
+		{Name: "WDTEN", Description: "Watchdog timer enable", Offset: 3, Mask: 0x01,
+			Values: map[uint16]string{0: "disabled", 1: "enabled"}},
+		{Name: "STVREN", Description: "Stack full/underflow reset enable", Offset: 6, Mask: 0x01,
+			Values: map[uint16]string{0: "disabled", 1: "enabled"}},
+		{Name: "LVP", Description: "Low voltage programming enable", Offset: 6, Mask: 0x04,
+			Values: map[uint16]string{0: "disabled", 1: "enabled"}},
+		{Name: "CP0", Description: "Code protection of block 0", Offset: 8, Mask: 0x01,
+			Values: map[uint16]string{0: "enabled", 1: "disabled"}},
+	},
+}
+
+// ConfigTable returns the table used to decode the profile's config region: its
+// ConfigFields if it lists any, or otherwise the generic table of its family, if there
+// is one.
+func (p PIC8Profile) ConfigTable() []ConfigField {
+	if len(p.ConfigFields) > 0 {
+		return p.ConfigFields
+	}
+	return configTables[p.Family]
+}
+
+// ConfigStart returns the address of the start of the profile's config region as it is
+// sent to the bootloader, i.e. after any word or zero based translation. The offsets of
+// the ConfigTable fields are relative to this address.
+func (p PIC8Profile) ConfigStart() uint32 {
+	p.applyFamilyDefaults()
+	switch {
+	case p.ZeroBasedConfig:
+		return 0
+	case p.AddressMode == AddressModeWord:
+		return uint32(Address(p.ConfigOffset).Word())
+	}
+	return p.ConfigOffset
+}
+
+// DecodeConfig decodes raw config bytes, read from the start of the config region, into
+// the settings described by a decode table.
+func DecodeConfig(fields []ConfigField, data []byte) ([]ConfigSetting, error) {
+	settings := make([]ConfigSetting, 0, len(fields))
+	for _, field := range fields {
+		if field.Mask == 0 {
+			return nil, fmt.Errorf("config field %v has no mask", field.Name)
+		}
+		size := field.size()
+		if field.Offset+size > uint32(len(data)) {
+			return nil, fmt.Errorf("config field %v at offset %X is beyond the %v bytes read", field.Name, field.Offset, len(data))
+		}
+		word := uint16(data[field.Offset])
+		if size == 2 {
+			word |= uint16(data[field.Offset+1]) << 8
+		}
+		value := (word & field.Mask) >> uint(bits.TrailingZeros16(field.Mask))
+		settings = append(settings, ConfigSetting{
+			Name:        field.Name,
+			Description: field.Description,
+			Value:       value,
+			Meaning:     field.Values[value],
+		})
+	}
+	return settings, nil
+}
+
+// DecodeConfigWords decodes the config words returned by the GetVersion command into
+// settings, using the generic table of the given device family.
+//
+// For PIC16 devices, the config words are CONFIG1 and CONFIG2 of an enhanced mid-range
+// device. For PIC18 devices, they are the first four config bytes (CONFIG1L to CONFIG2H),
+// so the table's fields that lie beyond them are left out.
+func DecodeConfigWords(family string, words [4]byte) ([]ConfigSetting, error) {
+	table, ok := configTables[family]
+	if !ok {
+		return nil, fmt.Errorf("unsupported device family %q", family)
+	}
+	var fields []ConfigField
+	for _, field := range table {
+		if field.Offset+field.size() <= uint32(len(words)) {
+			fields = append(fields, field)
+		}
+	}
+	return DecodeConfig(fields, words[:])
+}
@@ -0,0 +1,18 @@
+package microchipboot
+
+// crc16 returns the CRC-16/XMODEM of data, i.e. the CCITT polynomial 0x1021 with an
+// initial value of 0, as used by Microchip's serial bootloaders.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,105 @@
+package microchipboot
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// Image digest algorithms.
+const (
+	// DigestCRC32 is the IEEE CRC-32, stored little endian.
+	DigestCRC32 = "crc32"
+	// DigestSHA256 is the SHA-256 hash.
+	DigestSHA256 = "sha256"
+)
+
+// ErrNoDigest is returned by GetImageDigest if no digest algorithm has been configured.
+var ErrNoDigest = errors.New("no image digest algorithm configured")
+
+// ImageDigest configures an integrity digest of the application image, which firmware
+// can recalculate at startup to check itself. The digest is calculated over the flash
+// bytes as they appear in the hex file, with unprogrammed locations taken as erased (0xFF).
+type ImageDigest struct {
+	// Algorithm is DigestCRC32 or DigestSHA256. If empty, no digest is calculated.
+	Algorithm string
+	// Range of flash covered by the digest. If End is zero, the digest covers the
+	// application area from BootloaderOffset up to FooterAddress or, if there is no
+	// footer, up to the end of the loaded flash data.
+	Range AddressRange
+	// If non-zero, the digest is added to the image at this flash address when it is
+	// loaded, so that it is written along with the rest of the image.
+	FooterAddress uint32
+}
+
+// digestRange returns the range of flash covered by the digest.
+func (p *pic8Programmer) digestRange() AddressRange {
+	r := p.options.Digest.Range
+	if r.End != 0 {
+		return r
+	}
+	r.Start = Address(p.profile.BootloaderOffset)
+	if p.options.Digest.FooterAddress != 0 {
+		r.End = Address(p.options.Digest.FooterAddress)
+		return r
+	}
+	for _, segment := range p.flash {
+		if end := Address(segment.Address + uint32(len(segment.Data))); end > r.End {
+			r.End = end
+		}
+	}
+	return r
+}
+
+// GetImageDigest returns the digest of the loaded image, as configured by the Digest
+// option.
+func (p *pic8Programmer) GetImageDigest() ([]byte, error) {
+	r := p.digestRange()
+	if r.End <= r.Start {
+		return nil, fmt.Errorf("no flash data loaded")
+	}
+	return calculateDigest(p.options.Digest.Algorithm, segmentsToBinary(p.flash, uint32(r.Start), uint32(r.End-r.Start)))
+}
+
+func calculateDigest(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case "":
+		return nil, ErrNoDigest
+	case DigestCRC32:
+		digest := make([]byte, 4)
+		binary.LittleEndian.PutUint32(digest, crc32.ChecksumIEEE(data))
+		return digest, nil
+	case DigestSHA256:
+		digest := sha256.Sum256(data)
+		return digest[:], nil
+	default:
+		return nil, fmt.Errorf("invalid digest algorithm %q, expected %q or %q", algorithm, DigestCRC32, DigestSHA256)
+	}
+}
+
+// addDigestFooter adds the image digest to the flash data at the footer address.
+func (p *pic8Programmer) addDigestFooter() error {
+	digest, err := p.GetImageDigest()
+	if err != nil {
+		return fmt.Errorf("failed to calculate image digest: %w", err)
+	}
+	footer := gohex.DataSegment{Address: p.options.Digest.FooterAddress, Data: digest}
+	end := footer.Address + uint32(len(digest))
+	if footer.Address < p.profile.BootloaderOffset || end > p.profile.FlashSize {
+		return fmt.Errorf("digest footer at %X lies outside the application area", footer.Address)
+	}
+	for _, segment := range p.flash {
+		if footer.Address < segment.Address+uint32(len(segment.Data)) && segment.Address < end {
+			return fmt.Errorf("digest footer at %X overlaps the image data at %X", footer.Address, segment.Address)
+		}
+	}
+	plannerLog.Debugf("adding %v digest %X at %X", p.options.Digest.Algorithm, digest, footer.Address)
+	p.flash = append(p.flash, footer)
+	sort.Slice(p.flash, func(i, j int) bool { return p.flash[i].Address < p.flash[j].Address })
+	return nil
+}
@@ -0,0 +1,141 @@
+package microchipboot
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discovery defaults.
+const (
+	DefaultDiscoveryService = "microchipboot"
+	DefaultDiscoveryPort    = 30303
+	defaultDiscoveryTimeout = 2 * time.Second
+)
+
+// DiscoveryConfig configures the discovery of network serial bridges.
+// Zero values are replaced with defaults.
+type DiscoveryConfig struct {
+	// Service name that bridges must respond to.
+	Service string
+	// UDP port that the query is broadcast to.
+	Port int
+	// Address that the query is sent to. Defaults to the IPv4 broadcast address.
+	BroadcastAddress string
+	// How long to wait for responses.
+	Timeout time.Duration
+}
+
+// Bridge describes a network serial bridge found by DiscoverBridges.
+type Bridge struct {
+	Name string
+	Host string
+	// TCP port that the bridge accepts bootloader connections on.
+	Port int
+}
+
+// Address returns the host:port address of the bridge.
+func (b Bridge) Address() string {
+	return net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+}
+
+// DiscoverBridges broadcasts a discovery query and returns the bridges that respond.
+//
+// The query is a UDP datagram containing the service name followed by a newline. Bridges
+// respond with a datagram of newline separated key=value pairs, which must include
+// service (matching the query), name and port (the TCP port of the bridge), e.g.
+//
+//	service=microchipboot
+//	name=line1-station3
+//	port=2000
+func DiscoverBridges(config DiscoveryConfig) ([]Bridge, error) {
+	if config.Service == "" {
+		config.Service = DefaultDiscoveryService
+	}
+	if config.Port == 0 {
+		config.Port = DefaultDiscoveryPort
+	}
+	if config.BroadcastAddress == "" {
+		config.BroadcastAddress = net.IPv4bcast.String()
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultDiscoveryTimeout
+	}
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dest, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(config.BroadcastAddress, strconv.Itoa(config.Port)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo([]byte(config.Service+"\n"), dest); err != nil {
+		return nil, fmt.Errorf("failed to send discovery query: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(config.Timeout))
+
+	var bridges []Bridge
+	seen := make(map[string]bool)
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return bridges, err
+		}
+		bridge, ok := parseDiscoveryResponse(config.Service, buf[:n])
+		if !ok {
+			transportLog.Debugf("ignoring invalid discovery response from %v", addr)
+			continue
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			bridge.Host = udpAddr.IP.String()
+		}
+		if !seen[bridge.Address()] {
+			seen[bridge.Address()] = true
+			bridges = append(bridges, bridge)
+		}
+	}
+	return bridges, nil
+}
+
+func parseDiscoveryResponse(service string, data []byte) (Bridge, bool) {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	if fields["service"] != service {
+		return Bridge{}, false
+	}
+	port, err := strconv.Atoi(fields["port"])
+	if err != nil {
+		return Bridge{}, false
+	}
+	return Bridge{Name: fields["name"], Port: port}, true
+}
+
+// FindBridge discovers bridges and returns the one with the given name.
+func FindBridge(name string, config DiscoveryConfig) (Bridge, error) {
+	bridges, err := DiscoverBridges(config)
+	if err != nil {
+		return Bridge{}, err
+	}
+	for _, b := range bridges {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return Bridge{}, fmt.Errorf("bridge %q not found", name)
+}
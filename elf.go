@@ -0,0 +1,98 @@
+package microchipboot
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// ConvertELFToHex extracts the loadable contents of an ELF file, as produced by XC8 or
+// XC32, and writes them to w in Intel HEX format.
+//
+// The physical (load) address of each PT_LOAD segment is used, so initialised data is
+// placed at its location in flash rather than in RAM. ELF files without program headers
+// fall back to their allocated PROGBITS sections. Addresses are used as is, so they must
+// match the addresses that the toolchain writes to its HEX files.
+func ConvertELFToHex(r io.ReaderAt, w io.Writer) error {
+	return convertELFToHex(r, w, 1)
+}
+
+// ConvertPIC16BitELFToHex is like ConvertELFToHex for the ELF files of 16-bit PICs
+// produced by XC16. Their addresses are program counter values, which advance by 2 per
+// instruction, so they are doubled to give the byte addresses used in HEX files.
+func ConvertPIC16BitELFToHex(r io.ReaderAt, w io.Writer) error {
+	return convertELFToHex(r, w, 2)
+}
+
+func convertELFToHex(r io.ReaderAt, w io.Writer, addressScale uint64) error {
+	mem, err := loadELF(r, addressScale)
+	if err != nil {
+		return err
+	}
+	return mem.DumpIntelHex(w, 16)
+}
+
+// loadELF loads the contents of an ELF file, multiplying the addresses by addressScale.
+func loadELF(r io.ReaderAt, addressScale uint64) (*gohex.Memory, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse elf file: %w", err)
+	}
+	defer f.Close()
+
+	mem := gohex.NewMemory()
+	add := func(name string, address uint64, size uint64, data io.Reader) error {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(data, buf); err != nil {
+			return fmt.Errorf("failed to read %v: %w", name, err)
+		}
+		address *= addressScale
+		if address+size > math.MaxUint32+1 {
+			return fmt.Errorf("%v at %X is outside of the 32-bit address space", name, address)
+		}
+		if err := mem.AddBinary(uint32(address), buf); err != nil {
+			return fmt.Errorf("failed to load %v at %X: %w", name, address, err)
+		}
+		return nil
+	}
+
+	var loaded bool
+	for i, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+			continue
+		}
+		if err := add(fmt.Sprintf("segment %v", i), prog.Paddr, prog.Filesz, prog.Open()); err != nil {
+			return nil, err
+		}
+		loaded = true
+	}
+	if !loaded {
+		for _, section := range f.Sections {
+			if section.Type != elf.SHT_PROGBITS || section.Flags&elf.SHF_ALLOC == 0 || section.Size == 0 {
+				continue
+			}
+			if err := add(section.Name, section.Addr, section.Size, section.Open()); err != nil {
+				return nil, err
+			}
+			loaded = true
+		}
+	}
+	if !loaded {
+		return nil, fmt.Errorf("elf file contains no loadable data")
+	}
+	return mem, nil
+}
+
+// elfToHex converts an ELF file into hex data that can be passed to LoadHex, multiplying
+// its addresses by addressScale.
+func elfToHex(r io.ReaderAt, addressScale uint64) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	if err := convertELFToHex(r, buf, addressScale); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
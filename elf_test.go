@@ -0,0 +1,95 @@
+package microchipboot
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// buildELF returns a little endian 32-bit ELF file with a PT_LOAD segment containing
+// data at the physical address paddr.
+func buildELF(t *testing.T, paddr uint32, data []byte) []byte {
+	const headerSize, progSize = 52, 32
+	header := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     headerSize,
+		Ehsize:    headerSize,
+		Phentsize: progSize,
+		Phnum:     1,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	prog := elf.Prog32{
+		Type:   uint32(elf.PT_LOAD),
+		Off:    headerSize + progSize,
+		Vaddr:  0x1000,
+		Paddr:  paddr,
+		Filesz: uint32(len(data)),
+		Memsz:  uint32(len(data)),
+	}
+
+	buf := new(bytes.Buffer)
+	for _, v := range []interface{}{header, prog, data} {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestConvertELFToHex(t *testing.T) {
+	data := []byte{0x01, 0x02, 0x03, 0x00, 0x04, 0x05, 0x06, 0x00}
+	file := buildELF(t, 0x200, data)
+
+	tests := []struct {
+		convert func(r *bytes.Reader, w *bytes.Buffer) error
+		address uint32
+	}{
+		{func(r *bytes.Reader, w *bytes.Buffer) error { return ConvertELFToHex(r, w) }, 0x200},
+		{func(r *bytes.Reader, w *bytes.Buffer) error { return ConvertPIC16BitELFToHex(r, w) }, 0x400},
+	}
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		if err := test.convert(bytes.NewReader(file), buf); err != nil {
+			t.Fatal(err)
+		}
+		mem := gohex.NewMemory()
+		if err := mem.ParseIntelHex(buf); err != nil {
+			t.Fatal(err)
+		}
+		segments := mem.GetDataSegments()
+		if len(segments) != 1 || segments[0].Address != test.address || !bytes.Equal(segments[0].Data, data) {
+			t.Errorf("got %+v, want %v bytes at %X", segments, len(data), test.address)
+		}
+	}
+}
+
+func TestPIC16BitLoadELF(t *testing.T) {
+	prog := NewPIC16BitProgrammer(nil, PIC16BitProfile{
+		BootloaderOffset: 0x200,
+		FlashSize:        0x1000,
+	}, PIC16BitOptions{}).(*pic16BitProgrammer)
+
+	if err := LoadELF(prog, bytes.NewReader(buildELF(t, 0x200, []byte{1, 2, 3, 0}))); err != nil {
+		t.Fatal(err)
+	}
+	// The hex image is in byte addresses
+	if got := prog.flash; len(got) != 1 || got[0].Address != 0x400 {
+		t.Errorf("got %+v, want a segment at 400", got)
+	}
+}
+
+func TestLoadELFWithoutData(t *testing.T) {
+	file := buildELF(t, 0x200, nil)
+	err := ConvertELFToHex(bytes.NewReader(file), new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), "no loadable data") {
+		t.Errorf("got %v, want an error", err)
+	}
+}
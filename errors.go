@@ -0,0 +1,99 @@
+package microchipboot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Errors that can be checked for with errors.Is.
+var (
+	// ErrEchoMismatch is returned when the command echoed by the device doesn't match the
+	// command that was sent, which usually indicates a corrupted frame.
+	ErrEchoMismatch = errors.New("echo mismatch")
+	// ErrCRCMismatch is returned when a response or packet received from the device fails
+	// its CRC check.
+	ErrCRCMismatch = errors.New("CRC mismatch")
+	// ErrAddressError is returned when the device rejects a command's address.
+	ErrAddressError = errors.New("address error")
+	// ErrUnsupportedCommand is returned when the device doesn't support a command.
+	ErrUnsupportedCommand = errors.New("unsupported command")
+	// ErrPipelineFailed is returned when a pipelined write, other than the one being sent,
+	// fails even when it is resent on its own. Programming should then be restarted or
+	// continued with Resume.
+	ErrPipelineFailed = errors.New("pipelined write failed")
+	// ErrWrongDevice is returned by Connect when the device ID reported by the device
+	// doesn't match the one expected by the profile.
+	ErrWrongDevice = errors.New("wrong device")
+	// ErrBootloaderBusy is returned by a SharedBootloader when another goroutine holds a
+	// session on it.
+	ErrBootloaderBusy = errors.New("bootloader is in use by another session")
+	// ErrSessionReleased is returned when a command is sent through a Session that has
+	// been released.
+	ErrSessionReleased = errors.New("session has been released")
+)
+
+// ResponseError is returned when the device responds to a command with a code other than
+// ResultSuccess. It matches ErrAddressError and ErrUnsupportedCommand for the corresponding codes.
+type ResponseError struct {
+	Code int
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("command returned code %v: %v", e.Code, GetResponseCodeString(e.Code))
+}
+
+// Is reports whether the response code corresponds to the target sentinel error.
+func (e *ResponseError) Is(target error) bool {
+	switch target {
+	case ErrAddressError:
+		return e.Code == ResultAddressError
+	case ErrUnsupportedCommand:
+		return e.Code == ResultUnsupported
+	}
+	return false
+}
+
+// TimeoutError is returned when the device doesn't send the expected number of bytes in time.
+type TimeoutError struct {
+	// Number of bytes expected and received.
+	Expected, Received int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for response, received %v of %v bytes", e.Received, e.Expected)
+}
+
+// Timeout returns true, allowing TimeoutError to be treated like a net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// isTimeout returns true if err indicates that a read ran out of time. Serial ports report
+// a read timeout as the end of the file.
+func isTimeout(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// VerifyMismatchError is returned by Verify when the device's memory doesn't match the
+// loaded image. It describes the first mismatching range; the full list is available
+// from the programmer's VerifyReport.
+type VerifyMismatchError struct {
+	Region  string
+	Address Address
+	Length  Length
+	// Expected and actual data. Only set when verifying by reading.
+	Expected, Actual []byte
+	// Total number of mismatching ranges.
+	Total int
+}
+
+func (e *VerifyMismatchError) Error() string {
+	m := Mismatch{Address: e.Address, Length: e.Length, Expected: e.Expected, Actual: e.Actual}
+	return fmt.Sprintf("failed to verify %v: %v (%v mismatching ranges in total)", e.Region, m, e.Total)
+}
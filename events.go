@@ -0,0 +1,201 @@
+package microchipboot
+
+import "time"
+
+// RowEvent describes a single erase, write or verify operation performed by a Programmer.
+type RowEvent struct {
+	Region  Region
+	Address uint32
+	// Number of bytes erased, written or verified.
+	Length   int
+	Duration time.Duration
+	// Number of times that commands were retried during the operation. This is only
+	// counted if the bootloader has been wrapped with NewRetryBootloader.
+	Retries int
+	// Error returned by the operation, if any. Data that is read back successfully but
+	// doesn't match is reported by Verify rather than here.
+	Err error
+}
+
+// EventSink receives events from a Programmer as it works, e.g. for collecting telemetry
+// or showing the status of each row. The methods are called synchronously, so they
+// should return quickly.
+type EventSink interface {
+	// OnStage is called when the programmer moves to a new stage (StageErase, StageWrite
+	// or StageVerify).
+	OnStage(stage string)
+	OnErase(event RowEvent)
+	OnWrite(event RowEvent)
+	OnVerify(event RowEvent)
+}
+
+// wrappedBootloader is implemented by bootloaders that decorate another bootloader.
+type wrappedBootloader interface {
+	unwrap() Bootloader
+}
+
+// findBootloader returns the first bootloader in the chain of wrapped bootloaders for which
+// match returns true, or nil if there is none.
+func findBootloader(b Bootloader, match func(Bootloader) bool) Bootloader {
+	for b != nil {
+		if match(b) {
+			return b
+		}
+		w, ok := b.(wrappedBootloader)
+		if !ok {
+			break
+		}
+		b = w.unwrap()
+	}
+	return nil
+}
+
+// retryCounter is implemented by bootloaders that count the commands that they retry.
+type retryCounter interface {
+	retries() int
+}
+
+// findRetryCounter looks for a retry counter in the chain of wrapped bootloaders.
+func findRetryCounter(b Bootloader) retryCounter {
+	c, _ := findBootloader(b, func(b Bootloader) bool {
+		_, ok := b.(retryCounter)
+		return ok
+	}).(retryCounter)
+	return c
+}
+
+// events dispatches row events to an EventSink and collects the statistics of each stage.
+type events struct {
+	sink    EventSink
+	counter retryCounter
+	stage   string
+	// When the current stage started
+	stageStart time.Time
+	stats      ProgramStats
+	// Value of the retry counter when the statistics were reset
+	retryBase int
+}
+
+// do runs f, which performs a single operation, and reports it to the sink.
+func (e *events) do(stage string, region Region, address uint32, length int, f func() error) error {
+	e.setStage(stage)
+	if e.sink == nil {
+		err := f()
+		e.count(stage, length, err)
+		return err
+	}
+	var retries int
+	if e.counter != nil {
+		retries = e.counter.retries()
+	}
+	start := time.Now()
+	err := f()
+	event := RowEvent{
+		Region:   region,
+		Address:  address,
+		Length:   length,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	if e.counter != nil {
+		event.Retries = e.counter.retries() - retries
+	}
+	e.count(stage, length, err)
+	switch stage {
+	case StageErase:
+		e.sink.OnErase(event)
+	case StageWrite:
+		e.sink.OnWrite(event)
+	case StageVerify:
+		e.sink.OnVerify(event)
+	}
+	return err
+}
+
+// count adds a successful operation to the statistics. Erases are counted by
+// executeStep, which knows the number of rows.
+func (e *events) count(stage string, length int, err error) {
+	if err != nil {
+		return
+	}
+	switch stage {
+	case StageWrite:
+		e.stats.BytesWritten += length
+	case StageVerify:
+		e.stats.BytesVerified += length
+	}
+}
+
+// begin starts a new stage, reporting it to the sink even if the previous operation was
+// in the same stage.
+func (e *events) begin(stage string) {
+	e.end()
+	e.setStage(stage)
+}
+
+// setStage reports a change of stage to the sink.
+func (e *events) setStage(stage string) {
+	if stage == e.stage {
+		return
+	}
+	e.end()
+	e.stage = stage
+	e.stageStart = time.Now()
+	if e.sink != nil {
+		e.sink.OnStage(stage)
+	}
+}
+
+// end ends the current stage, adding the time spent in it to the statistics.
+func (e *events) end() {
+	elapsed := time.Since(e.stageStart)
+	switch e.stage {
+	case StageErase:
+		e.stats.EraseDuration += elapsed
+	case StageWrite:
+		e.stats.WriteDuration += elapsed
+	case StageVerify:
+		e.stats.VerifyDuration += elapsed
+	}
+	e.stage = ""
+}
+
+// resetStats starts collecting statistics afresh.
+func (e *events) resetStats() {
+	e.end()
+	e.stats = ProgramStats{}
+	if e.counter != nil {
+		e.retryBase = e.counter.retries()
+	}
+}
+
+// getStats returns the statistics collected since they were last reset.
+func (e *events) getStats() ProgramStats {
+	stats := e.stats
+	if e.counter != nil {
+		stats.Retries = e.counter.retries() - e.retryBase
+	}
+	return stats
+}
+
+// countReads wraps a verification read function so that each read is reported.
+func (e *events) countReads(region Region, readFunc func(uint32, uint16) ([]byte, error)) func(uint32, uint16) ([]byte, error) {
+	return func(address uint32, length uint16) (data []byte, err error) {
+		err = e.do(StageVerify, region, address, int(length), func() error {
+			data, err = readFunc(address, length)
+			return err
+		})
+		return data, err
+	}
+}
+
+// countChecksums wraps a verification checksum function so that each checksum is reported.
+func (e *events) countChecksums(region Region, checksumFunc func(uint32, uint16) (uint16, error)) func(uint32, uint16) (uint16, error) {
+	return func(address uint32, length uint16) (sum uint16, err error) {
+		err = e.do(StageVerify, region, address, int(length), func() error {
+			sum, err = checksumFunc(address, length)
+			return err
+		})
+		return sum, err
+	}
+}
@@ -0,0 +1,148 @@
+package microchipboot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FleetDevice is a device programmed by a FleetProgrammer.
+type FleetDevice struct {
+	// Name identifies the device in progress reports and results, e.g. its port name.
+	Name       string
+	Bootloader Bootloader
+}
+
+// FleetOptions configures a FleetProgrammer.
+type FleetOptions struct {
+	// Maximum number of devices that are programmed at once. If zero, all devices are
+	// programmed at the same time.
+	Workers int
+	// If set, Progress is called as each device makes progress. It is called from
+	// multiple goroutines at once.
+	Progress func(device string, stage string, done, total int)
+	// If true, each device is reset once it has been programmed and verified.
+	Reset bool
+}
+
+// FleetResult is the outcome of programming a single device.
+type FleetResult struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// FleetResults holds the outcome of programming every device, in the order the devices
+// were given.
+type FleetResults []FleetResult
+
+// Failed returns the results of the devices that failed.
+func (r FleetResults) Failed() FleetResults {
+	var failed FleetResults
+	for _, result := range r {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Err returns an error summarising the devices that failed, or nil if every device was
+// programmed successfully.
+func (r FleetResults) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, result := range failed {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", result.Name, result.Err))
+	}
+	return fmt.Errorf("%v of %v devices failed: %v", len(failed), len(r), strings.Join(msgs, "; "))
+}
+
+// FleetProgrammer programs the same image into many devices concurrently, such as a
+// panel of boards each connected to its own serial port.
+type FleetProgrammer struct {
+	newProgrammer func(Bootloader) Programmer
+	options       FleetOptions
+}
+
+// NewFleetProgrammer creates a fleet programmer. newProgrammer is called to create the
+// programmer for each device, e.g.
+//
+//	func(b Bootloader) Programmer { return NewPIC8Programmer(b, profile, options) }
+func NewFleetProgrammer(newProgrammer func(Bootloader) Programmer, options FleetOptions) *FleetProgrammer {
+	return &FleetProgrammer{
+		newProgrammer: newProgrammer,
+		options:       options,
+	}
+}
+
+// Program connects to each device, then programs and verifies the hex image. A failure
+// only affects the device concerned. Devices that haven't been started when ctx is
+// cancelled fail with ctx.Err(), and those in progress are aborted.
+func (f *FleetProgrammer) Program(ctx context.Context, devices []FleetDevice, hex []byte) FleetResults {
+	workers := f.options.Workers
+	if workers <= 0 || workers > len(devices) {
+		workers = len(devices)
+	}
+
+	results := make(FleetResults, len(devices))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				start := time.Now()
+				err := f.programDevice(ctx, devices[i], hex)
+				results[i] = FleetResult{Name: devices[i].Name, Err: err, Duration: time.Since(start)}
+			}
+		}()
+	}
+	for i := range devices {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+func (f *FleetProgrammer) programDevice(ctx context.Context, device FleetDevice, hex []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	prog := f.newProgrammer(NewContextBootloader(ctx, device.Bootloader))
+	if f.options.Progress != nil {
+		SetProgressHandler(prog, func(stage string, done, total int) {
+			f.options.Progress(device.Name, stage, done, total)
+		})
+	}
+
+	plannerLog.Debugf("%v: connecting", device.Name)
+	if err := prog.Connect(); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer prog.Disconnect()
+	if err := prog.LoadHex(bytes.NewReader(hex)); err != nil {
+		return err
+	}
+	if err := prog.Program(); err != nil {
+		return err
+	}
+	if err := prog.Verify(); err != nil {
+		return err
+	}
+	if f.options.Reset {
+		if err := prog.Reset(); err != nil {
+			return fmt.Errorf("failed to reset: %w", err)
+		}
+	}
+	plannerLog.Debugf("%v: complete", device.Name)
+	return nil
+}
@@ -0,0 +1,119 @@
+package microchipboot
+
+import (
+	"fmt"
+	"io"
+)
+
+// Framings of the bootloader protocol on the serial transport.
+const (
+	// FramingRaw sends commands as they are, preceded by the 55 sync byte. This is what
+	// the unified bootloader expects.
+	FramingRaw = "raw"
+	// FramingAN1310 wraps each command in an AN1310 style packet: an STX byte, the
+	// command with a CRC-16 appended and any STX, ETX and DLE bytes escaped with DLE,
+	// then an ETX byte. The sync byte isn't sent. The device must answer each command
+	// with a single packet, holding what it would send unframed without the sync byte.
+	FramingAN1310 = "an1310"
+)
+
+// AN1310 packet control bytes.
+const (
+	an1310STX = 0x0F
+	an1310ETX = 0x04
+	an1310DLE = 0x05
+)
+
+// Sync byte that starts each unframed command.
+const syncByte = 0x55
+
+func validateFraming(framing string) error {
+	switch framing {
+	case "", FramingRaw, FramingAN1310:
+		return nil
+	default:
+		return fmt.Errorf("invalid framing %q, expected %q or %q", framing, FramingRaw, FramingAN1310)
+	}
+}
+
+// an1310Framer frames the data written to it into AN1310 packets, and unframes the packets
+// read from it. Each packet read is returned preceded by the sync byte, so that it reads
+// the same as an unframed response.
+type an1310Framer struct {
+	rw io.ReadWriter
+	// Unframed data that hasn't been read yet
+	rx []byte
+	// Packet being received, if inPacket is set
+	packet   []byte
+	inPacket bool
+	escaped  bool
+}
+
+func (f *an1310Framer) Write(p []byte) (int, error) {
+	payload := p
+	if len(payload) > 0 && payload[0] == syncByte {
+		payload = payload[1:]
+	}
+	crc := crc16(payload)
+	frame := []byte{an1310STX}
+	for _, c := range append(append([]byte(nil), payload...), byte(crc), byte(crc>>8)) {
+		if c == an1310STX || c == an1310ETX || c == an1310DLE {
+			frame = append(frame, an1310DLE)
+		}
+		frame = append(frame, c)
+	}
+	frame = append(frame, an1310ETX)
+	if _, err := f.rw.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *an1310Framer) Read(p []byte) (int, error) {
+	buf := make([]byte, 64)
+	for len(f.rx) == 0 {
+		n, err := f.rw.Read(buf)
+		for _, c := range buf[:n] {
+			if perr := f.receive(c); perr != nil {
+				return 0, perr
+			}
+		}
+		if err != nil && len(f.rx) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, f.rx)
+	f.rx = f.rx[n:]
+	return n, nil
+}
+
+// receive processes a byte received from the device.
+func (f *an1310Framer) receive(c byte) error {
+	switch {
+	case f.escaped:
+		f.escaped = false
+		f.packet = append(f.packet, c)
+	case c == an1310STX:
+		// A packet starts, abandoning any incomplete one
+		f.inPacket = true
+		f.packet = f.packet[:0]
+	case !f.inPacket:
+		// Noise between packets
+	case c == an1310DLE:
+		f.escaped = true
+	case c == an1310ETX:
+		f.inPacket = false
+		if len(f.packet) < 2 {
+			return fmt.Errorf("%w: packet is too short", ErrCRCMismatch)
+		}
+		data := f.packet[:len(f.packet)-2]
+		crc := uint16(f.packet[len(f.packet)-2]) | uint16(f.packet[len(f.packet)-1])<<8
+		if actual := crc16(data); actual != crc {
+			return fmt.Errorf("%w: packet CRC is %04X, expected %04X", ErrCRCMismatch, crc, actual)
+		}
+		f.rx = append(append(f.rx, syncByte), data...)
+	default:
+		f.packet = append(f.packet, c)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package microchipboot
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	if crc := crc16([]byte("123456789")); crc != 0x31C3 {
+		t.Errorf("got %04X, want 31C3", crc)
+	}
+}
+
+// framedDevice answers write commands sent in AN1310 packets.
+type framedDevice struct {
+	fakeWriteDevice
+	decoder an1310Framer
+	tx      bytes.Buffer
+	// If set, a byte of the next response is corrupted
+	corrupt bool
+}
+
+func (d *framedDevice) Read(p []byte) (int, error) {
+	return d.tx.Read(p)
+}
+
+func (d *framedDevice) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if err := d.decoder.receive(c); err != nil {
+			return 0, err
+		}
+	}
+	d.fakeWriteDevice.Write(d.decoder.rx)
+	d.decoder.rx = nil
+	encoder := an1310Framer{rw: &d.tx}
+	encoder.Write(d.fakeWriteDevice.rx.Bytes())
+	d.fakeWriteDevice.rx.Reset()
+	if d.corrupt {
+		d.corrupt = false
+		d.tx.Bytes()[2] ^= 0x80
+	}
+	return len(p), nil
+}
+
+// crcDevice answers write commands with CRCs appended to the commands and responses.
+type crcDevice struct {
+	fakeWriteDevice
+	// If set, the CRC of the next response is corrupted
+	corrupt bool
+}
+
+func (d *crcDevice) Write(p []byte) (int, error) {
+	frame := p[:len(p)-crcLength]
+	if crc := uint16(p[len(p)-2]) | uint16(p[len(p)-1])<<8; crc != crc16(frame[1:]) {
+		return 0, errors.New("command CRC mismatch")
+	}
+	d.fakeWriteDevice.Write(frame)
+	crc := crc16(d.rx.Bytes()[1:])
+	if d.corrupt {
+		d.corrupt = false
+		crc++
+	}
+	d.rx.Write([]byte{byte(crc), byte(crc >> 8)})
+	return len(p), nil
+}
+
+func TestProtocolCRC(t *testing.T) {
+	device := &crcDevice{fakeWriteDevice: fakeWriteDevice{fail: map[uint32]bool{0x80: true}}}
+	b := &streamBootloader{rw: device}
+	b.setProtocolOptions(ProtocolOptions{CRC: true})
+
+	if err := b.WriteFlash(0x40, make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+	// The CRC also follows a failing result code
+	if err := b.WriteFlash(0x80, make([]byte, 64)); !errors.Is(err, ErrAddressError) {
+		t.Errorf("got %v, want an address error", err)
+	}
+	device.corrupt = true
+	if err := b.WriteFlash(0xC0, make([]byte, 64)); !errors.Is(err, ErrCRCMismatch) {
+		t.Errorf("got %v, want a CRC mismatch", err)
+	}
+	if device.rx.Len() != 0 {
+		t.Errorf("%v bytes of the responses weren't read", device.rx.Len())
+	}
+}
+
+func TestAN1310Framing(t *testing.T) {
+	device := &framedDevice{}
+	b := &streamBootloader{rw: &an1310Framer{rw: device}}
+
+	// The address contains bytes that must be escaped
+	data := []byte{an1310STX, an1310ETX, an1310DLE, syncByte}
+	if err := b.WriteFlash(0x0F0405, data); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{0x0F0405}; !reflect.DeepEqual(device.writes, want) {
+		t.Errorf("got writes %X, want %X", device.writes, want)
+	}
+
+	device.corrupt = true
+	if err := b.WriteFlash(0x40, data); !errors.Is(err, ErrCRCMismatch) {
+		t.Errorf("got %v, want a CRC mismatch", err)
+	}
+}
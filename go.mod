@@ -1,11 +1,15 @@
 module github.com/amrbekhit/microchipboot
 
-go 1.12
+go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/eclipse/paho.mqtt.golang v1.4.1
 	github.com/marcinbor85/gohex v0.0.0-20210308104911-55fb1c624d84
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
+	go.starlark.net v0.0.0-20220328144851-d1966c6b9fcd
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -1,19 +1,266 @@
 package microchipboot
 
-type logger interface {
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Logger is the interface of the logger used by the package, e.g. a logrus logger.
+// Loggers can also implement Tracef, Warnf and Errorf to receive messages at those
+// levels, and FieldLogger to receive the fields attached to messages. Warnings and
+// errors are logged with Infof by loggers that don't implement Warnf and Errorf.
+type Logger interface {
 	Debugf(string, ...interface{})
 	Infof(string, ...interface{})
 }
 
+// tracer is implemented by loggers that support a trace level, such as logrus.
+type tracer interface {
+	Tracef(string, ...interface{})
+}
+
+// warner is implemented by loggers that support warning and error levels, such as logrus.
+type warner interface {
+	Warnf(string, ...interface{})
+	Errorf(string, ...interface{})
+}
+
+// Fields are key-value metadata attached to a log message, so that log aggregation
+// systems can filter messages by e.g. address range or retry count.
+type Fields map[string]interface{}
+
+// Keys of the fields attached to log messages.
+const (
+	// FieldOperation is the bootloader command or programming step, e.g. writeflash.
+	FieldOperation = "operation"
+	// FieldAddress is the device address, as a uint32.
+	FieldAddress = "address"
+	// FieldLength is the number of bytes, or rows for an erase.
+	FieldLength = "length"
+	// FieldAttempt is the number of the attempt, starting from 1, for retried commands.
+	FieldAttempt = "attempt"
+)
+
+// commandNames are the operations logged for the bootloader commands.
+var commandNames = map[uint8]string{
+	commandGetVersion:        "getversion",
+	commandReadFlash:         "readflash",
+	commandWriteFlash:        "writeflash",
+	commandEraseFlash:        "eraseflash",
+	commandReadEE:            "readee",
+	commandWriteEE:           "writeee",
+	commandReadConfig:        "readconfig",
+	commandWriteConfig:       "writeconfig",
+	commandCalculateChecksum: "checksum",
+	commandReset:             "reset",
+}
+
+// commandFields returns the fields describing a bootloader command.
+func commandFields(command uint8, address uint32, length int) Fields {
+	name, ok := commandNames[command]
+	if !ok {
+		name = fmt.Sprintf("%02X", command)
+	}
+	return Fields{FieldOperation: name, FieldAddress: address, FieldLength: length}
+}
+
+// operationFields returns the fields describing a programming operation on a range of
+// addresses.
+func operationFields(operation string, address uint32, length int) Fields {
+	return Fields{FieldOperation: operation, FieldAddress: address, FieldLength: length}
+}
+
+// FieldLogger is implemented by loggers that can attach fields to messages. Messages
+// with fields are logged with the logger returned by WithFields. For loggers that
+// don't implement FieldLogger, the fields are appended to the message as key=value
+// pairs.
+type FieldLogger interface {
+	WithFields(fields Fields) Logger
+}
+
 type nullLogger struct{}
 
 func (l *nullLogger) Debugf(format string, args ...interface{}) {}
 func (l *nullLogger) Infof(format string, args ...interface{})  {}
 
 // The package logger
-var pkgLog logger = &nullLogger{}
+var pkgLog Logger = &nullLogger{}
+
+// Whether trace messages are emitted
+var traceEnabled bool
 
 // SetLogger sets the logger used internally by the package.
-func SetLogger(l logger) {
+func SetLogger(l Logger) {
 	pkgLog = l
 }
+
+// SetTrace enables or disables trace logging, which hex dumps every frame sent to
+// and received from the device. Trace messages are only emitted if the logger passed
+// to SetLogger implements Tracef.
+func SetTrace(enabled bool) {
+	traceEnabled = enabled
+}
+
+// LogLevel is the maximum verbosity of the messages logged by a subsystem.
+type LogLevel int
+
+// Log levels, in increasing verbosity. The values are fixed, with LevelError and LevelWarn
+// below zero, so that LevelInfo, LevelDebug and LevelTrace keep their original values.
+const (
+	LevelError LogLevel = -2
+	LevelWarn  LogLevel = -1
+	LevelInfo  LogLevel = 0
+	LevelDebug LogLevel = 1
+	LevelTrace LogLevel = 2
+)
+
+// ParseLogLevel converts a level name (error, warn, info, debug or trace) into a LogLevel.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch name {
+	case "error":
+		return LevelError, nil
+	case "warn":
+		return LevelWarn, nil
+	case "info":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
+	default:
+		return LevelInfo, fmt.Errorf("invalid log level %q", name)
+	}
+}
+
+// Logging subsystems.
+const (
+	// SubsystemTransport covers the raw data sent and received by transports.
+	SubsystemTransport = "transport"
+	// SubsystemProtocol covers the bootloader commands and responses.
+	SubsystemProtocol = "protocol"
+	// SubsystemPlanner covers the programmer's planning of erase, write and verify operations.
+	SubsystemPlanner = "planner"
+)
+
+// subsystemLogger forwards messages to the package logger if they are within its level,
+// attaching its fields.
+type subsystemLogger struct {
+	// Shared by the loggers derived with WithFields
+	level  *LogLevel
+	fields Fields
+}
+
+func newSubsystemLogger() *subsystemLogger {
+	level := LevelTrace
+	return &subsystemLogger{level: &level}
+}
+
+// WithFields returns a logger for the same subsystem that attaches fields, as well as
+// any that l attaches, to its messages.
+func (l *subsystemLogger) WithFields(fields Fields) *subsystemLogger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &subsystemLogger{level: l.level, fields: merged}
+}
+
+func (l *subsystemLogger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+func (l *subsystemLogger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+func (l *subsystemLogger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *subsystemLogger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+func (l *subsystemLogger) Tracef(format string, args ...interface{}) {
+	l.log(LevelTrace, format, args...)
+}
+
+func (l *subsystemLogger) log(level LogLevel, format string, args ...interface{}) {
+	if level > *l.level || (level == LevelTrace && !traceEnabled) {
+		return
+	}
+	out := pkgLog
+	if len(l.fields) > 0 {
+		if f, ok := out.(FieldLogger); ok {
+			out = f.WithFields(l.fields)
+		} else {
+			format, args = "%s%s", []interface{}{fmt.Sprintf(format, args...), formatFields(l.fields)}
+		}
+	}
+	switch level {
+	case LevelError, LevelWarn:
+		w, ok := out.(warner)
+		switch {
+		case !ok:
+			out.Infof(format, args...)
+		case level == LevelError:
+			w.Errorf(format, args...)
+		default:
+			w.Warnf(format, args...)
+		}
+	case LevelInfo:
+		out.Infof(format, args...)
+	case LevelDebug:
+		out.Debugf(format, args...)
+	case LevelTrace:
+		if t, ok := out.(tracer); ok {
+			t.Tracef(format, args...)
+		}
+	}
+}
+
+// formatFields formats fields as key=value pairs in key order, with addresses in hex.
+func formatFields(fields Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		if address, ok := fields[k].(uint32); ok && k == FieldAddress {
+			fmt.Fprintf(&b, " %v=%X", k, address)
+		} else {
+			fmt.Fprintf(&b, " %v=%v", k, fields[k])
+		}
+	}
+	return b.String()
+}
+
+// Subsystem loggers. By default, no messages are filtered.
+var (
+	transportLog = newSubsystemLogger()
+	protocolLog  = newSubsystemLogger()
+	plannerLog   = newSubsystemLogger()
+)
+
+var subsystems = map[string]*subsystemLogger{
+	SubsystemTransport: transportLog,
+	SubsystemProtocol:  protocolLog,
+	SubsystemPlanner:   plannerLog,
+}
+
+// SetLogLevel limits the verbosity of the messages logged by a subsystem. Messages
+// are still subject to the level of the logger passed to SetLogger.
+func SetLogLevel(subsystem string, level LogLevel) error {
+	l, ok := subsystems[subsystem]
+	if !ok {
+		return fmt.Errorf("invalid subsystem %q", subsystem)
+	}
+	*l.level = level
+	return nil
+}
@@ -0,0 +1,67 @@
+package microchipboot
+
+import (
+	"fmt"
+	"testing"
+)
+
+// recordingLogger records the messages logged at each level.
+type recordingLogger struct {
+	messages []string
+	fields   Fields
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.messages = append(l.messages, "debug: "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.messages = append(l.messages, "info: "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.messages = append(l.messages, "warn: "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.messages = append(l.messages, "error: "+fmt.Sprintf(format, args...))
+}
+
+// fieldRecordingLogger records the fields attached to messages as well.
+type fieldRecordingLogger struct {
+	*recordingLogger
+}
+
+func (l fieldRecordingLogger) WithFields(fields Fields) Logger {
+	l.fields = fields
+	return l
+}
+
+func TestSubsystemLoggerFields(t *testing.T) {
+	defer SetLogger(pkgLog)
+	l := &subsystemLogger{level: new(LogLevel)}
+	*l.level = LevelInfo
+
+	rec := &recordingLogger{}
+	SetLogger(rec)
+	l.WithFields(operationFields(StageWrite, 0x1000, 64)).WithFields(Fields{FieldAttempt: 2}).Warnf("write failed")
+	l.Debugf("filtered")
+	l.Errorf("failed")
+	expected := []string{
+		"warn: write failed address=1000 attempt=2 length=64 operation=write",
+		"error: failed",
+	}
+	if fmt.Sprint(rec.messages) != fmt.Sprint(expected) {
+		t.Errorf("messages are %q, expected %q", rec.messages, expected)
+	}
+
+	fieldRec := fieldRecordingLogger{&recordingLogger{}}
+	SetLogger(fieldRec)
+	l.WithFields(commandFields(commandEraseFlash, 0x2000, 4)).Infof("erasing")
+	if fmt.Sprint(fieldRec.messages) != "[info: erasing]" {
+		t.Errorf("messages are %q", fieldRec.messages)
+	}
+	if fieldRec.fields[FieldOperation] != "eraseflash" || fieldRec.fields[FieldAddress] != uint32(0x2000) || fieldRec.fields[FieldLength] != 4 {
+		t.Errorf("fields are %v", fieldRec.fields)
+	}
+}
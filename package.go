@@ -0,0 +1,166 @@
+package microchipboot
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// packageMagic starts every firmware package.
+var packageMagic = []byte("MCBPKG\x01")
+
+// ErrInvalidSignature is returned when a firmware package isn't signed by the expected key.
+var ErrInvalidSignature = errors.New("invalid package signature")
+
+// PackageMetadata describes the firmware in a package.
+type PackageMetadata struct {
+	Version     string    `json:"version,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+	// Set if the image is encrypted with AES-CTR, using IV as the initial counter block.
+	Encrypted bool   `json:"encrypted,omitempty"`
+	IV        []byte `json:"iv,omitempty"`
+}
+
+// FirmwarePackage is an opened firmware package.
+type FirmwarePackage struct {
+	Metadata PackageMetadata
+	// The decrypted image in Intel HEX format.
+	Hex []byte
+}
+
+// PackageKeys holds the keys needed to open a firmware package.
+type PackageKeys struct {
+	// PublicKey is the Ed25519 key that the package must be signed with.
+	PublicKey ed25519.PublicKey
+	// EncryptionKey is the AES key (16, 24 or 32 bytes) that the image is encrypted
+	// with, if any.
+	EncryptionKey []byte
+}
+
+// CreatePackage writes a firmware package containing a hex image and its metadata, signed
+// with an Ed25519 key. If encryptionKey is not nil, the image is encrypted with AES-CTR
+// so that it can only be opened by holders of the key.
+//
+// A package consists of a magic string, the length prefixed JSON metadata, the length
+// prefixed image and finally the signature of everything before it. Lengths are 32-bit
+// big endian.
+func CreatePackage(w io.Writer, hex io.Reader, metadata PackageMetadata, signingKey ed25519.PrivateKey, encryptionKey []byte) error {
+	if len(signingKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid signing key length %v", len(signingKey))
+	}
+	image, err := ioutil.ReadAll(hex)
+	if err != nil {
+		return err
+	}
+	// Make sure that the image is valid before packaging it
+	if _, err := loadHex(bytes.NewReader(image)); err != nil {
+		return err
+	}
+
+	metadata.Encrypted = encryptionKey != nil
+	metadata.IV = nil
+	if metadata.Encrypted {
+		metadata.IV = make([]byte, aes.BlockSize)
+		if _, err := rand.Read(metadata.IV); err != nil {
+			return fmt.Errorf("failed to generate iv: %w", err)
+		}
+		if image, err = cryptPackageImage(image, encryptionKey, metadata.IV); err != nil {
+			return err
+		}
+	}
+	header, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(packageMagic)
+	for _, section := range [][]byte{header, image} {
+		binary.Write(buf, binary.BigEndian, uint32(len(section)))
+		buf.Write(section)
+	}
+	buf.Write(ed25519.Sign(signingKey, buf.Bytes()))
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// OpenPackage reads a firmware package, checking its signature and decrypting the image
+// if necessary.
+func OpenPackage(r io.Reader, keys PackageKeys) (*FirmwarePackage, error) {
+	if len(keys.PublicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length %v", len(keys.PublicKey))
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, packageMagic) || len(data) < len(packageMagic)+ed25519.SignatureSize {
+		return nil, fmt.Errorf("not a firmware package")
+	}
+	signed, signature := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
+	if !ed25519.Verify(keys.PublicKey, signed, signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	var sections [][]byte
+	rest := signed[len(packageMagic):]
+	for i := 0; i < 2; i++ {
+		if len(rest) < 4 || uint32(len(rest)-4) < binary.BigEndian.Uint32(rest) {
+			return nil, fmt.Errorf("truncated firmware package")
+		}
+		n := binary.BigEndian.Uint32(rest)
+		sections = append(sections, rest[4:4+n])
+		rest = rest[4+n:]
+	}
+
+	pkg := &FirmwarePackage{Hex: sections[1]}
+	if err := json.Unmarshal(sections[0], &pkg.Metadata); err != nil {
+		return nil, fmt.Errorf("invalid package metadata: %w", err)
+	}
+	if pkg.Metadata.Encrypted {
+		if keys.EncryptionKey == nil {
+			return nil, fmt.Errorf("package is encrypted but no encryption key was given")
+		}
+		if pkg.Hex, err = cryptPackageImage(pkg.Hex, keys.EncryptionKey, pkg.Metadata.IV); err != nil {
+			return nil, err
+		}
+		if _, err := loadHex(bytes.NewReader(pkg.Hex)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt package, the encryption key may be wrong: %w", err)
+		}
+	}
+	return pkg, nil
+}
+
+// LoadPackage opens a firmware package and loads its image into the programmer. Nothing
+// is loaded unless the package's signature is valid.
+func LoadPackage(p Programmer, r io.Reader, keys PackageKeys) (PackageMetadata, error) {
+	pkg, err := OpenPackage(r, keys)
+	if err != nil {
+		return PackageMetadata{}, err
+	}
+	return pkg.Metadata, p.LoadHex(bytes.NewReader(pkg.Hex))
+}
+
+// cryptPackageImage encrypts or decrypts a package image in AES-CTR mode.
+func cryptPackageImage(image, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid iv length %v", len(iv))
+	}
+	out := make([]byte, len(image))
+	cipher.NewCTR(block, iv).XORKeyStream(out, image)
+	return out, nil
+}
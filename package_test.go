@@ -0,0 +1,36 @@
+package microchipboot
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPackage(t *testing.T) {
+	const hex = ":0400000001020304F2\n:00000001FF\n"
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{0x42}, 16)
+
+	buf := new(bytes.Buffer)
+	if err := CreatePackage(buf, strings.NewReader(hex), PackageMetadata{Version: "1.0"}, priv, key); err != nil {
+		t.Fatal(err)
+	}
+	pkg, err := OpenPackage(bytes.NewReader(buf.Bytes()), PackageKeys{PublicKey: pub, EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pkg.Hex) != hex || pkg.Metadata.Version != "1.0" || !pkg.Metadata.Encrypted {
+		t.Errorf("got %+v", pkg)
+	}
+
+	tampered := append([]byte{}, buf.Bytes()...)
+	tampered[len(tampered)-ed25519.SignatureSize-1] ^= 1
+	if _, err := OpenPackage(bytes.NewReader(tampered), PackageKeys{PublicKey: pub, EncryptionKey: key}); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("got %v, want ErrInvalidSignature", err)
+	}
+}
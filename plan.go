@@ -0,0 +1,392 @@
+package microchipboot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// PlanStep is a single erase or write operation in a Plan.
+type PlanStep struct {
+	Region  Region
+	Address uint32
+	// Number of rows to erase. Only set for erase steps.
+	Rows uint16
+	// Data to write. Nil for erase steps.
+	Data []byte
+}
+
+// IsErase returns true if the step erases rows rather than writing data.
+func (s PlanStep) IsErase() bool {
+	return s.Data == nil
+}
+
+// Plan is the precomputed sequence of operations needed to program and verify an image.
+// A plan can be computed once and then executed against many devices with the same
+// geometry, guaranteeing that identical operations are performed on each.
+type Plan struct {
+	// Row sizes of the device that the plan was computed for.
+	EraseRowSize int
+	WriteRowSize int
+	// Largest packet that the plan's writes were sized for.
+	MaxPacketSize int
+	// Erase and write operations, in the order that they are executed.
+	Steps []PlanStep
+	// Expected checksums of the flash ranges checked when verifying by checksum.
+	Checksums []CheckedRange
+
+	// Segments checked when verifying by reading
+	flash, eeprom, config, id []gohex.DataSegment
+	// Options that the plan was computed with
+	options PIC8Options
+}
+
+// NewPIC8Plan computes the plan for programming a hex image into 8-bit PICs with the
+// given profile, options and device info, without needing a connection to a device.
+func NewPIC8Plan(profile PIC8Profile, options PIC8Options, info VersionInfo, hex io.Reader) (*Plan, error) {
+	prog := NewPIC8Programmer(nil, profile, options).(*pic8Programmer)
+	prog.info = info
+	if err := prog.LoadHex(hex); err != nil {
+		return nil, err
+	}
+	return prog.Plan()
+}
+
+// planWrites converts the segments into row-aligned blocks of length writeRowSize,
+// ordered by address. Any bytes not covered by the segments are padded with the erased
+// values given by erased, which repeat from address 0.
+func planWrites(region Region, segments []gohex.DataSegment, writeRowSize int, erased []byte) []PlanStep {
+	blocks := make(map[uint32][]byte)
+	for _, segment := range segments {
+		for i, data := range segment.Data {
+			byteAddress := segment.Address + uint32(i)
+			rowAlignedAddress := byteAddress & ^uint32(writeRowSize-1)
+			b, ok := blocks[rowAlignedAddress]
+			if !ok {
+				// Create a blank block
+				b = erasedData(rowAlignedAddress, writeRowSize, erased)
+				blocks[rowAlignedAddress] = b
+			}
+			// Copy the data into the block
+			b[byteAddress-rowAlignedAddress] = data
+		}
+	}
+
+	steps := make([]PlanStep, 0, len(blocks))
+	for addr, block := range blocks {
+		steps = append(steps, PlanStep{Region: region, Address: addr, Data: block})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].Address < steps[j].Address })
+	return steps
+}
+
+// erasedData returns length bytes of erased memory starting at address, where erased
+// gives the erased value of each byte, repeating from address 0.
+func erasedData(address uint32, length int, erased []byte) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = erased[(address+uint32(i))%uint32(len(erased))]
+	}
+	return data
+}
+
+// skipBlankRows removes the writes that only contain erased bytes.
+func skipBlankRows(steps []PlanStep, erased []byte) []PlanStep {
+	var kept []PlanStep
+	for _, step := range steps {
+		if !bytes.Equal(step.Data, erasedData(step.Address, len(step.Data), erased)) {
+			kept = append(kept, step)
+		}
+	}
+	plannerLog.Debugf("skipping %v blank rows", len(steps)-len(kept))
+	return kept
+}
+
+// packWrites coalesces adjacent writes to the same region into transfers of up to
+// maxChunk bytes, made up of whole rows, and splits rows that are larger than maxChunk.
+// Rows are split into equal parts, halving the row until it fits, so that every part
+// starts on the same boundary within the row.
+func packWrites(steps []PlanStep, maxChunk int) []PlanStep {
+	// Writes are always split on a word boundary
+	maxChunk &^= 1
+	if maxChunk <= 0 {
+		return steps
+	}
+	var packed []PlanStep
+	for _, step := range steps {
+		if n := len(packed); n > 0 {
+			last := &packed[n-1]
+			if last.Region == step.Region && last.Address+uint32(len(last.Data)) == step.Address &&
+				len(last.Data)+len(step.Data) <= maxChunk {
+				last.Data = append(last.Data, step.Data...)
+				continue
+			}
+		}
+		chunk := len(step.Data)
+		for chunk > maxChunk && chunk%4 == 0 {
+			chunk /= 2
+		}
+		if chunk > maxChunk {
+			chunk = maxChunk
+		}
+		for offset := 0; offset < len(step.Data); offset += chunk {
+			end := offset + chunk
+			if end > len(step.Data) {
+				end = len(step.Data)
+			}
+			packed = append(packed, PlanStep{
+				Region:  step.Region,
+				Address: step.Address + uint32(offset),
+				Data:    append([]byte(nil), step.Data[offset:end]...),
+			})
+		}
+	}
+	return packed
+}
+
+// planErases returns the erase operations covering every row touched by the segments.
+func planErases(region Region, segments []gohex.DataSegment, eraseRowSize int) []PlanStep {
+	var steps []PlanStep
+	for _, segment := range segments {
+		steps = append(steps, PlanStep{
+			Region:  region,
+			Address: uint32(Address(segment.Address).RowStart(eraseRowSize)),
+			Rows:    uint16(RowsSpanned(Address(segment.Address), Length(len(segment.Data)), eraseRowSize)),
+		})
+	}
+	return steps
+}
+
+// planEraseAll returns the erase operations covering the whole application area, apart
+// from any excluded rows. If the bootloader offset isn't row aligned, the row that it
+// lies in is shared with the bootloader and is left alone.
+func (p *pic8Programmer) planEraseAll() []PlanStep {
+	rowSize := p.info.EraseRowSize
+	start := Address(p.profile.BootloaderOffset)
+	if !start.RowAligned(rowSize) {
+		start = start.RowStart(rowSize) + Address(rowSize)
+	}
+	protected := p.protectedRanges()
+	isProtected := func(row Address) bool {
+		for _, r := range protected {
+			if row < r.End && row+Address(rowSize) > r.Start {
+				return true
+			}
+		}
+		return false
+	}
+
+	var steps []PlanStep
+	for row := start; row < Address(p.profile.FlashSize); row += Address(rowSize) {
+		if isProtected(row) {
+			continue
+		}
+		if n := len(steps); n > 0 {
+			last := &steps[n-1]
+			if Address(last.Address)+Address(int(last.Rows)*rowSize) == row && last.Rows < math.MaxUint16 {
+				last.Rows++
+				continue
+			}
+		}
+		steps = append(steps, PlanStep{Region: RegionFlash, Address: uint32(row), Rows: 1})
+	}
+	return steps
+}
+
+// checksum16 calculates the checksum of data in the same way as the CalculateChecksum
+// command, as the sum of little endian 16-bit words.
+func checksum16(data []byte) uint16 {
+	var sum uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint16(data[i]) + (uint16(data[i+1]) << 8)
+	}
+	return sum
+}
+
+// fillGaps widens the segments to whole 16-bit words and joins those separated by less
+// than maxGap bytes, filling the space with erased values. Such gaps lie in rows that
+// are erased and written along with the segments, so their contents are known. erased
+// gives the erased value of each byte, repeating from address 0.
+func fillGaps(segments []gohex.DataSegment, maxGap int, erased []byte) []gohex.DataSegment {
+	sorted := append([]gohex.DataSegment{}, segments...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Address < sorted[j].Address
+	})
+
+	var spans []AddressRange
+	for _, segment := range sorted {
+		start := Address(segment.Address &^ 1)
+		end := Address((segment.Address + uint32(len(segment.Data)) + 1) &^ 1)
+		if n := len(spans); n > 0 && start < spans[n-1].End+Address(maxGap) {
+			if end > spans[n-1].End {
+				spans[n-1].End = end
+			}
+			continue
+		}
+		spans = append(spans, AddressRange{Start: start, End: end})
+	}
+
+	result := make([]gohex.DataSegment, len(spans))
+	i := 0
+	for j, span := range spans {
+		data := erasedData(uint32(span.Start), int(span.Length()), erased)
+		for ; i < len(sorted) && Address(sorted[i].Address) < span.End; i++ {
+			copy(data[sorted[i].Address-uint32(span.Start):], sorted[i].Data)
+		}
+		result[j] = gohex.DataSegment{Address: uint32(span.Start), Data: data}
+	}
+	return result
+}
+
+// planChecksums splits the segments into ranges that can be checksummed by the device and
+// calculates the expected checksum of each.
+func planChecksums(segments []gohex.DataSegment) []CheckedRange {
+	// The maximum length to checksum needs to fit inside 16-bits and be an even number
+	const maxChecksumChunk = math.MaxUint16 - 1
+	var ranges []CheckedRange
+	for _, segment := range segments {
+		for offset := 0; offset < len(segment.Data); offset += maxChecksumChunk {
+			chunk := segment.Data[offset:]
+			if len(chunk) > maxChecksumChunk {
+				chunk = chunk[:maxChecksumChunk]
+			}
+			ranges = append(ranges, CheckedRange{
+				Address:          Address(segment.Address + uint32(offset)),
+				Length:           Length(len(chunk)),
+				ExpectedChecksum: checksum16(chunk),
+			})
+		}
+	}
+	return ranges
+}
+
+// Plan returns the plan for programming the loaded image, computing it if necessary.
+// The device info must be known, i.e. Connect must have been called.
+func (p *pic8Programmer) Plan() (*Plan, error) {
+	if p.plan != nil {
+		return p.plan, nil
+	}
+	if p.info.EraseRowSize == 0 || p.info.WriteRowSize == 0 {
+		return nil, fmt.Errorf("device row sizes are unknown, connect to the device first")
+	}
+
+	plan := &Plan{
+		EraseRowSize:  p.info.EraseRowSize,
+		WriteRowSize:  p.info.WriteRowSize,
+		MaxPacketSize: p.info.MaxPacketSize,
+		flash:         p.flash,
+		eeprom:        p.eeprom,
+		config:        p.config,
+		id:            p.id,
+		options:       p.options,
+	}
+	// Excluded rows are never erased or written
+	flash := excludeRanges(p.flash, p.protectedRanges())
+	id := excludeRanges(p.id, p.protectedRanges())
+	if p.options.EraseAll {
+		plan.Steps = append(plan.Steps, p.planEraseAll()...)
+	} else {
+		plan.Steps = append(plan.Steps, planErases(RegionFlash, flash, p.info.EraseRowSize)...)
+	}
+	plan.Steps = append(plan.Steps, p.packWrites(p.skipBlankRows(planWrites(RegionFlash, flash, p.info.WriteRowSize, p.erasedFlash())))...)
+	if p.options.ProgramEEPROM {
+		plan.Steps = append(plan.Steps, p.packWrites(planWrites(RegionEEPROM, p.eeprom, p.profile.WriteSize(RegionEEPROM, p.info), []byte{erasedValue}))...)
+	}
+	if p.options.ProgramConfig {
+		plan.Steps = append(plan.Steps, planWrites(RegionConfig, p.config, p.profile.WriteSize(RegionConfig, p.info), []byte{erasedValue})...)
+	}
+	if p.options.ProgramID {
+		plan.Steps = append(plan.Steps, planErases(RegionID, id, p.info.EraseRowSize)...)
+		plan.Steps = append(plan.Steps, p.packWrites(p.skipBlankRows(planWrites(RegionID, id, p.info.WriteRowSize, p.erasedFlash())))...)
+	}
+	// The checksum is calculated over whole words, so exclude whole words
+	// Nearby segments are checksummed together, as the device includes the erased gap
+	plan.Checksums = planChecksums(excludeRanges(fillGaps(flash, p.info.WriteRowSize, p.erasedFlash()), wordAlignRanges(p.verifyExclusions())))
+
+	p.plan = plan
+	return plan, nil
+}
+
+// skipBlankRows removes writes of erased rows unless the options say otherwise. This is
+// only done for flash and ID rows, which are erased before being written.
+func (p *pic8Programmer) skipBlankRows(steps []PlanStep) []PlanStep {
+	if p.options.WriteBlankRows {
+		return steps
+	}
+	return skipBlankRows(steps, p.erasedFlash())
+}
+
+// packWrites sizes the writes to fit the device's maximum packet size. Config writes are
+// left alone as bootloaders usually write them one word at a time.
+func (p *pic8Programmer) packWrites(steps []PlanStep) []PlanStep {
+	if p.info.MaxPacketSize == 0 {
+		return steps
+	}
+	return packWrites(steps, maxReadChunk(p.info))
+}
+
+// LoadPlan sets the plan to execute, instead of loading a hex file.
+// The plan must have been computed with the same options as the programmer.
+func (p *pic8Programmer) LoadPlan(plan *Plan) error {
+	if !reflect.DeepEqual(plan.options, p.options) {
+		return fmt.Errorf("plan was computed with different options to the programmer")
+	}
+	p.plan = plan
+	p.flash, p.eeprom, p.config, p.id = plan.flash, plan.eeprom, plan.config, plan.id
+	return nil
+}
+
+// checkPlan makes sure that the plan was computed for the connected device's geometry.
+func (p *pic8Programmer) checkPlan(plan *Plan) error {
+	if plan.EraseRowSize != p.info.EraseRowSize || plan.WriteRowSize != p.info.WriteRowSize {
+		return fmt.Errorf("plan was computed for row sizes %v/%v but the device has %v/%v",
+			plan.EraseRowSize, plan.WriteRowSize, p.info.EraseRowSize, p.info.WriteRowSize)
+	}
+	if p.info.MaxPacketSize != 0 && plan.MaxPacketSize > p.info.MaxPacketSize {
+		return fmt.Errorf("plan was computed for a packet size of %v but the device only supports %v",
+			plan.MaxPacketSize, p.info.MaxPacketSize)
+	}
+	return nil
+}
+
+// executeStep performs a single plan step on the device.
+func (p *pic8Programmer) executeStep(step PlanStep) error {
+	if step.IsErase() {
+		plannerLog.WithFields(operationFields(StageErase, step.Address, int(step.Rows))).
+			Debugf("erasing %v rows at %X", step.Rows, step.Address)
+		err := p.events.do(StageErase, step.Region, step.Address, int(step.Rows)*p.info.EraseRowSize, func() error {
+			return p.bootloader.EraseFlash(step.Address, step.Rows)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to erase %v at %X: %w", step.Region, step.Address, err)
+		}
+		p.events.stats.RowsErased += int(step.Rows)
+		return nil
+	}
+
+	var writeFunc func(uint32, []byte) error
+	switch step.Region {
+	case RegionFlash, RegionID:
+		writeFunc = p.bootloader.WriteFlash
+	case RegionEEPROM:
+		writeFunc = p.writeEE
+	case RegionConfig:
+		writeFunc = p.writeMaskedConfig
+	default:
+		return fmt.Errorf("invalid region %v", step.Region)
+	}
+	plannerLog.WithFields(operationFields(StageWrite, step.Address, len(step.Data))).
+		Debugf("writing %v bytes at %X", len(step.Data), step.Address)
+	err := p.events.do(StageWrite, step.Region, step.Address, len(step.Data), func() error {
+		return writeFunc(step.Address, step.Data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %v at address %X: %w", step.Region, step.Address, err)
+	}
+	return nil
+}
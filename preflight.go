@@ -0,0 +1,102 @@
+package microchipboot
+
+import (
+	"fmt"
+	"io"
+)
+
+// PreflightCheckPIC8 checks that a hex image can be programmed into a device with the
+// given profile and options, without touching the device. Unlike LoadHex, which stops at
+// the first problem, it returns a description of every problem found, or nil if there are
+// none. If info is provided (i.e. EraseRowSize is non-zero), the image is also checked
+// against the device's row sizes. info must be in bytes, as returned by
+// Programmer.GetVersionInfo, rather than the words reported by PIC16 devices.
+func PreflightCheckPIC8(profile PIC8Profile, options PIC8Options, info VersionInfo, hex io.Reader) ([]string, error) {
+	mem, err := loadHex(hex)
+	if err != nil {
+		return nil, err
+	}
+	var findings []string
+	findf := func(format string, args ...interface{}) {
+		findings = append(findings, fmt.Sprintf(format, args...))
+	}
+	if err := profile.Validate(); err != nil {
+		findf("invalid profile: %v", err)
+		return findings, nil
+	}
+	profile.applyFamilyDefaults()
+
+	type region struct {
+		name string
+		AddressRange
+	}
+	bootloader := region{"bootloader", AddressRange{Start: 0, End: Address(profile.BootloaderOffset)}}
+	application := region{"application", AddressRange{Start: Address(profile.BootloaderOffset), End: Address(profile.FlashSize)}}
+	regions := []region{application}
+	addRegion := func(name string, offset, size uint32) {
+		if size > 0 {
+			regions = append(regions, region{name, AddressRange{Start: Address(offset), End: Address(offset + size)}})
+		}
+	}
+	addRegion("id", profile.IDOffset, profile.IDSize)
+	addRegion("config", profile.ConfigOffset, profile.ConfigSize)
+	addRegion("eeprom", profile.EEPROMOffset, profile.EEPROMSize)
+	overlaps := func(a, b AddressRange) bool {
+		return a.Start < b.End && b.Start < a.End
+	}
+
+	prog := &pic8Programmer{profile: profile, options: options, info: info}
+	for _, segment := range mem.GetDataSegments() {
+		start := int64(segment.Address)
+		if options.FlashRelocation != 0 && segment.Address < profile.FlashSize {
+			start += int64(options.FlashRelocation)
+		}
+		if start < 0 {
+			findf("segment at %X is relocated to a negative address", segment.Address)
+			continue
+		}
+		s := AddressRange{Start: Address(start), End: Address(start) + Address(len(segment.Data))}
+
+		var within *region
+		for i, r := range regions {
+			if s.Start >= r.Start && s.End <= r.End {
+				within = &regions[i]
+				break
+			}
+		}
+		if within == nil {
+			if options.IgnoreOutOfRangeSegments {
+				continue
+			}
+			switch {
+			case overlaps(s, bootloader.AddressRange):
+				findf("segment %X-%X overlaps the bootloader (%X-%X)", s.Start, s.End, bootloader.Start, bootloader.End)
+			default:
+				found := false
+				for _, r := range regions {
+					if overlaps(s, r.AddressRange) {
+						findf("segment %X-%X extends beyond the %v region (%X-%X)", s.Start, s.End, r.name, r.Start, r.End)
+						found = true
+					}
+				}
+				if !found {
+					findf("segment %X-%X lies outside every region of the profile", s.Start, s.End)
+				}
+			}
+			continue
+		}
+		if within.name != application.name {
+			continue
+		}
+
+		for _, r := range prog.protectedRanges() {
+			if overlaps(s, r) {
+				findf("segment %X-%X overlaps the excluded range %X-%X and won't be fully programmed", s.Start, s.End, r.Start, r.End)
+			}
+		}
+		if info.EraseRowSize > 0 && s.Start.RowStart(info.EraseRowSize) < bootloader.End {
+			findf("segment %X-%X shares an erase row with the bootloader, which would be erased", s.Start, s.End)
+		}
+	}
+	return findings, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"strings"
 
 	"github.com/marcinbor85/gohex"
 )
@@ -19,6 +20,307 @@ type Programmer interface {
 	Reset() error
 }
 
+// VerifyAgainstHex loads a hex file into the programmer and verifies it against the device,
+// without erasing or writing anything. The programmer must already be connected.
+func VerifyAgainstHex(p Programmer, hex io.Reader) error {
+	if err := p.LoadHex(hex); err != nil {
+		return err
+	}
+	return p.Verify()
+}
+
+// blankChecker is implemented by the programmers that support BlankCheck.
+type blankChecker interface {
+	blankCheck(regions Region) ([]BlankCheckResult, error)
+}
+
+// BlankCheck checks that the selected regions of the programmer's profile are erased and
+// returns a result for each of them. The programmer must already be connected.
+func BlankCheck(p Programmer, regions Region) ([]BlankCheckResult, error) {
+	checker, ok := p.(blankChecker)
+	if !ok {
+		return nil, fmt.Errorf("blank checking is not supported by %T", p)
+	}
+	return checker.blankCheck(regions)
+}
+
+// The functions below provide the features that not every Programmer supports. The
+// programmers in this package support all of them; other implementations opt in to a
+// feature by implementing the method that its function documents.
+
+// notSupported returns the error reported when p doesn't implement an optional feature.
+func notSupported(feature string, p Programmer) error {
+	return fmt.Errorf("%v is not supported by %T", feature, p)
+}
+
+// LoadELF loads an ELF executable into the programmer, as an alternative to LoadHex.
+// p must implement LoadELF(r io.ReaderAt) error.
+func LoadELF(p Programmer, r io.ReaderAt) error {
+	loader, ok := p.(interface{ LoadELF(r io.ReaderAt) error })
+	if !ok {
+		return notSupported("loading ELF files", p)
+	}
+	return loader.LoadELF(r)
+}
+
+// LoadSREC loads a Motorola S-record image into the programmer, as an alternative to
+// LoadHex. p must implement LoadSREC(data io.Reader) error.
+func LoadSREC(p Programmer, data io.Reader) error {
+	loader, ok := p.(interface{ LoadSREC(data io.Reader) error })
+	if !ok {
+		return notSupported("loading S-record files", p)
+	}
+	return loader.LoadSREC(data)
+}
+
+// LoadEEPROMHex loads the initial EEPROM contents from a separate hex file, after the
+// main image has been loaded. p must implement LoadEEPROMHex(data io.Reader) error.
+func LoadEEPROMHex(p Programmer, data io.Reader) error {
+	loader, ok := p.(interface{ LoadEEPROMHex(data io.Reader) error })
+	if !ok {
+		return notSupported("loading EEPROM hex files", p)
+	}
+	return loader.LoadEEPROMHex(data)
+}
+
+// SetUserID sets the user ID that Program writes to the device's ID locations, e.g.
+// a per-unit serial number. p must implement SetUserID(id []byte) error.
+func SetUserID(p Programmer, id []byte) error {
+	setter, ok := p.(interface{ SetUserID(id []byte) error })
+	if !ok {
+		return notSupported("setting the user ID", p)
+	}
+	return setter.SetUserID(id)
+}
+
+// PatchImage overwrites part of the loaded image, e.g. with a serial number.
+// p must implement PatchImage(address Address, data []byte) error.
+func PatchImage(p Programmer, address Address, data []byte) error {
+	patcher, ok := p.(interface {
+		PatchImage(address Address, data []byte) error
+	})
+	if !ok {
+		return notSupported("patching the image", p)
+	}
+	return patcher.PatchImage(address, data)
+}
+
+// ProgramStream programs and verifies a hex image as it is read, without loading it
+// into memory first. p must implement ProgramStream(hex io.Reader) error.
+func ProgramStream(p Programmer, hex io.Reader) error {
+	streamer, ok := p.(interface{ ProgramStream(hex io.Reader) error })
+	if !ok {
+		return notSupported("streaming programming", p)
+	}
+	return streamer.ProgramStream(hex)
+}
+
+// Resume continues programming after Program has failed, skipping the flash rows that
+// have already been written. p must implement Resume() error.
+func Resume(p Programmer) error {
+	resumer, ok := p.(interface{ Resume() error })
+	if !ok {
+		return notSupported("resuming programming", p)
+	}
+	return resumer.Resume()
+}
+
+// NeedsUpdate returns false if the device already contains the loaded image.
+// p must implement NeedsUpdate() (bool, error).
+func NeedsUpdate(p Programmer) (bool, error) {
+	checker, ok := p.(interface{ NeedsUpdate() (bool, error) })
+	if !ok {
+		return false, notSupported("checking for updates", p)
+	}
+	return checker.NeedsUpdate()
+}
+
+// GetVerifyReport returns the report of the last verification, or nil if there isn't
+// one or p doesn't implement VerifyReport() *VerifyReport.
+func GetVerifyReport(p Programmer) *VerifyReport {
+	reporter, ok := p.(interface{ VerifyReport() *VerifyReport })
+	if !ok {
+		return nil
+	}
+	return reporter.VerifyReport()
+}
+
+// GetStats returns statistics about the last programming session, or zero statistics
+// if p doesn't implement Stats() ProgramStats.
+func GetStats(p Programmer) ProgramStats {
+	counter, ok := p.(interface{ Stats() ProgramStats })
+	if !ok {
+		return ProgramStats{}
+	}
+	return counter.Stats()
+}
+
+// GetImageDigest returns the integrity digest of the loaded image.
+// p must implement GetImageDigest() ([]byte, error).
+func GetImageDigest(p Programmer) ([]byte, error) {
+	digester, ok := p.(interface{ GetImageDigest() ([]byte, error) })
+	if !ok {
+		return nil, notSupported("image digests", p)
+	}
+	return digester.GetImageDigest()
+}
+
+// ReadRange reads length bytes of a region starting at address. The programmer must
+// already be connected. p must implement
+// ReadRange(region Region, address Address, length Length) ([]byte, error).
+func ReadRange(p Programmer, region Region, address Address, length Length) ([]byte, error) {
+	reader, ok := p.(interface {
+		ReadRange(region Region, address Address, length Length) ([]byte, error)
+	})
+	if !ok {
+		return nil, notSupported("reading memory", p)
+	}
+	return reader.ReadRange(region, address, length)
+}
+
+// GetPlan returns the plan that Program would carry out for the loaded image.
+// p must implement Plan() (*Plan, error).
+func GetPlan(p Programmer) (*Plan, error) {
+	planner, ok := p.(interface{ Plan() (*Plan, error) })
+	if !ok {
+		return nil, notSupported("planning", p)
+	}
+	return planner.Plan()
+}
+
+// LoadPlan loads a plan computed earlier, e.g. by NewPIC8Plan, so that Program carries
+// it out instead of computing its own. p must implement LoadPlan(plan *Plan) error.
+func LoadPlan(p Programmer, plan *Plan) error {
+	planner, ok := p.(interface{ LoadPlan(plan *Plan) error })
+	if !ok {
+		return notSupported("loading plans", p)
+	}
+	return planner.LoadPlan(plan)
+}
+
+// SetProgressHandler sets the function that is called as programming progresses. It has
+// no effect unless p implements SetProgressHandler(handler ProgressFunc).
+func SetProgressHandler(p Programmer, handler ProgressFunc) {
+	if setter, ok := p.(interface{ SetProgressHandler(handler ProgressFunc) }); ok {
+		setter.SetProgressHandler(handler)
+	}
+}
+
+// SetEventSink sets the sink that receives the events raised while programming. It has
+// no effect unless p implements SetEventSink(sink EventSink).
+func SetEventSink(p Programmer, sink EventSink) {
+	if setter, ok := p.(interface{ SetEventSink(sink EventSink) }); ok {
+		setter.SetEventSink(sink)
+	}
+}
+
+// DumpToHex reads the selected regions from the device and writes them to w as a hex
+// file. The programmer must already be connected. p must implement
+// DumpToHex(w io.Writer, regions Region) error.
+func DumpToHex(p Programmer, w io.Writer, regions Region) error {
+	dumper, ok := p.(interface {
+		DumpToHex(w io.Writer, regions Region) error
+	})
+	if !ok {
+		return notSupported("dumping memory", p)
+	}
+	return dumper.DumpToHex(w, regions)
+}
+
+// Region identifies a memory region. Regions can be combined to form a mask.
+type Region uint
+
+// Memory regions.
+const (
+	RegionFlash Region = 1 << iota
+	RegionEEPROM
+	RegionConfig
+	RegionID
+)
+
+// RegionAll selects every memory region.
+const RegionAll = RegionFlash | RegionEEPROM | RegionConfig | RegionID
+
+// regionList lists the individual regions in the order they are processed.
+var regionList = []Region{RegionFlash, RegionEEPROM, RegionConfig, RegionID}
+
+// ParseRegions parses a comma separated list of region names, e.g. "flash,eeprom",
+// into a region mask. "all" selects every region.
+func ParseRegions(s string) (Region, error) {
+	var mask Region
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			mask |= RegionAll
+			continue
+		}
+		found := false
+		for _, r := range regionList {
+			if r.String() == name {
+				mask |= r
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid region %q", name)
+		}
+	}
+	return mask, nil
+}
+
+func (r Region) String() string {
+	switch r {
+	case RegionFlash:
+		return "flash"
+	case RegionEEPROM:
+		return "eeprom"
+	case RegionConfig:
+		return "config"
+	case RegionID:
+		return "id"
+	default:
+		return fmt.Sprintf("region(%d)", uint(r))
+	}
+}
+
+// maxReadChunk returns the largest number of bytes that can be read in a single command,
+// based on the device's maximum packet size.
+func maxReadChunk(info VersionInfo) int {
+	n := info.MaxPacketSize - commandHeaderSize
+	if n <= 0 {
+		n = info.WriteRowSize
+	}
+	if n > math.MaxUint16 {
+		n = math.MaxUint16
+	}
+	return n
+}
+
+// readRange reads length bytes starting at address, split into chunks of at most chunkSize bytes.
+func readRange(address Address, length Length, chunkSize int, readFunc func(uint32, uint16) ([]byte, error)) ([]byte, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid read chunk size %v", chunkSize)
+	}
+	data := make([]byte, 0, length)
+	for offset := Length(0); offset < length; offset += Length(chunkSize) {
+		addr := address + Address(offset)
+		n := length - offset
+		if n > Length(chunkSize) {
+			n = Length(chunkSize)
+		}
+		plannerLog.WithFields(operationFields("read", uint32(addr), int(n))).Debugf("reading %v bytes at %X", n, addr)
+		chunk, err := readFunc(uint32(addr), uint16(n))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read at address %X: %w", addr, err)
+		}
+		if Length(len(chunk)) != n {
+			return nil, fmt.Errorf("short read at address %X, expected %v bytes, got %v", addr, n, len(chunk))
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
 func loadHex(data io.Reader) (*gohex.Memory, error) {
 	mem := gohex.NewMemory()
 	err := mem.ParseIntelHex(data)
@@ -28,65 +330,122 @@ func loadHex(data io.Reader) (*gohex.Memory, error) {
 	return mem, nil
 }
 
-type progError struct {
-	Address uint32
-	Err     error
-}
-
-func (e *progError) Error() string {
-	return fmt.Sprintf("error at %X: %v", e.Address, e.Err)
+// patchSegments returns a copy of the segments with data written at address, overwriting
+// any data already there and joining the segments that it touches.
+func patchSegments(segments []gohex.DataSegment, address uint32, data []byte) []gohex.DataSegment {
+	mem := gohex.NewMemory()
+	for _, segment := range segments {
+		mem.SetBinary(segment.Address, segment.Data)
+	}
+	mem.SetBinary(address, data)
+	return mem.GetDataSegments()
 }
 
-func (e *progError) Unwrap() error { return e.Err }
+// excludeRanges returns a copy of the segments with any data lying within the given ranges removed.
+// Segments that partially overlap a range are split.
+func excludeRanges(segments []gohex.DataSegment, ranges []AddressRange) []gohex.DataSegment {
+	if len(ranges) == 0 {
+		return segments
+	}
+	excluded := func(address uint32) bool {
+		for _, r := range ranges {
+			if r.Contains(Address(address)) {
+				return true
+			}
+		}
+		return false
+	}
 
-func writeSegments(segments []gohex.DataSegment, writeRowSize int, writeFunc func(uint32, []byte) error) error {
-	// Convert the segments into row-aligned blocks of length writeRowSize
-	blocks := make(map[uint32][]byte)
+	var result []gohex.DataSegment
 	for _, segment := range segments {
-		for i, data := range segment.Data {
-			byteAddress := segment.Address + uint32(i)
-			rowAlignedAddress := byteAddress & ^uint32(writeRowSize-1)
-			b, ok := blocks[rowAlignedAddress]
-			if !ok {
-				// Create a blank block
-				b = make([]byte, writeRowSize)
-				for i := range b {
-					b[i] = 0xFF
+		start := -1
+		for i := 0; i <= len(segment.Data); i++ {
+			if i < len(segment.Data) && !excluded(segment.Address+uint32(i)) {
+				if start < 0 {
+					start = i
 				}
-				blocks[rowAlignedAddress] = b
+				continue
+			}
+			if start >= 0 {
+				result = append(result, gohex.DataSegment{
+					Address: segment.Address + uint32(start),
+					Data:    segment.Data[start:i],
+				})
+				start = -1
 			}
-			// Copy the data into the block
-			b[byteAddress-rowAlignedAddress] = data
 		}
 	}
-	// Now write the blocks to flash
-	for addr, block := range blocks {
-		pkgLog.Debugf("writing %v bytes at %X", len(block), addr)
-		err := writeFunc(addr, block)
-		if err != nil {
-			return &progError{Address: addr, Err: err}
+	return result
+}
+
+// wordAlignRanges widens each range so that it starts and ends on a 16-bit word boundary.
+func wordAlignRanges(ranges []AddressRange) []AddressRange {
+	aligned := make([]AddressRange, len(ranges))
+	for i, r := range ranges {
+		aligned[i] = AddressRange{Start: r.Start &^ 1, End: (r.End + 1) &^ 1}
+	}
+	return aligned
+}
+
+// alignReads wraps a read function so that every read starts and ends on a multiple of
+// alignment bytes. The extra bytes read from the device are discarded. Aligning can make
+// a read longer than maxChunk bytes, in which case it is split into several aligned reads.
+func alignReads(alignment, maxChunk int, readFunc func(uint32, uint16) ([]byte, error)) func(uint32, uint16) ([]byte, error) {
+	if alignment <= 1 {
+		return readFunc
+	}
+	chunk := uint32(maxChunk)
+	if chunk == 0 || chunk > math.MaxUint16 {
+		chunk = math.MaxUint16
+	}
+	chunk -= chunk % uint32(alignment)
+	if chunk == 0 {
+		chunk = uint32(alignment)
+	}
+	return func(address uint32, length uint16) ([]byte, error) {
+		start := address - address%uint32(alignment)
+		end := address + uint32(length)
+		if rem := end % uint32(alignment); rem != 0 {
+			end += uint32(alignment) - rem
+		}
+		data := make([]byte, 0, end-start)
+		for from := start; from < end; from += chunk {
+			n := end - from
+			if n > chunk {
+				n = chunk
+			}
+			part, err := readFunc(from, uint16(n))
+			if err != nil {
+				return nil, err
+			}
+			if uint32(len(part)) < n {
+				return nil, fmt.Errorf("short read at %X, expected %v bytes, got %v", from, n, len(part))
+			}
+			data = append(data, part[:n]...)
 		}
+		offset := address - start
+		return data[offset : offset+uint32(length)], nil
 	}
-	return nil
 }
 
-func eraseSegments(segments []gohex.DataSegment, eraseRowSize int, eraseFunc func(uint32, uint16) error) error {
+// segmentsToBinary returns length bytes of the segments' data starting at address.
+// Any addresses not covered by the segments are filled with the erased value.
+func segmentsToBinary(segments []gohex.DataSegment, address, length uint32) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = erasedValue
+	}
 	for _, segment := range segments {
-		start := segment.Address & ^uint32(eraseRowSize-1)
-		num := uint16(math.Ceil(
-			float64((segment.Address+uint32(len(segment.Data)))-start) /
-				float64(eraseRowSize)))
-
-		pkgLog.Debugf("erasing %v rows at %X", num, start)
-		err := eraseFunc(start, num)
-		if err != nil {
-			return &progError{Address: start, Err: err}
+		for i, b := range segment.Data {
+			if addr := segment.Address + uint32(i); addr >= address && addr < address+length {
+				data[addr-address] = b
+			}
 		}
 	}
-	return nil
+	return data
 }
 
-func verifySegmentsByReading(segments []gohex.DataSegment, writeRowSize int, readFunc func(uint32, uint16) ([]byte, error)) error {
+func verifySegmentsByReading(segments []gohex.DataSegment, writeRowSize int, readFunc func(uint32, uint16) ([]byte, error), report *RegionReport) error {
 	for _, segment := range segments {
 		offset := 0
 		for addr := segment.Address; addr-segment.Address < uint32(len(segment.Data)); addr, offset = addr+uint32(writeRowSize), offset+writeRowSize {
@@ -95,15 +454,34 @@ func verifySegmentsByReading(segments []gohex.DataSegment, writeRowSize int, rea
 				chunk = segment.Data[offset : offset+writeRowSize]
 			}
 
-			pkgLog.Debugf("verifying data at %X length %v", addr, len(chunk))
+			plannerLog.WithFields(operationFields(StageVerify, addr, len(chunk))).
+				Debugf("verifying data at %X length %v", addr, len(chunk))
 			data, err := readFunc(addr, uint16(len(chunk)))
 			if err != nil {
-				return fmt.Errorf("failed to read flash at address %X: %v", addr, err)
+				return fmt.Errorf("failed to read flash at address %X: %w", addr, err)
+			}
+			if len(data) != len(chunk) {
+				return fmt.Errorf("read of flash at address %X returned %v bytes, expected %v", addr, len(data), len(chunk))
 			}
-			// Compare the bytes
-			for i := range data {
-				if data[i] != chunk[i] {
-					return fmt.Errorf("mismatch at %X, expected %X read %X", addr+uint32(i), chunk[i], data[i])
+			report.Checked = append(report.Checked, CheckedRange{Address: Address(addr), Length: Length(len(chunk))})
+
+			// Compare the bytes, grouping consecutive mismatches together
+			start := -1
+			for i := 0; i <= len(chunk); i++ {
+				if i < len(chunk) && data[i] != chunk[i] {
+					if start < 0 {
+						start = i
+					}
+					continue
+				}
+				if start >= 0 {
+					report.Mismatches = append(report.Mismatches, Mismatch{
+						Address:  Address(addr + uint32(start)),
+						Length:   Length(i - start),
+						Expected: append([]byte{}, chunk[start:i]...),
+						Actual:   append([]byte{}, data[start:i]...),
+					})
+					start = -1
 				}
 			}
 		}
@@ -111,31 +489,72 @@ func verifySegmentsByReading(segments []gohex.DataSegment, writeRowSize int, rea
 	return nil
 }
 
-func verifySegmentsByChecksum(segments []gohex.DataSegment, checksumFunc func(uint32, uint16) (uint16, error)) error {
-	// The maximum length to checksum needs to fit inside 16-bits and be an even number
-	const maxChecksumChunk = math.MaxUint16 - 1
-	for _, segment := range segments {
-		offset := 0
-		for addr := segment.Address; addr-segment.Address < uint32(len(segment.Data)); addr, offset = addr+uint32(maxChecksumChunk), offset+maxChecksumChunk {
-			chunk := segment.Data[offset:]
-			if len(chunk) > maxChecksumChunk {
-				chunk = segment.Data[offset : offset+maxChecksumChunk]
-			}
-
-			pkgLog.Debugf("verifying checksum at %X length %v", addr, len(chunk))
-			picsum, err := checksumFunc(addr, uint16(len(chunk)))
-			if err != nil {
-				return fmt.Errorf("failed to calculate checksum at address %X: %v", addr, err)
-			}
-			// Calculate the local checksum
-			var localsum uint16
-			for i := 0; i < len(chunk); i += 2 {
-				localsum += uint16(chunk[i]) + (uint16(chunk[i+1]) << 8)
-			}
-			if picsum != localsum {
-				return fmt.Errorf("checksum mismatch at %X, PIC: %X, local: %X", addr, picsum, localsum)
-			}
+func verifyChecksums(ranges []CheckedRange, checksumFunc func(uint32, uint16) (uint16, error), report *RegionReport) error {
+	for _, r := range ranges {
+		plannerLog.WithFields(operationFields(StageVerify, uint32(r.Address), int(r.Length))).
+			Debugf("verifying checksum at %X length %v", r.Address, r.Length)
+		picsum, err := checksumFunc(uint32(r.Address), uint16(r.Length))
+		if err != nil {
+			return fmt.Errorf("failed to calculate checksum at address %X: %w", r.Address, err)
+		}
+		r.DeviceChecksum = picsum
+		report.Checked = append(report.Checked, r)
+		if picsum != r.ExpectedChecksum {
+			report.Mismatches = append(report.Mismatches, Mismatch{Address: r.Address, Length: r.Length})
 		}
 	}
 	return nil
 }
+
+// erasedValue is the value read back from an erased memory location.
+const erasedValue = 0xFF
+
+// BlankCheckResult is the result of blank checking a memory region.
+type BlankCheckResult struct {
+	Region Region
+	Range  AddressRange
+	// The first addresses in the range that aren't erased, if any.
+	NonBlank []Address
+}
+
+// Blank returns true if the whole region is erased.
+func (r BlankCheckResult) Blank() bool {
+	return len(r.NonBlank) == 0
+}
+
+// Maximum number of rows erased by each EraseFlash command sent by EraseRange.
+const maxEraseRangeRows = 0xFFFF
+
+// EraseRange erases the flash from start up to, but not including, end. The span is
+// widened to whole erase rows, using the erase row size reported by the device, and the
+// range that was erased is returned. Addresses are those passed to the bootloader.
+func EraseRange(bootloader Bootloader, start, end Address) (AddressRange, error) {
+	if end <= start {
+		return AddressRange{}, fmt.Errorf("invalid range %X-%X, start must be less than end", start, end)
+	}
+	info, err := bootloader.GetVersion()
+	if err != nil {
+		return AddressRange{}, fmt.Errorf("failed to get device info: %w", err)
+	}
+	if info.EraseRowSize == 0 {
+		return AddressRange{}, fmt.Errorf("device reports an erase row size of 0")
+	}
+	rowSize := Address(info.EraseRowSize)
+	erased := AddressRange{Start: start - start%rowSize, End: end}
+	if end%rowSize != 0 {
+		erased.End = end - end%rowSize + rowSize
+	}
+	for address := erased.Start; address < erased.End; {
+		rows := uint32((erased.End - address) / rowSize)
+		if rows > maxEraseRangeRows {
+			rows = maxEraseRangeRows
+		}
+		plannerLog.WithFields(operationFields(StageErase, uint32(address), int(rows))).
+			Debugf("erasing %v rows at %X", rows, address)
+		if err := bootloader.EraseFlash(uint32(address), uint16(rows)); err != nil {
+			return AddressRange{}, err
+		}
+		address += Address(rows) * rowSize
+	}
+	return erased, nil
+}
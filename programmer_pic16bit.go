@@ -0,0 +1,138 @@
+package microchipboot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// Number of bytes used to store each 24-bit instruction in the hex file: three data
+// bytes followed by an unimplemented "phantom" byte.
+const pic16BitInstructionSize = 4
+
+// PIC16BitProfile defines the memory structure for 16-bit PICs (PIC24 and dsPIC33).
+// All addresses and sizes are program counter addresses, as used in the device datasheet.
+// Each instruction occupies two program counter addresses.
+type PIC16BitProfile struct {
+	BootloaderOffset uint32
+	FlashSize        uint32
+	// Location of the configuration words on devices that store them outside flash
+	// (e.g. 0xF80000 on dsPIC33F). Leave as zero on devices that keep the configuration
+	// words at the end of flash.
+	ConfigOffset uint32
+	ConfigSize   uint32
+	// VerifyExclude lists program counter address ranges that are skipped during verification.
+	VerifyExclude []AddressRange
+}
+
+// PIC16BitOptions holds programming options for 16-bit PICs.
+type PIC16BitOptions struct {
+	ProgramConfig bool
+	// If true, then verification is done by reading back from flash memory.
+	// Otherwise, checksum is used.
+	VerifyByReading bool
+	// If true, Program does nothing if the device already contains the loaded image.
+	SkipIfUpToDate bool
+}
+
+// pic16BitProgrammer programs 16-bit PICs. The bootloader protocol is the same as for
+// word addressed 8-bit PICs, with 4 bytes transferred per instruction, so the 8-bit
+// programmer is reused once the hex image has been normalised to whole instructions.
+type pic16BitProgrammer struct {
+	*pic8Programmer
+}
+
+// NewPIC16BitProgrammer creates a new programmer for PIC24 and dsPIC33 devices.
+//
+// The bootloader is sent program counter addresses and 4 bytes per instruction, including
+// the phantom byte, which is always zero. The row sizes reported by the device are in
+// program counter units.
+func NewPIC16BitProgrammer(bootloader Bootloader, profile PIC16BitProfile, options PIC16BitOptions) Programmer {
+	// The hex file uses byte addresses, which are twice the program counter address
+	byteRange := func(r AddressRange) AddressRange {
+		return AddressRange{Start: r.Start * 2, End: r.End * 2}
+	}
+	p8 := PIC8Profile{
+		AddressMode:      AddressModeWord,
+		BootloaderOffset: profile.BootloaderOffset * 2,
+		FlashSize:        profile.FlashSize * 2,
+		ConfigOffset:     profile.ConfigOffset * 2,
+		ConfigSize:       profile.ConfigSize * 2,
+		ConfigWriteSize:  pic16BitInstructionSize,
+	}
+	for _, r := range profile.VerifyExclude {
+		p8.VerifyExclude = append(p8.VerifyExclude, byteRange(r))
+	}
+	prog := NewPIC8Programmer(bootloader, p8, PIC8Options{
+		ProgramConfig:   options.ProgramConfig,
+		VerifyByReading: options.VerifyByReading,
+		SkipIfUpToDate:  options.SkipIfUpToDate,
+	}).(*pic8Programmer)
+	// The phantom byte of an erased instruction reads as zero
+	prog.erasedPattern = []byte{erasedValue, erasedValue, erasedValue, 0}
+	return &pic16BitProgrammer{pic8Programmer: prog}
+}
+
+// LoadELF loads the loadable segments of an ELF file. The program counter addresses
+// used by XC16 are doubled into byte addresses, and the file is then normalised to
+// whole instructions in the same way as a hex file.
+func (p *pic16BitProgrammer) LoadELF(r io.ReaderAt) error {
+	hex, err := elfToHex(r, 2)
+	if err != nil {
+		return err
+	}
+	return p.LoadHex(hex)
+}
+
+// LoadSREC loads a Motorola S-record file.
+func (p *pic16BitProgrammer) LoadSREC(data io.Reader) error {
+	hex, err := srecToHex(data)
+	if err != nil {
+		return err
+	}
+	return p.LoadHex(hex)
+}
+
+// LoadHex loads and parses the specified hex data. Each segment is extended to cover
+// whole instructions, with any missing instructions filled with the erased value.
+func (p *pic16BitProgrammer) LoadHex(data io.Reader) error {
+	mem, err := loadHex(data)
+	if err != nil {
+		return err
+	}
+
+	normalised := gohex.NewMemory()
+	for _, segment := range mem.GetDataSegments() {
+		if err := normalised.AddBinary(alignInstructions(segment)); err != nil {
+			return fmt.Errorf("failed to load segment at %X: %w", segment.Address, err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := normalised.DumpIntelHex(buf, 16); err != nil {
+		return err
+	}
+	return p.pic8Programmer.LoadHex(buf)
+}
+
+// alignInstructions expands the segment to start and end on an instruction boundary and
+// clears the phantom byte of every instruction.
+func alignInstructions(segment gohex.DataSegment) (uint32, []byte) {
+	start := segment.Address &^ (pic16BitInstructionSize - 1)
+	end := segment.Address + uint32(len(segment.Data))
+	if rem := end % pic16BitInstructionSize; rem != 0 {
+		end += pic16BitInstructionSize - rem
+	}
+
+	data := make([]byte, end-start)
+	for i := range data {
+		data[i] = erasedValue
+	}
+	copy(data[segment.Address-start:], segment.Data)
+	for i := pic16BitInstructionSize - 1; i < len(data); i += pic16BitInstructionSize {
+		data[i] = 0
+	}
+	return start, data
+}
@@ -0,0 +1,343 @@
+package microchipboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// PIC32 address space constants.
+const (
+	pic32PhysicalMask = 0x1FFFFFFF
+	pic32KSEG0        = 0x80000000
+	pic32WordSize     = 4
+)
+
+// PhysicalAddress converts a PIC32 KSEG0 or KSEG1 virtual address into a physical address.
+// Physical addresses are returned unchanged.
+func PhysicalAddress(address uint32) uint32 {
+	return address & pic32PhysicalMask
+}
+
+// KSEG0Address converts a PIC32 physical or virtual address into a cached KSEG0 virtual address.
+func KSEG0Address(address uint32) uint32 {
+	return PhysicalAddress(address) | pic32KSEG0
+}
+
+// PIC32Profile defines the memory structure for PIC32 devices. Addresses may be given
+// as either physical or KSEG0/KSEG1 virtual addresses.
+type PIC32Profile struct {
+	// Start of program flash, e.g. 0x1D000000.
+	FlashStart uint32
+	FlashSize  uint32
+	// Address of the application, i.e. the end of the bootloader if it lives in program flash.
+	ApplicationStart uint32
+	// Location of the configuration words in boot flash, e.g. 0x1FC00BF0.
+	ConfigOffset uint32
+	ConfigSize   uint32
+	// Row sizes in bytes. PIC32 row sizes are too large to be reported by GetVersion, so
+	// they must be given here.
+	EraseRowSize int
+	WriteRowSize int
+	// If true, the bootloader is sent KSEG0 virtual addresses. Otherwise, physical addresses are used.
+	VirtualAddresses bool
+	// VerifyExclude lists address ranges that are skipped during verification.
+	VerifyExclude []AddressRange
+}
+
+// PIC32Options holds programming options for PIC32 devices.
+type PIC32Options struct {
+	ProgramConfig bool
+	// If true, then verification is done by reading back from flash memory.
+	// Otherwise, a 32-bit checksum is used.
+	VerifyByReading bool
+}
+
+// pic32Programmer programs PIC32 devices. The 8-bit programmer is reused, working in
+// physical addresses, with the device's address translation and row sizes handled by
+// pic32Bootloader. Config words live in boot flash and have to be erased before they
+// are written, so they are handled as the 8-bit programmer's ID region.
+type pic32Programmer struct {
+	*pic8Programmer
+	pic32 PIC32Profile
+	raw   Bootloader
+}
+
+// NewPIC32Programmer creates a new programmer for PIC32 devices.
+//
+// Verification by checksum uses the CalculateChecksum command with a 32-bit response,
+// calculated as the sum of little endian 32-bit words, which requires the bootloader to
+// implement CommandSender.
+func NewPIC32Programmer(bootloader Bootloader, profile PIC32Profile, options PIC32Options) Programmer {
+	physicalRange := func(r AddressRange) AddressRange {
+		return AddressRange{Start: Address(PhysicalAddress(uint32(r.Start))), End: Address(PhysicalAddress(uint32(r.End)))}
+	}
+	p8 := PIC8Profile{
+		BootloaderOffset: PhysicalAddress(profile.ApplicationStart),
+		FlashSize:        PhysicalAddress(profile.FlashStart) + profile.FlashSize,
+		IDOffset:         PhysicalAddress(profile.ConfigOffset),
+		IDSize:           profile.ConfigSize,
+	}
+	for _, r := range profile.VerifyExclude {
+		p8.VerifyExclude = append(p8.VerifyExclude, physicalRange(r))
+	}
+	wrapped := &pic32Bootloader{Bootloader: bootloader, profile: profile}
+	prog := &pic32Programmer{
+		pic8Programmer: NewPIC8Programmer(wrapped, p8, PIC8Options{
+			ProgramID:       options.ProgramConfig,
+			VerifyByReading: options.VerifyByReading,
+		}).(*pic8Programmer),
+		pic32: profile,
+		raw:   bootloader,
+	}
+	if !options.VerifyByReading {
+		prog.compareFlash = prog.compareFlash32
+	}
+	return prog
+}
+
+// LoadELF loads the loadable segments of an ELF file. Virtual addresses are
+// converted into physical addresses in the same way as for a hex file.
+func (p *pic32Programmer) LoadELF(r io.ReaderAt) error {
+	hex, err := elfToHex(r, 1)
+	if err != nil {
+		return err
+	}
+	return p.LoadHex(hex)
+}
+
+// LoadSREC loads a Motorola S-record file.
+func (p *pic32Programmer) LoadSREC(data io.Reader) error {
+	hex, err := srecToHex(data)
+	if err != nil {
+		return err
+	}
+	return p.LoadHex(hex)
+}
+
+// LoadHex loads and parses the specified hex data. Virtual addresses are converted into
+// physical addresses and each segment is extended to whole 32-bit words.
+func (p *pic32Programmer) LoadHex(data io.Reader) error {
+	mem, err := loadHex(data)
+	if err != nil {
+		return err
+	}
+
+	normalised := gohex.NewMemory()
+	for _, segment := range mem.GetDataSegments() {
+		start := PhysicalAddress(segment.Address) &^ (pic32WordSize - 1)
+		offset := PhysicalAddress(segment.Address) - start
+		length := offset + uint32(len(segment.Data))
+		if rem := length % pic32WordSize; rem != 0 {
+			length += pic32WordSize - rem
+		}
+		buf := make([]byte, length)
+		for i := range buf {
+			buf[i] = erasedValue
+		}
+		copy(buf[offset:], segment.Data)
+		if err := normalised.AddBinary(start, buf); err != nil {
+			return fmt.Errorf("failed to load segment at %X: %w", segment.Address, err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := normalised.DumpIntelHex(buf, 16); err != nil {
+		return err
+	}
+	return p.pic8Programmer.LoadHex(buf)
+}
+
+// Verify checks that the device contains the loaded image.
+func (p *pic32Programmer) Verify() error {
+	defer p.events.end()
+	if p.options.VerifyByReading {
+		return p.pic8Programmer.Verify()
+	}
+	checksum, err := p.checksum32()
+	if err != nil {
+		return err
+	}
+
+	p.report = &VerifyReport{Method: VerifyMethodChecksum}
+	p.events.begin(StageVerify)
+	if err := p.verifyChecksum32(RegionFlash, p.flash, checksum, p.report.addRegion("flash")); err != nil {
+		return fmt.Errorf("failed to verify flash: %w", err)
+	}
+	if p.options.ProgramID {
+		if err := p.verifyChecksum32(RegionID, p.id, checksum, p.report.addRegion("config")); err != nil {
+			return fmt.Errorf("failed to verify config: %w", err)
+		}
+	}
+	return p.report.err()
+}
+
+// Resume continues programming after Program has failed part way through, checking the
+// flash that has already been written with 32-bit checksums unless verifying by reading.
+func (p *pic32Programmer) Resume() error {
+	if p.options.VerifyByReading {
+		return p.pic8Programmer.Resume()
+	}
+	matches, err := p.writeMatches32()
+	if err != nil {
+		return err
+	}
+	return p.resume(matches)
+}
+
+// ProgramStream programs a hex image as it is read, without loading it into memory first,
+// so that images of several megabytes can be programmed from small hosts. Each flash row
+// is checked with a 32-bit checksum, or by reading, as soon as it has been written.
+func (p *pic32Programmer) ProgramStream(hex io.Reader) error {
+	matches := p.writeMatches
+	if !p.options.VerifyByReading {
+		var err error
+		if matches, err = p.writeMatches32(); err != nil {
+			return err
+		}
+	}
+	if err := p.programStream(hex, PhysicalAddress, p.LoadHex, matches); err != nil {
+		return err
+	}
+	return p.Verify()
+}
+
+// writeMatches32 returns a function that checks whether the device already contains the
+// data of a write step using 32-bit checksums.
+func (p *pic32Programmer) writeMatches32() (func(PlanStep) (bool, error), error) {
+	checksum, err := p.checksum32()
+	if err != nil {
+		return nil, err
+	}
+	return func(step PlanStep) (bool, error) {
+		picsum, err := checksum(step.Address, uint16(len(step.Data)))
+		if err != nil {
+			return false, err
+		}
+		return picsum == sum32(step.Data), nil
+	}, nil
+}
+
+// compareFlash32 compares the flash with the image using 32-bit checksums.
+func (p *pic32Programmer) compareFlash32(report *RegionReport) error {
+	checksum, err := p.checksum32()
+	if err != nil {
+		return err
+	}
+	return p.verifyChecksum32(RegionFlash, p.flash, checksum, report)
+}
+
+// checksum32 returns a function that calculates 32-bit checksums on the device.
+func (p *pic32Programmer) checksum32() (func(uint32, uint16) (uint32, error), error) {
+	sender, ok := p.raw.(CommandSender)
+	if !ok {
+		return nil, fmt.Errorf("bootloader does not support 32-bit checksums, verify by reading instead")
+	}
+	return func(address uint32, length uint16) (uint32, error) {
+		resp, err := sender.SendCommand(NewCalculateChecksum32Command(p.deviceAddress(address), length))
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32(resp), nil
+	}, nil
+}
+
+// sum32 calculates the sum of the little endian 32-bit words in data.
+func sum32(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i+pic32WordSize <= len(data); i += pic32WordSize {
+		sum += binary.LittleEndian.Uint32(data[i:])
+	}
+	return sum
+}
+
+func (p *pic32Programmer) verifyChecksum32(region Region, segments []gohex.DataSegment, checksumFunc func(uint32, uint16) (uint32, error), report *RegionReport) error {
+	// The checksum is calculated over whole words, so the length must be a multiple of 4
+	const maxChecksumChunk = 0xFFFC
+	for _, segment := range excludeRanges(segments, p.verifyExclusions()) {
+		for offset := 0; offset < len(segment.Data); offset += maxChecksumChunk {
+			chunk := segment.Data[offset:]
+			if len(chunk) > maxChecksumChunk {
+				chunk = chunk[:maxChecksumChunk]
+			}
+			address := segment.Address + uint32(offset)
+			sum := sum32(chunk)
+
+			plannerLog.WithFields(operationFields(StageVerify, address, len(chunk))).
+				Debugf("verifying checksum at %X length %v", address, len(chunk))
+			var picsum uint32
+			err := p.events.do(StageVerify, region, address, len(chunk), func() (err error) {
+				picsum, err = checksumFunc(address, uint16(len(chunk)))
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to calculate checksum at address %X: %w", address, err)
+			}
+			report.Checked = append(report.Checked, CheckedRange{Address: Address(address), Length: Length(len(chunk))})
+			if picsum != sum {
+				report.Mismatches = append(report.Mismatches, Mismatch{Address: Address(address), Length: Length(len(chunk))})
+			}
+		}
+	}
+	return nil
+}
+
+// deviceAddress converts a physical address into the address expected by the bootloader.
+func (p *pic32Programmer) deviceAddress(address uint32) uint32 {
+	if p.pic32.VirtualAddresses {
+		return KSEG0Address(address)
+	}
+	return address
+}
+
+// pic32Bootloader converts the physical addresses used by the programmer into the addresses
+// expected by the bootloader, and replaces the row sizes reported by the device with
+// those in the profile.
+type pic32Bootloader struct {
+	Bootloader
+	profile PIC32Profile
+}
+
+func (b *pic32Bootloader) unwrap() Bootloader {
+	return b.Bootloader
+}
+
+func (b *pic32Bootloader) address(address uint32) uint32 {
+	if b.profile.VirtualAddresses {
+		return KSEG0Address(address)
+	}
+	return address
+}
+
+func (b *pic32Bootloader) GetVersion() (VersionInfo, error) {
+	info, err := b.Bootloader.GetVersion()
+	if err != nil {
+		return info, err
+	}
+	if b.profile.EraseRowSize != 0 {
+		info.EraseRowSize = b.profile.EraseRowSize
+	}
+	if b.profile.WriteRowSize != 0 {
+		info.WriteRowSize = b.profile.WriteRowSize
+	}
+	return info, nil
+}
+
+func (b *pic32Bootloader) ReadFlash(address uint32, length uint16) ([]byte, error) {
+	return b.Bootloader.ReadFlash(b.address(address), length)
+}
+
+func (b *pic32Bootloader) WriteFlash(address uint32, data []byte) error {
+	return b.Bootloader.WriteFlash(b.address(address), data)
+}
+
+func (b *pic32Bootloader) EraseFlash(address uint32, numRows uint16) error {
+	return b.Bootloader.EraseFlash(b.address(address), numRows)
+}
+
+func (b *pic32Bootloader) CalculateChecksum(address uint32, length uint16) (uint16, error) {
+	return b.Bootloader.CalculateChecksum(b.address(address), length)
+}
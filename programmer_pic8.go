@@ -1,8 +1,10 @@
 package microchipboot
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"math"
 
 	"github.com/marcinbor85/gohex"
 )
@@ -14,6 +16,15 @@ type pic8Programmer struct {
 	profile    PIC8Profile
 	options    PIC8Options
 	info       VersionInfo
+	report     *VerifyReport
+	plan       *Plan
+	progress   progress
+	events     events
+	// Overrides the erased value of each byte of flash, repeating from address 0, for
+	// devices where it isn't the same for every 16-bit word
+	erasedPattern []byte
+	// If set, replaces the 16-bit checksums that the flash is compared with by isUpToDate
+	compareFlash func(report *RegionReport) error
 
 	flash  []gohex.DataSegment
 	config []gohex.DataSegment
@@ -21,8 +32,41 @@ type pic8Programmer struct {
 	id     []gohex.DataSegment
 }
 
+// Device families supported by the PIC8 programmer.
+const (
+	FamilyPIC16 = "pic16"
+	FamilyPIC18 = "pic18"
+)
+
+// Address modes, which determine how addresses are passed to the bootloader.
+const (
+	// Addresses are byte addresses, as used in the hex file.
+	AddressModeByte = "byte"
+	// Flash, config and ID addresses are 16-bit word addresses, i.e. half the hex file address.
+	AddressModeWord = "word"
+)
+
+// Family specific defaults.
+const (
+	pic18ConfigOffset    = 0x300000
+	pic18ConfigSize      = 14
+	pic18ConfigWriteSize = 1
+	pic18EEPROMOffset    = 0xF00000
+	// PIC16 program memory words are 14 bits wide
+	pic16ErasedWord = 0x3FFF
+	// Erased flash word of other devices
+	defaultErasedWord = 0xFFFF
+)
+
 // PIC8Profile defines the memory structure for 8-bit PICs.
 type PIC8Profile struct {
+	// Family is the device family (FamilyPIC16 or FamilyPIC18). If set, family
+	// specific defaults are applied to fields that are left as zero.
+	Family string
+	// AddressMode is AddressModeByte or AddressModeWord. All addresses in the profile are
+	// byte addresses as used in the hex file, regardless of the address mode.
+	// Defaults to AddressModeWord for the pic16 family and AddressModeByte otherwise.
+	AddressMode      string
 	BootloaderOffset uint32
 	FlashSize        uint32
 	EEPROMOffset     uint32
@@ -31,6 +75,87 @@ type PIC8Profile struct {
 	ConfigSize       uint32
 	IDOffset         uint32
 	IDSize           uint32
+	// If true, config addresses are passed to the bootloader relative to ConfigOffset
+	// rather than as absolute addresses.
+	ZeroBasedConfig bool
+	// ConfigWriteSize is the number of config bytes written per WriteConfig command.
+	// If zero, the write row size reported by the device is used.
+	ConfigWriteSize int
+	// EEPROMWriteSize is the maximum number of EEPROM bytes written per WriteEE command.
+	// Set it to 1 for bootloaders that only accept single byte EEPROM writes.
+	// If zero, the write row size reported by the device is used.
+	EEPROMWriteSize int
+	// Read alignment constraints for each region. If set, reads are expanded to start and
+	// end on a multiple of this many bytes, and the extra bytes are discarded. For example,
+	// some devices require flash reads to start on an even address and be an even length.
+	// Reads of the ID region use FlashReadAlignment.
+	FlashReadAlignment  int
+	EEPROMReadAlignment int
+	ConfigReadAlignment int
+	// If true, EEPROM addresses are passed to the bootloader relative to EEPROMOffset
+	// rather than as the virtual addresses used in the hex file. Defaults to true for
+	// the pic18 family, whose bootloaders address EEPROM from 0, and false otherwise.
+	ZeroBasedEEPROM *bool
+	// VerifyExclude lists address ranges that are skipped during verification, such as
+	// areas that the application modifies at runtime.
+	VerifyExclude []AddressRange
+	// DeviceManaged lists address ranges that the bootloader writes itself, such as an
+	// application CRC or boot counter. They are omitted from read back comparison and
+	// from the expected checksum calculated from the hex file.
+	DeviceManaged []AddressRange
+	// Location in flash of the application's version or build hash. If VersionLength
+	// is non-zero, it is used to determine whether the device is already up to date.
+	VersionAddress uint32
+	VersionLength  uint32
+	// ErasedWord is the value that an erased 16-bit flash word reads back as. It is used
+	// to pad partial flash and ID rows, to detect blank rows that needn't be written, and
+	// for the gaps between the hex file's data when calculating the checksum that the
+	// device should report. Defaults to 0x3FFF for the pic16 family and 0xFFFF otherwise.
+	ErasedWord uint16
+	// If non-zero, Connect fails with ErrWrongDevice unless the device reports this
+	// device ID, so that an image isn't programmed into the wrong kind of device.
+	ExpectedDeviceID int
+	// ConfigFields describes the device's config words, so that the config region can be
+	// decoded into named settings. If empty, the generic table of the family is used.
+	// See ConfigTable.
+	ConfigFields []ConfigField
+}
+
+// applyFamilyDefaults fills in any unset fields with the defaults for the profile's family.
+func (p *PIC8Profile) applyFamilyDefaults() {
+	switch p.Family {
+	case FamilyPIC16:
+		if p.AddressMode == "" {
+			// PIC16 bootloaders use word addresses
+			p.AddressMode = AddressModeWord
+		}
+		if p.ErasedWord == 0 {
+			p.ErasedWord = pic16ErasedWord
+		}
+	case FamilyPIC18:
+		if p.ConfigOffset == 0 {
+			p.ConfigOffset = pic18ConfigOffset
+		}
+		if p.ConfigSize == 0 {
+			// CONFIG1L to CONFIG7H
+			p.ConfigSize = pic18ConfigSize
+		}
+		if p.ConfigWriteSize == 0 {
+			// PIC18 config bytes are written one at a time
+			p.ConfigWriteSize = pic18ConfigWriteSize
+		}
+		if p.EEPROMOffset == 0 {
+			// XC8 places PIC18 EEPROM data at 0xF00000 in the hex file
+			p.EEPROMOffset = pic18EEPROMOffset
+		}
+		if p.ZeroBasedEEPROM == nil {
+			zeroBased := true
+			p.ZeroBasedEEPROM = &zeroBased
+		}
+	}
+	if p.ErasedWord == 0 {
+		p.ErasedWord = defaultErasedWord
+	}
 }
 
 // PIC8Options holds programming options.
@@ -41,6 +166,118 @@ type PIC8Options struct {
 	// If true, then verification is done by reading back from flash memory.
 	// Otherwise, checksum is used.
 	VerifyByReading bool
+	// FlashRelocation is added to the address of every flash segment in the hex file
+	// when it is loaded. This allows an image linked at 0 to be placed above the bootloader,
+	// provided that the bootloader remaps the vectors accordingly.
+	FlashRelocation int32
+	// If true, Program does nothing if the device already contains the loaded image.
+	// This is determined by comparing the version metadata in the profile or, if no
+	// metadata location is configured, by comparing the checksum of the flash segments.
+	// The EEPROM, config and ID are read back and compared if they are programmed.
+	SkipIfUpToDate bool
+	// If true, flash rows that only contain erased (0xFF) bytes are written anyway. By
+	// default they are skipped, as the erase has already left them in that state.
+	WriteBlankRows bool
+	// If true, the whole application area, from BootloaderOffset to FlashSize, is erased
+	// before programming rather than only the rows covered by the hex file. This makes sure
+	// that no code from a previous, larger image is left behind.
+	EraseAll bool
+	// If true, the parts of hex file segments that don't lie within any region of the
+	// profile are logged and dropped instead of causing LoadHex to fail. This is useful
+	// when the toolchain emits data, such as user IDs, that the profile doesn't describe.
+	IgnoreOutOfRangeSegments bool
+	// ExcludeRanges lists flash address ranges, such as calibration data or serial number
+	// rows, that are never erased, written or verified, even if the hex file contains data
+	// for them. Ranges are widened to whole erase rows, since part of a row can't be
+	// erased without losing the rest of it.
+	ExcludeRanges []AddressRange
+	// Digest configures an integrity digest of the application image, which can be
+	// added to the image so that the firmware can check itself.
+	Digest ImageDigest
+	// ProtocolVariant selects the protocol variant, either ProtocolV1, ProtocolV2 or
+	// ProtocolAuto to detect it from the firmware version. If empty, the transport's
+	// setting is kept, which defaults to ProtocolV1.
+	ProtocolVariant string
+	// If true, CRCs are added to commands and checked on responses, for bootloader builds
+	// that support them. See ProtocolOptions.CRC.
+	ProtocolCRC bool
+	// If true, each flash write is checked straight after it is done, by checksum or by
+	// reading as selected by VerifyByReading. A row that doesn't match is erased and written
+	// again, so a transient link error only costs that row rather than failing Verify.
+	VerifyEachRow bool
+	// Number of times a row that fails VerifyEachRow is written again before Program
+	// fails. Defaults to 2.
+	RowRetries int
+	// If true, the EEPROM is read before programming and any bytes that the hex file
+	// doesn't set are restored afterwards, so that settings stored by the application
+	// survive an update. This needs EEPROMSize to be set in the profile.
+	PreserveEEPROM bool
+	// ConfigMask limits the bits of the listed config words that are programmed. The
+	// device's config is read first and only the masked bits are taken from the hex file,
+	// protecting bits such as calibration or code protection from a stray hex record.
+	// Words that aren't listed are programmed in full.
+	ConfigMask []ConfigWordMask
+}
+
+// ConfigWordMask selects the bits of a config word that are programmed.
+type ConfigWordMask struct {
+	// Hex file address of the config word.
+	Address uint32
+	// Bits of the little endian 16-bit word that are taken from the hex file. The other
+	// bits keep the device's current value.
+	Mask uint16
+}
+
+// defaultRowRetries is the number of times a row that fails VerifyEachRow is written
+// again if RowRetries isn't set.
+const defaultRowRetries = 2
+
+// Validate checks that the profile describes a usable memory layout, after applying
+// any family defaults.
+func (p PIC8Profile) Validate() error {
+	switch p.Family {
+	case "", FamilyPIC16, FamilyPIC18:
+	default:
+		return fmt.Errorf("invalid family %q, expected %q or %q", p.Family, FamilyPIC16, FamilyPIC18)
+	}
+	switch p.AddressMode {
+	case "", AddressModeByte, AddressModeWord:
+	default:
+		return fmt.Errorf("invalid addressmode %q, expected %q or %q", p.AddressMode, AddressModeByte, AddressModeWord)
+	}
+	p.applyFamilyDefaults()
+
+	if p.FlashSize == 0 {
+		return fmt.Errorf("flashsize must be set")
+	}
+	if p.BootloaderOffset >= p.FlashSize {
+		return fmt.Errorf("bootloaderoffset (%X) must be less than flashsize (%X)", p.BootloaderOffset, p.FlashSize)
+	}
+	if p.EEPROMSize > 0 && p.EEPROMOffset == 0 {
+		return fmt.Errorf("eepromoffset must be set when eepromsize is non-zero")
+	}
+	if p.ConfigSize > 0 && p.ConfigOffset == 0 {
+		return fmt.Errorf("configoffset must be set when configsize is non-zero")
+	}
+	if p.IDSize > 0 && p.IDOffset == 0 {
+		return fmt.Errorf("idoffset must be set when idsize is non-zero")
+	}
+	for _, r := range append(append([]AddressRange{}, p.VerifyExclude...), p.DeviceManaged...) {
+		if r.Start >= r.End {
+			return fmt.Errorf("invalid address range %X-%X, start must be less than end", r.Start, r.End)
+		}
+	}
+	return nil
+}
+
+// BootloaderRegionProfile returns a copy of the profile whose application area is the
+// bootloader region, i.e. from 0 up to BootloaderOffset. It is used to program a new
+// bootloader image via a second stage updater running from the application area.
+func (p PIC8Profile) BootloaderRegionProfile() PIC8Profile {
+	p.FlashSize = p.BootloaderOffset
+	p.BootloaderOffset = 0
+	p.VersionLength = 0
+	return p
 }
 
 // NewPIC8Programmer creates a new programmer for 8-bit PICs.
@@ -49,11 +286,123 @@ func NewPIC8Programmer(bootloader Bootloader, profile PIC8Profile, options PIC8O
 
 	prog.bootloader = bootloader
 	prog.profile = profile
+	prog.profile.applyFamilyDefaults()
 	prog.options = options
+	if prog.profile.AddressMode == AddressModeWord {
+		prog.bootloader = &wordAddressBootloader{bootloader}
+	}
+	prog.events.counter = findRetryCounter(prog.bootloader)
 
 	return prog
 }
 
+// LoadELF loads the loadable segments of an ELF file.
+func (p *pic8Programmer) LoadELF(r io.ReaderAt) error {
+	hex, err := elfToHex(r, 1)
+	if err != nil {
+		return err
+	}
+	return p.LoadHex(hex)
+}
+
+// LoadSREC loads a Motorola S-record file.
+func (p *pic8Programmer) LoadSREC(data io.Reader) error {
+	hex, err := srecToHex(data)
+	if err != nil {
+		return err
+	}
+	return p.LoadHex(hex)
+}
+
+// LoadEEPROMHex loads the initial EEPROM contents from a separate hex file, replacing any
+// EEPROM data in the main image. It must be called after the main image is loaded, which
+// discards it, and the ProgramEEPROM option must be set. Addresses below the size of the
+// EEPROM are taken as offsets from its start, as some toolchains write them that way.
+func (p *pic8Programmer) LoadEEPROMHex(data io.Reader) error {
+	if !p.options.ProgramEEPROM {
+		return fmt.Errorf("eeprom programming is disabled")
+	}
+	if p.profile.EEPROMSize == 0 {
+		return fmt.Errorf("the profile has no eeprom")
+	}
+	mem, err := loadHex(data)
+	if err != nil {
+		return err
+	}
+
+	start, size := p.profile.EEPROMOffset, p.profile.EEPROMSize
+	var eeprom []gohex.DataSegment
+	for _, segment := range mem.GetDataSegments() {
+		end := segment.Address + uint32(len(segment.Data))
+		switch {
+		case segment.Address >= start && end <= start+size:
+		case start != 0 && end <= size:
+			segment.Address += start
+		default:
+			return fmt.Errorf("invalid eeprom segment at address %X", segment.Address)
+		}
+		eeprom = append(eeprom, segment)
+		plannerLog.Debugf("loaded eeprom segment at %X length %v", segment.Address, len(segment.Data))
+	}
+	p.eeprom = eeprom
+	p.plan = nil
+	return nil
+}
+
+// PatchImage overwrites the loaded image with data at address, which is the address
+// in the device after any relocation. The data must lie within one of the profile's
+// regions, which must be enabled for programming. If the image has a digest footer, the
+// digest is recalculated.
+func (p *pic8Programmer) PatchImage(address Address, data []byte) error {
+	start := uint32(address)
+	end := start + uint32(len(data))
+	within := func(offset, size uint32) bool {
+		return start >= offset && end <= offset+size
+	}
+
+	switch {
+	case within(p.profile.BootloaderOffset, p.profile.FlashSize-p.profile.BootloaderOffset):
+		p.flash = patchSegments(p.flash, start, data)
+		// Flash segments are whole words, as when they are loaded
+		for i := range p.flash {
+			if len(p.flash[i].Data)&1 == 1 {
+				p.flash[i].Data = append(p.flash[i].Data, 0xFF)
+			}
+		}
+		if footer := p.options.Digest.FooterAddress; footer != 0 {
+			digest, err := p.GetImageDigest()
+			if err != nil {
+				return fmt.Errorf("failed to calculate image digest: %w", err)
+			}
+			p.flash = patchSegments(p.flash, footer, digest)
+		}
+
+	case within(p.profile.IDOffset, p.profile.IDSize):
+		if !p.options.ProgramID {
+			return fmt.Errorf("id programming is disabled")
+		}
+		p.id = patchSegments(p.id, start, data)
+
+	case within(p.profile.ConfigOffset, p.profile.ConfigSize):
+		if !p.options.ProgramConfig {
+			return fmt.Errorf("config programming is disabled")
+		}
+		p.config = patchSegments(p.config, start, data)
+
+	case within(p.profile.EEPROMOffset, p.profile.EEPROMSize):
+		if !p.options.ProgramEEPROM {
+			return fmt.Errorf("eeprom programming is disabled")
+		}
+		p.eeprom = patchSegments(p.eeprom, start, data)
+
+	default:
+		return fmt.Errorf("patch at %X length %v lies outside the profile's regions", start, len(data))
+	}
+	plannerLog.Debugf("patched image at %X length %v", start, len(data))
+	p.plan = nil
+	return nil
+}
+
 // LoadHex loads and parses the specified hex data.
 func (p *pic8Programmer) LoadHex(data io.Reader) error {
 	var err error
@@ -61,49 +410,131 @@ func (p *pic8Programmer) LoadHex(data io.Reader) error {
 	if err != nil {
 		return err
 	}
+	// Discard any previously loaded segments and plan
+	p.flash, p.config, p.eeprom, p.id = nil, nil, nil, nil
+	p.plan = nil
+
+	if p.options.FlashRelocation&1 == 1 {
+		return fmt.Errorf("flash relocation %X must be an even number", p.options.FlashRelocation)
+	}
+
+	// Extract the various segments
+	for _, segment := range p.memory.GetDataSegments() {
+		if p.options.FlashRelocation != 0 && segment.Address < p.profile.FlashSize {
+			if err := p.relocateSegment(&segment); err != nil {
+				return err
+			}
+		}
+		if p.loadSegment(segment) {
+			continue
+		}
+		if !p.options.IgnoreOutOfRangeSegments {
+			return fmt.Errorf("invalid data segment at address %X", segment.Address)
+		}
+		p.loadSegmentInRange(segment)
+	}
+	if p.options.Digest.FooterAddress != 0 {
+		return p.addDigestFooter()
+	}
+	return nil
+}
 
+// loadSegment adds a segment to the region that contains the whole of it, unless
+// programming of that region is disabled. It returns false if no region contains it.
+func (p *pic8Programmer) loadSegment(segment gohex.DataSegment) bool {
 	validSegment := func(s *gohex.DataSegment, start, length uint32) bool {
 		if s.Address >= start && s.Address+uint32(len(s.Data)) <= start+length {
 			return true
 		}
 		return false
 	}
+	skip := func(region string) bool {
+		plannerLog.WithFields(operationFields("load", segment.Address, len(segment.Data))).
+			Warnf("ignoring %v bytes of %v data at address %X as %v programming is disabled",
+				len(segment.Data), region, segment.Address, region)
+		return true
+	}
 
-	// Extract the various segments
-	for _, segment := range p.memory.GetDataSegments() {
-		switch {
-		case validSegment(&segment, p.profile.BootloaderOffset, p.profile.FlashSize-p.profile.BootloaderOffset):
-			// Make sure the length is an even number
-			if len(segment.Data)&1 == 1 {
-				// Add an extra byte to pad the segment out
-				segment.Data = append(segment.Data, 0xFF)
-			}
-			p.flash = append(p.flash, segment)
-			pkgLog.Debugf("loaded flash segment at %X length %v", segment.Address, len(segment.Data))
-
-		case validSegment(&segment, p.profile.IDOffset, p.profile.IDSize):
-			p.id = append(p.id, segment)
-			pkgLog.Debugf("loaded id segment at %X length %v", segment.Address, len(segment.Data))
-
-		case validSegment(&segment, p.profile.ConfigOffset, p.profile.ConfigSize):
-			// Unused configuration bytes are saved as 0xFF in the hex file,
-			// but are read as 0x00 by the PIC. Therefore, replace any 0xFF's with 0x00.
-			for i := range segment.Data {
-				if segment.Data[i] == 0xFF {
-					segment.Data[i] = 0
-				}
+	switch {
+	case validSegment(&segment, p.profile.BootloaderOffset, p.profile.FlashSize-p.profile.BootloaderOffset):
+		// Make sure the length is an even number
+		if len(segment.Data)&1 == 1 {
+			// Add an extra byte to pad the segment out
+			segment.Data = append(segment.Data, 0xFF)
+		}
+		p.flash = append(p.flash, segment)
+		plannerLog.Debugf("loaded flash segment at %X length %v", segment.Address, len(segment.Data))
+
+	case validSegment(&segment, p.profile.IDOffset, p.profile.IDSize):
+		if !p.options.ProgramID {
+			return skip("id")
+		}
+		p.id = append(p.id, segment)
+		plannerLog.Debugf("loaded id segment at %X length %v", segment.Address, len(segment.Data))
+
+	case validSegment(&segment, p.profile.ConfigOffset, p.profile.ConfigSize):
+		if !p.options.ProgramConfig {
+			return skip("config")
+		}
+		// Unused configuration bytes are saved as 0xFF in the hex file,
+		// but are read as 0x00 by the PIC. Therefore, replace any 0xFF's with 0x00.
+		for i := range segment.Data {
+			if segment.Data[i] == 0xFF {
+				segment.Data[i] = 0
 			}
-			p.config = append(p.config, segment)
-			pkgLog.Debugf("loaded config segment at %X length %v", segment.Address, len(segment.Data))
+		}
+		p.config = append(p.config, segment)
+		plannerLog.Debugf("loaded config segment at %X length %v", segment.Address, len(segment.Data))
 
-		case validSegment(&segment, p.profile.EEPROMOffset, p.profile.EEPROMSize):
-			p.eeprom = append(p.eeprom, segment)
-			pkgLog.Debugf("loaded eeprom segment at %X length %v", segment.Address, len(segment.Data))
+	case validSegment(&segment, p.profile.EEPROMOffset, p.profile.EEPROMSize):
+		if !p.options.ProgramEEPROM {
+			return skip("eeprom")
+		}
+		p.eeprom = append(p.eeprom, segment)
+		plannerLog.Debugf("loaded eeprom segment at %X length %v", segment.Address, len(segment.Data))
 
-		default:
-			return fmt.Errorf("invalid data segment at address %X", segment.Address)
+	default:
+		return false
+	}
+	return true
+}
+
+// loadSegmentInRange loads the parts of a segment that lie within the profile's regions
+// and drops the rest, e.g. the part of a segment that extends past the end of flash.
+func (p *pic8Programmer) loadSegmentInRange(segment gohex.DataSegment) {
+	start := Address(segment.Address)
+	end := start + Address(len(segment.Data))
+	kept := 0
+	for _, r := range p.profile.Regions() {
+		from, to := r.Start, r.End
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
 		}
+		if from >= to {
+			continue
+		}
+		data := append([]byte{}, segment.Data[from-start:to-start]...)
+		p.loadSegment(gohex.DataSegment{Address: uint32(from), Data: data})
+		kept += len(data)
+	}
+	plannerLog.WithFields(operationFields("load", segment.Address, len(segment.Data))).
+		Warnf("ignoring %v bytes of the data segment at address %X length %v, which lie outside the profile's regions",
+			len(segment.Data)-kept, segment.Address, len(segment.Data))
+}
+
+// relocateSegment shifts a flash segment by the configured relocation, making sure
+// that it still lies within the application area.
+func (p *pic8Programmer) relocateSegment(s *gohex.DataSegment) error {
+	address := int64(s.Address) + int64(p.options.FlashRelocation)
+	end := address + int64(len(s.Data))
+	if address < int64(p.profile.BootloaderOffset) || end > int64(p.profile.FlashSize) {
+		return fmt.Errorf("flash segment at %X relocated to %X lies outside the application area", s.Address, address)
 	}
+	plannerLog.Debugf("relocated flash segment at %X to %X", s.Address, address)
+	s.Address = uint32(address)
 	return nil
 }
 
@@ -111,16 +542,40 @@ func (p *pic8Programmer) LoadHex(data io.Reader) error {
 func (p *pic8Programmer) Connect() error {
 	var err error
 	if err = p.bootloader.Connect(); err != nil {
-		return fmt.Errorf("failed to open bootloader: %v", err)
+		return fmt.Errorf("failed to open bootloader: %w", err)
+	}
+	if p.options.ProtocolVariant != "" {
+		if err := setProtocolVariant(p.bootloader, p.options.ProtocolVariant); err != nil {
+			return fmt.Errorf("failed to set protocol variant: %w", err)
+		}
 	}
-	// Get the device info
+	if p.options.ProtocolCRC {
+		err := updateProtocolOptions(p.bootloader, func(options *ProtocolOptions) {
+			options.CRC = true
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enable protocol CRCs: %w", err)
+		}
+	}
+	// Get the device info, which also detects the protocol variant
 	p.info, err = p.bootloader.GetVersion()
 	if err != nil {
-		return fmt.Errorf("failed to get device info: %v", err)
+		return fmt.Errorf("failed to get device info: %w", err)
+	}
+	if p.profile.ExpectedDeviceID != 0 && p.info.DeviceID != p.profile.ExpectedDeviceID {
+		return fmt.Errorf("device ID is %04X but the profile expects %04X: %w", p.info.DeviceID, p.profile.ExpectedDeviceID, ErrWrongDevice)
 	}
 	return nil
 }
 
+// erasedFlash returns the erased value of each byte of flash, repeating from address 0.
+func (p *pic8Programmer) erasedFlash() []byte {
+	if p.erasedPattern != nil {
+		return p.erasedPattern
+	}
+	return []byte{byte(p.profile.ErasedWord), byte(p.profile.ErasedWord >> 8)}
+}
+
 // Disconnect closes the connection with the PIC.
 func (p *pic8Programmer) Disconnect() {
 	p.bootloader.Disconnect()
@@ -133,99 +588,730 @@ func (p *pic8Programmer) GetVersionInfo() VersionInfo {
 
 // Program erases and writes the program data previously loaded with LoadHexFile.
 func (p *pic8Programmer) Program() error {
-	// Erase flash
-	if err := eraseSegments(p.flash, p.info.EraseRowSize, p.bootloader.EraseFlash); err != nil {
-		return fmt.Errorf("failed to erase segment at %X: %v", err.(*progError).Address, err.(*progError).Err)
+	p.events.resetStats()
+	defer p.events.end()
+	plan, err := p.Plan()
+	if err != nil {
+		return err
+	}
+	if err := p.checkPlan(plan); err != nil {
+		return err
 	}
 
-	// Program flash
-	if err := writeSegments(p.flash, p.info.WriteRowSize, p.bootloader.WriteFlash); err != nil {
-		return fmt.Errorf("failed to write flash at address %X: %v", err.(*progError).Address, err.(*progError).Err)
+	if p.options.SkipIfUpToDate {
+		upToDate, err := p.isUpToDate()
+		if err != nil {
+			return fmt.Errorf("failed to check if device is up to date: %w", err)
+		}
+		if upToDate {
+			plannerLog.Infof("device is already up to date, skipping programming")
+			return nil
+		}
 	}
 
-	// Program EEPROM
+	var saved []byte
+	if p.options.PreserveEEPROM {
+		if p.profile.EEPROMSize == 0 {
+			return fmt.Errorf("eepromsize must be set to preserve the eeprom")
+		}
+		plannerLog.Infof("saving eeprom")
+		if saved, err = p.ReadRange(RegionEEPROM, Address(p.profile.EEPROMOffset), Length(p.profile.EEPROMSize)); err != nil {
+			return fmt.Errorf("failed to save eeprom: %w", err)
+		}
+	}
+	if err := p.executeSteps(plan.Steps); err != nil {
+		return err
+	}
+	if saved != nil {
+		if err := p.restoreEEPROM(saved); err != nil {
+			return fmt.Errorf("failed to restore eeprom: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreEEPROM writes the saved EEPROM contents back, except for the bytes set by the hex
+// file. Only the rows that have changed are written.
+func (p *pic8Programmer) restoreEEPROM(saved []byte) error {
+	expected := append([]byte{}, saved...)
 	if p.options.ProgramEEPROM {
-		if err := writeSegments(p.eeprom, p.info.WriteRowSize, p.bootloader.WriteEE); err != nil {
-			return fmt.Errorf("failed to write eeprom at address %X: %v", err.(*progError).Address, err.(*progError).Err)
+		for _, segment := range p.eeprom {
+			copy(expected[segment.Address-p.profile.EEPROMOffset:], segment.Data)
 		}
 	}
+	current, err := p.ReadRange(RegionEEPROM, Address(p.profile.EEPROMOffset), Length(p.profile.EEPROMSize))
+	if err != nil {
+		return err
+	}
 
-	// Write Config
-	if p.options.ProgramConfig {
-		// // Erase the config
-		// if err := eraseSegments(p.config, p.info.EraseRowSize, p.bootloader.EraseFlash); err != nil {
-		// 	return fmt.Errorf("failed to erase config segment at %X: %v", err.(*progError).Address, err.(*progError).Err)
-		// }
-		// Flash the new config
-		if err := writeSegments(p.config, p.info.WriteRowSize, p.bootloader.WriteConfig); err != nil {
-			return fmt.Errorf("failed to write config at address %X: %v", err.(*progError).Address, err.(*progError).Err)
+	rowSize := p.profile.WriteSize(RegionEEPROM, p.info)
+	for offset := 0; offset < len(expected); offset += rowSize {
+		end := offset + rowSize
+		if end > len(expected) {
+			end = len(expected)
+		}
+		if bytes.Equal(current[offset:end], expected[offset:end]) {
+			continue
+		}
+		step := PlanStep{Region: RegionEEPROM, Address: p.profile.EEPROMOffset + uint32(offset), Data: expected[offset:end]}
+		if err := p.executeStep(step); err != nil {
+			return err
 		}
 	}
+	return drainPipeline(p.bootloader)
+}
 
-	// Write ID
-	if p.options.ProgramID {
-		// // Erase the ID
-		if err := eraseSegments(p.id, p.info.EraseRowSize, p.bootloader.EraseFlash); err != nil {
-			return fmt.Errorf("failed to erase id segment at %X: %v", err.(*progError).Address, err.(*progError).Err)
+// executeSteps performs the plan steps in order, reporting the progress of each stage.
+func (p *pic8Programmer) executeSteps(steps []PlanStep) error {
+	// Report the first stage even if the last operation was in the same stage
+	p.events.end()
+	var erases, writes int
+	for _, step := range steps {
+		if step.IsErase() {
+			erases++
+		} else {
+			writes++
 		}
-		// Flash the new ID data
-		if err := writeSegments(p.id, p.info.WriteRowSize, p.bootloader.WriteFlash); err != nil {
-			return fmt.Errorf("failed to write id at address %X: %v", err.(*progError).Address, err.(*progError).Err)
+	}
+	var erased, written int
+	// Flash writes done so far, which may need to be written again by verifyRow
+	var flashWrites []PlanStep
+	for _, step := range steps {
+		if err := p.executeStep(step); err != nil {
+			return err
+		}
+		if p.options.VerifyEachRow && step.Region == RegionFlash && !step.IsErase() {
+			flashWrites = append(flashWrites, step)
+			if err := p.verifyRow(flashWrites); err != nil {
+				return err
+			}
+		}
+		if step.IsErase() {
+			erased++
+			p.progress.set(StageErase, erased, erases)
+		} else {
+			written++
+			p.progress.set(StageWrite, written, writes)
 		}
 	}
+	// Make sure that any pipelined writes have completed
+	if err := drainPipeline(p.bootloader); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+// verifyRow checks the last of the flash writes done so far, writing it again until it
+// matches or RowRetries is used up. Flash must be erased before it is written again, so
+// the earlier writes that share its erase rows are written again as well.
+func (p *pic8Programmer) verifyRow(writes []PlanStep) error {
+	step := writes[len(writes)-1]
+	retries := p.options.RowRetries
+	if retries <= 0 {
+		retries = defaultRowRetries
+	}
+	for attempt := 0; ; attempt++ {
+		// Pipelined writes must complete before the row can be checked
+		if err := drainPipeline(p.bootloader); err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+		ok, err := p.writeMatches(step)
+		if err != nil {
+			return fmt.Errorf("failed to check flash at %X: %w", step.Address, err)
+		}
+		if ok {
+			return nil
+		}
+		if attempt == retries {
+			return fmt.Errorf("flash at %X doesn't match after writing it %v times", step.Address, attempt+1)
+		}
+		fields := operationFields(StageWrite, step.Address, len(step.Data))
+		fields[FieldAttempt] = attempt + 2
+		plannerLog.WithFields(fields).Warnf("flash at %X doesn't match, writing it again", step.Address)
+		if err := p.rewriteRows(writes); err != nil {
+			return err
+		}
+	}
+}
 
+// rewriteRows erases the rows containing the last of writes and performs again the writes
+// that lie in them.
+func (p *pic8Programmer) rewriteRows(writes []PlanStep) error {
+	rowSize := uint32(p.info.EraseRowSize)
+	step := writes[len(writes)-1]
+	from := step.Address - step.Address%rowSize
+	to := step.Address + uint32(len(step.Data))
+	if to%rowSize != 0 {
+		to += rowSize - to%rowSize
+	}
+	// Erasing from the start of the row would also erase the end of any earlier writes
+	// that share it
+	i := len(writes) - 1
+	for ; i > 0 && writes[i-1].Address+uint32(len(writes[i-1].Data)) > from; i-- {
+		if writes[i-1].Address < from {
+			from = writes[i-1].Address - writes[i-1].Address%rowSize
+		}
+	}
+	erase := PlanStep{Region: RegionFlash, Address: from, Rows: uint16((to - from) / rowSize)}
+	if err := p.executeStep(erase); err != nil {
+		return err
+	}
+	for _, w := range writes[i:] {
+		if err := p.executeStep(w); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Resume continues programming after Program has failed part way through. The flash
+// writes that have already been done are checked by checksum, or by reading if the
+// VerifyByReading option is set, and programming continues from the erase row containing
+// the first write that doesn't match. EEPROM, config and ID data are always written again.
+func (p *pic8Programmer) Resume() error {
+	return p.resume(p.writeMatches)
+}
+
+// resume continues programming from the first flash write for which matches returns false.
+func (p *pic8Programmer) resume(matches func(PlanStep) (bool, error)) error {
+	p.events.resetStats()
+	defer p.events.end()
+	plan, err := p.Plan()
+	if err != nil {
+		return err
+	}
+	if err := p.checkPlan(plan); err != nil {
+		return err
+	}
+
+	var writes []PlanStep
+	for _, step := range plan.Steps {
+		if step.Region == RegionFlash && !step.IsErase() {
+			writes = append(writes, step)
+		}
+	}
+	from := uint32(math.MaxUint32)
+	for i, step := range writes {
+		ok, err := matches(step)
+		if err != nil {
+			return fmt.Errorf("failed to check flash at %X: %w", step.Address, err)
+		}
+		if ok {
+			continue
+		}
+		// Erasing from the start of the row would also erase the end of any earlier
+		// writes that share it, so they have to be written again too
+		from = step.Address - step.Address%uint32(plan.EraseRowSize)
+		for j := i - 1; j >= 0 && writes[j].Address+uint32(len(writes[j].Data)) > from; j-- {
+			from = writes[j].Address - writes[j].Address%uint32(plan.EraseRowSize)
+		}
+		break
+	}
+	if from == math.MaxUint32 {
+		plannerLog.Infof("flash is already programmed, resuming with the remaining regions")
+	} else {
+		plannerLog.Infof("resuming flash programming from %X", from)
+	}
+	return p.executeSteps(resumeSteps(plan.Steps, from, plan.EraseRowSize))
+}
+
+// resumeSteps returns the steps needed to resume programming flash from the erase row at
+// address from. Steps for the other regions are always kept.
+func resumeSteps(steps []PlanStep, from uint32, eraseRowSize int) []PlanStep {
+	var resumed []PlanStep
+	for _, step := range steps {
+		if step.Region != RegionFlash {
+			resumed = append(resumed, step)
+			continue
+		}
+		if !step.IsErase() {
+			if step.Address >= from {
+				resumed = append(resumed, step)
+			}
+			continue
+		}
+		end := step.Address + uint32(step.Rows)*uint32(eraseRowSize)
+		if end <= from {
+			continue
+		}
+		if step.Address < from {
+			step.Rows -= uint16((from - step.Address) / uint32(eraseRowSize))
+			step.Address = from
+		}
+		resumed = append(resumed, step)
+	}
+	return resumed
+}
+
+// writeMatches returns true if the device already contains the data of a write step.
+func (p *pic8Programmer) writeMatches(step PlanStep) (bool, error) {
+	if p.options.VerifyByReading {
+		data, err := p.readFlash(step.Address, uint16(len(step.Data)))
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(data, step.Data), nil
+	}
+	picsum, err := p.bootloader.CalculateChecksum(step.Address, uint16(len(step.Data)))
+	if err != nil {
+		return false, err
+	}
+	return picsum == checksum16(step.Data), nil
+}
+
+// NeedsUpdate returns false if the device already contains the loaded image, so that
+// programming can be skipped. See isUpToDate for how the device is compared.
+func (p *pic8Programmer) NeedsUpdate() (bool, error) {
+	upToDate, err := p.isUpToDate()
+	if err != nil {
+		return false, fmt.Errorf("failed to check if device is up to date: %w", err)
+	}
+	return !upToDate, nil
+}
+
+// isUpToDate returns true if the device already contains the loaded image, in every
+// region that is programmed. If the profile gives the location of the application's
+// version metadata, that is compared in place of the rest of the flash. Otherwise, the
+// flash is checksummed against the image. The other regions are read back.
+func (p *pic8Programmer) isUpToDate() (bool, error) {
+	report := new(VerifyReport)
+	if p.profile.VersionLength > 0 {
+		expected := segmentsToBinary(p.flash, p.profile.VersionAddress, p.profile.VersionLength)
+		actual, err := p.readFlash(p.profile.VersionAddress, uint16(p.profile.VersionLength))
+		if err != nil {
+			return false, err
+		}
+		plannerLog.Debugf("image version %X, device version %X", expected, actual)
+		if !bytes.Equal(expected, actual) {
+			return false, nil
+		}
+	} else if p.compareFlash != nil {
+		if err := p.compareFlash(report.addRegion("flash")); err != nil {
+			return false, err
+		}
+	} else {
+		plan, err := p.Plan()
+		if err != nil {
+			return false, err
+		}
+		if err := verifyChecksums(plan.Checksums, p.bootloader.CalculateChecksum, report.addRegion("flash")); err != nil {
+			return false, err
+		}
+	}
+	if err := p.compareByReading(report, false, nil); err != nil {
+		return false, err
+	}
+	return report.Passed(), nil
+}
+
+// WriteSize returns the number of bytes of the region to write per command: the region's
+// configured write size, or the device's write row size if the profile doesn't set one.
+func (p PIC8Profile) WriteSize(region Region, info VersionInfo) int {
+	p.applyFamilyDefaults()
+	size := 0
+	switch region {
+	case RegionEEPROM:
+		size = p.EEPROMWriteSize
+	case RegionConfig:
+		size = p.ConfigWriteSize
+	}
+	if size > 0 {
+		return size
+	}
+	return info.WriteRowSize
+}
+
+// configAddress translates a hex file config address into a bootloader config address.
+func (p *pic8Programmer) configAddress(address uint32) uint32 {
+	if p.profile.ZeroBasedConfig {
+		return address - p.profile.ConfigOffset
+	}
+	return address
+}
+
+func (p *pic8Programmer) writeConfig(address uint32, data []byte) error {
+	return p.bootloader.WriteConfig(p.configAddress(address), data)
+}
+
+// configMask returns the bits of the config byte at address that are programmed.
+func (p *pic8Programmer) configMask(address uint32) byte {
+	for _, m := range p.options.ConfigMask {
+		switch address {
+		case m.Address:
+			return byte(m.Mask)
+		case m.Address + 1:
+			return byte(m.Mask >> 8)
+		}
+	}
+	return 0xFF
+}
+
+// applyConfigMask returns the config data to write at address, with the bits that aren't
+// selected by ConfigMask replaced by the device's current config.
+func (p *pic8Programmer) applyConfigMask(address uint32, data []byte) ([]byte, error) {
+	if len(p.options.ConfigMask) == 0 {
+		return data, nil
+	}
+	// Earlier config writes must complete before the config is read
+	if err := drainPipeline(p.bootloader); err != nil {
+		return nil, err
+	}
+	current, err := p.readConfig(address, uint16(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config at %X: %w", address, err)
+	}
+	masked := make([]byte, len(data))
+	for i := range data {
+		mask := p.configMask(address + uint32(i))
+		masked[i] = data[i]&mask | current[i]&^mask
+	}
+	return masked, nil
+}
+
+// writeMaskedConfig writes config data, only changing the bits selected by ConfigMask.
+func (p *pic8Programmer) writeMaskedConfig(address uint32, data []byte) error {
+	masked, err := p.applyConfigMask(address, data)
+	if err != nil {
+		return err
+	}
+	return p.writeConfig(address, masked)
+}
+
+// maskedConfig returns the config segments as they should be on the device, taking
+// ConfigMask into account.
+func (p *pic8Programmer) maskedConfig(segments []gohex.DataSegment) ([]gohex.DataSegment, error) {
+	if len(p.options.ConfigMask) == 0 {
+		return segments, nil
+	}
+	masked := make([]gohex.DataSegment, len(segments))
+	for i, segment := range segments {
+		data, err := p.applyConfigMask(segment.Address, segment.Data)
+		if err != nil {
+			return nil, err
+		}
+		masked[i] = gohex.DataSegment{Address: segment.Address, Data: data}
+	}
+	return masked, nil
+}
+
+func (p *pic8Programmer) readConfig(address uint32, length uint16) ([]byte, error) {
+	return alignReads(p.profile.ConfigReadAlignment, maxReadChunk(p.info), func(address uint32, length uint16) ([]byte, error) {
+		return p.bootloader.ReadConfig(p.configAddress(address), length)
+	})(address, length)
+}
+
+// eepromAddress translates a hex file EEPROM address into a bootloader EEPROM address.
+func (p *pic8Programmer) eepromAddress(address uint32) uint32 {
+	if p.profile.ZeroBasedEEPROM != nil && *p.profile.ZeroBasedEEPROM {
+		return address - p.profile.EEPROMOffset
+	}
+	return address
+}
+
+func (p *pic8Programmer) writeEE(address uint32, data []byte) error {
+	return p.bootloader.WriteEE(p.eepromAddress(address), data)
+}
+
+func (p *pic8Programmer) readEE(address uint32, length uint16) ([]byte, error) {
+	return alignReads(p.profile.EEPROMReadAlignment, maxReadChunk(p.info), func(address uint32, length uint16) ([]byte, error) {
+		return p.bootloader.ReadEE(p.eepromAddress(address), length)
+	})(address, length)
+}
+
+func (p *pic8Programmer) readFlash(address uint32, length uint16) ([]byte, error) {
+	return alignReads(p.profile.FlashReadAlignment, maxReadChunk(p.info), p.bootloader.ReadFlash)(address, length)
+}
+
 // Verify reads back the program memory and compares it to the data in the hex file.
 func (p *pic8Programmer) Verify() error {
+	defer p.events.end()
 	if p.options.VerifyByReading {
 		return p.verifyByReading()
 	}
 	return p.verifyByChecksum()
 }
 
+// verifyExclusions returns all the address ranges that are excluded from verification.
+func (p *pic8Programmer) verifyExclusions() []AddressRange {
+	ranges := append([]AddressRange{}, p.profile.VerifyExclude...)
+	ranges = append(ranges, p.profile.DeviceManaged...)
+	return append(ranges, p.protectedRanges()...)
+}
+
+// protectedRanges returns the excluded ranges, widened to whole erase rows if the row
+// size is known.
+func (p *pic8Programmer) protectedRanges() []AddressRange {
+	rowSize := p.info.EraseRowSize
+	if rowSize == 0 {
+		return p.options.ExcludeRanges
+	}
+	var ranges []AddressRange
+	for _, r := range p.options.ExcludeRanges {
+		end := r.End.RowStart(rowSize)
+		if end < r.End {
+			end += Address(rowSize)
+		}
+		ranges = append(ranges, AddressRange{Start: r.Start.RowStart(rowSize), End: end})
+	}
+	return ranges
+}
+
 func (p *pic8Programmer) verifyByReading() error {
-	// Verify flash
-	err := verifySegmentsByReading(p.flash, p.info.WriteRowSize, p.bootloader.ReadFlash)
+	exclude := func(segments []gohex.DataSegment) []gohex.DataSegment {
+		return excludeRanges(segments, p.verifyExclusions())
+	}
+	p.report = &VerifyReport{Method: VerifyMethodRead}
+
+	total := segmentsLength(exclude(p.flash))
+	if p.options.ProgramEEPROM {
+		total += segmentsLength(exclude(p.eeprom))
+	}
+	if p.options.ProgramConfig {
+		total += segmentsLength(exclude(p.config))
+	}
+	if p.options.ProgramID {
+		total += segmentsLength(exclude(p.id))
+	}
+	p.progress.start(StageVerify, total)
+	p.events.begin(StageVerify)
+
+	err := p.compareByReading(p.report, true, func(region Region, read func(uint32, uint16) ([]byte, error)) func(uint32, uint16) ([]byte, error) {
+		return p.progress.countReads(p.events.countReads(region, read))
+	})
 	if err != nil {
-		return fmt.Errorf("failed to verify flash: %v", err)
+		return err
+	}
+	return p.report.err()
+}
+
+// compareByReading reads back the regions that are programmed and compares them with the
+// loaded image, adding the results to report. Flash is only compared if flash is true. If
+// wrap isn't nil, it wraps the read function of each region.
+func (p *pic8Programmer) compareByReading(report *VerifyReport, flash bool, wrap func(Region, func(uint32, uint16) ([]byte, error)) func(uint32, uint16) ([]byte, error)) error {
+	exclude := func(segments []gohex.DataSegment) []gohex.DataSegment {
+		return excludeRanges(segments, p.verifyExclusions())
+	}
+	reader := func(region Region, read func(uint32, uint16) ([]byte, error)) func(uint32, uint16) ([]byte, error) {
+		if wrap == nil {
+			return read
+		}
+		return wrap(region, read)
+	}
+
+	// Verify flash
+	if flash {
+		err := verifySegmentsByReading(exclude(p.flash), p.info.WriteRowSize, reader(RegionFlash, p.readFlash), report.addRegion("flash"))
+		if err != nil {
+			return fmt.Errorf("failed to verify flash: %w", err)
+		}
 	}
 
 	// Verify EEPROM
 	if p.options.ProgramEEPROM {
-		err = verifySegmentsByReading(p.eeprom, p.info.WriteRowSize, p.bootloader.ReadEE)
+		err := verifySegmentsByReading(exclude(p.eeprom), p.info.WriteRowSize, reader(RegionEEPROM, p.readEE), report.addRegion("eeprom"))
 		if err != nil {
-			return fmt.Errorf("failed to verify eeprom: %v", err)
+			return fmt.Errorf("failed to verify eeprom: %w", err)
 		}
 	}
 
 	// Verify config
 	if p.options.ProgramConfig {
-		err = verifySegmentsByReading(p.config, p.info.WriteRowSize, p.bootloader.ReadConfig)
+		config, err := p.maskedConfig(exclude(p.config))
+		if err != nil {
+			return fmt.Errorf("failed to verify config: %w", err)
+		}
+		err = verifySegmentsByReading(config, p.profile.WriteSize(RegionConfig, p.info), reader(RegionConfig, p.readConfig), report.addRegion("config"))
 		if err != nil {
-			return fmt.Errorf("failed to verify config: %v", err)
+			return fmt.Errorf("failed to verify config: %w", err)
 		}
 	}
 
 	// Verify ID
 	if p.options.ProgramID {
-		err = verifySegmentsByReading(p.id, p.info.WriteRowSize, p.bootloader.ReadFlash)
+		err := verifySegmentsByReading(exclude(p.id), p.info.WriteRowSize, reader(RegionID, p.readFlash), report.addRegion("id"))
 		if err != nil {
-			return fmt.Errorf("failed to verify id: %v", err)
+			return fmt.Errorf("failed to verify id: %w", err)
 		}
 	}
-
 	return nil
 }
 
 func (p *pic8Programmer) verifyByChecksum() error {
+	plan, err := p.Plan()
+	if err != nil {
+		return err
+	}
+	p.report = &VerifyReport{Method: VerifyMethodChecksum}
+
+	total := 0
+	for _, r := range plan.Checksums {
+		total += int(r.Length)
+	}
+	p.progress.start(StageVerify, total)
+	p.events.begin(StageVerify)
+
 	// Verify flash
-	err := verifySegmentsByChecksum(p.flash, p.bootloader.CalculateChecksum)
+	err = verifyChecksums(plan.Checksums, p.progress.countChecksums(p.events.countChecksums(RegionFlash, p.bootloader.CalculateChecksum)), p.report.addRegion("flash"))
 	if err != nil {
-		return fmt.Errorf("failed to verify flash: %v", err)
+		return fmt.Errorf("failed to verify flash: %w", err)
 	}
-	return nil
+	return p.report.err()
+}
+
+// SetEventSink sets the sink that is notified of each stage and row operation.
+func (p *pic8Programmer) SetEventSink(sink EventSink) {
+	p.events.sink = sink
+	p.events.counter = findRetryCounter(p.bootloader)
+}
+
+// SetProgressHandler sets the function that is called as Program and Verify make progress.
+func (p *pic8Programmer) SetProgressHandler(handler ProgressFunc) {
+	p.progress.handler = handler
+}
+
+// Stats returns statistics about the work done since the start of the last call to
+// Program or Resume, including any verification since.
+func (p *pic8Programmer) Stats() ProgramStats {
+	return p.events.getStats()
+}
+
+// VerifyReport returns the detailed results of the last call to Verify, or nil if
+// Verify hasn't been called.
+func (p *pic8Programmer) VerifyReport() *VerifyReport {
+	return p.report
+}
+
+// Maximum number of non-blank addresses listed for each region by blankCheck.
+const maxNonBlankAddresses = 16
+
+// blankCheck checks that the selected regions are erased and returns a result for each
+// of them that the profile describes. Flash is checked by checksum unless the
+// VerifyByReading option is set, with any chunks that don't match read back to find the
+// non-blank addresses. The other regions are always read.
+func (p *pic8Programmer) blankCheck(regions Region) ([]BlankCheckResult, error) {
+	ranges := p.profile.Regions()
+	var results []BlankCheckResult
+	for _, region := range regionList {
+		if regions&region == 0 {
+			continue
+		}
+		r, ok := ranges[region.String()]
+		if !ok {
+			continue
+		}
+		erased := []byte{erasedValue}
+		if region == RegionFlash || region == RegionID {
+			erased = p.erasedFlash()
+		}
+
+		plannerLog.Debugf("blank checking %v from %X to %X", region, r.Start, r.End)
+		result := BlankCheckResult{Region: region, Range: r}
+		var err error
+		if region == RegionFlash && !p.options.VerifyByReading {
+			result.NonBlank, err = p.blankCheckFlashByChecksum(r, erased)
+		} else {
+			result.NonBlank, err = p.findNonBlank(region, r.Start, r.Length(), erased)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to blank check %v: %w", region, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// blankCheckFlashByChecksum compares the device checksum of each chunk of the range to
+// that of erased flash, and reads back the chunks that don't match to find the
+// non-blank addresses.
+func (p *pic8Programmer) blankCheckFlashByChecksum(r AddressRange, erased []byte) ([]Address, error) {
+	// The maximum length to checksum needs to fit inside 16-bits and be an even number
+	const maxChecksumChunk = math.MaxUint16 - 1
+	var nonBlank []Address
+	for address := r.Start; address < r.End && len(nonBlank) < maxNonBlankAddresses; address += maxChecksumChunk {
+		n := r.End - address
+		if n > maxChecksumChunk {
+			n = maxChecksumChunk
+		}
+		picsum, err := p.bootloader.CalculateChecksum(uint32(address), uint16(n))
+		if err != nil {
+			return nil, fmt.Errorf("failed to calculate checksum at address %X: %w", address, err)
+		}
+		if picsum == checksum16(erasedData(uint32(address), int(n), erased)) {
+			continue
+		}
+		found, err := p.findNonBlank(RegionFlash, address, Length(n), erased)
+		if err != nil {
+			return nil, err
+		}
+		nonBlank = append(nonBlank, found...)
+	}
+	if len(nonBlank) > maxNonBlankAddresses {
+		nonBlank = nonBlank[:maxNonBlankAddresses]
+	}
+	return nonBlank, nil
+}
+
+// findNonBlank reads length bytes of the region starting at address and returns the
+// first addresses that don't hold their erased value.
+func (p *pic8Programmer) findNonBlank(region Region, address Address, length Length, erased []byte) ([]Address, error) {
+	data, err := p.ReadRange(region, address, length)
+	if err != nil {
+		return nil, err
+	}
+	expected := erasedData(uint32(address), len(data), erased)
+	var nonBlank []Address
+	for i := range data {
+		if data[i] != expected[i] {
+			nonBlank = append(nonBlank, address+Address(i))
+			if len(nonBlank) == maxNonBlankAddresses {
+				break
+			}
+		}
+	}
+	return nonBlank, nil
+}
+
+// ReadRange reads length bytes of the given region starting at address, splitting the
+// read into chunks that fit within the device's maximum packet size.
+func (p *pic8Programmer) ReadRange(region Region, address Address, length Length) ([]byte, error) {
+	var readFunc func(uint32, uint16) ([]byte, error)
+	switch region {
+	case RegionFlash, RegionID:
+		readFunc = p.readFlash
+	case RegionEEPROM:
+		readFunc = p.readEE
+	case RegionConfig:
+		readFunc = p.readConfig
+	default:
+		return nil, fmt.Errorf("invalid region %v", region)
+	}
+	return readRange(address, length, maxReadChunk(p.info), readFunc)
+}
+
+// DumpToHex reads the selected regions from the device and writes them to w in Intel HEX
+// format. The regions are read in full, as defined by the profile, using the addresses
+// that they occupy in a hex file. Regions that are empty in the profile are skipped.
+func (p *pic8Programmer) DumpToHex(w io.Writer, regions Region) error {
+	mem := gohex.NewMemory()
+	ranges := p.profile.Regions()
+	for _, region := range regionList {
+		if regions&region == 0 {
+			continue
+		}
+		r, ok := ranges[region.String()]
+		if !ok {
+			continue
+		}
+		plannerLog.Debugf("dumping %v from %X to %X", region, r.Start, r.End)
+		data, err := p.ReadRange(region, r.Start, r.Length())
+		if err != nil {
+			return fmt.Errorf("failed to read %v: %w", region, err)
+		}
+		if err := mem.AddBinary(uint32(r.Start), data); err != nil {
+			return err
+		}
+	}
+	return mem.DumpIntelHex(w, 16)
 }
 
 // Reset resets the PIC.
@@ -0,0 +1,100 @@
+package microchipboot
+
+import "fmt"
+
+// LintPIC8Profile checks a profile and its options for inconsistencies and returns a list
+// of warnings. If info is provided (i.e. EraseRowSize is non-zero), region boundaries are
+// also checked for alignment against the device row sizes.
+// Errors that make the profile unusable should be checked separately with Validate.
+func LintPIC8Profile(profile PIC8Profile, options PIC8Options, info VersionInfo) []string {
+	var warnings []string
+	warnf := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	profile.applyFamilyDefaults()
+
+	// Option/region coherence
+	if options.ProgramEEPROM && profile.EEPROMSize == 0 {
+		warnf("EEPROMSize is 0 but ProgramEEPROM is true")
+	}
+	if options.ProgramConfig && profile.ConfigSize == 0 {
+		warnf("ConfigSize is 0 but ProgramConfig is true")
+	}
+	if options.ProgramID && profile.IDSize == 0 {
+		warnf("IDSize is 0 but ProgramID is true")
+	}
+	if options.FlashRelocation&1 == 1 {
+		warnf("FlashRelocation (%X) is not an even number", options.FlashRelocation)
+	}
+	if size := profile.ConfigWriteSize; size&(size-1) != 0 {
+		warnf("ConfigWriteSize (%v) is not a power of two", size)
+	}
+	if size := profile.EEPROMWriteSize; size&(size-1) != 0 {
+		warnf("EEPROMWriteSize (%v) is not a power of two", size)
+	}
+
+	// Region overlaps
+	type region struct {
+		name string
+		AddressRange
+	}
+	var regions []region
+	addRegion := func(name string, offset, size uint32) {
+		if size > 0 {
+			regions = append(regions, region{name, AddressRange{Start: Address(offset), End: Address(offset + size)}})
+		}
+	}
+	addRegion("flash", 0, profile.FlashSize)
+	addRegion("eeprom", profile.EEPROMOffset, profile.EEPROMSize)
+	addRegion("config", profile.ConfigOffset, profile.ConfigSize)
+	addRegion("id", profile.IDOffset, profile.IDSize)
+	for i := range regions {
+		for j := i + 1; j < len(regions); j++ {
+			a, b := regions[i], regions[j]
+			if a.Start < b.End && b.Start < a.End {
+				warnf("%v region (%X-%X) overlaps %v region (%X-%X)", a.name, a.Start, a.End, b.name, b.Start, b.End)
+			}
+		}
+	}
+
+	// Exclusion ranges
+	inRegion := func(r AddressRange) bool {
+		for _, region := range regions {
+			if r.Start >= region.Start && r.End <= region.End {
+				return true
+			}
+		}
+		return false
+	}
+	for _, r := range profile.VerifyExclude {
+		if !inRegion(r) {
+			warnf("VerifyExclude range %X-%X does not lie within a single region", r.Start, r.End)
+		}
+	}
+	for _, r := range profile.DeviceManaged {
+		if !inRegion(r) {
+			warnf("DeviceManaged range %X-%X does not lie within a single region", r.Start, r.End)
+		}
+	}
+
+	// Row alignment
+	if info.EraseRowSize > 0 {
+		if !Address(profile.BootloaderOffset).RowAligned(info.EraseRowSize) {
+			warnf("BootloaderOffset (%X) is not aligned to the erase row size (%v)", profile.BootloaderOffset, info.EraseRowSize)
+		}
+		if !Address(profile.FlashSize).RowAligned(info.EraseRowSize) {
+			warnf("FlashSize (%X) is not aligned to the erase row size (%v)", profile.FlashSize, info.EraseRowSize)
+		}
+		if options.FlashRelocation%int32(info.EraseRowSize) != 0 {
+			warnf("FlashRelocation (%X) is not aligned to the erase row size (%v)", options.FlashRelocation, info.EraseRowSize)
+		}
+	}
+	if info.WriteRowSize > 0 && profile.ConfigWriteSize > info.WriteRowSize {
+		warnf("ConfigWriteSize (%v) is larger than the write row size (%v)", profile.ConfigWriteSize, info.WriteRowSize)
+	}
+	if info.WriteRowSize > 0 && profile.EEPROMWriteSize > info.WriteRowSize {
+		warnf("EEPROMWriteSize (%v) is larger than the write row size (%v)", profile.EEPROMWriteSize, info.WriteRowSize)
+	}
+
+	return warnings
+}
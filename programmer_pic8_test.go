@@ -0,0 +1,188 @@
+package microchipboot
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// writeLogger is a simulated device that records the address and length of each
+// EEPROM and config write.
+type writeLogger struct {
+	*SimulatedBootloader
+	writes []string
+}
+
+func (d *writeLogger) WriteEE(address uint32, data []byte) error {
+	d.writes = append(d.writes, fmt.Sprintf("eeprom %X+%v", address, len(data)))
+	return d.SimulatedBootloader.WriteEE(address, data)
+}
+
+func (d *writeLogger) WriteConfig(address uint32, data []byte) error {
+	d.writes = append(d.writes, fmt.Sprintf("config %X+%v", address, len(data)))
+	return d.SimulatedBootloader.WriteConfig(address, data)
+}
+
+// pic18Hex returns a hex image with the given EEPROM and config data at their PIC18 hex
+// file addresses.
+func pic18Hex(t *testing.T, eeprom, config []byte) string {
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x800, []byte{1, 2, 3, 4})
+	if eeprom != nil {
+		mem.AddBinary(0xF00010, eeprom)
+	}
+	if config != nil {
+		mem.AddBinary(0x300000, config)
+	}
+	var buf strings.Builder
+	if err := mem.DumpIntelHex(&buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestPIC18FamilyDefaults(t *testing.T) {
+	profile := PIC8Profile{Family: FamilyPIC18}
+	profile.applyFamilyDefaults()
+	if profile.ConfigOffset != 0x300000 || profile.ConfigSize != 14 || profile.EEPROMOffset != 0xF00000 {
+		t.Errorf("got config %X+%v, eeprom %X", profile.ConfigOffset, profile.ConfigSize, profile.EEPROMOffset)
+	}
+	if profile.ZeroBasedEEPROM == nil || !*profile.ZeroBasedEEPROM {
+		t.Errorf("EEPROM isn't zero based by default")
+	}
+
+	absolute := false
+	profile = PIC8Profile{Family: FamilyPIC18, ConfigSize: 8, ZeroBasedEEPROM: &absolute}
+	profile.applyFamilyDefaults()
+	if profile.ConfigSize != 8 || *profile.ZeroBasedEEPROM {
+		t.Errorf("defaults overrode config size %v and zero based EEPROM %v", profile.ConfigSize, *profile.ZeroBasedEEPROM)
+	}
+}
+
+func TestPIC18EEPROMAddresses(t *testing.T) {
+	absolute := false
+	tests := []struct {
+		name      string
+		zeroBased *bool
+		eeprom    AddressRange
+		want      string
+	}{
+		// EEPROM is written a whole row at a time
+		{"default", nil, AddressRange{Start: 0, End: 0x100}, "eeprom 0+64"},
+		{"absolute", &absolute, AddressRange{Start: 0xF00000, End: 0xF00100}, "eeprom F00000+64"},
+	}
+	for _, test := range tests {
+		device := &writeLogger{SimulatedBootloader: NewSimulatedBootloader(SimulatedDevice{
+			Info:   VersionInfo{MaxPacketSize: 128, EraseRowSize: 64, WriteRowSize: 64},
+			Flash:  []AddressRange{{Start: 0, End: 0x8000}},
+			EEPROM: test.eeprom,
+		})}
+		prog := NewPIC8Programmer(device, PIC8Profile{
+			Family:           FamilyPIC18,
+			BootloaderOffset: 0x800,
+			FlashSize:        0x8000,
+			EEPROMSize:       0x100,
+			ZeroBasedEEPROM:  test.zeroBased,
+		}, PIC8Options{ProgramEEPROM: true})
+		if err := prog.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.LoadHex(strings.NewReader(pic18Hex(t, []byte{0xAA, 0x55}, nil))); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.Program(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(device.writes, []string{test.want}) {
+			t.Errorf("%v: got writes %v, want %v", test.name, device.writes, test.want)
+		}
+		if err := prog.Verify(); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+	}
+}
+
+func TestPIC18ConfigWrites(t *testing.T) {
+	tests := []struct {
+		name       string
+		zeroBased  bool
+		configBase Address
+		want       []string
+	}{
+		// Config bytes are written one at a time at their hex file addresses
+		{"absolute", false, 0x300000, []string{"config 300000+1", "config 300001+1", "config 300002+1"}},
+		{"zero based", true, 0, []string{"config 0+1", "config 1+1", "config 2+1"}},
+	}
+	for _, test := range tests {
+		device := &writeLogger{SimulatedBootloader: NewSimulatedBootloader(SimulatedDevice{
+			Info:   VersionInfo{MaxPacketSize: 128, EraseRowSize: 64, WriteRowSize: 64},
+			Flash:  []AddressRange{{Start: 0, End: 0x8000}},
+			Config: AddressRange{Start: test.configBase, End: test.configBase + 14},
+		})}
+		// The config offset, size and write size all come from the family defaults
+		prog := NewPIC8Programmer(device, PIC8Profile{
+			Family:           FamilyPIC18,
+			BootloaderOffset: 0x800,
+			FlashSize:        0x8000,
+			ZeroBasedConfig:  test.zeroBased,
+		}, PIC8Options{ProgramConfig: true})
+		if err := prog.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.LoadHex(strings.NewReader(pic18Hex(t, nil, []byte{0x12, 0x34, 0x56}))); err != nil {
+			t.Fatal(err)
+		}
+		if err := prog.Program(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(device.writes, test.want) {
+			t.Errorf("%v: got writes %v, want %v", test.name, device.writes, test.want)
+		}
+		if err := prog.Verify(); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+	}
+}
+
+func TestDisabledRegionsAreSkipped(t *testing.T) {
+	defer SetLogger(pkgLog)
+	rec := &recordingLogger{}
+	SetLogger(rec)
+
+	device := &writeLogger{SimulatedBootloader: newSimulatedPIC18()}
+	prog := NewPIC8Programmer(device, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+		EEPROMSize:       0x100,
+	}, PIC8Options{})
+	if err := prog.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.LoadHex(strings.NewReader(pic18Hex(t, []byte{0xAA, 0x55}, []byte{0x12}))); err != nil {
+		t.Fatal(err)
+	}
+	if err := prog.Program(); err != nil {
+		t.Fatal(err)
+	}
+	if len(device.writes) != 0 {
+		t.Errorf("disabled regions were written: %v", device.writes)
+	}
+
+	want := []string{
+		"warn: ignoring 2 bytes of eeprom data at address F00010 as eeprom programming is disabled",
+		"warn: ignoring 1 bytes of config data at address 300000 as config programming is disabled",
+	}
+	for _, message := range want {
+		found := false
+		for _, m := range rec.messages {
+			found = found || strings.HasPrefix(m, message)
+		}
+		if !found {
+			t.Errorf("%q wasn't logged in %q", message, rec.messages)
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package microchipboot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/marcinbor85/gohex"
+)
+
+func TestExcludeRanges(t *testing.T) {
+	segments := []gohex.DataSegment{
+		{Address: 0x100, Data: []byte{0, 1, 2, 3, 4, 5, 6, 7}},
+		{Address: 0x200, Data: []byte{8, 9}},
+	}
+	ranges := []AddressRange{
+		{Start: 0x102, End: 0x104},
+		{Start: 0x107, End: 0x202},
+	}
+
+	got := excludeRanges(segments, ranges)
+	want := []gohex.DataSegment{
+		{Address: 0x100, Data: []byte{0, 1}},
+		{Address: 0x104, Data: []byte{4, 5, 6}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadHexTrimsOutOfRangeSegments(t *testing.T) {
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x7F0, bytes.Repeat([]byte{1}, 0x20))
+	mem.AddBinary(0x7FF0, bytes.Repeat([]byte{2}, 0x20))
+	mem.AddBinary(0x900000, make([]byte, 0x10))
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	prog := NewPIC8Programmer(nil, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x800,
+		FlashSize:        0x8000,
+	}, PIC8Options{IgnoreOutOfRangeSegments: true}).(*pic8Programmer)
+	if err := prog.LoadHex(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []gohex.DataSegment{
+		{Address: 0x800, Data: bytes.Repeat([]byte{1}, 0x10)},
+		{Address: 0x7FF0, Data: bytes.Repeat([]byte{2}, 0x10)},
+	}
+	if !reflect.DeepEqual(prog.flash, want) {
+		t.Errorf("got flash %+v, want %+v", prog.flash, want)
+	}
+}
+
+func TestAlignReads(t *testing.T) {
+	memory := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	read := alignReads(2, 0, func(address uint32, length uint16) ([]byte, error) {
+		if address&1 == 1 || length&1 == 1 {
+			t.Fatalf("unaligned read at %X length %v", address, length)
+		}
+		return memory[address : address+uint32(length)], nil
+	})
+
+	data, err := read(3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{3, 4, 5}; !reflect.DeepEqual(data, want) {
+		t.Errorf("got %v, want %v", data, want)
+	}
+}
+
+func TestAlignReadsLimitsChunk(t *testing.T) {
+	memory := make([]byte, 32)
+	for i := range memory {
+		memory[i] = byte(i)
+	}
+	// A 6 byte read from 1 is aligned to 8 bytes from 0, which is more than the maximum
+	// of 6, so it is split into reads of 4 bytes
+	var reads []uint16
+	read := alignReads(4, 6, func(address uint32, length uint16) ([]byte, error) {
+		if address%4 != 0 || length%4 != 0 || length > 6 {
+			t.Fatalf("bad read at %X length %v", address, length)
+		}
+		reads = append(reads, length)
+		return memory[address : address+uint32(length)], nil
+	})
+
+	data, err := read(1, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(data, want) {
+		t.Errorf("got %v, want %v", data, want)
+	}
+	if want := []uint16{4, 4}; !reflect.DeepEqual(reads, want) {
+		t.Errorf("got reads of %v bytes, want %v", reads, want)
+	}
+}
+
+func TestVerifySegmentsByReadingReportsAllMismatches(t *testing.T) {
+	segments := []gohex.DataSegment{{Address: 0x100, Data: []byte{0, 1, 2, 3, 4, 5, 6, 7}}}
+	device := []byte{0, 9, 9, 3, 4, 5, 6, 9}
+	read := func(address uint32, length uint16) ([]byte, error) {
+		return device[address-0x100 : address-0x100+uint32(length)], nil
+	}
+
+	report := &VerifyReport{Method: VerifyMethodRead}
+	if err := verifySegmentsByReading(segments, 4, read, report.addRegion("flash")); err != nil {
+		t.Fatal(err)
+	}
+	want := []Mismatch{
+		{Address: 0x101, Length: 2, Expected: []byte{1, 2}, Actual: []byte{9, 9}},
+		{Address: 0x107, Length: 1, Expected: []byte{7}, Actual: []byte{9}},
+	}
+	if got := report.Regions[0].Mismatches; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if report.Passed() {
+		t.Errorf("expected report to fail")
+	}
+}
+
+func TestVerifySegmentsByReadingShortRead(t *testing.T) {
+	segments := []gohex.DataSegment{{Address: 0x100, Data: []byte{0, 1, 2, 3}}}
+	read := func(address uint32, length uint16) ([]byte, error) {
+		return []byte{0, 1}, nil
+	}
+
+	report := &VerifyReport{Method: VerifyMethodRead}
+	if err := verifySegmentsByReading(segments, 4, read, report.addRegion("flash")); err == nil {
+		t.Error("short read wasn't reported")
+	}
+}
+
+func TestVerifyReportSummary(t *testing.T) {
+	shifted := &VerifyReport{Method: VerifyMethodRead, Regions: []*RegionReport{{Name: "flash", Mismatches: []Mismatch{
+		{Address: 0x100, Length: 6, Expected: []byte{1, 2, 3, 4, 5, 6}, Actual: []byte{3, 4, 5, 6, 7, 8}},
+		{Address: 0x200, Length: 5, Expected: []byte{10, 20, 30, 40, 50}, Actual: []byte{30, 40, 50, 60, 70}},
+	}}}}
+	if s := shifted.Summary(); s.Shift != 2 || s.Ranges != 2 || s.Bytes != 11 {
+		t.Errorf("got %+v, want a shift of 2", s)
+	}
+
+	noisy := &VerifyReport{Method: VerifyMethodRead, Regions: []*RegionReport{{Name: "flash", Mismatches: []Mismatch{
+		{Address: 0x101, Length: 1, Expected: []byte{0x10}, Actual: []byte{0x11}},
+		{Address: 0x180, Length: 1, Expected: []byte{0xFF}, Actual: []byte{0x7F}},
+	}}}}
+	s := noisy.Summary()
+	if s.Shift != 0 || s.BitsFlipped != 2 || s.ErasedBytes != 0 {
+		t.Errorf("got %+v, want isolated bit errors", s)
+	}
+	var buf bytes.Buffer
+	if err := noisy.WriteDiff(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "# read verification: " + s.String() + "\n" +
+		"flash   00000101 expected 10 actual 11\n" +
+		"flash   00000180 expected FF actual 7F\n"
+	if buf.String() != want {
+		t.Errorf("got diff %q, want %q", buf.String(), want)
+	}
+}
+
+func TestAlignInstructions(t *testing.T) {
+	address, data := alignInstructions(gohex.DataSegment{Address: 0x102, Data: []byte{0x11, 0x22, 0x33, 0x44}})
+	if address != 0x100 {
+		t.Errorf("got address %X, want 100", address)
+	}
+	want := []byte{0xFF, 0xFF, 0x11, 0x00, 0x33, 0x44, 0xFF, 0x00}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("got %X, want %X", data, want)
+	}
+}
+
+func TestPackWrites(t *testing.T) {
+	row := func(address uint32, v byte) PlanStep {
+		return PlanStep{Region: RegionFlash, Address: address, Data: []byte{v, v, v, v}}
+	}
+	steps := []PlanStep{row(0x00, 1), row(0x04, 2), row(0x08, 3), row(0x10, 4)}
+
+	got := packWrites(steps, 9)
+	want := []PlanStep{
+		{Region: RegionFlash, Address: 0x00, Data: []byte{1, 1, 1, 1, 2, 2, 2, 2}},
+		row(0x08, 3),
+		row(0x10, 4),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	got = packWrites([]PlanStep{row(0x00, 1)}, 3)
+	want = []PlanStep{
+		{Region: RegionFlash, Address: 0x00, Data: []byte{1, 1}},
+		{Region: RegionFlash, Address: 0x02, Data: []byte{1, 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A row larger than the packet is split in half rather than at the packet size
+	got = packWrites([]PlanStep{{Region: RegionFlash, Address: 0x40, Data: make([]byte, 64)}}, 58)
+	want = []PlanStep{
+		{Region: RegionFlash, Address: 0x40, Data: make([]byte, 32)},
+		{Region: RegionFlash, Address: 0x60, Data: make([]byte, 32)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestFillGaps(t *testing.T) {
+	segments := []gohex.DataSegment{
+		{Address: 0x105, Data: []byte{1, 2}},
+		{Address: 0x100, Data: []byte{3}},
+		{Address: 0x200, Data: []byte{4, 5}},
+	}
+
+	got := fillGaps(segments, 8, []byte{0xFF, 0x3F})
+	want := []gohex.DataSegment{
+		{Address: 0x100, Data: []byte{3, 0x3F, 0xFF, 0x3F, 0xFF, 1, 2, 0x3F}},
+		{Address: 0x200, Data: []byte{4, 5}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPlanWritesPadding(t *testing.T) {
+	segments := []gohex.DataSegment{
+		{Address: 0x02, Data: []byte{0x12, 0x34}},
+		{Address: 0x08, Data: []byte{0xFF, 0x3F}},
+	}
+	erased := []byte{0xFF, 0x3F}
+
+	got := skipBlankRows(planWrites(RegionFlash, segments, 4, erased), erased)
+	want := []PlanStep{
+		{Region: RegionFlash, Address: 0x00, Data: []byte{0xFF, 0x3F, 0x12, 0x34}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPlanEraseAllUnalignedOffset(t *testing.T) {
+	prog := NewPIC8Programmer(nil, PIC8Profile{
+		Family:           FamilyPIC18,
+		BootloaderOffset: 0x820,
+		FlashSize:        0x1000,
+	}, PIC8Options{EraseAll: true}).(*pic8Programmer)
+	prog.info = VersionInfo{EraseRowSize: 64}
+
+	// The row at 0x800 also holds the end of the bootloader
+	got := prog.planEraseAll()
+	want := []PlanStep{{Region: RegionFlash, Address: 0x840, Rows: 31}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadPlanChecksOptions(t *testing.T) {
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x800, make([]byte, 0x10))
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	profile := PIC8Profile{Family: FamilyPIC18, BootloaderOffset: 0x800, FlashSize: 0x8000}
+	options := PIC8Options{ExcludeRanges: []AddressRange{{Start: 0x7F00, End: 0x8000}}}
+	plan, err := NewPIC8Plan(profile, options, VersionInfo{EraseRowSize: 64, WriteRowSize: 64}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadPlan(NewPIC8Programmer(nil, profile, options), plan); err != nil {
+		t.Errorf("plan rejected: %v", err)
+	}
+	if err := LoadPlan(NewPIC8Programmer(nil, profile, PIC8Options{}), plan); err == nil {
+		t.Error("plan computed with different options accepted")
+	}
+}
+
+func TestPreflightCheckPIC8(t *testing.T) {
+	mem := gohex.NewMemory()
+	mem.AddBinary(0x7F0, make([]byte, 0x20))
+	mem.AddBinary(0x900, make([]byte, 0x10))
+	mem.AddBinary(0x7FF0, make([]byte, 0x20))
+	mem.AddBinary(0xF000F0, make([]byte, 0x20))
+	mem.AddBinary(0x900000, make([]byte, 0x10))
+	buf := new(bytes.Buffer)
+	if err := mem.DumpIntelHex(buf, 16); err != nil {
+		t.Fatal(err)
+	}
+	profile := PIC8Profile{Family: FamilyPIC18, BootloaderOffset: 0x800, FlashSize: 0x8000, EEPROMSize: 0x100}
+
+	got, err := PreflightCheckPIC8(profile, PIC8Options{}, VersionInfo{EraseRowSize: 0x1000}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"segment 7F0-810 overlaps the bootloader (0-800)",
+		"segment 900-910 shares an erase row with the bootloader, which would be erased",
+		"segment 7FF0-8010 extends beyond the application region (800-8000)",
+		"segment 900000-900010 lies outside every region of the profile",
+		"segment F000F0-F00110 extends beyond the eeprom region (F00000-F00100)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecodeApplicationInfo(t *testing.T) {
+	layout := AppInfoLayout{Fields: []AppInfoField{
+		{Name: "version", Offset: 0, Length: 3, Type: AppInfoVersion},
+		{Name: "name", Offset: 3, Length: 6, Type: AppInfoString},
+		{Name: "build", Offset: 9, Length: 2, Type: AppInfoUint},
+		{Name: "hash", Offset: 11, Length: 2},
+	}}
+	info, err := DecodeApplicationInfo(layout, []byte{1, 2, 3, 'a', 'p', 'p', 0, 0xFF, 0xFF, 0x34, 0x12, 0xAB, 0xCD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"version": "1.2.3", "name": "app", "build": "4660", "hash": "abcd"}
+	if !reflect.DeepEqual(info.Fields, want) {
+		t.Errorf("got %v, want %v", info.Fields, want)
+	}
+	if info.Erased {
+		t.Errorf("info reported as erased")
+	}
+}
+
+func TestProgrammerRegistry(t *testing.T) {
+	decode := func(v interface{}) error {
+		return json.Unmarshal([]byte(`{"Profile": {"BootloaderOffset": 2048, "FlashSize": 32768}}`), v)
+	}
+	prog, err := NewProgrammer(FamilyPIC18, nil, decode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := prog.(*pic8Programmer); p.profile.Family != FamilyPIC18 || p.profile.ConfigOffset != pic18ConfigOffset {
+		t.Errorf("profile is %+v, expected pic18 defaults", p.profile)
+	}
+	if _, err := NewProgrammer("sam", nil, decode); err == nil {
+		t.Error("unknown family was accepted")
+	}
+
+	RegisterProgrammerFactory("test", func(bootloader Bootloader, decode func(interface{}) error) (Programmer, error) {
+		return prog, nil
+	})
+	defer func() {
+		programmerFactoriesMu.Lock()
+		delete(programmerFactories, "test")
+		programmerFactoriesMu.Unlock()
+	}()
+	if got, err := NewProgrammer("test", nil, decode); got != prog || err != nil {
+		t.Errorf("got %v, %v from the registered factory", got, err)
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	profile := PIC8Profile{Family: FamilyPIC16}
+	// CONFIG1 with FOSC 4, WDTE enabled, CP disabled and BOREN disabled, CONFIG2 with LVP set
+	settings, err := DecodeConfig(profile.ConfigTable(), []byte{0xFC, 0x39, 0xFF, 0x3F})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, s := range settings {
+		got[s.Name] = fmt.Sprintf("%v %v", s.Value, s.Meaning)
+	}
+	want := map[string]string{"FOSC": "4 ", "WDTE": "3 enabled", "CP": "1 disabled", "BOREN": "0 disabled", "LVP": "1 enabled"}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%v is %q, want %q", name, got[name], value)
+		}
+	}
+
+	profile.ConfigFields = []ConfigField{{Name: "X", Offset: 4, Mask: 1}}
+	if _, err := DecodeConfig(profile.ConfigTable(), make([]byte, 4)); err == nil {
+		t.Error("field beyond the data was decoded")
+	}
+}
+
+func TestDecodeConfigWords(t *testing.T) {
+	// CONFIG1H FOSC 8, CONFIG2L BOREN 3, CONFIG2H WDTEN set
+	settings, err := DecodeConfigWords(FamilyPIC18, [4]byte{0x00, 0x08, 0x06, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]uint16{}
+	for _, s := range settings {
+		got[s.Name] = s.Value
+	}
+	want := map[string]uint16{"FOSC": 8, "PWRTEN": 0, "BOREN": 3, "WDTEN": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := DecodeConfigWords("pic24", [4]byte{}); err == nil {
+		t.Error("unknown family was decoded")
+	}
+}
+
+func TestConfigStart(t *testing.T) {
+	tests := []struct {
+		profile PIC8Profile
+		want    uint32
+	}{
+		{PIC8Profile{Family: FamilyPIC18}, 0x300000},
+		{PIC8Profile{Family: FamilyPIC18, ZeroBasedConfig: true}, 0},
+		{PIC8Profile{Family: FamilyPIC16, ConfigOffset: 0x1000E}, 0x8007},
+		{PIC8Profile{ConfigOffset: 0x1000E}, 0x1000E},
+	}
+	for _, test := range tests {
+		if got := test.profile.ConfigStart(); got != test.want {
+			t.Errorf("%+v: got %X, want %X", test.profile, got, test.want)
+		}
+	}
+}
+
+func TestPackUserID(t *testing.T) {
+	id, err := UserIDFromSerial(0x1234, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, []byte{0x12, 0x34}) {
+		t.Errorf("got id %X", id)
+	}
+	if _, err := UserIDFromSerial(0x10000, 2); err == nil {
+		t.Errorf("serial number that doesn't fit accepted")
+	}
+
+	if got := packUserID(FamilyPIC18, id); !bytes.Equal(got, id) {
+		t.Errorf("got pic18 data %X", got)
+	}
+	if got, want := packUserID(FamilyPIC16, id), []byte{1, 0, 2, 0, 3, 0, 4, 0}; !bytes.Equal(got, want) {
+		t.Errorf("got pic16 data %X, want %X", got, want)
+	}
+	if n := (PIC8Profile{Family: FamilyPIC16, IDSize: 8}).UserIDLength(); n != 2 {
+		t.Errorf("got pic16 user id length %v", n)
+	}
+}
@@ -0,0 +1,75 @@
+package microchipboot
+
+import "github.com/marcinbor85/gohex"
+
+// Stages reported to a ProgressFunc.
+const (
+	StageErase  = "erase"
+	StageWrite  = "write"
+	StageVerify = "verify"
+)
+
+// ProgressFunc is called as a Programmer makes progress through a stage. For the erase
+// and write stages, done and total count operations; for the verify stage, they count bytes.
+type ProgressFunc func(stage string, done, total int)
+
+// progress tracks the progress of the current stage and reports it to a ProgressFunc.
+type progress struct {
+	handler     ProgressFunc
+	stage       string
+	done, total int
+}
+
+// start begins a new stage.
+func (p *progress) start(stage string, total int) {
+	p.set(stage, 0, total)
+}
+
+// set records the progress of the given stage.
+func (p *progress) set(stage string, done, total int) {
+	p.stage, p.done, p.total = stage, done, total
+	p.report()
+}
+
+// add records n more units of the current stage as done.
+func (p *progress) add(n int) {
+	p.done += n
+	p.report()
+}
+
+func (p *progress) report() {
+	if p.handler != nil {
+		p.handler(p.stage, p.done, p.total)
+	}
+}
+
+// countReads wraps a read function so that the bytes read are added to the progress.
+func (p *progress) countReads(readFunc func(uint32, uint16) ([]byte, error)) func(uint32, uint16) ([]byte, error) {
+	return func(address uint32, length uint16) ([]byte, error) {
+		data, err := readFunc(address, length)
+		if err == nil {
+			p.add(int(length))
+		}
+		return data, err
+	}
+}
+
+// countChecksums wraps a checksum function so that the bytes checksummed are added to the progress.
+func (p *progress) countChecksums(checksumFunc func(uint32, uint16) (uint16, error)) func(uint32, uint16) (uint16, error) {
+	return func(address uint32, length uint16) (uint16, error) {
+		sum, err := checksumFunc(address, length)
+		if err == nil {
+			p.add(int(length))
+		}
+		return sum, err
+	}
+}
+
+// segmentsLength returns the total number of bytes in the segments.
+func segmentsLength(segments []gohex.DataSegment) int {
+	n := 0
+	for _, segment := range segments {
+		n += len(segment.Data)
+	}
+	return n
+}
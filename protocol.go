@@ -0,0 +1,163 @@
+package microchipboot
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Protocol variants.
+const (
+	// ProtocolAuto selects the variant from the firmware version reported by GetVersion.
+	ProtocolAuto = "auto"
+	// ProtocolV1 is the protocol as documented for the Unified Bootloader, used by
+	// firmware reporting a major version below 2.
+	ProtocolV1 = "v1"
+	// ProtocolV2 is used by firmware reporting major version 2 or later, which answers
+	// read commands with a result code before the data.
+	ProtocolV2 = "v2"
+)
+
+// ProtocolOptions adjusts the bootloader protocol to match differences between bootloader
+// firmware versions.
+type ProtocolOptions struct {
+	// Variant selects the protocol variant, either ProtocolV1, ProtocolV2 or ProtocolAuto.
+	// Defaults to ProtocolV1. With ProtocolAuto, the variant is detected when GetVersion
+	// is called and version 1 is assumed until then. The fields below are applied on top
+	// of the variant's settings.
+	Variant string
+	// If true, read commands are answered with a result code before the data, as with
+	// write commands. Some bootloader firmware versions do this so that they can report an
+	// address error for reads as well. By default, reads return only the data.
+	ReadSuccessCodes bool
+	// If set, replaces the 55 AA unlock sequence sent with write and erase commands.
+	UnlockSequence [2]byte
+	// Number of status bytes that follow each result code, which are logged and
+	// otherwise ignored.
+	ExtraStatusBytes int
+	// If true, a CRC-16 is appended to every command and response, for bootloader builds
+	// that check the integrity of each frame. The command's CRC covers the command
+	// header and data, and the response's CRC covers everything the device sends after
+	// the echoed sync byte, up to and including a failing result code. Both are
+	// CRC-16/XMODEM, sent low byte first.
+	CRC bool
+}
+
+// protocolVariants holds the settings of each protocol variant.
+var protocolVariants = map[string]ProtocolOptions{
+	ProtocolV1: {},
+	ProtocolV2: {ReadSuccessCodes: true},
+}
+
+// ErrProtocolOptionsNotSupported is returned by SetProtocolOptions if the transport doesn't
+// implement the protocol framing itself.
+var ErrProtocolOptionsNotSupported = errors.New("transport doesn't support protocol options")
+
+// protocolConfigurable is implemented by transports that frame the bootloader protocol
+// themselves.
+type protocolConfigurable interface {
+	protocolOptions() ProtocolOptions
+	setProtocolOptions(options ProtocolOptions) error
+}
+
+// findProtocolConfigurable returns the transport underlying bootloader that frames the
+// protocol.
+func findProtocolConfigurable(bootloader Bootloader) (protocolConfigurable, error) {
+	p, ok := findBootloader(bootloader, func(b Bootloader) bool {
+		_, ok := b.(protocolConfigurable)
+		return ok
+	}).(protocolConfigurable)
+	if !ok {
+		return nil, ErrProtocolOptionsNotSupported
+	}
+	return p, nil
+}
+
+// SetProtocolOptions sets the protocol options used by the transport underlying
+// bootloader.
+func SetProtocolOptions(bootloader Bootloader, options ProtocolOptions) error {
+	p, err := findProtocolConfigurable(bootloader)
+	if err != nil {
+		return err
+	}
+	return p.setProtocolOptions(options)
+}
+
+// updateProtocolOptions changes the protocol options of the transport underlying
+// bootloader with update, keeping the options that it doesn't change.
+func updateProtocolOptions(bootloader Bootloader, update func(*ProtocolOptions)) error {
+	p, err := findProtocolConfigurable(bootloader)
+	if err != nil {
+		return err
+	}
+	options := p.protocolOptions()
+	update(&options)
+	return p.setProtocolOptions(options)
+}
+
+// setProtocolVariant overrides the protocol variant of the transport underlying
+// bootloader, keeping the rest of its protocol options.
+func setProtocolVariant(bootloader Bootloader, variant string) error {
+	return updateProtocolOptions(bootloader, func(options *ProtocolOptions) {
+		options.Variant = variant
+	})
+}
+
+// validateProtocolVariant checks that variant is one of the known variants.
+func validateProtocolVariant(variant string) error {
+	if _, ok := protocolVariants[variant]; !ok && variant != "" && variant != ProtocolAuto {
+		return fmt.Errorf("invalid protocol variant %q, expected %q, %q or %q", variant, ProtocolAuto, ProtocolV1, ProtocolV2)
+	}
+	return nil
+}
+
+// detectProtocolVariant returns the protocol variant used by the firmware.
+func detectProtocolVariant(info VersionInfo) string {
+	if info.VersionMajor >= 2 {
+		return ProtocolV2
+	}
+	return ProtocolV1
+}
+
+// resolve returns the settings of the variant in use, with the explicitly set options
+// applied on top. detected is the variant detected from the firmware version, if any,
+// which is only used with ProtocolAuto.
+func (o ProtocolOptions) resolve(detected string) ProtocolOptions {
+	variant := o.Variant
+	if variant == ProtocolAuto {
+		variant = detected
+	}
+	if variant == "" {
+		variant = ProtocolV1
+	}
+	resolved := protocolVariants[variant]
+	resolved.Variant = variant
+	resolved.ReadSuccessCodes = resolved.ReadSuccessCodes || o.ReadSuccessCodes
+	if o.UnlockSequence != [2]byte{} {
+		resolved.UnlockSequence = o.UnlockSequence
+	}
+	if o.ExtraStatusBytes != 0 {
+		resolved.ExtraStatusBytes = o.ExtraStatusBytes
+	}
+	resolved.CRC = resolved.CRC || o.CRC
+	return resolved
+}
+
+// isReadCommand returns true if cmd reads from one of the memory regions.
+func isReadCommand(cmd Command) bool {
+	switch cmd.Command {
+	case commandReadFlash, commandReadEE, commandReadConfig:
+		return true
+	}
+	return false
+}
+
+// apply adjusts a command's framing and expected response to the resolved options.
+func (o ProtocolOptions) apply(cmd Command) Command {
+	if o.ReadSuccessCodes && isReadCommand(cmd) {
+		cmd.expectsSuccessCode = true
+	}
+	if o.UnlockSequence != [2]byte{} && cmd.UnlockSequence != [2]byte{} {
+		cmd.UnlockSequence = o.UnlockSequence
+	}
+	return cmd
+}
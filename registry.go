@@ -0,0 +1,128 @@
+package microchipboot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Device families registered by this package, in addition to FamilyPIC16 and
+// FamilyPIC18.
+const (
+	// FamilyPIC8 is an 8-bit PIC without any family specific defaults.
+	FamilyPIC8 = "pic8"
+	// FamilyPIC24 covers the 16-bit PIC24 and dsPIC33 devices.
+	FamilyPIC24 = "pic24"
+	FamilyPIC32 = "pic32"
+)
+
+// ProgrammerFactory creates a programmer for a device family. decode decodes the family's
+// profile, e.g. as read from a YAML, JSON or TOML file, into the value that it is given.
+type ProgrammerFactory func(bootloader Bootloader, decode func(v interface{}) error) (Programmer, error)
+
+var (
+	programmerFactoriesMu sync.RWMutex
+	programmerFactories   = make(map[string]ProgrammerFactory)
+)
+
+// RegisterProgrammerFactory makes a device family available to NewProgrammer under the
+// given name, so that other packages can add support for families that this package
+// doesn't, such as SAM or AVR devices. It is meant to be called from the init function
+// of the package implementing the family, and panics if factory is nil or the name is
+// already registered.
+//
+// The families registered by this package decode a profile with Profile and Options
+// sections, e.g. a PIC32Profile and PIC32Options for FamilyPIC32.
+func RegisterProgrammerFactory(name string, factory ProgrammerFactory) {
+	programmerFactoriesMu.Lock()
+	defer programmerFactoriesMu.Unlock()
+	if factory == nil {
+		panic("microchipboot: RegisterProgrammerFactory factory is nil")
+	}
+	if _, dup := programmerFactories[name]; dup {
+		panic("microchipboot: RegisterProgrammerFactory called twice for family " + name)
+	}
+	programmerFactories[name] = factory
+}
+
+// ProgrammerFamilies returns the names of the registered device families in
+// alphabetical order.
+func ProgrammerFamilies() []string {
+	programmerFactoriesMu.RLock()
+	defer programmerFactoriesMu.RUnlock()
+	var names []string
+	for name := range programmerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewProgrammer creates a programmer for the named device family, decoding its profile
+// with decode.
+func NewProgrammer(family string, bootloader Bootloader, decode func(v interface{}) error) (Programmer, error) {
+	programmerFactoriesMu.RLock()
+	factory, ok := programmerFactories[family]
+	programmerFactoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown device family %q, expected one of %v", family, strings.Join(ProgrammerFamilies(), ", "))
+	}
+	return factory(bootloader, decode)
+}
+
+func init() {
+	for _, family := range []string{FamilyPIC8, FamilyPIC16, FamilyPIC18} {
+		RegisterProgrammerFactory(family, newPIC8Factory(family))
+	}
+	RegisterProgrammerFactory(FamilyPIC24, func(bootloader Bootloader, decode func(interface{}) error) (Programmer, error) {
+		var config struct {
+			Profile PIC16BitProfile
+			Options PIC16BitOptions
+		}
+		if err := decode(&config); err != nil {
+			return nil, err
+		}
+		if config.Profile.FlashSize == 0 {
+			return nil, fmt.Errorf("invalid profile: flashsize must be set")
+		}
+		return NewPIC16BitProgrammer(bootloader, config.Profile, config.Options), nil
+	})
+	RegisterProgrammerFactory(FamilyPIC32, func(bootloader Bootloader, decode func(interface{}) error) (Programmer, error) {
+		var config struct {
+			Profile PIC32Profile
+			Options PIC32Options
+		}
+		if err := decode(&config); err != nil {
+			return nil, err
+		}
+		if config.Profile.FlashSize == 0 || config.Profile.EraseRowSize == 0 || config.Profile.WriteRowSize == 0 {
+			return nil, fmt.Errorf("invalid profile: flashsize, eraserowsize and writerowsize must be set")
+		}
+		return NewPIC32Programmer(bootloader, config.Profile, config.Options), nil
+	})
+}
+
+// newPIC8Factory returns the factory for an 8-bit PIC family, which sets the profile's
+// Family unless it is FamilyPIC8.
+func newPIC8Factory(family string) ProgrammerFactory {
+	return func(bootloader Bootloader, decode func(interface{}) error) (Programmer, error) {
+		var config struct {
+			Profile PIC8Profile
+			Options PIC8Options
+		}
+		if err := decode(&config); err != nil {
+			return nil, err
+		}
+		if family != FamilyPIC8 {
+			if config.Profile.Family != "" && config.Profile.Family != family {
+				return nil, fmt.Errorf("invalid profile: family is %q but %q was selected", config.Profile.Family, family)
+			}
+			config.Profile.Family = family
+		}
+		if err := config.Profile.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid profile: %w", err)
+		}
+		return NewPIC8Programmer(bootloader, config.Profile, config.Options), nil
+	}
+}
@@ -0,0 +1,259 @@
+package microchipboot
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math/bits"
+)
+
+// Verification methods.
+const (
+	VerifyMethodRead     = "read"
+	VerifyMethodChecksum = "checksum"
+)
+
+// VerifyReport describes the result of a verification.
+type VerifyReport struct {
+	Method  string
+	Regions []*RegionReport
+}
+
+// RegionReport describes the verification of a single memory region.
+type RegionReport struct {
+	Name       string
+	Checked    []CheckedRange
+	Mismatches []Mismatch
+}
+
+// CheckedRange is a range of addresses that was compared with the device.
+// The checksums are only set when verifying by checksum.
+type CheckedRange struct {
+	Address          Address
+	Length           Length
+	ExpectedChecksum uint16 `json:",omitempty"`
+	DeviceChecksum   uint16 `json:",omitempty"`
+}
+
+// Mismatch is a range of addresses where the device contents differ from the expected data.
+// When verifying by checksum, the individual bytes aren't known, so Expected and Actual are empty.
+type Mismatch struct {
+	Address  Address
+	Length   Length
+	Expected []byte `json:",omitempty"`
+	Actual   []byte `json:",omitempty"`
+}
+
+func (m Mismatch) String() string {
+	if len(m.Expected) == 0 {
+		return fmt.Sprintf("checksum mismatch in range %X-%X", m.Address, m.Address+Address(m.Length)-1)
+	}
+	return fmt.Sprintf("mismatch at %X, expected %X read %X", m.Address, m.Expected[0], m.Actual[0])
+}
+
+// Passed returns true if no mismatches were found.
+func (r *VerifyReport) Passed() bool {
+	return r.firstMismatch() == nil
+}
+
+// NumMismatches returns the total number of mismatching ranges in all regions.
+func (r *VerifyReport) NumMismatches() int {
+	n := 0
+	for _, region := range r.Regions {
+		n += len(region.Mismatches)
+	}
+	return n
+}
+
+func (r *VerifyReport) firstMismatch() *RegionReport {
+	for _, region := range r.Regions {
+		if len(region.Mismatches) > 0 {
+			return region
+		}
+	}
+	return nil
+}
+
+// addRegion adds a new region to the report and returns it.
+func (r *VerifyReport) addRegion(name string) *RegionReport {
+	region := &RegionReport{Name: name}
+	r.Regions = append(r.Regions, region)
+	return region
+}
+
+// err returns an error describing the first mismatch, or nil if verification passed.
+func (r *VerifyReport) err() error {
+	region := r.firstMismatch()
+	if region == nil {
+		return nil
+	}
+	m := region.Mismatches[0]
+	return &VerifyMismatchError{
+		Region:   region.Name,
+		Address:  m.Address,
+		Length:   m.Length,
+		Expected: m.Expected,
+		Actual:   m.Actual,
+		Total:    r.NumMismatches(),
+	}
+}
+
+// WriteJSON writes the report in JSON format.
+func (r *VerifyReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Largest shift between the expected and device data that Summary looks for.
+const maxMismatchShift = 16
+
+// MismatchSummary summarises the mismatches found by a verification, to help tell
+// systematic failures, such as an addressing bug, from random ones, such as line noise.
+// The byte counts are only known when verifying by reading.
+type MismatchSummary struct {
+	// Number of mismatching ranges.
+	Ranges int
+	// Number of mismatching bytes, and the number of bits that differ in them.
+	Bytes, BitsFlipped int
+	// Number of mismatching bytes that read back as erased, which suggests that they
+	// weren't written at all.
+	ErasedBytes int
+	// If non-zero, the device data of every mismatching range of at least 4 bytes
+	// matches the expected data shifted by this many bytes, which suggests that the data
+	// was written at the wrong address. A positive shift means that the device data is
+	// at a lower address than expected.
+	Shift int
+}
+
+// String describes the likely cause of the mismatches.
+func (s MismatchSummary) String() string {
+	text := fmt.Sprintf("%v mismatching ranges", s.Ranges)
+	if s.Bytes == 0 {
+		return text
+	}
+	text += fmt.Sprintf(", %v bytes, %v bits flipped", s.Bytes, s.BitsFlipped)
+	switch {
+	case s.Shift != 0:
+		text += fmt.Sprintf("; the device data is the expected data shifted by %v bytes, suggesting an addressing problem", s.Shift)
+	case s.ErasedBytes == s.Bytes:
+		text += "; every mismatching byte is erased, suggesting writes that didn't happen"
+	case s.BitsFlipped <= 2*s.Ranges:
+		text += "; isolated bit errors, suggesting noise"
+	}
+	return text
+}
+
+// Summary summarises the mismatches in the report.
+func (r *VerifyReport) Summary() MismatchSummary {
+	var s MismatchSummary
+	shift, shifted := 0, true
+	for _, region := range r.Regions {
+		for _, m := range region.Mismatches {
+			s.Ranges++
+			for i := range m.Expected {
+				s.Bytes++
+				s.BitsFlipped += bits.OnesCount8(m.Expected[i] ^ m.Actual[i])
+				if m.Actual[i] == erasedValue {
+					s.ErasedBytes++
+				}
+			}
+			if len(m.Expected) < 4 {
+				continue
+			}
+			k := findShift(m.Expected, m.Actual)
+			if k == 0 || (shift != 0 && k != shift) {
+				shifted = false
+			}
+			shift = k
+		}
+	}
+	if shifted {
+		s.Shift = shift
+	}
+	return s
+}
+
+// findShift returns the shift k for which actual[i] == expected[i+k] wherever both
+// exist, or 0 if there is none.
+func findShift(expected, actual []byte) int {
+	for k := 1; k <= maxMismatchShift && k <= len(expected)/2; k++ {
+		for _, shift := range []int{k, -k} {
+			matches := true
+			for i := range actual {
+				if j := i + shift; j >= 0 && j < len(expected) && actual[i] != expected[j] {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				return shift
+			}
+		}
+	}
+	return 0
+}
+
+// WriteDiff writes every mismatching byte in a plain text format, one per line, preceded
+// by the summary. When verifying by checksum, the mismatching ranges are listed instead.
+func (r *VerifyReport) WriteDiff(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# %v verification: %v\n", r.Method, r.Summary()); err != nil {
+		return err
+	}
+	for _, region := range r.Regions {
+		for _, m := range region.Mismatches {
+			if len(m.Expected) == 0 {
+				if _, err := fmt.Fprintf(w, "%-7v %08X-%08X checksum mismatch\n", region.Name, m.Address, m.Address+Address(m.Length)-1); err != nil {
+					return err
+				}
+				continue
+			}
+			for i := range m.Expected {
+				if _, err := fmt.Fprintf(w, "%-7v %08X expected %02X actual %02X\n", region.Name, m.Address+Address(i), m.Expected[i], m.Actual[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Verification report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #999; padding: 2px 8px; font-family: monospace; text-align: left; }
+.pass { color: green; }
+.fail { color: red; }
+</style>
+</head>
+<body>
+<h1>Verification report</h1>
+<p>Method: {{.Method}}</p>
+{{if .Passed}}<p class="pass">PASSED</p>{{else}}<p class="fail">FAILED: {{.NumMismatches}} mismatching ranges</p>{{end}}
+{{range .Regions}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>Address</th><th>Length</th>{{if eq $.Method "checksum"}}<th>Expected checksum</th><th>Device checksum</th>{{end}}</tr>
+{{range .Checked}}<tr><td>{{printf "%X" .Address}}</td><td>{{.Length}}</td>{{if eq $.Method "checksum"}}<td>{{printf "%04X" .ExpectedChecksum}}</td><td>{{printf "%04X" .DeviceChecksum}}</td>{{end}}</tr>
+{{end}}</table>
+{{if .Mismatches}}
+<table>
+<tr><th>Mismatch address</th><th>Length</th><th>Expected</th><th>Actual</th></tr>
+{{range .Mismatches}}<tr class="fail"><td>{{printf "%X" .Address}}</td><td>{{.Length}}</td><td>{{printf "% X" .Expected}}</td><td>{{printf "% X" .Actual}}</td></tr>
+{{end}}</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as a simple HTML page.
+func (r *VerifyReport) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
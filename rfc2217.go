@@ -0,0 +1,196 @@
+package microchipboot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Telnet commands and options used by RFC 2217.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetBinary          = 0
+	telnetSuppressGoAhead = 3
+	telnetComPortOption   = 44
+	comPortSetBaudRate    = 1
+	comPortSetDataSize    = 2
+	comPortSetParity      = 3
+	comPortSetStopSize    = 4
+	comPortParityNone     = 1
+	comPortOneStopBit     = 1
+	comPortEightDataBits  = 8
+)
+
+// rfc2217Negotiation returns the Telnet commands that put the connection into binary mode
+// and set the remote serial port to the given baud rate, with 8 data bits, no parity and
+// 1 stop bit.
+func rfc2217Negotiation(baud int) []byte {
+	buf := []byte{
+		telnetIAC, telnetWILL, telnetBinary,
+		telnetIAC, telnetDO, telnetBinary,
+		telnetIAC, telnetWILL, telnetSuppressGoAhead,
+		telnetIAC, telnetDO, telnetSuppressGoAhead,
+		telnetIAC, telnetWILL, telnetComPortOption,
+	}
+	subnegotiate := func(data ...byte) {
+		buf = append(buf, telnetIAC, telnetSB, telnetComPortOption)
+		buf = append(buf, telnetEscape(data)...)
+		buf = append(buf, telnetIAC, telnetSE)
+	}
+	rate := make([]byte, 4)
+	binary.BigEndian.PutUint32(rate, uint32(baud))
+	subnegotiate(append([]byte{comPortSetBaudRate}, rate...)...)
+	subnegotiate(comPortSetDataSize, comPortEightDataBits)
+	subnegotiate(comPortSetParity, comPortParityNone)
+	subnegotiate(comPortSetStopSize, comPortOneStopBit)
+	return buf
+}
+
+// telnetEscape doubles any IAC bytes in data, so that they aren't taken as commands.
+func telnetEscape(data []byte) []byte {
+	escaped := make([]byte, 0, len(data))
+	for _, b := range data {
+		escaped = append(escaped, b)
+		if b == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+	}
+	return escaped
+}
+
+// Telnet decoder states.
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSubnegotiation
+	telnetStateSubnegotiationIAC
+)
+
+// telnetDecoder strips Telnet commands from the received data. Option negotiations from
+// the server are ignored, which is sufficient for RFC 2217 servers such as ser2net. The
+// state is kept between calls as commands may be split across reads.
+type telnetDecoder struct {
+	state int
+}
+
+func (d *telnetDecoder) decode(data []byte) []byte {
+	out := data[:0]
+	for _, b := range data {
+		switch d.state {
+		case telnetStateData:
+			if b == telnetIAC {
+				d.state = telnetStateIAC
+			} else {
+				out = append(out, b)
+			}
+		case telnetStateIAC:
+			switch b {
+			case telnetIAC:
+				out = append(out, b)
+				d.state = telnetStateData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				d.state = telnetStateOption
+			case telnetSB:
+				d.state = telnetStateSubnegotiation
+			default:
+				d.state = telnetStateData
+			}
+		case telnetStateOption:
+			d.state = telnetStateData
+		case telnetStateSubnegotiation:
+			if b == telnetIAC {
+				d.state = telnetStateSubnegotiationIAC
+			}
+		case telnetStateSubnegotiationIAC:
+			if b == telnetSE {
+				d.state = telnetStateData
+			} else {
+				d.state = telnetStateSubnegotiation
+			}
+		}
+	}
+	return out
+}
+
+// NewBootloaderFromURL creates a bootloader for a serial port given as a URL:
+//
+//	serial:///dev/ttyUSB0?baud=115200   a local serial port (a plain port name also works)
+//	tcp://host:port                     a raw TCP serial bridge
+//	rfc2217://host:port?baud=115200     a Telnet COM port control (RFC 2217) server, such as ser2net
+//	pipe:///tmp/sim.sock                a pipe, e.g. a Unix domain socket, FIFO or pseudo terminal
+//	pipe://./pipe/com1                  a Windows named pipe, here \\.\pipe\com1
+//
+// The baud rate defaults to 115200. NewSerialBootloader also accepts these URLs as the
+// port name, in which case a baud parameter takes precedence over the configured rate.
+func NewBootloaderFromURL(rawurl string) (Bootloader, error) {
+	if !strings.Contains(rawurl, "://") {
+		return NewSerialBootloader(rawurl, defaultSerialBaud)
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	config := SerialConfig{Name: u.Path}
+	if config.Baud, err = urlBaud(u, defaultSerialBaud); err != nil {
+		return nil, err
+	}
+	if u.Scheme == "serial" {
+		return NewSerialBootloaderWithConfig(config)
+	}
+	return newRemoteSerialBootloader(u, config)
+}
+
+// urlBaud returns the baud rate given by the baud parameter of a port URL, or baud if
+// there isn't one.
+func urlBaud(u *url.URL, baud int) (int, error) {
+	s := u.Query().Get("baud")
+	if s == "" {
+		return baud, nil
+	}
+	baud, err := strconv.Atoi(s)
+	if err != nil || baud <= 0 {
+		return 0, fmt.Errorf("invalid baud rate %q", s)
+	}
+	return baud, nil
+}
+
+// newRemoteSerialBootloader creates a bootloader for a serial port behind a tcp, rfc2217
+// or pipe URL, using the baud rate and read timeout from the config.
+func newRemoteSerialBootloader(u *url.URL, config SerialConfig) (Bootloader, error) {
+	if u.Scheme == "pipe" {
+		path := u.Path
+		if u.Host != "" {
+			// A UNC path, i.e. a Windows named pipe
+			path = `\\` + u.Host + strings.Replace(u.Path, "/", `\`, -1)
+		}
+		return NewPipeBootloader(PipeConfig{Path: path, ReadTimeout: config.ReadTimeout, Resync: config.Resync})
+	}
+	if u.Scheme != "tcp" && u.Scheme != "rfc2217" {
+		return nil, fmt.Errorf("unsupported port scheme %q, expected serial, tcp, rfc2217 or pipe", u.Scheme)
+	}
+	host, portString, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", u.Host, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+	return NewTCPBootloader(host, port, TCPConfig{
+		ReadTimeout: config.ReadTimeout,
+		RFC2217:     u.Scheme == "rfc2217",
+		Baud:        config.Baud,
+		Resync:      config.Resync,
+	})
+}
@@ -0,0 +1,47 @@
+package microchipboot
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTelnetDecoder(t *testing.T) {
+	data := []byte{0x55, 0xFF, 0x00, 0xFF}
+	stream := append([]byte{telnetIAC, telnetDO, telnetBinary}, telnetEscape(data)...)
+	stream = append(stream, telnetIAC, telnetSB, telnetComPortOption, 101, 0, 0, 0x1C, 0x20, telnetIAC, telnetSE)
+
+	// Feed the stream one byte at a time to make sure that commands split across reads
+	// are handled
+	var d telnetDecoder
+	var got []byte
+	for i := range stream {
+		got = append(got, d.decode(append([]byte{}, stream[i]))...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %X, want %X", got, data)
+	}
+}
+
+func TestURLBaudTakesPrecedence(t *testing.T) {
+	b, err := NewSerialBootloaderWithConfig(SerialConfig{Name: "rfc2217://localhost:3001?baud=9600", Baud: 57600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baud := b.(*tcpBootloader).config.Baud; baud != 9600 {
+		t.Errorf("rfc2217 baud rate is %v, want 9600", baud)
+	}
+	b, err = NewSerialBootloaderWithConfig(SerialConfig{Name: "serial:///dev/ttyUSB0?baud=9600", Baud: 57600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baud := b.(*serialBootloader).config.Baud; baud != 9600 {
+		t.Errorf("serial baud rate is %v, want 9600", baud)
+	}
+	b, err = NewSerialBootloaderWithConfig(SerialConfig{Name: "rfc2217://localhost:3001", Baud: 57600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baud := b.(*tcpBootloader).config.Baud; baud != 57600 {
+		t.Errorf("baud rate without a URL parameter is %v, want 57600", baud)
+	}
+}
@@ -0,0 +1,90 @@
+package microchipboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ErrRolledBack is matched by the error returned by ProgramWithRollback when programming
+// or verification failed and the previous application was programmed back successfully.
+var ErrRolledBack = errors.New("previous application restored")
+
+// rolledBackError wraps the error that caused a rollback, so that both it and
+// ErrRolledBack can be checked for.
+type rolledBackError struct {
+	err error
+}
+
+func (e *rolledBackError) Error() string {
+	return fmt.Sprintf("update failed, previous application restored: %v", e.err)
+}
+
+func (e *rolledBackError) Unwrap() error {
+	return e.err
+}
+
+func (e *rolledBackError) Is(target error) bool {
+	return target == ErrRolledBack
+}
+
+// ProgramWithRollback programs and verifies the image loaded into p, making sure that the
+// device isn't left without a working application if the update fails. Before anything is
+// erased, the application area of flash is read and saved as a hex file at backupPath.
+// If programming or verification then fails, the backup is programmed and verified again
+// and the returned error matches ErrRolledBack. If the rollback fails as well, the backup
+// is kept so that it can be programmed by hand.
+//
+// If backupPath is empty, the backup is saved to a temporary file that is removed once
+// it is no longer needed. p must be connected. The backup is programmed with the same
+// options as the image, so FlashRelocation must not be used.
+func ProgramWithRollback(p Programmer, backupPath string) error {
+	var backup bytes.Buffer
+	plannerLog.Infof("backing up application")
+	if err := DumpToHex(p, &backup, RegionFlash); err != nil {
+		return fmt.Errorf("failed to back up application: %w", err)
+	}
+	remove := false
+	if backupPath == "" {
+		f, err := ioutil.TempFile("", "microchipboot-backup-*.hex")
+		if err != nil {
+			return fmt.Errorf("failed to save backup: %w", err)
+		}
+		f.Close()
+		backupPath = f.Name()
+		remove = true
+	}
+	if err := ioutil.WriteFile(backupPath, backup.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to save backup: %w", err)
+	}
+	plannerLog.Debugf("saved backup to %v", backupPath)
+
+	err := p.Program()
+	if err == nil {
+		err = p.Verify()
+	}
+	if err == nil {
+		if remove {
+			os.Remove(backupPath)
+		}
+		return nil
+	}
+
+	plannerLog.Warnf("update failed, restoring backup: %v", err)
+	rollbackErr := p.LoadHex(bytes.NewReader(backup.Bytes()))
+	if rollbackErr == nil {
+		rollbackErr = p.Program()
+	}
+	if rollbackErr == nil {
+		rollbackErr = p.Verify()
+	}
+	if rollbackErr != nil {
+		return fmt.Errorf("update failed: %v, and restoring the backup from %v failed: %w", err, backupPath, rollbackErr)
+	}
+	if remove {
+		os.Remove(backupPath)
+	}
+	return &rolledBackError{err}
+}
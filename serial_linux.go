@@ -0,0 +1,92 @@
+package microchipboot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Directory that Linux lists tty devices in.
+const ttyClassDir = "/sys/class/tty"
+
+// Enables RTS/CTS hardware flow control, from asm-generic/termbits.h.
+const crtscts = 0x80000000
+
+func ioctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setHardwareFlowControl enables or disables RTS/CTS flow control on the serial port.
+// The settings of a serial port are shared by all of its open file descriptors, so this
+// can be done while the port is open elsewhere.
+func setHardwareFlowControl(name string, enabled bool) error {
+	file, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var termios syscall.Termios
+	if err := ioctl(file, syscall.TCGETS, unsafe.Pointer(&termios)); err != nil {
+		return err
+	}
+	if enabled {
+		termios.Cflag |= crtscts
+	} else {
+		termios.Cflag &^= crtscts
+	}
+	return ioctl(file, syscall.TCSETS, unsafe.Pointer(&termios))
+}
+
+// setModemLine sets or clears the DTR or RTS line of the serial port.
+func setModemLine(name string, line ModemLine, active bool) error {
+	file, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	bits := syscall.TIOCM_DTR
+	if line == LineRTS {
+		bits = syscall.TIOCM_RTS
+	}
+	request := uintptr(syscall.TIOCMBIC)
+	if active {
+		request = syscall.TIOCMBIS
+	}
+	return ioctl(file, request, unsafe.Pointer(&bits))
+}
+
+// listSerialPorts returns the tty devices that are backed by hardware. Legacy serial
+// ports (ttyS*) are only included if a UART has been detected.
+func listSerialPorts() ([]string, error) {
+	entries, err := ioutil.ReadDir(ttyClassDir)
+	if err != nil {
+		return nil, err
+	}
+	var ports []string
+	for _, entry := range entries {
+		dir := filepath.Join(ttyClassDir, entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, "device")); err != nil {
+			// Virtual terminal
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), "ttyS") {
+			uartType, err := ioutil.ReadFile(filepath.Join(dir, "type"))
+			if err != nil || strings.TrimSpace(string(uartType)) == "0" {
+				continue
+			}
+		}
+		ports = append(ports, filepath.Join("/dev", entry.Name()))
+	}
+	sort.Strings(ports)
+	return ports, nil
+}
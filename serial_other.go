@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package microchipboot
+
+import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+func setHardwareFlowControl(name string, enabled bool) error {
+	return errors.New("hardware flow control is only supported on Linux")
+}
+
+func setModemLine(name string, line ModemLine, active bool) error {
+	return errors.New("setting the modem lines is only supported on Linux")
+}
+
+// listSerialPorts returns the callout devices on macOS and BSD systems.
+func listSerialPorts() ([]string, error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("listing serial ports is not supported on Windows")
+	}
+	ports, err := filepath.Glob("/dev/cu.*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ports)
+	return ports, nil
+}
@@ -0,0 +1,277 @@
+package microchipboot
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serial number sources.
+const (
+	// SerialSourceCounter takes serial numbers from a counter that is incremented for
+	// each device.
+	SerialSourceCounter = "counter"
+	// SerialSourceUUID generates a random (version 4) UUID for each device.
+	SerialSourceUUID = "uuid"
+)
+
+// Serial number formats.
+const (
+	// SerialUint is a little endian unsigned integer, which can be read back with
+	// AppInfoUint. It can only be used with counters.
+	SerialUint = "uint"
+	// SerialString is ASCII text, padded with NUL bytes. Counters are written in decimal,
+	// with leading zeros, and UUIDs in their usual 36 character form.
+	SerialString = "string"
+	// SerialHex is raw bytes. Counters are written big endian and UUIDs take 16 bytes.
+	SerialHex = "hex"
+)
+
+// Length of a UUID in bytes and as text.
+const (
+	uuidLength     = 16
+	uuidTextLength = 36
+)
+
+// SerialTemplate describes where and how a per-unit serial number is patched into the
+// image before it is programmed.
+type SerialTemplate struct {
+	// Address of the serial number, which may lie in flash, EEPROM, config or ID memory.
+	Address uint32
+	Length  uint32
+	// One of SerialUint, SerialString or SerialHex. Defaults to SerialUint.
+	Format string
+	// SerialSourceCounter or SerialSourceUUID. Defaults to SerialSourceCounter.
+	Source string
+	// Prefix is written before string serial numbers, e.g. "SN".
+	Prefix string
+	// First counter value, used when there is no counter file yet.
+	Start uint64
+}
+
+// applyDefaults fills in the fields that are left empty.
+func (t *SerialTemplate) applyDefaults() {
+	if t.Format == "" {
+		t.Format = SerialUint
+	}
+	if t.Source == "" {
+		t.Source = SerialSourceCounter
+	}
+}
+
+// validate returns an error if the template can't be used.
+func (t SerialTemplate) validate() error {
+	if t.Length == 0 {
+		return fmt.Errorf("serial number length must be set")
+	}
+	switch t.Format {
+	case SerialUint, SerialString, SerialHex:
+	default:
+		return fmt.Errorf("invalid serial number format %q", t.Format)
+	}
+	if t.Prefix != "" && t.Format != SerialString {
+		return fmt.Errorf("a serial number prefix can only be used with the %v format", SerialString)
+	}
+	switch t.Source {
+	case SerialSourceCounter:
+		if t.Format == SerialUint && t.Length > 8 {
+			return fmt.Errorf("%v serial numbers can't be longer than 8 bytes", SerialUint)
+		}
+	case SerialSourceUUID:
+		switch {
+		case t.Format == SerialUint:
+			return fmt.Errorf("uuids can't use the %v format", SerialUint)
+		case t.Format == SerialHex && t.Length != uuidLength:
+			return fmt.Errorf("uuids take %v bytes, not %v", uuidLength, t.Length)
+		case t.Format == SerialString && int(t.Length) < len(t.Prefix)+uuidTextLength:
+			return fmt.Errorf("uuids take %v bytes as text, plus the prefix", uuidTextLength)
+		}
+	default:
+		return fmt.Errorf("invalid serial number source %q", t.Source)
+	}
+	return nil
+}
+
+// Serial is a serial number allocated to a device.
+type Serial struct {
+	// Value is the serial number as text, e.g. for logs and labels.
+	Value string
+	// Data is written to the image at the template's address.
+	Data []byte
+}
+
+// Serializer allocates serial numbers and patches them into a programmer's image. The
+// next counter value is kept in a file, if one is given, so that counting carries on
+// where it left off. A serial number is never reused, even if programming fails, so that
+// no two devices share one; Record lists the serial numbers of the devices that were
+// programmed. A Serializer can be shared between goroutines.
+type Serializer struct {
+	template    SerialTemplate
+	counterFile string
+	recordFile  string
+	mutex       sync.Mutex
+	// Next counter value, when there is no counter file.
+	next uint64
+}
+
+// NewSerializer creates a serializer for the template. counterFile and recordFile may
+// be empty, in which case the counter starts from the template's Start value each time
+// and no record is kept.
+func NewSerializer(template SerialTemplate, counterFile, recordFile string) (*Serializer, error) {
+	template.applyDefaults()
+	if err := template.validate(); err != nil {
+		return nil, err
+	}
+	return &Serializer{
+		template:    template,
+		counterFile: counterFile,
+		recordFile:  recordFile,
+		next:        template.Start,
+	}, nil
+}
+
+// Next allocates the next serial number.
+func (s *Serializer) Next() (Serial, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.template.Source == SerialSourceUUID {
+		uuid := make([]byte, uuidLength)
+		if _, err := rand.Read(uuid); err != nil {
+			return Serial{}, fmt.Errorf("failed to generate uuid: %w", err)
+		}
+		// Set the version (4, random) and the variant (RFC 4122)
+		uuid[6] = uuid[6]&0x0F | 0x40
+		uuid[8] = uuid[8]&0x3F | 0x80
+		text := fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+		if s.template.Format == SerialHex {
+			return Serial{Value: text, Data: uuid}, nil
+		}
+		return s.stringSerial(text)
+	}
+
+	value, err := s.readCounter()
+	if err != nil {
+		return Serial{}, err
+	}
+	serial, err := s.counterSerial(value)
+	if err != nil {
+		return Serial{}, err
+	}
+	if err := s.writeCounter(value + 1); err != nil {
+		return Serial{}, err
+	}
+	return serial, nil
+}
+
+// counterSerial encodes a counter value as the template describes.
+func (s *Serializer) counterSerial(value uint64) (Serial, error) {
+	switch s.template.Format {
+	case SerialString:
+		digits := int(s.template.Length) - len(s.template.Prefix)
+		return s.stringSerial(fmt.Sprintf("%0*d", digits, value))
+	case SerialHex:
+		data, err := UserIDFromSerial(value, int(s.template.Length))
+		if err != nil {
+			return Serial{}, err
+		}
+		return Serial{Value: strconv.FormatUint(value, 10), Data: data}, nil
+	default:
+		if s.template.Length < 8 && value>>(8*s.template.Length) != 0 {
+			return Serial{}, fmt.Errorf("serial number %v doesn't fit in %v bytes", value, s.template.Length)
+		}
+		data := make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, value)
+		return Serial{Value: strconv.FormatUint(value, 10), Data: data[:s.template.Length]}, nil
+	}
+}
+
+// stringSerial returns the text with the prefix, padded with NUL bytes to the template's
+// length.
+func (s *Serializer) stringSerial(text string) (Serial, error) {
+	value := s.template.Prefix + text
+	if len(value) > int(s.template.Length) {
+		return Serial{}, fmt.Errorf("serial number %v doesn't fit in %v bytes", value, s.template.Length)
+	}
+	data := make([]byte, s.template.Length)
+	copy(data, value)
+	return Serial{Value: value, Data: data}, nil
+}
+
+// readCounter returns the next counter value.
+func (s *Serializer) readCounter() (uint64, error) {
+	if s.counterFile == "" {
+		return s.next, nil
+	}
+	data, err := ioutil.ReadFile(s.counterFile)
+	if os.IsNotExist(err) {
+		return s.template.Start, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read counter file: %w", err)
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid counter file %v: %w", s.counterFile, err)
+	}
+	return value, nil
+}
+
+// writeCounter saves the next counter value. The file is replaced in one step, so that
+// it isn't left empty if the program is stopped part way through.
+func (s *Serializer) writeCounter(value uint64) error {
+	if s.counterFile == "" {
+		s.next = value
+		return nil
+	}
+	tmp := s.counterFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(value, 10)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write counter file: %w", err)
+	}
+	if err := os.Rename(tmp, s.counterFile); err != nil {
+		return fmt.Errorf("failed to write counter file: %w", err)
+	}
+	return nil
+}
+
+// Apply allocates the next serial number and patches it into the programmer's loaded
+// image, so that it is written by the next call to Program.
+func (s *Serializer) Apply(p Programmer) (Serial, error) {
+	serial, err := s.Next()
+	if err != nil {
+		return Serial{}, err
+	}
+	if err := PatchImage(p, Address(s.template.Address), serial.Data); err != nil {
+		return Serial{}, fmt.Errorf("failed to patch serial number %v into the image: %w", serial.Value, err)
+	}
+	plannerLog.Debugf("patched serial number %v at %X", serial.Value, s.template.Address)
+	return serial, nil
+}
+
+// Record appends a serial number to the record file, as a line holding the time, the
+// serial number and its data in hex, separated by commas. It does nothing if there is
+// no record file.
+func (s *Serializer) Record(serial Serial) error {
+	if s.recordFile == "" {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, err := os.OpenFile(s.recordFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open serial number record: %w", err)
+	}
+	_, err = fmt.Fprintf(f, "%v,%v,%v\n", time.Now().Format(time.RFC3339), serial.Value, hex.EncodeToString(serial.Data))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write serial number record: %w", err)
+	}
+	return f.Close()
+}
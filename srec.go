@@ -0,0 +1,106 @@
+package microchipboot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// ConvertSRECToHex converts a Motorola S-record file into Intel HEX format. S1, S2 and
+// S3 data records, with 16, 24 and 32-bit addresses respectively, are supported. Header,
+// count and start address records are checked but otherwise ignored.
+func ConvertSRECToHex(r io.Reader, w io.Writer) error {
+	mem, err := loadSREC(r)
+	if err != nil {
+		return err
+	}
+	return mem.DumpIntelHex(w, 16)
+}
+
+func loadSREC(r io.Reader) (*gohex.Memory, error) {
+	mem := gohex.NewMemory()
+	scanner := bufio.NewScanner(r)
+	var line int
+	var records int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		recordType, address, data, err := parseSRECRecord(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		switch recordType {
+		case '1', '2', '3':
+			records++
+			if err := mem.AddBinary(address, data); err != nil {
+				return nil, fmt.Errorf("line %v: %w", line, err)
+			}
+		case '5', '6':
+			if int(address) != records {
+				return nil, fmt.Errorf("line %v: record count is %v, expected %v", line, address, records)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mem, nil
+}
+
+// parseSRECRecord parses a single S-record, returning its type, address and data.
+func parseSRECRecord(text string) (byte, uint32, []byte, error) {
+	if len(text) < 4 || text[0] != 'S' {
+		return 0, 0, nil, fmt.Errorf("invalid record %q", text)
+	}
+	recordType := text[1]
+	var addressSize int
+	switch recordType {
+	case '0', '1', '5', '9':
+		addressSize = 2
+	case '2', '6', '8':
+		addressSize = 3
+	case '3', '7':
+		addressSize = 4
+	default:
+		return 0, 0, nil, fmt.Errorf("invalid record type S%c", recordType)
+	}
+
+	raw, err := hex.DecodeString(text[2:])
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("invalid record: %w", err)
+	}
+	// The byte count covers the address, data and checksum
+	if len(raw) < 1 || int(raw[0]) != len(raw)-1 || len(raw) < 2+addressSize {
+		return 0, 0, nil, fmt.Errorf("invalid record length")
+	}
+	var sum byte
+	for _, b := range raw[:len(raw)-1] {
+		sum += b
+	}
+	if ^sum != raw[len(raw)-1] {
+		return 0, 0, nil, fmt.Errorf("checksum mismatch, expected %02X, got %02X", ^sum, raw[len(raw)-1])
+	}
+
+	var address uint32
+	for _, b := range raw[1 : 1+addressSize] {
+		address = address<<8 | uint32(b)
+	}
+	return recordType, address, raw[1+addressSize : len(raw)-1], nil
+}
+
+// srecToHex converts an S-record file into hex data that can be passed to LoadHex.
+func srecToHex(r io.Reader) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	if err := ConvertSRECToHex(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
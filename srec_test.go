@@ -0,0 +1,39 @@
+package microchipboot
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLoadSREC(t *testing.T) {
+	const srec = `S00600004844521B
+S107010001020304ED
+S20802000005060708DB
+S30900030000090A0B0CC9
+S5030003F9
+S9030000FC
+`
+	mem, err := loadSREC(strings.NewReader(srec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32][]byte{
+		0x0100:  {1, 2, 3, 4},
+		0x20000: {5, 6, 7, 8},
+		0x30000: {9, 10, 11, 12},
+	}
+	segments := mem.GetDataSegments()
+	if len(segments) != len(want) {
+		t.Fatalf("got %v segments, want %v", len(segments), len(want))
+	}
+	for _, s := range segments {
+		if !bytes.Equal(s.Data, want[s.Address]) {
+			t.Errorf("segment at %X: got %X, want %X", s.Address, s.Data, want[s.Address])
+		}
+	}
+
+	if _, err := loadSREC(strings.NewReader("S107010001020304EE\n")); err == nil {
+		t.Error("expected checksum error")
+	}
+}
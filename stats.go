@@ -0,0 +1,31 @@
+package microchipboot
+
+import "time"
+
+// ProgramStats summarises a programming session, e.g. for a dashboard. The statistics
+// are collected from the start of the last call to Program or Resume, and include any
+// calls to Verify since.
+type ProgramStats struct {
+	// Number of bytes written to the device, including EEPROM, config and ID data.
+	BytesWritten int
+	RowsErased   int
+	// Number of bytes read back or checksummed by Verify.
+	BytesVerified int
+	// Number of times that commands were retried. This is only counted if the bootloader
+	// has been wrapped with NewRetryBootloader.
+	Retries int
+	// Time spent in each stage.
+	EraseDuration  time.Duration
+	WriteDuration  time.Duration
+	VerifyDuration time.Duration
+}
+
+// Throughput returns the rate at which the image was programmed in bytes per second,
+// counting the time spent both erasing and writing. It returns 0 if nothing was written.
+func (s ProgramStats) Throughput() float64 {
+	elapsed := s.EraseDuration + s.WriteDuration
+	if s.BytesWritten == 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(s.BytesWritten) / elapsed.Seconds()
+}
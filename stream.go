@@ -0,0 +1,231 @@
+package microchipboot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// Intel HEX record types.
+const (
+	hexRecordData                   = 0x00
+	hexRecordEOF                    = 0x01
+	hexRecordExtendedSegmentAddress = 0x02
+	hexRecordExtendedLinearAddress  = 0x04
+)
+
+// hexRecordReader parses Intel HEX data one record at a time, so that large images don't
+// need to be held in memory.
+type hexRecordReader struct {
+	scanner *bufio.Scanner
+	line    int
+	// Base address set by the last extended address record
+	base uint32
+	eof  bool
+}
+
+func newHexRecordReader(r io.Reader) *hexRecordReader {
+	return &hexRecordReader{scanner: bufio.NewScanner(r)}
+}
+
+// next returns the address and data of the next data record, or io.EOF after the end of
+// file record.
+func (r *hexRecordReader) next() (uint32, []byte, error) {
+	for !r.eof && r.scanner.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ':' {
+			return 0, nil, fmt.Errorf("line %v: missing start code", r.line)
+		}
+		record := make([]byte, hex.DecodedLen(len(line)-1))
+		if _, err := hex.Decode(record, line[1:]); err != nil {
+			return 0, nil, fmt.Errorf("line %v: %w", r.line, err)
+		}
+		if len(record) < 5 || len(record) != int(record[0])+5 {
+			return 0, nil, fmt.Errorf("line %v: invalid record length", r.line)
+		}
+		var sum byte
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			return 0, nil, fmt.Errorf("line %v: invalid checksum", r.line)
+		}
+
+		address := uint32(record[1])<<8 | uint32(record[2])
+		data := record[4 : len(record)-1]
+		switch record[3] {
+		case hexRecordData:
+			return r.base + address, data, nil
+		case hexRecordEOF:
+			r.eof = true
+		case hexRecordExtendedSegmentAddress:
+			if len(data) != 2 {
+				return 0, nil, fmt.Errorf("line %v: invalid extended segment address", r.line)
+			}
+			r.base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+		case hexRecordExtendedLinearAddress:
+			if len(data) != 2 {
+				return 0, nil, fmt.Errorf("line %v: invalid extended linear address", r.line)
+			}
+			r.base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+		}
+		// Start address records are ignored
+	}
+	if err := r.scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+	if !r.eof {
+		return 0, nil, fmt.Errorf("missing end of file record")
+	}
+	return 0, nil, io.EOF
+}
+
+// ProgramStream programs a hex image as it is read, rather than loading it first, so that
+// the memory used doesn't grow with the size of the image. Flash records are assembled
+// into one erase row at a time, which is erased, written and checked as soon as a record
+// for a later row arrives. Records within a row may be in any order, but the rows must
+// be in ascending address order, as they usually are. EEPROM, config and ID data is
+// collected and programmed and verified at the end. p must be connected.
+//
+// Each flash row is checked as it is written and the other regions are verified at the
+// end, so there's no need to call Verify afterwards. The programmer is left with only the
+// EEPROM, config and ID data loaded.
+// FlashRelocation, ExcludeRanges, Digest and EraseAll can't be used while streaming.
+func (p *pic8Programmer) ProgramStream(hex io.Reader) error {
+	err := p.programStream(hex, func(address uint32) uint32 { return address }, p.LoadHex, p.writeMatches)
+	if err != nil {
+		return err
+	}
+	return p.Verify()
+}
+
+// programStream streams the flash records of a hex image into the device. translate
+// converts hex file addresses into device addresses, matches checks each write and the
+// remaining records are loaded with load and programmed at the end.
+func (p *pic8Programmer) programStream(hex io.Reader, translate func(uint32) uint32, load func(io.Reader) error, matches func(PlanStep) (bool, error)) error {
+	if p.info.EraseRowSize == 0 || p.info.WriteRowSize == 0 {
+		return fmt.Errorf("device row sizes are unknown, connect to the device first")
+	}
+	if p.options.FlashRelocation != 0 || len(p.options.ExcludeRanges) > 0 || p.options.Digest.FooterAddress != 0 || p.options.EraseAll {
+		return fmt.Errorf("flash relocation, excluded ranges, digests and eraseall can't be used when streaming")
+	}
+	p.events.resetStats()
+	defer p.events.end()
+
+	rowSize := uint32(p.info.EraseRowSize)
+	// The erase row being assembled, if any
+	var row *gohex.Memory
+	var rowStart uint32
+	// Records outside flash, in hex file addresses
+	rest := gohex.NewMemory()
+
+	records := newHexRecordReader(hex)
+	for {
+		address, data, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read hex file: %w", err)
+		}
+		start := translate(address)
+		if start < p.profile.BootloaderOffset || start >= p.profile.FlashSize {
+			// The other regions are small, so they are collected and programmed at the end
+			if err := rest.AddBinary(address, data); err != nil {
+				return fmt.Errorf("failed to load record at %X: %w", address, err)
+			}
+			continue
+		}
+		if start+uint32(len(data)) > p.profile.FlashSize {
+			return fmt.Errorf("record at %X extends beyond the application area", address)
+		}
+
+		// Records can span erase rows
+		for len(data) > 0 {
+			rowAddress := start - start%rowSize
+			n := rowAddress + rowSize - start
+			if n > uint32(len(data)) {
+				n = uint32(len(data))
+			}
+			switch {
+			case row != nil && rowAddress < rowStart:
+				return fmt.Errorf("record at %X comes after the row at %X has been written, the records must be in ascending address order to be streamed",
+					address, rowStart)
+			case row == nil || rowAddress > rowStart:
+				if row != nil {
+					if err := p.streamRow(row, rowStart, matches); err != nil {
+						return err
+					}
+				}
+				if rowAddress < p.profile.BootloaderOffset {
+					return fmt.Errorf("record at %X shares an erase row with the bootloader", address)
+				}
+				row, rowStart = gohex.NewMemory(), rowAddress
+			}
+			if err := row.AddBinary(start, data[:n]); err != nil {
+				return fmt.Errorf("failed to load record at %X: %w", address, err)
+			}
+			start += n
+			data = data[n:]
+		}
+	}
+	if row != nil {
+		if err := p.streamRow(row, rowStart, matches); err != nil {
+			return err
+		}
+	}
+
+	// Program the remaining regions in the usual way
+	var buf bytes.Buffer
+	if err := rest.DumpIntelHex(&buf, 16); err != nil {
+		return err
+	}
+	if err := load(&buf); err != nil {
+		return err
+	}
+	plan, err := p.Plan()
+	if err != nil {
+		return err
+	}
+	if err := p.checkPlan(plan); err != nil {
+		return err
+	}
+	if err := p.executeSteps(plan.Steps); err != nil {
+		return err
+	}
+	return drainPipeline(p.bootloader)
+}
+
+// streamRow erases the erase row at rowStart, writes the data assembled for it and checks
+// each write with matches.
+func (p *pic8Programmer) streamRow(row *gohex.Memory, rowStart uint32, matches func(PlanStep) (bool, error)) error {
+	writes := p.packWrites(p.skipBlankRows(planWrites(RegionFlash, row.GetDataSegments(), p.info.WriteRowSize, p.erasedFlash())))
+	steps := append([]PlanStep{{Region: RegionFlash, Address: rowStart, Rows: 1}}, writes...)
+	for _, step := range steps {
+		if err := p.executeStep(step); err != nil {
+			return err
+		}
+	}
+	// Pipelined writes must complete before they can be checked
+	if err := drainPipeline(p.bootloader); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	for _, step := range writes {
+		ok, err := matches(step)
+		if err != nil {
+			return fmt.Errorf("failed to check flash at %X: %w", step.Address, err)
+		}
+		if !ok {
+			return fmt.Errorf("flash at %X doesn't match after writing it", step.Address)
+		}
+	}
+	return nil
+}
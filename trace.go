@@ -0,0 +1,137 @@
+package microchipboot
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// TraceFormat selects how a transport trace is written.
+type TraceFormat int
+
+const (
+	// TraceHexDump writes a timestamped hex dump of each frame.
+	TraceHexDump TraceFormat = iota
+	// TraceBinary writes a compact binary capture that can be read with ReadTrace.
+	TraceBinary
+)
+
+// Directions of traced frames.
+const (
+	TraceTX = "tx"
+	TraceRX = "rx"
+)
+
+// traceMagic starts every binary trace.
+var traceMagic = []byte("MCBTRACE\x01")
+
+// ErrTraceNotSupported is returned by EnableTrace if the transport can't be traced.
+var ErrTraceNotSupported = errors.New("transport doesn't support tracing")
+
+// TraceRecord is a single frame read from a binary trace.
+type TraceRecord struct {
+	Time time.Time
+	// TraceTX or TraceRX
+	Direction string
+	Data      []byte
+}
+
+// traceable is implemented by transports that can record the bytes that they send and
+// receive.
+type traceable interface {
+	setTraceWriter(w io.Writer, format TraceFormat) error
+}
+
+// EnableTrace records every frame sent to and received from the device by the transport
+// underlying bootloader to w, along with the time that it was sent or received. Unlike
+// SetTrace, this doesn't depend on the logger and captures the exact bytes on the wire,
+// including partial responses received before a timeout. Passing a nil writer disables
+// tracing.
+func EnableTrace(bootloader Bootloader, w io.Writer, format TraceFormat) error {
+	t, ok := findBootloader(bootloader, func(b Bootloader) bool {
+		_, ok := b.(traceable)
+		return ok
+	}).(traceable)
+	if !ok {
+		return ErrTraceNotSupported
+	}
+	return t.setTraceWriter(w, format)
+}
+
+// traceWriter writes frames to a trace in the selected format.
+type traceWriter struct {
+	w      io.Writer
+	format TraceFormat
+	start  time.Time
+}
+
+func newTraceWriter(w io.Writer, format TraceFormat) (*traceWriter, error) {
+	switch format {
+	case TraceHexDump:
+	case TraceBinary:
+		if _, err := w.Write(traceMagic); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid trace format %v", format)
+	}
+	return &traceWriter{w: w, format: format, start: time.Now()}, nil
+}
+
+// write records a frame. Errors are logged rather than returned so that a failing trace
+// doesn't abort the session.
+func (t *traceWriter) write(direction string, data []byte) {
+	now := time.Now()
+	var err error
+	switch t.format {
+	case TraceHexDump:
+		_, err = fmt.Fprintf(t.w, "%v %v %v bytes (+%v)\n%v", now.Format("15:04:05.000000"), direction, len(data), now.Sub(t.start), hex.Dump(data))
+	case TraceBinary:
+		header := make([]byte, 13)
+		binary.BigEndian.PutUint64(header, uint64(now.UnixNano()))
+		if direction == TraceRX {
+			header[8] = 1
+		}
+		binary.BigEndian.PutUint32(header[9:], uint32(len(data)))
+		if _, err = t.w.Write(header); err == nil {
+			_, err = t.w.Write(data)
+		}
+	}
+	if err != nil {
+		transportLog.Warnf("failed to write trace: %v", err)
+	}
+}
+
+// ReadTrace reads the frames recorded in a binary trace.
+func ReadTrace(r io.Reader) ([]TraceRecord, error) {
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != string(traceMagic) {
+		return nil, fmt.Errorf("not a binary trace")
+	}
+
+	var records []TraceRecord
+	header := make([]byte, 13)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return records, err
+		}
+		record := TraceRecord{
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header))),
+			Direction: TraceTX,
+			Data:      make([]byte, binary.BigEndian.Uint32(header[9:])),
+		}
+		if header[8] == 1 {
+			record.Direction = TraceRX
+		}
+		if _, err := io.ReadFull(r, record.Data); err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
@@ -0,0 +1,72 @@
+package microchipboot
+
+import (
+	"fmt"
+
+	"github.com/marcinbor85/gohex"
+)
+
+// Number of PIC16 user ID words used to hold each byte of a user ID.
+const pic16UserIDWordsPerByte = 2
+
+// UserIDLength returns the number of bytes of user ID that the ID region holds. PIC16
+// user ID words only hold 4 bits each, as set by XC8's __IDLOC, so each byte takes two
+// words. Other devices hold a byte in each ID location.
+func (p PIC8Profile) UserIDLength() int {
+	p.applyFamilyDefaults()
+	if p.Family == FamilyPIC16 {
+		return int(p.IDSize) / (2 * pic16UserIDWordsPerByte)
+	}
+	return int(p.IDSize)
+}
+
+// packUserID converts a user ID into the data that is written to the ID region of a
+// device of the given family.
+func packUserID(family string, id []byte) []byte {
+	if family != FamilyPIC16 {
+		return append([]byte{}, id...)
+	}
+	// Each byte is split into two little endian words, most significant nibble first
+	data := make([]byte, 0, len(id)*2*pic16UserIDWordsPerByte)
+	for _, b := range id {
+		data = append(data, b>>4, 0, b&0x0F, 0)
+	}
+	return data
+}
+
+// UserIDFromSerial returns a serial number as a big endian user ID of length bytes, so
+// that it reads in the same order as a hex dump of the ID region. It returns an error if
+// the serial number doesn't fit.
+func UserIDFromSerial(serial uint64, length int) ([]byte, error) {
+	id := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		id[i] = byte(serial)
+		serial >>= 8
+	}
+	if serial != 0 {
+		return nil, fmt.Errorf("serial number doesn't fit in %v bytes", length)
+	}
+	return id, nil
+}
+
+// SetUserID sets the user ID that Program writes to the ID region, replacing any ID data
+// in the loaded image. The ID is packed to suit the profile's family, as described by
+// UserIDLength, and any ID locations that it doesn't cover are left erased. It must be
+// called after the image is loaded, which discards it, and the ProgramID option must be
+// set.
+func (p *pic8Programmer) SetUserID(id []byte) error {
+	if !p.options.ProgramID {
+		return fmt.Errorf("id programming is disabled")
+	}
+	n := p.profile.UserIDLength()
+	if n == 0 {
+		return fmt.Errorf("the profile has no user id locations")
+	}
+	if len(id) > n {
+		return fmt.Errorf("user id is %v bytes but the device only holds %v", len(id), n)
+	}
+	p.id = []gohex.DataSegment{{Address: p.profile.IDOffset, Data: packUserID(p.profile.Family, id)}}
+	p.plan = nil
+	plannerLog.Debugf("set user id %X", id)
+	return nil
+}